@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+)
+
+// browserCommand returns the command that opens url in the default browser on goos
+func browserCommand(goos, url string) (name string, args []string) {
+	switch goos {
+	case "darwin":
+		return "open", []string{url}
+	case "windows":
+		// start is built into cmd; the empty argument is the window title, so a quoted URL isn't taken for one
+		return "cmd", []string{"/c", "start", "", url}
+	default:
+		return "xdg-open", []string{url}
+	}
+}
+
+// hasDisplay reports whether a browser could be shown on goos, given how to read the environment
+// macOS and Windows always have a desktop; elsewhere an SSH session or container usually has no display
+func hasDisplay(goos string, getenv func(string) string) bool {
+	if goos == "darwin" || goos == "windows" {
+		return true
+	}
+	return getenv("DISPLAY") != "" || getenv("WAYLAND_DISPLAY") != ""
+}
+
+// openBrowser opens url in the default browser without waiting for it to close
+// It returns an error when there's no browser to open, such as on a headless server
+func openBrowser(url string, getenv func(string) string) error {
+	if !hasDisplay(runtime.GOOS, getenv) {
+		return errors.New("no display is available")
+	}
+	name, args := browserCommand(runtime.GOOS, url)
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return fmt.Errorf("%s is not installed", name)
+	}
+	cmd := exec.Command(path, args...)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// Only reap the opener; whether it succeeded can't be told apart from the user closing the browser
+	go func() { _ = cmd.Wait() }()
+	return nil
+}
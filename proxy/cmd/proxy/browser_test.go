@@ -0,0 +1,64 @@
+package main
+
+import (
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestBrowserCommand(t *testing.T) {
+	url := "http://localhost:8080?secret=abc123"
+	tests := []struct {
+		goos     string
+		wantName string
+		wantArgs []string
+	}{
+		{"darwin", "open", []string{url}},
+		{"windows", "cmd", []string{"/c", "start", "", url}},
+		{"linux", "xdg-open", []string{url}},
+		{"freebsd", "xdg-open", []string{url}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.goos, func(t *testing.T) {
+			name, args := browserCommand(tt.goos, url)
+			if name != tt.wantName || !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("browserCommand(%q) = %s %v, want %s %v", tt.goos, name, args, tt.wantName, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestHasDisplay(t *testing.T) {
+	tests := []struct {
+		name string
+		goos string
+		env  map[string]string
+		want bool
+	}{
+		{"macOS", "darwin", nil, true},
+		{"Windows", "windows", nil, true},
+		{"X11", "linux", map[string]string{"DISPLAY": ":0"}, true},
+		{"Wayland", "linux", map[string]string{"WAYLAND_DISPLAY": "wayland-0"}, true},
+		{"headless", "linux", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			getenv := func(key string) string { return tt.env[key] }
+			if got := hasDisplay(tt.goos, getenv); got != tt.want {
+				t.Errorf("hasDisplay() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestOpenBrowser_Headless tests that a missing display is reported rather than launching anything
+func TestOpenBrowser_Headless(t *testing.T) {
+	if hasDisplay(runtime.GOOS, func(string) string { return "" }) {
+		t.Skip("This platform always has a display")
+	}
+	if err := openBrowser("http://localhost:8080", func(string) string { return "" }); err == nil {
+		t.Error("Expected an error without a display")
+	}
+}
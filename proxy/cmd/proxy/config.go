@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// fileConfig is the JSON file given with --config
+// Every setting mirrors a flag; unset fields leave the flag's default alone
+type fileConfig struct {
+	Connection             string           `json:"connection"`
+	Port                   int              `json:"port"`
+	AllowedOrigins         []string         `json:"allowedOrigins"`
+	ReadOnly               *bool            `json:"readOnly"`
+	MaxConns               *int             `json:"maxConns"`
+	MinConns               *int             `json:"minConns"`
+	MaxRows                *int             `json:"maxRows"`
+	MaxRowsCeiling         *int             `json:"maxRowsCeiling"`
+	DefaultQueryTimeout    string           `json:"defaultQueryTimeout"` // a Go duration, e.g. "30s"
+	MaxQueryTimeout        string           `json:"maxQueryTimeout"`
+	IdleTransactionTimeout string           `json:"idleTransactionTimeout"`
+	Databases              []configDatabase `json:"databases"`
+}
+
+// configDatabase is one entry of a config file's databases, the equivalent of --db
+type configDatabase struct {
+	Name       string `json:"name"`
+	Connection string `json:"connection"`
+}
+
+// loadConfig reads a config file, rejecting fields it doesn't know so typos don't go unnoticed
+func loadConfig(path string) (*fileConfig, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var config fileConfig
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return &config, nil
+}
+
+// flagValues returns the config's settings as flag values, keyed by flag name
+func (c *fileConfig) flagValues() map[string][]string {
+	values := make(map[string][]string)
+	if c.Port != 0 {
+		values["port"] = []string{strconv.Itoa(c.Port)}
+	}
+	if len(c.AllowedOrigins) > 0 {
+		values["allowed-origins"] = []string{strings.Join(c.AllowedOrigins, ",")}
+	}
+	if c.ReadOnly != nil {
+		values["read-only"] = []string{strconv.FormatBool(*c.ReadOnly)}
+	}
+	for name, value := range map[string]*int{
+		"max-conns":        c.MaxConns,
+		"min-conns":        c.MinConns,
+		"max-rows":         c.MaxRows,
+		"max-rows-ceiling": c.MaxRowsCeiling,
+	} {
+		if value != nil {
+			values[name] = []string{strconv.Itoa(*value)}
+		}
+	}
+	for name, value := range map[string]string{
+		"default-query-timeout":    c.DefaultQueryTimeout,
+		"max-query-timeout":        c.MaxQueryTimeout,
+		"idle-transaction-timeout": c.IdleTransactionTimeout,
+	} {
+		if value != "" {
+			values[name] = []string{value}
+		}
+	}
+	for _, db := range c.Databases {
+		values["db"] = append(values["db"], db.Name+"="+db.Connection)
+	}
+	return values
+}
+
+// applyConfig sets every flag the command line left out from the config file,
+// so flags override the file and the file overrides the defaults
+// Values go through the flags themselves and get the same validation
+func applyConfig(fs *flag.FlagSet, config *fileConfig) error {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	for name, values := range config.flagValues() {
+		if explicit[name] {
+			continue
+		}
+		for _, value := range values {
+			if err := fs.Set(name, value); err != nil {
+				return fmt.Errorf("invalid value for --%s in config file: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// validatePort checks a --port value
+func validatePort(port string) error {
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return errors.New("port must be a number between 1 and 65535")
+	}
+	return nil
+}
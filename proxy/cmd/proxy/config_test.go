@@ -0,0 +1,126 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeConfig writes a config file into a temporary directory and returns its path
+func writeConfig(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "proxy.json")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name      string
+		contents  string
+		wantError bool
+	}{
+		{name: "all fields", contents: `{"connection": "postgres://localhost/app", "port": 9000, "maxRows": 0, "databases": [{"name": "analytics", "connection": "postgres://localhost/analytics"}]}`},
+		{name: "empty object", contents: `{}`},
+		{name: "unknown field", contents: `{"maxRow": 10}`, wantError: true},
+		{name: "wrong type", contents: `{"port": "9000"}`, wantError: true},
+		{name: "not JSON", contents: `port: 9000`, wantError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadConfig(writeConfig(t, tt.contents))
+			if (err != nil) != tt.wantError {
+				t.Errorf("loadConfig() error = %v, wantError %v", err, tt.wantError)
+			}
+		})
+	}
+
+	if _, err := loadConfig(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("Expected a missing file to fail")
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	config, err := loadConfig(writeConfig(t, `{
+		"port": 9000,
+		"allowedOrigins": ["http://localhost:4321", "https://app.example.com"],
+		"readOnly": true,
+		"maxRows": 0,
+		"maxRowsCeiling": 500,
+		"defaultQueryTimeout": "1m",
+		"databases": [
+			{"name": "app", "connection": "postgres://localhost/app"},
+			{"name": "analytics", "connection": "postgres://localhost/analytics"}
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("loadConfig() failed: %v", err)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	port := fs.String("port", defaultPort, "")
+	origins := fs.String("allowed-origins", "", "")
+	readOnly := fs.Bool("read-only", false, "")
+	maxRows := fs.Int("max-rows", 10000, "")
+	maxRowsCeiling := fs.Int("max-rows-ceiling", 1000000, "")
+	defaultTimeout := fs.Duration("default-query-timeout", 30*time.Second, "")
+	maxTimeout := fs.Duration("max-query-timeout", 5*time.Minute, "")
+	var databases databaseFlags
+	fs.Var(&databases, "db", "")
+
+	// Flags on the command line win over the file
+	if err := fs.Parse([]string{"--port", "9001", "--max-rows-ceiling", "2000"}); err != nil {
+		t.Fatalf("Parse() failed: %v", err)
+	}
+	if err := applyConfig(fs, config); err != nil {
+		t.Fatalf("applyConfig() failed: %v", err)
+	}
+
+	if *port != "9001" {
+		t.Errorf("Expected the --port flag to win, got %s", *port)
+	}
+	if *maxRowsCeiling != 2000 {
+		t.Errorf("Expected the --max-rows-ceiling flag to win, got %d", *maxRowsCeiling)
+	}
+	if *origins != "http://localhost:4321,https://app.example.com" {
+		t.Errorf("Unexpected allowed origins: %s", *origins)
+	}
+	if !*readOnly {
+		t.Error("Expected read-only from the file")
+	}
+	if *maxRows != 0 {
+		t.Errorf("Expected an explicit 0 from the file to override the default, got %d", *maxRows)
+	}
+	if *defaultTimeout != time.Minute {
+		t.Errorf("Expected a 1m default timeout, got %v", *defaultTimeout)
+	}
+	if *maxTimeout != 5*time.Minute {
+		t.Errorf("Expected settings missing from the file to keep their default, got %v", *maxTimeout)
+	}
+	if databases.String() != "app,analytics" {
+		t.Errorf("Expected databases in file order, got %s", databases.String())
+	}
+}
+
+func TestApplyConfig_InvalidValue(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Duration("default-query-timeout", 30*time.Second, "")
+
+	err := applyConfig(fs, &fileConfig{DefaultQueryTimeout: "soon"})
+	if err == nil {
+		t.Fatal("Expected an invalid duration to fail")
+	}
+}
+
+func TestValidatePort(t *testing.T) {
+	for port, wantError := range map[string]bool{"8080": false, "1": false, "65535": false, "0": true, "65536": true, "http": true, "": true} {
+		if err := validatePort(port); (err != nil) != wantError {
+			t.Errorf("validatePort(%q) error = %v, wantError %v", port, err, wantError)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadTLSConfig(t *testing.T) {
+	tests := []struct {
+		name       string
+		certFile   string
+		keyFile    string
+		selfSigned bool
+		wantConfig bool
+		wantError  bool
+	}{
+		{name: "plain HTTP", wantConfig: false},
+		{name: "self-signed", selfSigned: true, wantConfig: true},
+		{name: "cert without key", certFile: "cert.pem", wantError: true},
+		{name: "key without cert", keyFile: "key.pem", wantError: true},
+		{name: "self-signed with cert", certFile: "cert.pem", keyFile: "key.pem", selfSigned: true, wantError: true},
+		{name: "missing files", certFile: "missing-cert.pem", keyFile: "missing-key.pem", wantError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := loadTLSConfig(tt.certFile, tt.keyFile, tt.selfSigned)
+			if (err != nil) != tt.wantError {
+				t.Fatalf("loadTLSConfig() error = %v, wantError %v", err, tt.wantError)
+			}
+			if (config != nil) != tt.wantConfig {
+				t.Errorf("loadTLSConfig() config = %v, wantConfig %v", config, tt.wantConfig)
+			}
+		})
+	}
+}
+
+func TestLoadTLSConfig_CertificateFiles(t *testing.T) {
+	cert, err := selfSignedCertificate()
+	if err != nil {
+		t.Fatalf("selfSignedCertificate() failed: %v", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+
+	config, err := loadTLSConfig(certFile, keyFile, false)
+	if err != nil {
+		t.Fatalf("loadTLSConfig() failed: %v", err)
+	}
+	if len(config.Certificates) != 1 || config.MinVersion != tls.VersionTLS12 {
+		t.Errorf("Unexpected TLS config: %+v", config)
+	}
+}
+
+func TestSelfSignedCertificate_ServesLocalhost(t *testing.T) {
+	config, err := loadTLSConfig("", "", true)
+	if err != nil {
+		t.Fatalf("loadTLSConfig() failed: %v", err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	server.TLS = config
+	server.StartTLS()
+	defer server.Close()
+
+	// A client that trusts the generated certificate can verify it for 127.0.0.1
+	roots := x509.NewCertPool()
+	roots.AddCert(config.Certificates[0].Leaf)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("TLS request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected status 204, got %d", resp.StatusCode)
+	}
+
+	if err := config.Certificates[0].Leaf.VerifyHostname("localhost"); err != nil {
+		t.Errorf("Expected the certificate to cover localhost: %v", err)
+	}
+}
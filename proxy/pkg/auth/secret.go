@@ -2,14 +2,31 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/hex"
 	"fmt"
 )
 
+// Secret sizes in random bytes; the hex-encoded secret is twice as long
+const (
+	DefaultSecretBytes = 32
+	MinSecretBytes     = 16
+	MaxSecretBytes     = 64
+)
+
 // GenerateSecret generates a cryptographically secure random secret
 // Returns a 64-character hex-encoded string (32 bytes)
 func GenerateSecret() (string, error) {
-	bytes := make([]byte, 32)
+	return GenerateSecretN(DefaultSecretBytes)
+}
+
+// GenerateSecretN generates a hex-encoded secret from n random bytes
+// n must be between MinSecretBytes and MaxSecretBytes
+func GenerateSecretN(n int) (string, error) {
+	if n < MinSecretBytes || n > MaxSecretBytes {
+		return "", fmt.Errorf("secret size must be between %d and %d bytes, got %d", MinSecretBytes, MaxSecretBytes, n)
+	}
+	bytes := make([]byte, n)
 	if _, err := rand.Read(bytes); err != nil {
 		return "", fmt.Errorf("failed to generate secret: %w", err)
 	}
@@ -17,11 +34,19 @@ func GenerateSecret() (string, error) {
 }
 
 // ValidateSecret validates that a secret is in the correct format
-// A valid secret must be exactly 64 characters and hex-encoded
+// A valid secret is hex-encoded and between 32 and 128 characters long, so it holds
+// MinSecretBytes to MaxSecretBytes bytes
 func ValidateSecret(secret string) bool {
-	if len(secret) != 64 {
+	if len(secret) < 2*MinSecretBytes || len(secret) > 2*MaxSecretBytes {
 		return false
 	}
 	_, err := hex.DecodeString(secret)
 	return err == nil
 }
+
+// CompareSecret reports whether a secret sent by a client matches the expected one
+// The comparison takes the same time wherever the secrets differ, so response timing
+// can't be used to guess the secret a character at a time
+func CompareSecret(got, want string) bool {
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
@@ -104,7 +104,7 @@ func TestValidateSecret(t *testing.T) {
 	})
 
 	t.Run("rejects secret that is too long", func(t *testing.T) {
-		longSecret := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef00" // 66 characters
+		longSecret := strings.Repeat("0123456789abcdef", 8) + "00" // 130 characters
 
 		if ValidateSecret(longSecret) {
 			t.Errorf("ValidateSecret() accepted long secret: %s", longSecret)
@@ -151,6 +151,76 @@ func TestValidateSecret(t *testing.T) {
 	})
 }
 
+func TestGenerateSecretN(t *testing.T) {
+	for _, n := range []int{MinSecretBytes, DefaultSecretBytes, 48, MaxSecretBytes} {
+		secret, err := GenerateSecretN(n)
+		if err != nil {
+			t.Fatalf("GenerateSecretN(%d) returned error: %v", n, err)
+		}
+		if len(secret) != 2*n {
+			t.Errorf("GenerateSecretN(%d) length = %d, want %d", n, len(secret), 2*n)
+		}
+		if !ValidateSecret(secret) {
+			t.Errorf("ValidateSecret() rejected a secret from GenerateSecretN(%d)", n)
+		}
+	}
+
+	for _, n := range []int{0, MinSecretBytes - 1, MaxSecretBytes + 1} {
+		if _, err := GenerateSecretN(n); err == nil {
+			t.Errorf("GenerateSecretN(%d) should have returned an error", n)
+		}
+	}
+}
+
+func TestValidateSecret_Lengths(t *testing.T) {
+	tests := []struct {
+		name   string
+		length int
+		want   bool
+	}{
+		{name: "shortest", length: 32, want: true},
+		{name: "default", length: 64, want: true},
+		{name: "longest", length: 128, want: true},
+		{name: "too short", length: 30, want: false},
+		{name: "too long", length: 130, want: false},
+		{name: "odd length", length: 65, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secret := strings.Repeat("a", tt.length)
+			if got := ValidateSecret(secret); got != tt.want {
+				t.Errorf("ValidateSecret() of %d characters = %v, want %v", tt.length, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompareSecret(t *testing.T) {
+	secret := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+	tests := []struct {
+		name string
+		got  string
+		want bool
+	}{
+		{name: "same secret", got: secret, want: true},
+		{name: "last character differs", got: secret[:63] + "0", want: false},
+		{name: "first character differs", got: "f" + secret[1:], want: false},
+		{name: "prefix", got: secret[:32], want: false},
+		{name: "longer", got: secret + "00", want: false},
+		{name: "empty", got: "", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CompareSecret(tt.got, secret); got != tt.want {
+				t.Errorf("CompareSecret(%q) = %v, want %v", tt.got, got, tt.want)
+			}
+		})
+	}
+}
+
 func BenchmarkGenerateSecret(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		_, err := GenerateSecret()
@@ -0,0 +1,83 @@
+package export
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/protocol"
+)
+
+// CSVWriter writes query results as CSV, one record per row in column order
+// Quoting of values containing commas, quotes, or newlines follows RFC 4180
+type CSVWriter struct {
+	w *csv.Writer
+}
+
+// NewCSVWriter creates a CSVWriter that writes to w
+func NewCSVWriter(w io.Writer) *CSVWriter {
+	return &CSVWriter{w: csv.NewWriter(w)}
+}
+
+// WriteHeader writes the header row of column names
+func (cw *CSVWriter) WriteHeader(columns []protocol.ColumnInfo) error {
+	record := make([]string, len(columns))
+	for i, col := range columns {
+		record[i] = col.Name
+	}
+	return cw.w.Write(record)
+}
+
+// WriteRows writes rows with their values in the order of columns
+func (cw *CSVWriter) WriteRows(columns []protocol.ColumnInfo, rows []map[string]interface{}) error {
+	record := make([]string, len(columns))
+	for _, row := range rows {
+		for i, col := range columns {
+			value, err := FormatValue(row[col.Name])
+			if err != nil {
+				return fmt.Errorf("failed to format column %s: %w", col.Name, err)
+			}
+			record[i] = value
+		}
+		if err := cw.w.Write(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush writes any buffered data to the underlying writer
+func (cw *CSVWriter) Flush() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+// FormatValue renders a result value as a CSV field
+// NULL becomes an empty field, and arrays and JSON values are written as JSON
+func FormatValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case json.RawMessage:
+		// json and jsonb columns hold their documents as Postgres returned them
+		return string(v), nil
+	case []interface{}, map[string]interface{}:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
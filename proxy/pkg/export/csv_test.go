@@ -0,0 +1,74 @@
+package export
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/protocol"
+)
+
+func TestCSVWriter(t *testing.T) {
+	columns := []protocol.ColumnInfo{
+		{Name: "id", DataType: "integer"},
+		{Name: "name", DataType: "text"},
+		{Name: "note", DataType: "text"},
+	}
+	rows := []map[string]interface{}{
+		{"id": int32(1), "name": "Alice", "note": nil},
+		{"id": int32(2), "name": "Smith, Bob", "note": `said "hi"`},
+		{"id": int32(3), "name": "Carol", "note": "line one\nline two"},
+	}
+
+	var buf bytes.Buffer
+	w := NewCSVWriter(&buf)
+	if err := w.WriteHeader(columns); err != nil {
+		t.Fatalf("WriteHeader() failed: %v", err)
+	}
+	if err := w.WriteRows(columns, rows); err != nil {
+		t.Fatalf("WriteRows() failed: %v", err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush() failed: %v", err)
+	}
+
+	want := "id,name,note\n" +
+		"1,Alice,\n" +
+		"2,\"Smith, Bob\",\"said \"\"hi\"\"\"\n" +
+		"3,Carol,\"line one\nline two\"\n"
+	if buf.String() != want {
+		t.Errorf("CSV mismatch:\ngot:  %q\nwant: %q", buf.String(), want)
+	}
+}
+
+func TestFormatValue(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    interface{}
+		expected string
+	}{
+		{"null", nil, ""},
+		{"string", "hello", "hello"},
+		{"empty string", "", ""},
+		{"bool", true, "true"},
+		{"integer", int64(42), "42"},
+		{"float", 1234567.5, "1234567.5"},
+		{"float32", float32(0.25), "0.25"},
+		{"array", []interface{}{int32(1), nil, int32(3)}, "[1,null,3]"},
+		{"json object", map[string]interface{}{"a": "b"}, `{"a":"b"}`},
+		{"raw json", json.RawMessage(`{"b": 1, "a": 2}`), `{"b": 1, "a": 2}`},
+		{"json null", json.RawMessage(`null`), "null"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FormatValue(tt.value)
+			if err != nil {
+				t.Fatalf("FormatValue(%v) failed: %v", tt.value, err)
+			}
+			if got != tt.expected {
+				t.Errorf("FormatValue(%v) = %q, want %q", tt.value, got, tt.expected)
+			}
+		})
+	}
+}
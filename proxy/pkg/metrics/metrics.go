@@ -0,0 +1,237 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Metric is a value that can be written in the Prometheus text exposition format
+type Metric interface {
+	metricType() string
+	write(w io.Writer, name string) error
+}
+
+// Counter is a monotonically increasing count
+type Counter struct {
+	value atomic.Uint64
+}
+
+// Inc adds one to the counter
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+// Value returns the current count
+func (c *Counter) Value() uint64 {
+	return c.value.Load()
+}
+
+func (c *Counter) metricType() string { return "counter" }
+
+func (c *Counter) write(w io.Writer, name string) error {
+	_, err := fmt.Fprintf(w, "%s %d\n", name, c.Value())
+	return err
+}
+
+// LabeledCounter is a set of counters distinguished by the value of one label
+type LabeledCounter struct {
+	label  string
+	mu     sync.Mutex
+	values map[string]uint64
+}
+
+// NewLabeledCounter creates a counter partitioned by the given label
+func NewLabeledCounter(label string) *LabeledCounter {
+	return &LabeledCounter{label: label, values: make(map[string]uint64)}
+}
+
+// Inc adds one to the counter for a label value
+func (c *LabeledCounter) Inc(value string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[value]++
+}
+
+// Value returns the count for a label value
+func (c *LabeledCounter) Value(value string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[value]
+}
+
+func (c *LabeledCounter) metricType() string { return "counter" }
+
+func (c *LabeledCounter) write(w io.Writer, name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	values := make([]string, 0, len(c.values))
+	for value := range c.values {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+
+	for _, value := range values {
+		if _, err := fmt.Fprintf(w, "%s{%s=%s} %d\n", name, c.label, quoteLabel(value), c.values[value]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	value atomic.Int64
+}
+
+// Inc adds one to the gauge
+func (g *Gauge) Inc() {
+	g.value.Add(1)
+}
+
+// Dec subtracts one from the gauge
+func (g *Gauge) Dec() {
+	g.value.Add(-1)
+}
+
+// Value returns the current value
+func (g *Gauge) Value() int64 {
+	return g.value.Load()
+}
+
+func (g *Gauge) metricType() string { return "gauge" }
+
+func (g *Gauge) write(w io.Writer, name string) error {
+	_, err := fmt.Fprintf(w, "%s %d\n", name, g.Value())
+	return err
+}
+
+// GaugeFunc is a gauge whose value is read when the metrics are written
+type GaugeFunc func() float64
+
+func (f GaugeFunc) metricType() string { return "gauge" }
+
+func (f GaugeFunc) write(w io.Writer, name string) error {
+	_, err := fmt.Fprintf(w, "%s %s\n", name, formatFloat(f()))
+	return err
+}
+
+// Histogram counts observations in cumulative buckets
+type Histogram struct {
+	bounds []float64 // upper bounds in increasing order; +Inf is implied
+
+	mu     sync.Mutex
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram creates a histogram with the given bucket upper bounds, which must be increasing
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+// Observe records a value
+func (h *Histogram) Observe(value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if i := sort.SearchFloat64s(h.bounds, value); i < len(h.bounds) {
+		h.counts[i]++
+	}
+	h.sum += value
+	h.count++
+}
+
+// Count returns the number of observations
+func (h *Histogram) Count() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count
+}
+
+func (h *Histogram) metricType() string { return "histogram" }
+
+func (h *Histogram) write(w io.Writer, name string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		if _, err := fmt.Fprintf(w, "%s_bucket{le=%s} %d\n", name, quoteLabel(formatFloat(bound)), cumulative); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "%s_sum %s\n", name, formatFloat(h.sum)); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+	return err
+}
+
+// Registry holds named metrics and writes them in registration order
+type Registry struct {
+	mu      sync.Mutex
+	entries []entry
+}
+
+// entry is a registered metric with its name and help text
+type entry struct {
+	name   string
+	help   string
+	metric Metric
+}
+
+// Register adds a metric under a name; names must be unique
+func (r *Registry) Register(name, help string, metric Metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, entry{name: name, help: help, metric: metric})
+}
+
+// Write writes every metric in the Prometheus text exposition format
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	entries := append([]entry(nil), r.entries...)
+	r.mu.Unlock()
+
+	for _, e := range entries {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", e.name, e.help, e.name, e.metric.metricType()); err != nil {
+			return err
+		}
+		if err := e.metric.write(w, e.name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// quoteLabel quotes a label value, escaping backslashes, quotes, and newlines
+func quoteLabel(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	value = strings.ReplaceAll(value, "\n", `\n`)
+	return `"` + value + `"`
+}
+
+// formatFloat renders a sample value the way Prometheus expects
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
@@ -0,0 +1,84 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRegistryWrite(t *testing.T) {
+	var registry Registry
+
+	queries := &Counter{}
+	queries.Inc()
+	queries.Inc()
+	registry.Register("queries_total", "Queries run.", queries)
+
+	errors := NewLabeledCounter("code")
+	errors.Inc("QUERY_ERROR")
+	errors.Inc("EMPTY_QUERY")
+	errors.Inc("QUERY_ERROR")
+	registry.Register("query_errors_total", "Failed queries by error code.", errors)
+
+	connections := &Gauge{}
+	connections.Inc()
+	connections.Inc()
+	connections.Dec()
+	registry.Register("connections", "Open connections.", connections)
+
+	registry.Register("pool_size", "Pool size.", GaugeFunc(func() float64 { return 5 }))
+
+	duration := NewHistogram([]float64{0.1, 1})
+	duration.Observe(0.05)
+	duration.Observe(0.1)
+	duration.Observe(0.5)
+	duration.Observe(3)
+	registry.Register("duration_seconds", "Query duration.", duration)
+
+	var out strings.Builder
+	if err := registry.Write(&out); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+
+	want := `# HELP queries_total Queries run.
+# TYPE queries_total counter
+queries_total 2
+# HELP query_errors_total Failed queries by error code.
+# TYPE query_errors_total counter
+query_errors_total{code="EMPTY_QUERY"} 1
+query_errors_total{code="QUERY_ERROR"} 2
+# HELP connections Open connections.
+# TYPE connections gauge
+connections 1
+# HELP pool_size Pool size.
+# TYPE pool_size gauge
+pool_size 5
+# HELP duration_seconds Query duration.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{le="0.1"} 2
+duration_seconds_bucket{le="1"} 3
+duration_seconds_bucket{le="+Inf"} 4
+duration_seconds_sum 3.65
+duration_seconds_count 4
+`
+	if out.String() != want {
+		t.Errorf("Output mismatch:\ngot:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+func TestQuoteLabel(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{"plain", `"plain"`},
+		{`say "hi"`, `"say \"hi\""`},
+		{`back\slash`, `"back\\slash"`},
+		{"two\nlines", `"two\nlines"`},
+	}
+
+	for _, tt := range tests {
+		if got := quoteLabel(tt.value); got != tt.expected {
+			t.Errorf("quoteLabel(%q) = %s, want %s", tt.value, got, tt.expected)
+		}
+	}
+}
@@ -2,85 +2,452 @@ package postgres
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/MPJHorner/PostgresMaster/proxy/pkg/protocol"
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/sqlutil"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgconn/ctxwatch"
+	"github.com/jackc/pgx/v5/pgtype"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+// Default connection pool sizing and retry behavior
+const (
+	DefaultMaxConns    = 5
+	DefaultMinConns    = 1
+	DefaultMaxAttempts = 4
+	DefaultBaseBackoff = 2 * time.Second
+	DefaultMaxBackoff  = 8 * time.Second
+
+	DefaultHealthCheckInterval = 15 * time.Second
+
+	DefaultApplicationName = "postgres-proxy"
+	DefaultMaxQueueDepth   = 50
+)
+
+// Errors that callers may want to distinguish with errors.Is
+var (
+	// ErrReadOnlyViolation is returned when a query attempts to write in read-only mode
+	ErrReadOnlyViolation = errors.New("read-only violation")
+	// ErrQueryCanceled is returned when a query is canceled before it completes
+	ErrQueryCanceled = errors.New("query canceled")
+	// ErrQueryTimeout is returned when a query runs past its timeout
+	ErrQueryTimeout = errors.New("query timeout exceeded")
+	// ErrConnectionLost is returned when the connection to the database dropped or couldn't be made
+	ErrConnectionLost = errors.New("connection lost")
+	// ErrServerBusy is returned when every connection is busy and the query queue is full
+	ErrServerBusy = errors.New("server busy")
+	// ErrParameterMismatch is returned when a query is given a different number of parameters than it has placeholders
+	ErrParameterMismatch = errors.New("parameter mismatch")
+	// ErrParameterTypeMismatch is returned when a parameter's value can't be sent as the type the query expects
+	ErrParameterTypeMismatch = errors.New("parameter type mismatch")
+)
+
+// DatabaseError is an error reported by Postgres while running a query
+// It keeps the parts of the report separate so clients can show the hint and point at the position
+type DatabaseError struct {
+	Code     string // SQLSTATE, e.g. 42P01
+	Message  string // primary message
+	Detail   string
+	Hint     string
+	Position int // 1-based character offset into the query; zero if not reported
+
+	summary string // Error() text, prefixed with what kind of error it is
+	kind    error  // ErrQueryCanceled, ErrQueryTimeout, ErrReadOnlyViolation or ErrConnectionLost, if it is one of them
+}
+
+func (e *DatabaseError) Error() string {
+	return e.summary
+}
+
+func (e *DatabaseError) Unwrap() error {
+	return e.kind
+}
+
+// RowError reports a row whose value couldn't be converted partway through a result
+// A streamed query has already handed the rows before it to its RowBatchFunc
+type RowError struct {
+	Row    int    // zero-based index of the row that failed
+	Column string // name of the column holding the value
+	Type   string // the column's data type
+	Err    error
+}
+
+func (e *RowError) Error() string {
+	return fmt.Sprintf("failed to convert row %d, column %s (%s): %v", e.Row, e.Column, e.Type, e.Err)
+}
+
+func (e *RowError) Unwrap() error {
+	return e.Err
+}
+
 // Client represents a connection to a PostgreSQL database
 type Client struct {
-	pool *pgxpool.Pool
+	poolMu   sync.RWMutex // guards pool, which the health check replaces when the database comes back
+	pool     *pgxpool.Pool
+	readOnly bool
+
+	// What the health check needs to rebuild the pool, and its state
+	config     *pgxpool.Config
+	retry      RetryConfig
+	progress   io.Writer    // where reconnect attempts are reported
+	state      atomic.Value // ConnectionState
+	stopHealth chan struct{}
+	healthDone chan struct{}
+	closeOnce  sync.Once
+
+	queue *queryQueue // nil when queries wait in the pool without a limit
+
+	// Type names looked up in pg_type: the internal names of types missing from
+	// builtinTypeNames, such as enums and composite types, and the SQL names of every
+	// type and modifier seen, as format_type writes them
+	typeMu        sync.Mutex
+	internalNames map[uint32]string
+	sqlNames      map[typeKey]string
+}
+
+// typeKey identifies a type together with its modifier, such as the length of a varchar
+// The modifier is -1 when there is none
+type typeKey struct {
+	oid    uint32
+	typmod int32
+}
+
+// querier is implemented by both pool connections and transactions
+type querier interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	Conn() *pgx.Conn
+}
+
+// RetryConfig controls how NewClient retries failed connection attempts
+type RetryConfig struct {
+	MaxAttempts int           // Total number of connection attempts, including the first
+	BaseBackoff time.Duration // Wait before the first retry; doubled for each subsequent retry
+	MaxBackoff  time.Duration // Upper bound on the wait between attempts
+}
+
+// DefaultRetryConfig returns the retry behavior used when nothing is overridden
+func DefaultRetryConfig() RetryConfig {
+	return RetryConfig{
+		MaxAttempts: DefaultMaxAttempts,
+		BaseBackoff: DefaultBaseBackoff,
+		MaxBackoff:  DefaultMaxBackoff,
+	}
+}
+
+// Validate checks that the retry configuration is usable
+func (r RetryConfig) Validate() error {
+	if r.MaxAttempts < 1 {
+		return fmt.Errorf("max attempts must be at least 1, got %d", r.MaxAttempts)
+	}
+	if r.BaseBackoff < 0 {
+		return fmt.Errorf("base backoff cannot be negative, got %v", r.BaseBackoff)
+	}
+	if r.MaxBackoff < r.BaseBackoff {
+		return fmt.Errorf("max backoff (%v) cannot be less than base backoff (%v)", r.MaxBackoff, r.BaseBackoff)
+	}
+	return nil
+}
+
+// Backoff returns how long to wait before the given attempt (1-based)
+// The first attempt never waits; retries wait BaseBackoff * 2^(attempt-2), capped at MaxBackoff
+func (r RetryConfig) Backoff(attempt int) time.Duration {
+	if attempt <= 1 {
+		return 0
+	}
+
+	wait := r.BaseBackoff
+	for i := 2; i < attempt; i++ {
+		if wait >= r.MaxBackoff {
+			break
+		}
+		wait *= 2
+	}
+	if wait > r.MaxBackoff {
+		wait = r.MaxBackoff
+	}
+	return wait
+}
+
+// Options configures how a Client connects to the database
+type Options struct {
+	MaxConns int32       // Maximum number of connections in the pool
+	MinConns int32       // Minimum number of connections kept open
+	Retry    RetryConfig // Connection retry behavior
+	ReadOnly bool        // Run every query inside a READ ONLY transaction
+
+	// How often to ping the database, replacing the pool if it stops answering; 0 disables
+	HealthCheckInterval time.Duration
+	// application_name for connections whose connection string doesn't set one, so they can be
+	// told apart in pg_stat_activity. Empty leaves it unset
+	ApplicationName string
+	// Queries that may wait for a connection when every one is busy; more fail with ErrServerBusy.
+	// Zero removes the limit, leaving queries to wait in the pool until they time out
+	MaxQueueDepth int
+	// Where connection progress, such as each attempt and retry, is reported. Nil discards it
+	Progress io.Writer
+}
+
+// DefaultOptions returns the options used when nothing is overridden
+func DefaultOptions() Options {
+	return Options{
+		MaxConns:            DefaultMaxConns,
+		MinConns:            DefaultMinConns,
+		Retry:               DefaultRetryConfig(),
+		HealthCheckInterval: DefaultHealthCheckInterval,
+		ApplicationName:     DefaultApplicationName,
+		MaxQueueDepth:       DefaultMaxQueueDepth,
+		Progress:            os.Stdout,
+	}
+}
+
+// Validate checks that the options describe a usable connection pool
+func (o Options) Validate() error {
+	if o.MaxConns < 1 {
+		return fmt.Errorf("max connections must be positive, got %d", o.MaxConns)
+	}
+	if o.MinConns < 1 {
+		return fmt.Errorf("min connections must be positive, got %d", o.MinConns)
+	}
+	if o.MinConns > o.MaxConns {
+		return fmt.Errorf("min connections (%d) cannot exceed max connections (%d)", o.MinConns, o.MaxConns)
+	}
+	if err := o.Retry.Validate(); err != nil {
+		return fmt.Errorf("invalid retry config: %w", err)
+	}
+	if o.HealthCheckInterval < 0 {
+		return fmt.Errorf("health check interval cannot be negative, got %v", o.HealthCheckInterval)
+	}
+	if o.MaxQueueDepth < 0 {
+		return fmt.Errorf("max queue depth cannot be negative, got %d", o.MaxQueueDepth)
+	}
+	return nil
 }
 
 // NewClient creates a new Postgres client with connection pooling and retry logic
-func NewClient(ctx context.Context, connString string) (*Client, error) {
+func NewClient(ctx context.Context, connString string, opts Options) (*Client, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid client options: %w", err)
+	}
+
 	config, err := pgxpool.ParseConfig(connString)
 	if err != nil {
+		// pgx redacts the password from the connection string it quotes
 		return nil, fmt.Errorf("failed to parse connection string: %w", err)
 	}
 
 	// Configure connection pool
-	config.MaxConns = 5
-	config.MinConns = 1
+	config.MaxConns = opts.MaxConns
+	config.MinConns = opts.MinConns
+	setApplicationName(config, opts.ApplicationName)
 
-	// Retry logic with exponential backoff
-	maxAttempts := 4
-	backoffDurations := []time.Duration{0, 2 * time.Second, 4 * time.Second, 8 * time.Second}
+	// Ask the server to cancel the running statement when a query's context is
+	// canceled, rather than only abandoning it on the client side
+	config.ConnConfig.BuildContextWatcherHandler = func(pgConn *pgconn.PgConn) ctxwatch.Handler {
+		return &pgconn.CancelRequestContextWatcherHandler{
+			Conn:          pgConn,
+			DeadlineDelay: time.Second,
+		}
+	}
+
+	progress := opts.Progress
+	if progress == nil {
+		progress = io.Discard
+	}
+	pool, err := connect(ctx, config, opts.Retry, progress)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{pool: pool, readOnly: opts.ReadOnly, config: config, retry: opts.Retry, progress: progress}
+	if opts.MaxQueueDepth > 0 {
+		c.queue = newQueryQueue(opts.MaxConns, opts.MaxQueueDepth)
+	}
+	if opts.HealthCheckInterval > 0 {
+		c.startHealthCheck(opts.HealthCheckInterval)
+	}
+	return c, nil
+}
+
+// setApplicationName sets application_name unless the connection string or PGAPPNAME already did
+func setApplicationName(config *pgxpool.Config, name string) {
+	if _, ok := config.ConnConfig.RuntimeParams["application_name"]; ok || name == "" {
+		return
+	}
+	config.ConnConfig.RuntimeParams["application_name"] = name
+}
+
+// connect opens a pool and pings it, retrying with exponential backoff
+// Progress messages for each attempt go to progress
+func connect(ctx context.Context, config *pgxpool.Config, retry RetryConfig, progress io.Writer) (*pgxpool.Pool, error) {
+	maxAttempts := retry.MaxAttempts
 
-	var pool *pgxpool.Pool
 	var lastErr error
 
 	for attempt := 1; attempt <= maxAttempts; attempt++ {
 		// Wait before retry (except first attempt)
 		if attempt > 1 {
-			waitDuration := backoffDurations[attempt-1]
-			fmt.Printf("Retrying... (attempt %d/%d) after %v\n", attempt, maxAttempts, waitDuration)
+			waitDuration := retry.Backoff(attempt)
+			fmt.Fprintf(progress, "Retrying... (attempt %d/%d) after %v\n", attempt, maxAttempts, waitDuration)
 			select {
 			case <-time.After(waitDuration):
 			case <-ctx.Done():
 				return nil, fmt.Errorf("context cancelled during retry: %w", ctx.Err())
 			}
 		} else {
-			fmt.Printf("Connecting to database... (attempt %d/%d)\n", attempt, maxAttempts)
+			fmt.Fprintf(progress, "Connecting to database... (attempt %d/%d)\n", attempt, maxAttempts)
 		}
 
 		// Attempt connection
-		pool, err = pgxpool.NewWithConfig(ctx, config)
+		// Errors can quote connection settings, so keep the password out of them.
+		// A pool takes ownership of its config, so each one gets a copy
+		// Opening a pool doesn't connect, so it only fails on settings no attempt would accept
+		pool, err := pgxpool.NewWithConfig(ctx, config.Copy())
 		if err != nil {
-			lastErr = fmt.Errorf("failed to create connection pool: %w", err)
-			continue
+			return nil, redactError(fmt.Errorf("failed to create connection pool: %w", err), config.ConnConfig.Password)
 		}
 
 		// Test connection with ping
 		if err := pool.Ping(ctx); err != nil {
-			lastErr = fmt.Errorf("failed to ping database: %w", err)
 			pool.Close()
+			// Retrying can't fix a wrong password or a missing database, it only delays the error
+			if !isRetryable(err) {
+				return nil, redactError(fmt.Errorf("%s: %w", connectErrorReason(err, config), err), config.ConnConfig.Password)
+			}
+			lastErr = redactError(fmt.Errorf("failed to ping database: %w", err), config.ConnConfig.Password)
 			continue
 		}
 
 		// Success!
-		fmt.Println("✓ Connected!")
-		return &Client{pool: pool}, nil
+		fmt.Fprintln(progress, "✓ Connected!")
+		return pool, nil
 	}
 
 	// All attempts failed
 	return nil, fmt.Errorf("failed to connect after %d attempts: %w", maxAttempts, lastErr)
 }
 
-// Close closes the database connection pool
+// isRetryable reports whether a failed connection attempt may succeed if it's tried again
+// Refused connections, timeouts, DNS failures and a server that is starting up or out of connections
+// pass with time, while a wrong password, a missing database or a TLS setup that doesn't match the
+// server's fail the same way every time. Anything unrecognized is retried, as every failure used to be
+func isRetryable(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		// Invalid authorization (28000, 28P01) and invalid catalog name (3D000)
+		return !strings.HasPrefix(pgErr.Code, "28") && pgErr.Code != "3D000"
+	}
+
+	var certErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	switch {
+	case errors.As(err, &certErr), errors.As(err, &authorityErr), errors.As(err, &hostnameErr), errors.As(err, &invalidErr):
+		return false
+	case strings.Contains(err.Error(), "server refused TLS connection"):
+		return false
+	}
+	return true
+}
+
+// connectErrorReason explains a connection failure isRetryable gave up on in terms of what to fix
+// SCRAM and MD5 password failures both arrive as 28P01, whichever method pg_hba.conf asks for
+func connectErrorReason(err error, config *pgxpool.Config) string {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch {
+		case pgErr.Code == "28P01": // Invalid password
+			return fmt.Sprintf("authentication failed for user %q; check the user name and password", config.ConnConfig.User)
+		case strings.HasPrefix(pgErr.Code, "28"): // Invalid authorization specification
+			return fmt.Sprintf("the server rejected user %q (%s); check that the role exists and pg_hba.conf allows it from this host",
+				config.ConnConfig.User, pgErr.Message)
+		case pgErr.Code == "3D000": // Invalid catalog name
+			return fmt.Sprintf("database %q does not exist; check the database name", config.ConnConfig.Database)
+		}
+	}
+	if strings.Contains(err.Error(), "server refused TLS connection") {
+		return "the server doesn't accept TLS connections; check sslmode"
+	}
+	if !isRetryable(err) {
+		return "the server's TLS certificate couldn't be verified; check sslmode and sslrootcert"
+	}
+	return "failed to connect to database"
+}
+
+// Close stops the health check and closes the database connection pool
 func (c *Client) Close() {
-	if c.pool != nil {
-		c.pool.Close()
+	c.closeOnce.Do(func() {
+		if c.stopHealth != nil {
+			close(c.stopHealth)
+			<-c.healthDone
+		}
+		if pool := c.currentPool(); pool != nil {
+			pool.Close()
+		}
+	})
+}
+
+// DatabaseName returns the name of the database the connection string connects to
+func (c *Client) DatabaseName() string {
+	if c.config == nil {
+		return ""
 	}
+	return c.config.ConnConfig.Database
+}
+
+// currentPool returns the pool queries should use, which changes after a reconnect
+func (c *Client) currentPool() *pgxpool.Pool {
+	c.poolMu.RLock()
+	defer c.poolMu.RUnlock()
+	return c.pool
 }
 
-// Ping tests the database connection
+// Ping tests the database connection on a pool connection, waiting its turn in the query queue
 func (c *Client) Ping(ctx context.Context) error {
-	return c.pool.Ping(ctx)
+	conn, err := c.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	return conn.Ping(ctx)
+}
+
+// PoolStats is a snapshot of the connection pool
+type PoolStats struct {
+	Total    int32 // open connections, whether idle, in use, or still connecting
+	Idle     int32 // connections waiting to be used
+	Acquired int32 // connections currently running a query or transaction
+	Max      int32 // the most connections the pool will open
+	Queued   int32 // queries waiting for a connection
+}
+
+// Stats returns the current state of the connection pool
+func (c *Client) Stats() PoolStats {
+	stat := c.currentPool().Stat()
+	return PoolStats{
+		Total:    stat.TotalConns(),
+		Idle:     stat.IdleConns(),
+		Acquired: stat.AcquiredConns(),
+		Max:      stat.MaxConns(),
+		Queued:   c.queue.queued(),
+	}
 }
 
 // QueryResult contains the results of a query execution
@@ -88,64 +455,320 @@ type QueryResult struct {
 	Rows          []map[string]interface{}
 	Columns       []protocol.ColumnInfo
 	RowCount      int
+	RowsAffected  int64  // from the command tag; rows returned for SELECT, rows changed for INSERT/UPDATE/DELETE
+	Command       string // the command tag without its row counts, e.g. "SELECT", "INSERT" or "CREATE TABLE"
 	ExecutionTime time.Duration
+	Timing        QueryTiming // where ExecutionTime went
+	Truncated     bool        // the query returned more rows than its row limit; the rest were discarded
+}
+
+// QueryTiming splits a query's execution time between Postgres and the proxy
+// Time spent handing batches to the caller, such as sending streamed chunks, is in neither
+type QueryTiming struct {
+	FirstRow   time.Duration // until the first row arrived, or the query finished if it returned none
+	Fetch      time.Duration // waiting for Postgres to plan and run the query and send its rows
+	Conversion time.Duration // decoding rows and converting their values in the proxy
+}
+
+// maxRowsKey is the context key holding a query's row limit
+type maxRowsKey struct{}
+
+// WithMaxRows returns a context that limits buffered queries run with it to maxRows rows
+// Results with more rows are cut off and marked Truncated. Zero or less means no limit.
+// Streamed queries are not limited, since they don't hold their rows in memory
+func WithMaxRows(ctx context.Context, maxRows int) context.Context {
+	return context.WithValue(ctx, maxRowsKey{}, maxRows)
 }
 
+// MaxRowsFromContext returns the row limit set on ctx by WithMaxRows, or zero if there is none
+func MaxRowsFromContext(ctx context.Context) int {
+	maxRows, _ := ctx.Value(maxRowsKey{}).(int)
+	return maxRows
+}
+
+// rowLimit caps how many rows executeOn reads
+type rowLimit struct {
+	maxRows int // zero or less reads every row
+	// stop cancels the query once the limit is hit so the database stops sending rows.
+	// Canceling a statement aborts the transaction it runs in and undoes its writes, so inside
+	// a caller's transaction, or for a statement that may write, stop is nil and the remaining
+	// rows are read and discarded instead
+	stop context.CancelFunc
+}
+
+// RowBatchFunc receives result rows in batches as they are read from the database
+// columns is the same for every batch; returning an error aborts the query
+type RowBatchFunc func(columns []protocol.ColumnInfo, rows []map[string]interface{}) error
+
 // ExecuteQuery executes a SQL query and returns the results
+// In read-only mode the query runs inside a READ ONLY transaction so the
+// database itself rejects any attempt to modify data
+// The number of rows returned is capped by the limit set with WithMaxRows, if any
 func (c *Client) ExecuteQuery(ctx context.Context, sql string, params []interface{}) (*QueryResult, error) {
+	resultRows := []map[string]interface{}{}
+	result, err := c.query(ctx, sql, params, 0, MaxRowsFromContext(ctx), func(_ []protocol.ColumnInfo, rows []map[string]interface{}) error {
+		resultRows = append(resultRows, rows...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result.Rows = resultRows
+	return result, nil
+}
+
+// StreamQuery executes a SQL query and passes its rows to fn in batches of batchSize
+// A batchSize of zero or less delivers all rows in a single batch
+// The returned QueryResult has no Rows; RowCount is the total number of rows streamed
+func (c *Client) StreamQuery(ctx context.Context, sql string, params []interface{}, batchSize int, fn RowBatchFunc) (*QueryResult, error) {
+	return c.query(ctx, sql, params, batchSize, 0, fn)
+}
+
+// query runs a query on a pool connection, inside a READ ONLY transaction in read-only mode
+func (c *Client) query(ctx context.Context, sql string, params []interface{}, batchSize, maxRows int, fn RowBatchFunc) (*QueryResult, error) {
+	// The query doesn't share a transaction with anything else, so it can be canceled at the row
+	// limit, but only if that can't roll back a write: a statement that returns rows while
+	// writing, such as INSERT ... RETURNING, has the rows past the limit read and discarded
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	limit := rowLimit{maxRows: maxRows}
+	if c.readOnly || sqlutil.IsReadOnly(sql) {
+		limit.stop = cancel
+	}
+
+	conn, err := c.acquire(ctx)
+	if err != nil {
+		return nil, c.handleQueryError(ctx, err)
+	}
+	defer conn.Release()
+
+	return c.executeAlone(ctx, conn, sql, nil, params, batchSize, limit, fn)
+}
+
+// executeAlone runs a statement on conn in a transaction of its own, READ ONLY in read-only mode
+// Canceling the context asks Postgres to cancel the statement, but that request can be lost, so
+// the transaction sets a statement_timeout that makes the server stop it and release its locks
+// itself. Outside read-only mode a statement without a deadline, or one Postgres won't run in a
+// transaction block such as VACUUM, runs without a transaction and relies on the cancel request
+func (c *Client) executeAlone(ctx context.Context, conn *queuedConn, sql string, prepared *pgconn.StatementDescription, params []interface{}, batchSize int, limit rowLimit, fn RowBatchFunc) (*QueryResult, error) {
+	if _, hasTimeout := statementTimeout(ctx); !c.readOnly && (!hasTimeout || !sqlutil.AllowedInTransaction(sql)) {
+		return c.executeOn(ctx, conn, sql, prepared, params, batchSize, limit, fn)
+	}
+
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{BeginQuery: beginStatement(ctx, c.readOnly)})
+	if err != nil {
+		return nil, c.handleQueryError(ctx, err)
+	}
+	// No-op once the transaction has been committed
+	defer func() { _ = tx.Rollback(context.Background()) }()
+
+	result, err := c.executeOn(ctx, tx, sql, prepared, params, batchSize, limit, fn)
+	// Nothing can have been written in read-only mode, and a statement stopped at its row limit
+	// was canceled, which undid whatever it wrote, so both are rolled back
+	if err != nil || c.readOnly || (result.Truncated && limit.stop != nil) {
+		return result, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, c.handleQueryError(ctx, err)
+	}
+	return result, nil
+}
+
+// beginStatement returns the statement that opens a transaction, READ ONLY if readOnly, setting
+// a statement_timeout for ctx's deadline in the same round trip. SET LOCAL ends with the
+// transaction, so the connection goes back to the pool with the server's own timeout
+func beginStatement(ctx context.Context, readOnly bool) string {
+	begin := "BEGIN"
+	if readOnly {
+		begin = "BEGIN READ ONLY"
+	}
+	if timeout, ok := statementTimeout(ctx); ok {
+		begin += fmt.Sprintf("; SET LOCAL statement_timeout = %d", timeout)
+	}
+	return begin
+}
+
+// statementTimeout returns the milliseconds left before ctx's deadline, rounded up, if it has one
+// A statement_timeout of zero would disable the timeout, so it is at least 1
+func statementTimeout(ctx context.Context) (int64, bool) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0, false
+	}
+	remaining := time.Until(deadline)
+	ms := int64((remaining + time.Millisecond - 1) / time.Millisecond)
+	if ms < 1 {
+		ms = 1
+	}
+	return ms, true
+}
+
+// executeOn runs a query against the given querier and passes its rows to fn in batches
+// Reading stops once limit.maxRows rows have been read and there are more. If prepared is not nil,
+// sql was prepared on q's connection under prepared's name and runs by that name without being parsed again
+func (c *Client) executeOn(ctx context.Context, q querier, sql string, prepared *pgconn.StatementDescription, params []interface{}, batchSize int, limit rowLimit, fn RowBatchFunc) (*QueryResult, error) {
 	// Measure execution time
 	startTime := time.Now()
 
-	// Execute the query
-	rows, err := c.pool.Query(ctx, sql, params...)
+	if err := c.checkParams(ctx, q, sql, prepared, params); err != nil {
+		return nil, c.handleQueryError(ctx, err)
+	}
+
+	// Execute the query; pgx runs a name it has prepared as that statement
+	query := sql
+	if prepared != nil {
+		query = prepared.Name
+	}
+	rows, err := q.Query(ctx, query, params...)
 	if err != nil {
-		return nil, c.handleQueryError(err)
+		return nil, c.handleQueryError(ctx, err)
 	}
 	defer rows.Close()
 
 	// Parse field descriptions (column metadata)
+	typeMap := rows.Conn().TypeMap()
 	fieldDescriptions := rows.FieldDescriptions()
 	columns := make([]protocol.ColumnInfo, len(fieldDescriptions))
+	arrayColumns := make([]bool, len(fieldDescriptions))
+	jsonColumns := make([]bool, len(fieldDescriptions))
 	for i, fd := range fieldDescriptions {
-		columns[i] = protocol.ColumnInfo{
-			Name:     string(fd.Name),
-			DataType: c.getDataTypeName(fd.DataTypeOID),
-			TypeOID:  fd.DataTypeOID,
-		}
+		columns[i] = c.describeColumn(fd)
+		arrayColumns[i] = isArrayType(typeMap, fd.DataTypeOID)
+		jsonColumns[i] = isJSONType(fd.DataTypeOID)
 	}
+	uniqueColumnNames(columns)
 
 	// Parse result rows
-	resultRows := []map[string]interface{}{}
+	rowCount := 0
+	truncated := false
+	batch := []map[string]interface{}{}
+	var timing QueryTiming
+	var delivery time.Duration
 	for rows.Next() {
+		if rowCount == 0 {
+			timing.FirstRow = time.Since(startTime)
+		}
+		if limit.maxRows > 0 && rowCount >= limit.maxRows {
+			truncated = true
+			break
+		}
+		convertStart := time.Now()
+
+		// Hands a streamed query the rows before a value that can't be converted, then reports where it broke
+		rowError := func(column int, err error) error {
+			if batchSize > 0 && len(batch) > 0 {
+				if err := fn(columns, batch); err != nil {
+					return err
+				}
+			}
+			return &RowError{Row: rowCount, Column: columns[column].Name, Type: columns[column].DataType, Err: err}
+		}
+
 		// Get values for this row
-		values, err := rows.Values()
+		values, column, err := decodeRow(typeMap, fieldDescriptions, rows.RawValues())
 		if err != nil {
-			return nil, fmt.Errorf("failed to read row values: %w", err)
+			return nil, rowError(column, err)
 		}
 
 		// Build row map
 		rowMap := make(map[string]interface{})
 		for i, col := range columns {
-			rowMap[col.Name] = c.convertValue(values[i])
+			value := values[i]
+			if jsonColumns[i] {
+				// Send the document as Postgres returned it rather than pgx's decoded copy,
+				// which loses key order, large-number precision and JSON null
+				rowMap[col.Name] = rawJSON(fieldDescriptions[i], rows.RawValues()[i])
+				continue
+			}
+			if arrayColumns[i] && value != nil {
+				// Values() flattens multi-dimensional arrays, so decode them again keeping their shape
+				value, err = decodeArray(typeMap, fieldDescriptions[i], rows.RawValues()[i])
+				if err != nil {
+					return nil, rowError(i, err)
+				}
+			}
+			if isCIDRType(fieldDescriptions[i].DataTypeOID) {
+				value = cidrStrings(value)
+			}
+			if col.Encoding == protocol.EncodingBase64 {
+				rowMap[col.Name] = encodeBase64(value)
+			} else {
+				rowMap[col.Name] = c.convertValue(value)
+			}
 		}
-		resultRows = append(resultRows, rowMap)
+		batch = append(batch, rowMap)
+		rowCount++
+		timing.Conversion += time.Since(convertStart)
+
+		// Hand off full batches; each batch gets a fresh slice since fn may retain it
+		if batchSize > 0 && len(batch) >= batchSize {
+			deliverStart := time.Now()
+			if err := fn(columns, batch); err != nil {
+				return nil, err
+			}
+			delivery += time.Since(deliverStart)
+			batch = make([]map[string]interface{}, 0, batchSize)
+		}
+	}
+	if timing.FirstRow == 0 {
+		timing.FirstRow = time.Since(startTime) // no rows
 	}
+	timing.Fetch = time.Since(startTime) - timing.Conversion - delivery
 
-	// Check for errors after iteration
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("error iterating rows: %w", err)
+	if truncated {
+		if limit.stop != nil {
+			limit.stop()
+		}
+		rows.Close()
+	}
+
+	// Check for errors after iteration; once a query is stopped at its limit, its cancellation isn't one
+	if err := rows.Err(); err != nil && !(truncated && limit.stop != nil) {
+		return nil, c.handleQueryError(ctx, err)
+	}
+
+	if len(batch) > 0 || batchSize <= 0 {
+		if err := fn(columns, batch); err != nil {
+			return nil, err
+		}
 	}
 
 	executionTime := time.Since(startTime)
 
+	// Look up custom types now that the connection is free for another query. A query stopped
+	// at its row limit has had its context canceled, but the lookup still needs one.
+	// Streamed chunks already sent keep the placeholder names; the final result has the real ones
+	lookupCtx := ctx
+	if truncated && limit.stop != nil {
+		lookupCtx = context.WithoutCancel(ctx)
+	}
+	c.resolveColumnTypes(lookupCtx, q, fieldDescriptions, columns)
+
 	return &QueryResult{
-		Rows:          resultRows,
 		Columns:       columns,
-		RowCount:      len(resultRows),
+		RowCount:      rowCount,
+		RowsAffected:  rows.CommandTag().RowsAffected(),
+		Command:       commandName(rows.CommandTag()),
 		ExecutionTime: executionTime,
+		Timing:        timing,
+		Truncated:     truncated,
 	}, nil
 }
 
+// commandName returns the statement type from a command tag, dropping the row counts
+// that follow it, as in "INSERT 0 5" or "SELECT 3"
+func commandName(tag pgconn.CommandTag) string {
+	words := strings.Fields(tag.String())
+	for len(words) > 0 {
+		if _, err := strconv.ParseInt(words[len(words)-1], 10, 64); err != nil {
+			break
+		}
+		words = words[:len(words)-1]
+	}
+	return strings.Join(words, " ")
+}
+
 // convertValue converts database values to JSON-friendly types
 func (c *Client) convertValue(value interface{}) interface{} {
 	// Handle NULL values
@@ -157,127 +780,664 @@ func (c *Client) convertValue(value interface{}) interface{} {
 	switch v := value.(type) {
 	case time.Time:
 		return v.Format(time.RFC3339)
+	case pgtype.Numeric:
+		// Numeric/decimal - render as an exact decimal string so no precision is lost
+		return numericString(v)
+	case []interface{}:
+		// Arrays - convert each element, keeping NULL elements as nil
+		converted := make([]interface{}, len(v))
+		for i, element := range v {
+			converted[i] = c.convertValue(element)
+		}
+		return converted
+	case map[string]interface{}:
+		// JSON objects pgx decoded itself, such as a jsonb field of a record
+		converted := make(map[string]interface{}, len(v))
+		for key, element := range v {
+			converted[key] = c.convertValue(element)
+		}
+		return converted
+	case json.RawMessage:
+		// json and jsonb documents, already encoded
+		return v
 	case []byte:
 		// Convert byte arrays to strings for JSON compatibility
 		return string(v)
+	case pgtype.Interval:
+		return intervalString(v)
+	case netip.Prefix:
+		return inetString(v)
+	case [16]byte:
+		// pgx decodes uuid as its 16 raw bytes
+		return uuidString(v)
 	default:
 		// All other types are already JSON-compatible
 		return value
 	}
 }
 
-// getDataTypeName returns a human-readable name for a Postgres OID
+// intervalString renders an interval the way Postgres does with its default IntervalStyle,
+// as in "1 year 2 mons 3 days 04:05:06.5"
+func intervalString(v pgtype.Interval) interface{} {
+	if !v.Valid {
+		return nil
+	}
+
+	var parts []string
+	unit := func(n int64, name string) {
+		if n == 0 {
+			return
+		}
+		// Postgres only uses the singular for exactly 1, so -1 is "-1 days"
+		if n != 1 {
+			name += "s"
+		}
+		parts = append(parts, fmt.Sprintf("%d %s", n, name))
+	}
+	unit(int64(v.Months/12), "year")
+	unit(int64(v.Months%12), "mon")
+	unit(int64(v.Days), "day")
+
+	// The time of day is left out when it is zero, unless it is all there is
+	if v.Microseconds != 0 || len(parts) == 0 {
+		micros := v.Microseconds
+		sign := ""
+		if micros < 0 {
+			sign = "-"
+			micros = -micros
+		}
+		clock := fmt.Sprintf("%s%02d:%02d:%02d", sign,
+			micros/int64(time.Hour/time.Microsecond),
+			micros/int64(time.Minute/time.Microsecond)%60,
+			micros/int64(time.Second/time.Microsecond)%60)
+		if fraction := micros % int64(time.Second/time.Microsecond); fraction != 0 {
+			clock += strings.TrimRight(fmt.Sprintf(".%06d", fraction), "0")
+		}
+		parts = append(parts, clock)
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// inetString renders an inet or cidr value in Postgres' text form
+// A mask covering the whole address is left out, as Postgres does for inet
+func inetString(p netip.Prefix) string {
+	if p.Bits() == p.Addr().BitLen() {
+		return p.Addr().String()
+	}
+	return p.String()
+}
+
+// isCIDRType reports whether the OID is cidr or an array of cidr
+func isCIDRType(oid uint32) bool {
+	return oid == pgtype.CIDROID || oid == pgtype.CIDRArrayOID
+}
+
+// cidrStrings renders cidr values (and cidr array elements) with their mask,
+// which Postgres always shows for cidr, unlike inet
+func cidrStrings(value interface{}) interface{} {
+	switch v := value.(type) {
+	case netip.Prefix:
+		return v.String()
+	case []interface{}:
+		converted := make([]interface{}, len(v))
+		for i, element := range v {
+			converted[i] = cidrStrings(element)
+		}
+		return converted
+	default:
+		return value
+	}
+}
+
+// uuidString renders a uuid in its standard hyphenated form
+func uuidString(b [16]byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// numericString renders a numeric value in Postgres' exact text form (including NaN and Infinity)
+func numericString(n pgtype.Numeric) interface{} {
+	value, err := n.Value()
+	if err != nil || value == nil {
+		return nil
+	}
+	return value
+}
+
+// describeColumn converts a result field description into the column metadata sent to clients
+func (c *Client) describeColumn(fd pgconn.FieldDescription) protocol.ColumnInfo {
+	column := protocol.ColumnInfo{
+		Name:         fd.Name,
+		DataType:     c.sqlTypeName(fd.DataTypeOID, fd.TypeModifier),
+		InternalType: c.getDataTypeName(fd.DataTypeOID),
+		TypeOID:      fd.DataTypeOID,
+		TableOID:     fd.TableOID,
+		TableColumn:  fd.TableAttributeNumber,
+	}
+	if isByteaType(fd.DataTypeOID) {
+		column.Encoding = protocol.EncodingBase64
+	}
+	return column
+}
+
+// uniqueColumnNames renames repeated column names, as in a join selecting two ids, so each
+// column keeps its own key in the row maps. The first keeps its name and later ones get a
+// suffix: id, id_1, id_2. Suffixes skip names another column already has
+func uniqueColumnNames(columns []protocol.ColumnInfo) {
+	used := make(map[string]bool, len(columns))
+	for _, column := range columns {
+		used[column.Name] = true
+	}
+	seen := make(map[string]bool, len(columns))
+	for i, column := range columns {
+		if !seen[column.Name] {
+			seen[column.Name] = true
+			continue
+		}
+		for n := 1; ; n++ {
+			name := fmt.Sprintf("%s_%d", column.Name, n)
+			if !used[name] {
+				used[name] = true
+				columns[i].Name = name
+				break
+			}
+		}
+	}
+}
+
+// isByteaType reports whether the OID is bytea or an array of bytea
+func isByteaType(oid uint32) bool {
+	return oid == pgtype.ByteaOID || oid == pgtype.ByteaArrayOID
+}
+
+// encodeBase64 encodes bytea values (and bytea array elements) as base64 strings
+// Binary data is rarely valid UTF-8, so a plain string conversion would corrupt it in JSON
+func encodeBase64(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []byte:
+		return base64.StdEncoding.EncodeToString(v)
+	case []interface{}:
+		encoded := make([]interface{}, len(v))
+		for i, element := range v {
+			encoded[i] = encodeBase64(element)
+		}
+		return encoded
+	default:
+		return value
+	}
+}
+
+// isJSONType reports whether the OID is json or jsonb
+func isJSONType(oid uint32) bool {
+	return oid == pgtype.JSONOID || oid == pgtype.JSONBOID
+}
+
+// isJSONArrayType reports whether the OID is json[] or jsonb[]
+func isJSONArrayType(oid uint32) bool {
+	return oid == pgtype.JSONArrayOID || oid == pgtype.JSONBArrayOID
+}
+
+// rawJSON returns a json or jsonb value as a json.RawMessage, so it is embedded in results
+// as a JSON object, array or scalar rather than a string
+// SQL NULL becomes nil, while a JSON null document stays the literal null
+func rawJSON(fd pgconn.FieldDescription, raw []byte) interface{} {
+	if raw == nil {
+		return nil
+	}
+	// Binary jsonb is the text form after a one-byte format version
+	if fd.DataTypeOID == pgtype.JSONBOID && fd.Format == pgtype.BinaryFormatCode && len(raw) > 0 {
+		raw = raw[1:]
+	}
+	// raw belongs to the row buffer, which the next row overwrites
+	return json.RawMessage(append([]byte(nil), raw...))
+}
+
+// decodeRow decodes a row's raw values the way pgx's Rows.Values does, but reports which column failed
+// Unlike Values, a failure doesn't close rows, so the rows before it can still be delivered
+func decodeRow(typeMap *pgtype.Map, fields []pgconn.FieldDescription, raw [][]byte) ([]interface{}, int, error) {
+	values := make([]interface{}, len(fields))
+	for i, fd := range fields {
+		buf := raw[i]
+		if buf == nil {
+			continue
+		}
+		dt, ok := typeMap.TypeForOID(fd.DataTypeOID)
+		if !ok {
+			// Types pgx doesn't know come back as their text, or a copy of their bytes
+			if fd.Format == pgx.TextFormatCode {
+				values[i] = string(buf)
+			} else {
+				values[i] = append([]byte(nil), buf...)
+			}
+			continue
+		}
+		value, err := dt.Codec.DecodeValue(typeMap, fd.DataTypeOID, fd.Format, buf)
+		if err != nil {
+			return nil, i, err
+		}
+		values[i] = value
+	}
+	return values, 0, nil
+}
+
+// isArrayType reports whether the OID is a Postgres array type known to the type map
+func isArrayType(typeMap *pgtype.Map, oid uint32) bool {
+	t, ok := typeMap.TypeForOID(oid)
+	if !ok {
+		return false
+	}
+	_, isArray := t.Codec.(*pgtype.ArrayCodec)
+	return isArray
+}
+
+// decodeArray decodes a raw array value into nested slices matching its dimensions
+func decodeArray(typeMap *pgtype.Map, fd pgconn.FieldDescription, raw []byte) (interface{}, error) {
+	if isJSONArrayType(fd.DataTypeOID) {
+		return decodeJSONArray(typeMap, fd, raw)
+	}
+
+	var arr pgtype.Array[interface{}]
+	if err := typeMap.Scan(fd.DataTypeOID, fd.Format, raw, &arr); err != nil {
+		return nil, err
+	}
+	if !arr.Valid {
+		return nil, nil
+	}
+	return nestArray(arr.Elements, arr.Dims), nil
+}
+
+// decodeJSONArray decodes a json[] or jsonb[] value keeping each document as Postgres returned it,
+// as rawJSON does for a json column. SQL NULL elements become nil
+func decodeJSONArray(typeMap *pgtype.Map, fd pgconn.FieldDescription, raw []byte) (interface{}, error) {
+	var arr pgtype.Array[json.RawMessage]
+	if err := typeMap.Scan(fd.DataTypeOID, fd.Format, raw, &arr); err != nil {
+		return nil, err
+	}
+	if !arr.Valid {
+		return nil, nil
+	}
+	elements := make([]interface{}, len(arr.Elements))
+	for i, doc := range arr.Elements {
+		if doc != nil {
+			elements[i] = doc
+		}
+	}
+	return nestArray(elements, arr.Dims), nil
+}
+
+// nestArray reshapes the flat elements of a multi-dimensional array into nested slices
+// e.g. elements [1 2 3 4] with dimensions 2x2 become [[1 2] [3 4]]
+func nestArray(elements []interface{}, dims []pgtype.ArrayDimension) []interface{} {
+	if len(dims) <= 1 || dims[0].Length == 0 {
+		return elements
+	}
+
+	outer := int(dims[0].Length)
+	size := len(elements) / outer
+	nested := make([]interface{}, outer)
+	for i := range nested {
+		nested[i] = nestArray(elements[i*size:(i+1)*size], dims[1:])
+	}
+	return nested
+}
+
+// builtinTypeNames maps common Postgres type OIDs to their names
+// Full list: https://github.com/postgres/postgres/blob/master/src/include/catalog/pg_type.dat
+var builtinTypeNames = map[uint32]string{
+	16:   "bool",
+	17:   "bytea",
+	18:   "char",
+	19:   "name",
+	20:   "int8",
+	21:   "int2",
+	23:   "int4",
+	25:   "text",
+	114:  "json",
+	142:  "xml",
+	194:  "pg_node_tree",
+	700:  "float4",
+	701:  "float8",
+	705:  "unknown",
+	790:  "money",
+	829:  "macaddr",
+	869:  "inet",
+	1000: "_bool",
+	1001: "_bytea",
+	1002: "_char",
+	1003: "_name",
+	1005: "_int2",
+	1007: "_int4",
+	1009: "_text",
+	1014: "_bpchar",
+	1015: "_varchar",
+	1016: "_int8",
+	1021: "_float4",
+	1022: "_float8",
+	1042: "bpchar",
+	1043: "varchar",
+	1082: "date",
+	1083: "time",
+	1114: "timestamp",
+	1115: "_timestamp",
+	1182: "_date",
+	1183: "_time",
+	1184: "timestamptz",
+	1185: "_timestamptz",
+	1186: "interval",
+	1187: "_interval",
+	1231: "_numeric",
+	1266: "timetz",
+	1270: "_timetz",
+	1560: "bit",
+	1562: "varbit",
+	1700: "numeric",
+	2950: "uuid",
+	3802: "jsonb",
+}
+
+// getDataTypeName returns Postgres' internal name for a type OID, such as int4 or _text
+// Types that aren't built in are named once resolveTypeNames has looked them up
 func (c *Client) getDataTypeName(oid uint32) string {
-	// Common Postgres type OIDs
-	// Full list: https://github.com/postgres/postgres/blob/master/src/include/catalog/pg_type.dat
-	typeNames := map[uint32]string{
-		16:   "bool",
-		17:   "bytea",
-		18:   "char",
-		19:   "name",
-		20:   "int8",
-		21:   "int2",
-		23:   "int4",
-		25:   "text",
-		114:  "json",
-		142:  "xml",
-		194:  "pg_node_tree",
-		700:  "float4",
-		701:  "float8",
-		705:  "unknown",
-		790:  "money",
-		829:  "macaddr",
-		869:  "inet",
-		1000: "_bool",
-		1001: "_bytea",
-		1002: "_char",
-		1003: "_name",
-		1005: "_int2",
-		1007: "_int4",
-		1009: "_text",
-		1014: "_bpchar",
-		1015: "_varchar",
-		1016: "_int8",
-		1021: "_float4",
-		1022: "_float8",
-		1042: "bpchar",
-		1043: "varchar",
-		1082: "date",
-		1083: "time",
-		1114: "timestamp",
-		1115: "_timestamp",
-		1182: "_date",
-		1183: "_time",
-		1184: "timestamptz",
-		1185: "_timestamptz",
-		1186: "interval",
-		1187: "_interval",
-		1231: "_numeric",
-		1266: "timetz",
-		1270: "_timetz",
-		1560: "bit",
-		1562: "varbit",
-		1700: "numeric",
-		2950: "uuid",
-		3802: "jsonb",
-	}
-
-	if name, ok := typeNames[oid]; ok {
+	if name, ok := builtinTypeNames[oid]; ok {
+		return name
+	}
+
+	c.typeMu.Lock()
+	name, ok := c.internalNames[oid]
+	c.typeMu.Unlock()
+	if ok {
 		return name
 	}
 	return fmt.Sprintf("unknown(%d)", oid)
 }
 
+// sqlTypeName returns the SQL name of a type with its modifier, as format_type writes it and
+// introspection reports it, such as integer or character varying(255)
+// Until resolveTypeNames has looked the type up, it falls back to the internal name
+func (c *Client) sqlTypeName(oid uint32, typmod int32) string {
+	c.typeMu.Lock()
+	name, ok := c.sqlNames[typeKey{oid: oid, typmod: typmod}]
+	c.typeMu.Unlock()
+	if ok {
+		return name
+	}
+	return c.getDataTypeName(oid)
+}
+
+// resolveTypeNames looks up the names of types that aren't cached yet
+// It runs on q so that inside a transaction it uses the transaction's own connection
+func (c *Client) resolveTypeNames(ctx context.Context, q querier, keys []typeKey) error {
+	var oids []uint32
+	var typmods []int32
+	seen := make(map[typeKey]bool)
+	c.typeMu.Lock()
+	for _, key := range keys {
+		if _, ok := c.sqlNames[key]; ok || seen[key] {
+			continue
+		}
+		seen[key] = true
+		oids = append(oids, key.oid)
+		typmods = append(typmods, key.typmod)
+	}
+	c.typeMu.Unlock()
+	if len(oids) == 0 {
+		return nil
+	}
+
+	rows, err := q.Query(ctx, `
+		SELECT k.oid, k.typmod, t.typname, format_type(k.oid, k.typmod)
+		FROM unnest($1::oid[], $2::int4[]) AS k(oid, typmod)
+		JOIN pg_type t ON t.oid = k.oid
+	`, oids, typmods)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	internalNames := make(map[uint32]string)
+	sqlNames := make(map[typeKey]string)
+	for rows.Next() {
+		var key typeKey
+		var internalName, sqlName string
+		if err := rows.Scan(&key.oid, &key.typmod, &internalName, &sqlName); err != nil {
+			return err
+		}
+		internalNames[key.oid] = internalName
+		sqlNames[key] = sqlName
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	c.typeMu.Lock()
+	defer c.typeMu.Unlock()
+	if c.internalNames == nil {
+		c.internalNames = make(map[uint32]string)
+		c.sqlNames = make(map[typeKey]string)
+	}
+	for oid, name := range internalNames {
+		if _, ok := builtinTypeNames[oid]; !ok {
+			c.internalNames[oid] = name
+		}
+	}
+	for key, name := range sqlNames {
+		c.sqlNames[key] = name
+	}
+	return nil
+}
+
+// resolveColumnTypes fills in the type names of result columns from their field descriptions
+// A failed lookup leaves the names already there rather than failing the query
+func (c *Client) resolveColumnTypes(ctx context.Context, q querier, fields []pgconn.FieldDescription, columns []protocol.ColumnInfo) {
+	keys := make([]typeKey, len(fields))
+	for i, fd := range fields {
+		keys[i] = typeKey{oid: fd.DataTypeOID, typmod: fd.TypeModifier}
+	}
+	if err := c.resolveTypeNames(ctx, q, keys); err != nil {
+		return
+	}
+	for i, fd := range fields {
+		columns[i].DataType = c.sqlTypeName(fd.DataTypeOID, fd.TypeModifier)
+		columns[i].InternalType = c.getDataTypeName(fd.DataTypeOID)
+	}
+}
+
 // handleQueryError categorizes and formats query errors
-func (c *Client) handleQueryError(err error) error {
+// ctx is the one the query ran with, which tells a timeout apart from a cancel
+func (c *Client) handleQueryError(ctx context.Context, err error) error {
 	// Check if it's a pgconn error with code
 	var pgErr *pgconn.PgError
 	if errors.As(err, &pgErr) {
+		dbErr := &DatabaseError{
+			Code:     pgErr.Code,
+			Message:  pgErr.Message,
+			Detail:   pgErr.Detail,
+			Hint:     pgErr.Hint,
+			Position: int(pgErr.Position),
+		}
 		switch pgErr.Code {
 		case "42601": // Syntax error
-			return fmt.Errorf("syntax error: %s", pgErr.Message)
+			dbErr.summary = "syntax error: " + pgErr.Message
 		case "42501": // Insufficient privilege
-			return fmt.Errorf("permission denied: %s", pgErr.Message)
+			dbErr.summary = "permission denied: " + pgErr.Message
 		case "42P01": // Undefined table
-			return fmt.Errorf("table does not exist: %s", pgErr.Message)
+			dbErr.summary = "table does not exist: " + pgErr.Message
 		case "42703": // Undefined column
-			return fmt.Errorf("column does not exist: %s", pgErr.Message)
+			dbErr.summary = "column does not exist: " + pgErr.Message
 		case "57014": // Query canceled
-			return fmt.Errorf("query canceled: %s", pgErr.Message)
+			// statement_timeout and the cancel request sent when ctx expires both end a timed-out
+			// query this way; the timeout may fire just before ctx does
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) || strings.Contains(pgErr.Message, "statement timeout") {
+				dbErr.kind = ErrQueryTimeout
+			} else {
+				dbErr.kind = ErrQueryCanceled
+			}
+		case "25006": // Read-only SQL transaction
+			dbErr.kind = ErrReadOnlyViolation
+		case "57P01", "57P02", "57P03": // Server shutting down, crashed or starting up
+			dbErr.kind = ErrConnectionLost
 		default:
 			// Return the full Postgres error
-			return fmt.Errorf("database error [%s]: %s", pgErr.Code, pgErr.Message)
+			dbErr.summary = fmt.Sprintf("database error [%s]: %s", pgErr.Code, pgErr.Message)
+		}
+		if strings.HasPrefix(pgErr.Code, "08") { // Connection exception
+			dbErr.kind = ErrConnectionLost
 		}
+		if dbErr.kind != nil {
+			dbErr.summary = fmt.Sprintf("%v: %s", dbErr.kind, pgErr.Message)
+		}
+		if dbErr.kind == ErrConnectionLost {
+			c.discardConnections()
+		}
+		return dbErr
 	}
 
 	// Check for context timeout
 	if errors.Is(err, context.DeadlineExceeded) {
-		return fmt.Errorf("query timeout exceeded")
+		return ErrQueryTimeout
+	}
+
+	// Check for explicit cancellation
+	if errors.Is(err, context.Canceled) {
+		return ErrQueryCanceled
+	}
+
+	if errors.Is(err, ErrServerBusy) {
+		return ErrServerBusy
+	}
+
+	// Found by checkParams before the query ran
+	if errors.Is(err, ErrParameterMismatch) || errors.Is(err, ErrParameterTypeMismatch) {
+		return err
+	}
+
+	if isConnectionLost(err) {
+		c.discardConnections()
+		return fmt.Errorf("%w: %v", ErrConnectionLost, err)
 	}
 
 	// Return generic error
 	return fmt.Errorf("query failed: %w", err)
 }
 
+// isConnectionLost reports whether err means the connection to the database failed,
+// rather than the query: it couldn't be opened, the network dropped or the server went away
+func isConnectionLost(err error) bool {
+	var connectErr *pgconn.ConnectError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &connectErr), errors.As(err, &netErr):
+		return true
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, net.ErrClosed):
+		return true
+	}
+	// pgconn and the pool don't export these errors
+	message := err.Error()
+	return strings.Contains(message, "conn closed") || strings.Contains(message, "closed pool")
+}
+
+// discardConnections drops the pool's connections after one was found broken
+// When the server restarts every idle connection is dead, so without this each of them
+// would fail a query before the pool noticed. Connections in use are closed once released
+func (c *Client) discardConnections() {
+	if pool := c.currentPool(); pool != nil {
+		pool.Reset()
+	}
+}
+
 // IntrospectSchema queries the database schema and returns information about tables and functions
-func (c *Client) IntrospectSchema(ctx context.Context) (*protocol.SchemaPayload, error) {
-	// Query for tables (including views and materialized views)
-	tables, err := c.queryTables(ctx)
+// If schemas is not empty only those schemas are described, otherwise every non-system schema is
+func (c *Client) IntrospectSchema(ctx context.Context, schemas []string) (*protocol.SchemaPayload, error) {
+	// NULL selects every non-system schema, where an empty array would select none
+	if len(schemas) == 0 {
+		schemas = nil
+	}
+
+	// Every lookup shares one connection, so introspecting waits its turn in the queue like a query
+	conn, err := c.acquire(ctx)
+	if err != nil {
+		return nil, c.handleQueryError(ctx, err)
+	}
+	defer conn.Release()
+
+	// Query for tables (including partitioned and foreign tables, views and materialized views)
+	tables, err := c.queryTables(ctx, conn, schemas)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query tables: %w", err)
 	}
 
-	// Query for columns for each table
+	// The rest is looked up by the OIDs of the tables found, one query for every table rather than one per table
+	oids := make([]uint32, len(tables))
+	for i, table := range tables {
+		oids[i] = table.OID
+	}
+
+	columns, err := c.queryColumns(ctx, conn, oids)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query columns: %w", err)
+	}
+
+	primaryKeys, err := c.queryPrimaryKeys(ctx, conn, oids)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query primary keys: %w", err)
+	}
+
+	foreignKeys, err := c.queryForeignKeys(ctx, conn, oids)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query foreign keys: %w", err)
+	}
+
+	checks, err := c.queryCheckConstraints(ctx, conn, oids)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query check constraints: %w", err)
+	}
+
+	uniques, err := c.queryUniqueConstraints(ctx, conn, oids)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query unique constraints: %w", err)
+	}
+
+	indexes, err := c.queryIndexes(ctx, conn, oids)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query indexes: %w", err)
+	}
+
+	partitions, err := c.queryPartitions(ctx, conn, schemas)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query partitions: %w", err)
+	}
+
 	for i := range tables {
-		columns, err := c.queryColumns(ctx, tables[i].Schema, tables[i].Name)
-		if err != nil {
-			return nil, fmt.Errorf("failed to query columns for %s.%s: %w", tables[i].Schema, tables[i].Name, err)
+		if tableColumns, ok := columns[tables[i].OID]; ok {
+			tables[i].Columns = tableColumns
+		}
+		tables[i].Partitions = partitions[tables[i].OID]
+
+		// Tables without any still get empty lists rather than null
+		tables[i].PrimaryKey = []string{}
+		if primaryKey, ok := primaryKeys[tables[i].OID]; ok {
+			tables[i].PrimaryKey = primaryKey
+		}
+		tables[i].ForeignKeys = []protocol.ForeignKey{}
+		if tableForeignKeys, ok := foreignKeys[tables[i].OID]; ok {
+			tables[i].ForeignKeys = tableForeignKeys
+		}
+		tables[i].CheckConstraints = []protocol.CheckInfo{}
+		if tableChecks, ok := checks[tables[i].OID]; ok {
+			tables[i].CheckConstraints = tableChecks
+		}
+		tables[i].UniqueConstraints = []protocol.UniqueInfo{}
+		if tableUniques, ok := uniques[tables[i].OID]; ok {
+			tables[i].UniqueConstraints = tableUniques
+		}
+		tables[i].Indexes = []protocol.IndexInfo{}
+		if tableIndexes, ok := indexes[tables[i].OID]; ok {
+			tables[i].Indexes = tableIndexes
 		}
-		tables[i].Columns = columns
 	}
 
 	// Query for functions
-	functions, err := c.queryFunctions(ctx)
+	functions, err := c.queryFunctions(ctx, conn, schemas)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query functions: %w", err)
 	}
@@ -288,18 +1448,53 @@ func (c *Client) IntrospectSchema(ctx context.Context) (*protocol.SchemaPayload,
 	}, nil
 }
 
-// queryTables retrieves all user-defined tables, views, and materialized views
-func (c *Client) queryTables(ctx context.Context) ([]protocol.TableInfo, error) {
+// schemaFilter restricts an introspection query to the schemas in $1, or to
+// every non-system schema when $1 is NULL
+const schemaFilter = `CASE WHEN $1::text[] IS NULL
+			THEN n.nspname NOT IN ('pg_catalog', 'information_schema')
+			ELSE n.nspname = ANY($1::text[])
+		  END`
+
+// queryTables retrieves the user-defined tables, views, and materialized views in schemas,
+// including partitioned and foreign tables
+func (c *Client) queryTables(ctx context.Context, q querier, schemas []string) ([]protocol.TableInfo, error) {
+	// Row estimates prefer the statistics collector's live tuple count, which tracks writes
+	// as they happen, over reltuples, which is only updated by VACUUM and ANALYZE.
+	// A partitioned table holds no rows itself, so its estimate is the sum over its partitions
 	query := `
-		SELECT n.nspname, c.relname, c.relkind
+		WITH RECURSIVE estimates AS (
+			SELECT c.oid, COALESCE(s.n_live_tup, GREATEST(c.reltuples, 0)::bigint) as estimated_rows
+			FROM pg_class c
+			LEFT JOIN pg_stat_all_tables s ON s.relid = c.oid
+			WHERE c.relkind IN ('r', 'f', 'm')
+		), partition_tree AS (
+			SELECT inhparent as root, inhrelid as relid FROM pg_inherits
+			UNION ALL
+			SELECT t.root, i.inhrelid FROM partition_tree t JOIN pg_inherits i ON i.inhparent = t.relid
+		)
+		SELECT
+			c.oid,
+			n.nspname,
+			c.relname,
+			c.relkind,
+			c.relispopulated,
+			CASE c.relkind
+				WHEN 'p' THEN COALESCE((
+					SELECT sum(e.estimated_rows)
+					FROM partition_tree t
+					JOIN estimates e ON e.oid = t.relid
+					WHERE t.root = c.oid
+				), 0)::bigint
+				ELSE COALESCE((SELECT e.estimated_rows FROM estimates e WHERE e.oid = c.oid), 0)
+			END as estimated_rows
 		FROM pg_class c
 		JOIN pg_namespace n ON n.oid = c.relnamespace
-		WHERE c.relkind IN ('r', 'v', 'm')
-		  AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+		WHERE c.relkind IN ('r', 'p', 'f', 'v', 'm')
+		  AND ` + schemaFilter + `
 		ORDER BY n.nspname, c.relname
 	`
 
-	rows, err := c.pool.Query(ctx, query)
+	rows, err := q.Query(ctx, query, schemas)
 	if err != nil {
 		return nil, err
 	}
@@ -307,8 +1502,11 @@ func (c *Client) queryTables(ctx context.Context) ([]protocol.TableInfo, error)
 
 	var tables []protocol.TableInfo
 	for rows.Next() {
+		var oid uint32
 		var schema, name, kind string
-		if err := rows.Scan(&schema, &name, &kind); err != nil {
+		var populated bool
+		var estimatedRows int64
+		if err := rows.Scan(&oid, &schema, &name, &kind, &populated, &estimatedRows); err != nil {
 			return nil, fmt.Errorf("failed to scan table row: %w", err)
 		}
 
@@ -321,16 +1519,30 @@ func (c *Client) queryTables(ctx context.Context) ([]protocol.TableInfo, error)
 			tableType = "view"
 		case "m":
 			tableType = "materialized view"
+		case "p":
+			tableType = "partitioned table"
+		case "f":
+			tableType = "foreign table"
 		default:
 			tableType = kind
 		}
 
-		tables = append(tables, protocol.TableInfo{
-			Schema:  schema,
-			Name:    name,
-			Type:    tableType,
-			Columns: []protocol.ColumnInfo{}, // Will be filled later
-		})
+		table := protocol.TableInfo{
+			OID:           oid,
+			Schema:        schema,
+			Name:          name,
+			Type:          tableType,
+			EstimatedRows: estimatedRows,
+			Columns:       []protocol.ColumnInfo{}, // Will be filled later
+			PrimaryKey:    []string{},
+			ForeignKeys:   []protocol.ForeignKey{},
+			Indexes:       []protocol.IndexInfo{},
+		}
+		// Only materialized views can be unpopulated; relispopulated is always true for the rest
+		if kind == "m" {
+			table.Populated = &populated
+		}
+		tables = append(tables, table)
 	}
 
 	if err := rows.Err(); err != nil {
@@ -340,43 +1552,64 @@ func (c *Client) queryTables(ctx context.Context) ([]protocol.TableInfo, error)
 	return tables, nil
 }
 
-// queryColumns retrieves all columns for a specific table
-func (c *Client) queryColumns(ctx context.Context, schema, table string) ([]protocol.ColumnInfo, error) {
+// queryColumns retrieves the columns of the tables with the given OIDs
+// in a single query, keyed by table OID and in column order
+func (c *Client) queryColumns(ctx context.Context, q querier, tableOIDs []uint32) (map[uint32][]protocol.ColumnInfo, error) {
 	query := `
 		SELECT
+			a.attrelid,
+			a.attnum,
 			a.attname,
 			format_type(a.atttypid, a.atttypmod) as type_name,
+			t.typname as internal_type,
 			NOT a.attnotnull as nullable,
-			a.atttypid as type_oid
+			a.atttypid as type_oid,
+			pg_get_expr(d.adbin, d.adrelid) as default_value,
+			a.attidentity <> '' as is_identity,
+			a.attgenerated <> '' as is_generated
 		FROM pg_attribute a
-		WHERE a.attrelid = ($1 || '.' || $2)::regclass
+		JOIN pg_type t ON t.oid = a.atttypid
+		LEFT JOIN pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+		WHERE a.attrelid = ANY($1::oid[])
 		  AND a.attnum > 0
 		  AND NOT a.attisdropped
-		ORDER BY a.attnum
+		ORDER BY a.attrelid, a.attnum
 	`
 
-	rows, err := c.pool.Query(ctx, query, schema, table)
+	rows, err := q.Query(ctx, query, tableOIDs)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var columns []protocol.ColumnInfo
+	columns := make(map[uint32][]protocol.ColumnInfo)
 	for rows.Next() {
-		var name, dataType string
-		var nullable bool
-		var typeOID uint32
+		var tableOID, typeOID uint32
+		var position int16
+		var name, dataType, internalType string
+		var nullable, isIdentity, isGenerated bool
+		var defaultValue *string // nil when no default is specified
 
-		if err := rows.Scan(&name, &dataType, &nullable, &typeOID); err != nil {
+		if err := rows.Scan(&tableOID, &position, &name, &dataType, &internalType, &nullable, &typeOID, &defaultValue, &isIdentity, &isGenerated); err != nil {
 			return nil, fmt.Errorf("failed to scan column row: %w", err)
 		}
 
-		columns = append(columns, protocol.ColumnInfo{
-			Name:     name,
-			DataType: dataType,
-			TypeOID:  typeOID,
-			Nullable: nullable,
-		})
+		column := protocol.ColumnInfo{
+			Name:            name,
+			DataType:        dataType,
+			InternalType:    internalType,
+			TypeOID:         typeOID,
+			Nullable:        nullable,
+			IsIdentity:      isIdentity,
+			IsGenerated:     isGenerated,
+			OrdinalPosition: int(position),
+		}
+		// Generated columns store their expression in pg_attrdef too, but it isn't a default
+		if defaultValue != nil && !isGenerated {
+			column.HasDefault = true
+			column.DefaultValue = *defaultValue
+		}
+		columns[tableOID] = append(columns[tableOID], column)
 	}
 
 	if err := rows.Err(); err != nil {
@@ -386,20 +1619,310 @@ func (c *Client) queryColumns(ctx context.Context, schema, table string) ([]prot
 	return columns, nil
 }
 
-// queryFunctions retrieves all user-defined functions
-func (c *Client) queryFunctions(ctx context.Context) ([]protocol.FunctionInfo, error) {
+// queryPartitions retrieves the direct partitions of the partitioned tables in schemas,
+// keyed by the OID of the partitioned table
+func (c *Client) queryPartitions(ctx context.Context, q querier, schemas []string) (map[uint32][]protocol.PartitionInfo, error) {
+	query := `
+		SELECT
+			i.inhparent,
+			pn.nspname,
+			pc.relname,
+			pg_get_expr(pc.relpartbound, pc.oid) as bound
+		FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhparent
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		JOIN pg_class pc ON pc.oid = i.inhrelid
+		JOIN pg_namespace pn ON pn.oid = pc.relnamespace
+		WHERE c.relkind = 'p'
+		  AND ` + schemaFilter + `
+		ORDER BY i.inhparent, pn.nspname, pc.relname
+	`
+
+	rows, err := q.Query(ctx, query, schemas)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	partitions := make(map[uint32][]protocol.PartitionInfo)
+	for rows.Next() {
+		var parentOID uint32
+		var partition protocol.PartitionInfo
+		if err := rows.Scan(&parentOID, &partition.Schema, &partition.Name, &partition.Bound); err != nil {
+			return nil, fmt.Errorf("failed to scan partition row: %w", err)
+		}
+		partitions[parentOID] = append(partitions[parentOID], partition)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating partition rows: %w", err)
+	}
+
+	return partitions, nil
+}
+
+// queryPrimaryKeys retrieves the primary key column names of the tables with the given OIDs,
+// keyed by table OID and in key order. Tables (and views) without a primary key are left out
+func (c *Client) queryPrimaryKeys(ctx context.Context, q querier, tableOIDs []uint32) (map[uint32][]string, error) {
+	query := `
+		SELECT i.indrelid, a.attname
+		FROM pg_index i
+		CROSS JOIN LATERAL unnest(i.indkey) WITH ORDINALITY AS k(attnum, position)
+		JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = k.attnum
+		WHERE i.indrelid = ANY($1::oid[])
+		  AND i.indisprimary
+		ORDER BY i.indrelid, k.position
+	`
+
+	rows, err := q.Query(ctx, query, tableOIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	primaryKeys := make(map[uint32][]string)
+	for rows.Next() {
+		var tableOID uint32
+		var name string
+		if err := rows.Scan(&tableOID, &name); err != nil {
+			return nil, fmt.Errorf("failed to scan primary key row: %w", err)
+		}
+		primaryKeys[tableOID] = append(primaryKeys[tableOID], name)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating primary key rows: %w", err)
+	}
+
+	return primaryKeys, nil
+}
+
+// queryForeignKeys retrieves the foreign key constraints declared on the tables with the given
+// OIDs, keyed by table OID. Referenced tables are reported with their own schema, which may
+// differ from the table's
+func (c *Client) queryForeignKeys(ctx context.Context, q querier, tableOIDs []uint32) (map[uint32][]protocol.ForeignKey, error) {
+	query := `
+		SELECT
+			con.conrelid,
+			con.conname,
+			array_agg(a.attname::text ORDER BY k.position) as columns,
+			rn.nspname,
+			rc.relname,
+			array_agg(ra.attname::text ORDER BY k.position) as referenced_columns,
+			con.confdeltype::text,
+			con.confupdtype::text
+		FROM pg_constraint con
+		CROSS JOIN LATERAL unnest(con.conkey, con.confkey) WITH ORDINALITY AS k(attnum, ref_attnum, position)
+		JOIN pg_attribute a ON a.attrelid = con.conrelid AND a.attnum = k.attnum
+		JOIN pg_attribute ra ON ra.attrelid = con.confrelid AND ra.attnum = k.ref_attnum
+		JOIN pg_class rc ON rc.oid = con.confrelid
+		JOIN pg_namespace rn ON rn.oid = rc.relnamespace
+		WHERE con.conrelid = ANY($1::oid[])
+		  AND con.contype = 'f'
+		GROUP BY con.oid, con.conrelid, con.conname, rn.nspname, rc.relname, con.confdeltype, con.confupdtype
+		ORDER BY con.conrelid, con.conname
+	`
+
+	rows, err := q.Query(ctx, query, tableOIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	foreignKeys := make(map[uint32][]protocol.ForeignKey)
+	for rows.Next() {
+		var tableOID uint32
+		var fk protocol.ForeignKey
+		var onDelete, onUpdate string
+		if err := rows.Scan(&tableOID, &fk.Name, &fk.Columns, &fk.ReferencedSchema, &fk.ReferencedTable, &fk.ReferencedColumns, &onDelete, &onUpdate); err != nil {
+			return nil, fmt.Errorf("failed to scan foreign key row: %w", err)
+		}
+		fk.OnDelete = foreignKeyAction(onDelete)
+		fk.OnUpdate = foreignKeyAction(onUpdate)
+		foreignKeys[tableOID] = append(foreignKeys[tableOID], fk)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating foreign key rows: %w", err)
+	}
+
+	return foreignKeys, nil
+}
+
+// queryCheckConstraints retrieves the check constraints of the tables with the given OIDs,
+// keyed by table OID. Column and table constraints are stored alike, so both are included
+func (c *Client) queryCheckConstraints(ctx context.Context, q querier, tableOIDs []uint32) (map[uint32][]protocol.CheckInfo, error) {
+	query := `
+		SELECT
+			con.conrelid,
+			con.conname,
+			ARRAY(
+				SELECT a.attname::text
+				FROM pg_attribute a
+				WHERE a.attrelid = con.conrelid AND a.attnum = ANY(con.conkey)
+				ORDER BY a.attnum
+			) as columns,
+			pg_get_constraintdef(con.oid, true) as definition
+		FROM pg_constraint con
+		WHERE con.conrelid = ANY($1::oid[])
+		  AND con.contype = 'c'
+		ORDER BY con.conrelid, con.conname
+	`
+
+	rows, err := q.Query(ctx, query, tableOIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	checks := make(map[uint32][]protocol.CheckInfo)
+	for rows.Next() {
+		var tableOID uint32
+		var check protocol.CheckInfo
+		if err := rows.Scan(&tableOID, &check.Name, &check.Columns, &check.Definition); err != nil {
+			return nil, fmt.Errorf("failed to scan check constraint row: %w", err)
+		}
+		checks[tableOID] = append(checks[tableOID], check)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating check constraint rows: %w", err)
+	}
+
+	return checks, nil
+}
+
+// queryUniqueConstraints retrieves the UNIQUE constraints of the tables with the given OIDs,
+// keyed by table OID. Each is backed by a unique index, which queryIndexes also reports
+func (c *Client) queryUniqueConstraints(ctx context.Context, q querier, tableOIDs []uint32) (map[uint32][]protocol.UniqueInfo, error) {
+	query := `
+		SELECT
+			con.conrelid,
+			con.conname,
+			array_agg(a.attname::text ORDER BY k.position) as columns,
+			con.condeferrable
+		FROM pg_constraint con
+		CROSS JOIN LATERAL unnest(con.conkey) WITH ORDINALITY AS k(attnum, position)
+		JOIN pg_attribute a ON a.attrelid = con.conrelid AND a.attnum = k.attnum
+		WHERE con.conrelid = ANY($1::oid[])
+		  AND con.contype = 'u'
+		GROUP BY con.oid, con.conrelid, con.conname, con.condeferrable
+		ORDER BY con.conrelid, con.conname
+	`
+
+	rows, err := q.Query(ctx, query, tableOIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	uniques := make(map[uint32][]protocol.UniqueInfo)
+	for rows.Next() {
+		var tableOID uint32
+		var unique protocol.UniqueInfo
+		if err := rows.Scan(&tableOID, &unique.Name, &unique.Columns, &unique.Deferrable); err != nil {
+			return nil, fmt.Errorf("failed to scan unique constraint row: %w", err)
+		}
+		uniques[tableOID] = append(uniques[tableOID], unique)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating unique constraint rows: %w", err)
+	}
+
+	return uniques, nil
+}
+
+// queryIndexes retrieves the indexes of the tables with the given OIDs, keyed by table OID,
+// including partial and expression indexes
+func (c *Client) queryIndexes(ctx context.Context, q querier, tableOIDs []uint32) (map[uint32][]protocol.IndexInfo, error) {
+	query := `
+		SELECT
+			i.indrelid,
+			ic.relname,
+			ARRAY(
+				SELECT pg_get_indexdef(i.indexrelid, k, true)
+				FROM generate_series(1, i.indnkeyatts) AS k
+				ORDER BY k
+			) as columns,
+			i.indisunique,
+			i.indisprimary,
+			i.indpred IS NOT NULL as is_partial,
+			pg_get_indexdef(i.indexrelid) as definition
+		FROM pg_index i
+		JOIN pg_class ic ON ic.oid = i.indexrelid
+		WHERE i.indrelid = ANY($1::oid[])
+		ORDER BY i.indrelid, ic.relname
+	`
+
+	rows, err := q.Query(ctx, query, tableOIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	indexes := make(map[uint32][]protocol.IndexInfo)
+	for rows.Next() {
+		var tableOID uint32
+		var index protocol.IndexInfo
+		if err := rows.Scan(&tableOID, &index.Name, &index.Columns, &index.Unique, &index.Primary, &index.Partial, &index.Definition); err != nil {
+			return nil, fmt.Errorf("failed to scan index row: %w", err)
+		}
+		indexes[tableOID] = append(indexes[tableOID], index)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating index rows: %w", err)
+	}
+
+	return indexes, nil
+}
+
+// foreignKeyAction maps a pg_constraint action code to its SQL keyword
+func foreignKeyAction(code string) string {
+	switch code {
+	case "a":
+		return "NO ACTION"
+	case "r":
+		return "RESTRICT"
+	case "c":
+		return "CASCADE"
+	case "n":
+		return "SET NULL"
+	case "d":
+		return "SET DEFAULT"
+	default:
+		return code
+	}
+}
+
+// queryFunctions retrieves the user-defined functions in schemas
+func (c *Client) queryFunctions(ctx context.Context, q querier, schemas []string) ([]protocol.FunctionInfo, error) {
+	// proallargtypes and proargmodes are NULL when every argument is IN, in which
+	// case proargtypes lists them
 	query := `
 		SELECT
 			n.nspname,
 			p.proname,
-			pg_get_function_result(p.oid) as return_type
+			pg_get_function_result(p.oid) as return_type,
+			l.lanname,
+			p.proretset,
+			ARRAY(
+				SELECT format_type(a.type_oid, NULL)
+				FROM unnest(COALESCE(p.proallargtypes, p.proargtypes::oid[])) WITH ORDINALITY AS a(type_oid, position)
+				ORDER BY a.position
+			) as arg_types,
+			COALESCE(p.proargnames, '{}') as arg_names,
+			COALESCE(p.proargmodes::text[], '{}') as arg_modes,
+			p.pronargdefaults
 		FROM pg_proc p
 		JOIN pg_namespace n ON n.oid = p.pronamespace
-		WHERE n.nspname NOT IN ('pg_catalog', 'information_schema')
+		JOIN pg_language l ON l.oid = p.prolang
+		WHERE ` + schemaFilter + `
 		ORDER BY n.nspname, p.proname
 	`
 
-	rows, err := c.pool.Query(ctx, query)
+	rows, err := q.Query(ctx, query, schemas)
 	if err != nil {
 		return nil, err
 	}
@@ -407,8 +1930,11 @@ func (c *Client) queryFunctions(ctx context.Context) ([]protocol.FunctionInfo, e
 
 	var functions []protocol.FunctionInfo
 	for rows.Next() {
-		var schema, name, returnType string
-		if err := rows.Scan(&schema, &name, &returnType); err != nil {
+		var schema, name, returnType, language string
+		var returnsSet bool
+		var argTypes, argNames, argModes []string
+		var numDefaults int16
+		if err := rows.Scan(&schema, &name, &returnType, &language, &returnsSet, &argTypes, &argNames, &argModes, &numDefaults); err != nil {
 			return nil, fmt.Errorf("failed to scan function row: %w", err)
 		}
 
@@ -416,6 +1942,9 @@ func (c *Client) queryFunctions(ctx context.Context) ([]protocol.FunctionInfo, e
 			Schema:     schema,
 			Name:       name,
 			ReturnType: returnType,
+			Arguments:  functionArgs(argTypes, argNames, argModes, int(numDefaults)),
+			Language:   language,
+			ReturnsSet: returnsSet,
 		})
 	}
 
@@ -425,3 +1954,38 @@ func (c *Client) queryFunctions(ctx context.Context) ([]protocol.FunctionInfo, e
 
 	return functions, nil
 }
+
+// argModes maps pg_proc.proargmodes codes to protocol argument modes
+var argModes = map[string]string{
+	"i": protocol.ArgModeIn,
+	"o": protocol.ArgModeOut,
+	"b": protocol.ArgModeInOut,
+	"v": protocol.ArgModeVariadic,
+	"t": protocol.ArgModeTable,
+}
+
+// functionArgs builds a function's argument list from its pg_proc arrays
+// names and modes may be empty, meaning every argument is unnamed or IN respectively.
+// The last numDefaults input arguments have defaults
+func functionArgs(types, names, modes []string, numDefaults int) []protocol.FunctionArg {
+	args := make([]protocol.FunctionArg, len(types))
+	var inputs []int
+	for i, argType := range types {
+		args[i] = protocol.FunctionArg{Type: argType, Mode: protocol.ArgModeIn}
+		if i < len(names) {
+			args[i].Name = names[i]
+		}
+		if i < len(modes) {
+			args[i].Mode = argModes[modes[i]]
+		}
+		switch args[i].Mode {
+		case protocol.ArgModeIn, protocol.ArgModeInOut, protocol.ArgModeVariadic:
+			inputs = append(inputs, i)
+		}
+	}
+
+	for _, i := range inputs[max(len(inputs)-numDefaults, 0):] {
+		args[i].HasDefault = true
+	}
+	return args
+}
@@ -0,0 +1,62 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// failingWriter accepts limit bytes and then fails
+type failingWriter struct {
+	limit, written int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.written+len(p) > w.limit {
+		return 0, errors.New("client went away")
+	}
+	w.written += len(p)
+	return len(p), nil
+}
+
+func TestClient_Integration_CopyOut(t *testing.T) {
+	url, ok := getTestDatabaseURL()
+	if !ok {
+		t.Skip("Skipping integration test: TEST_POSTGRES_URL not set")
+	}
+
+	ctx := context.Background()
+	client, err := NewClient(ctx, url, DefaultOptions())
+	if err != nil {
+		t.Fatalf("NewClient() failed: %v", err)
+	}
+	defer client.Close()
+
+	var out strings.Builder
+	result, err := client.CopyOut(ctx, "COPY (SELECT n, 'row ' || n AS label FROM generate_series(1, 3) n) TO STDOUT WITH (FORMAT csv, HEADER)", &out)
+	if err != nil {
+		t.Fatalf("CopyOut() failed: %v", err)
+	}
+	if want := "n,label\n1,row 1\n2,row 2\n3,row 3\n"; out.String() != want {
+		t.Errorf("CopyOut() wrote %q, want %q", out.String(), want)
+	}
+	if result.RowCount != 3 {
+		t.Errorf("Expected 3 rows, got %d", result.RowCount)
+	}
+
+	_, err = client.CopyOut(ctx, "COPY (SELECT * FROM missing_table) TO STDOUT", &out)
+	var dbErr *DatabaseError
+	if !errors.As(err, &dbErr) || dbErr.Code != "42P01" {
+		t.Errorf("Expected an undefined table error, got %v", err)
+	}
+
+	// A failing writer stops the copy, and the pool replaces the connection it closed
+	_, err = client.CopyOut(ctx, "COPY (SELECT generate_series(1, 100000)) TO STDOUT", &failingWriter{limit: 100})
+	if err == nil || !strings.Contains(err.Error(), "client went away") {
+		t.Errorf("Expected the writer's error, got %v", err)
+	}
+	if _, err := client.ExecuteQuery(ctx, "SELECT 1", nil); err != nil {
+		t.Errorf("Expected queries to work after a stopped copy, got %v", err)
+	}
+}
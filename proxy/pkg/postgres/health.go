@@ -0,0 +1,106 @@
+package postgres
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// ConnectionState describes whether the client can reach the database
+type ConnectionState string
+
+// Connection states reported by State
+const (
+	StateConnected    ConnectionState = "connected"    // the last health check succeeded
+	StateReconnecting ConnectionState = "reconnecting" // the database stopped answering and a new pool is being opened
+	StateDisconnected ConnectionState = "disconnected" // reconnecting failed; it is tried again at the next health check
+)
+
+// State reports whether the database is reachable, as of the last health check
+func (c *Client) State() ConnectionState {
+	if state, ok := c.state.Load().(ConnectionState); ok {
+		return state
+	}
+	return StateConnected
+}
+
+// startHealthCheck pings the database every interval until Close
+func (c *Client) startHealthCheck(interval time.Duration) {
+	c.stopHealth = make(chan struct{})
+	c.healthDone = make(chan struct{})
+	go c.watchHealth(interval)
+}
+
+func (c *Client) watchHealth(interval time.Duration) {
+	defer close(c.healthDone)
+
+	// Close interrupts a reconnect that is waiting between attempts
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-c.stopHealth:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.checkHealth(ctx, interval)
+		case <-c.stopHealth:
+			return
+		}
+	}
+}
+
+// checkHealth pings the database, replacing the pool if the connection was lost
+// After Postgres restarts every pooled connection is dead, and a fresh pool is the
+// quickest way to get queries working again without restarting the proxy
+func (c *Client) checkHealth(ctx context.Context, timeout time.Duration) {
+	pingCtx, cancel := context.WithTimeout(ctx, timeout)
+	err := c.Ping(pingCtx)
+	cancel()
+	if err == nil {
+		if c.State() != StateConnected {
+			log.Printf("Connection to database %s restored", c.DatabaseName())
+		}
+		c.state.Store(StateConnected)
+		return
+	}
+	if ctx.Err() != nil {
+		return // closing
+	}
+	// A ping that timed out waiting for a connection only means every one is busy; replacing
+	// the pool then would drop the queries using them. pgconn marks a server that stopped
+	// answering as a timeout, so that still reconnects
+	if !isConnectionLost(err) && !pgconn.Timeout(err) {
+		return
+	}
+
+	log.Printf("Health check failed for database %s, reconnecting: %v", c.DatabaseName(), redactError(err, c.config.ConnConfig.Password))
+	c.state.Store(StateReconnecting)
+	pool, err := connect(ctx, c.config, c.retry, c.progress)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("Reconnecting to database %s failed, trying again in %v: %v", c.DatabaseName(), timeout, err)
+			c.state.Store(StateDisconnected)
+		}
+		return
+	}
+
+	c.poolMu.Lock()
+	old := c.pool
+	c.pool = pool
+	c.poolMu.Unlock()
+	c.state.Store(StateConnected)
+	log.Printf("Connection to database %s restored", c.DatabaseName())
+
+	// Close waits for connections still in use, such as an open transaction's, to be released
+	go old.Close()
+}
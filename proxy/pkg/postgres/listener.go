@@ -0,0 +1,196 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgconn/ctxwatch"
+)
+
+// ErrListenerClosed is returned when subscribing on a listener that has been closed or lost its connection
+var ErrListenerClosed = errors.New("listener closed")
+
+// NotificationFunc receives a notification delivered on a LISTEN channel
+type NotificationFunc func(channel, payload string)
+
+// Listener subscribes a dedicated connection to LISTEN/NOTIFY channels
+type Listener interface {
+	Listen(ctx context.Context, channel string) error
+	Unlisten(ctx context.Context, channel string) error
+	Close() error
+}
+
+// pgListener implements Listener on its own connection
+// The connection spends most of its time blocked waiting for notifications, so
+// subscription changes are queued and the wait is interrupted to run them
+type pgListener struct {
+	conn     *pgx.Conn
+	fn       NotificationFunc
+	requests chan listenRequest
+	cancel   context.CancelFunc
+	done     chan struct{}
+	closeErr error
+	once     sync.Once
+
+	mu         sync.Mutex
+	cancelWait context.CancelFunc
+	err        error // why the connection stopped, if it failed
+}
+
+// listenRequest is a LISTEN or UNLISTEN command waiting to run on the listener connection
+type listenRequest struct {
+	ctx    context.Context
+	sql    string
+	result chan error
+}
+
+// NewListener opens a dedicated connection for LISTEN/NOTIFY and delivers notifications to fn
+// The connection is created from the pool's configuration but lives outside the pool, since
+// it is held for as long as the subscriber wants and would otherwise starve queries
+func (c *Client) NewListener(ctx context.Context, fn NotificationFunc) (Listener, error) {
+	config := c.currentPool().Config().ConnConfig.Copy()
+
+	// Waiting for notifications is interrupted routinely; a deadline does that immediately
+	// without sending the server a cancel request that could hit the next LISTEN
+	config.BuildContextWatcherHandler = func(pgConn *pgconn.PgConn) ctxwatch.Handler {
+		return &pgconn.DeadlineContextWatcherHandler{Conn: pgConn.Conn()}
+	}
+
+	conn, err := pgx.ConnectConfig(ctx, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open listener connection: %w", err)
+	}
+
+	runCtx, cancel := context.WithCancel(context.Background())
+	l := &pgListener{
+		conn:     conn,
+		fn:       fn,
+		requests: make(chan listenRequest, 16),
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	go l.run(runCtx)
+
+	return l, nil
+}
+
+// Listen subscribes to a notification channel
+func (l *pgListener) Listen(ctx context.Context, channel string) error {
+	if channel == "" {
+		return errors.New("channel name cannot be empty")
+	}
+	return l.exec(ctx, "LISTEN "+pgx.Identifier{channel}.Sanitize())
+}
+
+// Unlisten unsubscribes from a notification channel
+func (l *pgListener) Unlisten(ctx context.Context, channel string) error {
+	if channel == "" {
+		return errors.New("channel name cannot be empty")
+	}
+	return l.exec(ctx, "UNLISTEN "+pgx.Identifier{channel}.Sanitize())
+}
+
+// Close stops delivering notifications and closes the listener connection
+func (l *pgListener) Close() error {
+	l.once.Do(func() {
+		l.cancel()
+		<-l.done
+		l.closeErr = l.conn.Close(context.Background())
+	})
+	return l.closeErr
+}
+
+// exec queues a command for the listener connection and waits for its result
+func (l *pgListener) exec(ctx context.Context, sql string) error {
+	req := listenRequest{ctx: ctx, sql: sql, result: make(chan error, 1)}
+
+	select {
+	case l.requests <- req:
+	case <-l.done:
+		return l.closedError()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	l.interrupt()
+
+	select {
+	case err := <-req.result:
+		return err
+	case <-l.done:
+		return l.closedError()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// interrupt wakes the run loop if it is waiting for a notification
+func (l *pgListener) interrupt() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.cancelWait != nil {
+		l.cancelWait()
+	}
+}
+
+// run waits for notifications until ctx is canceled or the connection fails
+func (l *pgListener) run(ctx context.Context) {
+	defer close(l.done)
+
+	for {
+		l.serveRequests()
+
+		waitCtx, cancelWait := context.WithCancel(ctx)
+		l.mu.Lock()
+		l.cancelWait = cancelWait
+		l.mu.Unlock()
+
+		// A request queued after serveRequests returned may have missed the previous interrupt
+		if len(l.requests) > 0 {
+			cancelWait()
+		}
+
+		notification, err := l.conn.WaitForNotification(waitCtx)
+		cancelWait()
+
+		switch {
+		case err == nil:
+			l.fn(notification.Channel, notification.Payload)
+		case ctx.Err() != nil:
+			return
+		case waitCtx.Err() != nil:
+			// Interrupted to serve a subscription change
+		default:
+			l.mu.Lock()
+			l.err = err
+			l.mu.Unlock()
+			return
+		}
+	}
+}
+
+// serveRequests runs every queued LISTEN/UNLISTEN command
+func (l *pgListener) serveRequests() {
+	for {
+		select {
+		case req := <-l.requests:
+			_, err := l.conn.Exec(req.ctx, req.sql)
+			req.result <- err
+		default:
+			return
+		}
+	}
+}
+
+// closedError explains why the listener can no longer be used
+func (l *pgListener) closedError() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return fmt.Errorf("%w: %v", ErrListenerClosed, l.err)
+	}
+	return ErrListenerClosed
+}
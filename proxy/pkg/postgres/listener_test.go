@@ -0,0 +1,94 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestListener_EmptyChannel tests that channel names are required before touching the connection
+func TestListener_EmptyChannel(t *testing.T) {
+	l := &pgListener{} // Don't need a real connection for this test
+	ctx := context.Background()
+
+	if err := l.Listen(ctx, ""); err == nil {
+		t.Error("Expected Listen to reject an empty channel")
+	}
+	if err := l.Unlisten(ctx, ""); err == nil {
+		t.Error("Expected Unlisten to reject an empty channel")
+	}
+}
+
+func TestClient_Integration_Listener(t *testing.T) {
+	url, ok := getTestDatabaseURL()
+	if !ok {
+		t.Skip("Skipping integration test: TEST_POSTGRES_URL not set")
+	}
+
+	ctx := context.Background()
+	client, err := NewClient(ctx, url, DefaultOptions())
+	if err != nil {
+		t.Fatalf("NewClient() failed: %v", err)
+	}
+	defer client.Close()
+
+	type notification struct{ channel, payload string }
+	received := make(chan notification, 10)
+
+	listener, err := client.NewListener(ctx, func(channel, payload string) {
+		received <- notification{channel, payload}
+	})
+	if err != nil {
+		t.Fatalf("NewListener() failed: %v", err)
+	}
+	defer listener.Close()
+
+	// Subscribing while the listener is already waiting must interrupt the wait
+	for _, channel := range []string{"test_jobs", "Test Mixed Case"} {
+		if err := listener.Listen(ctx, channel); err != nil {
+			t.Fatalf("Listen(%q) failed: %v", channel, err)
+		}
+	}
+
+	expect := func(want notification) {
+		t.Helper()
+		select {
+		case got := <-received:
+			if got != want {
+				t.Errorf("Received %+v, want %+v", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for notification %+v", want)
+		}
+	}
+
+	if _, err := client.ExecuteQuery(ctx, "SELECT pg_notify($1, $2)", []interface{}{"test_jobs", "job 1"}); err != nil {
+		t.Fatalf("pg_notify failed: %v", err)
+	}
+	expect(notification{"test_jobs", "job 1"})
+
+	if _, err := client.ExecuteQuery(ctx, "SELECT pg_notify($1, $2)", []interface{}{"Test Mixed Case", "hello"}); err != nil {
+		t.Fatalf("pg_notify failed: %v", err)
+	}
+	expect(notification{"Test Mixed Case", "hello"})
+
+	// Unsubscribed channels are no longer delivered
+	if err := listener.Unlisten(ctx, "test_jobs"); err != nil {
+		t.Fatalf("Unlisten failed: %v", err)
+	}
+	if _, err := client.ExecuteQuery(ctx, "SELECT pg_notify($1, $2)", []interface{}{"test_jobs", "job 2"}); err != nil {
+		t.Fatalf("pg_notify failed: %v", err)
+	}
+	if _, err := client.ExecuteQuery(ctx, "SELECT pg_notify($1, $2)", []interface{}{"Test Mixed Case", "still here"}); err != nil {
+		t.Fatalf("pg_notify failed: %v", err)
+	}
+	expect(notification{"Test Mixed Case", "still here"})
+
+	if err := listener.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := listener.Listen(ctx, "test_jobs"); !errors.Is(err, ErrListenerClosed) {
+		t.Errorf("Expected ErrListenerClosed after Close, got %v", err)
+	}
+}
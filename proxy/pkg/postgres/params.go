@@ -0,0 +1,166 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/sqlutil"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// ParameterCountError reports a query given the wrong number of parameters
+// Expected comes from describing the statement, which both checkParams and pgx do before running it
+type ParameterCountError struct {
+	Expected int // placeholders in the statement
+	Got      int // parameters provided
+}
+
+func (e *ParameterCountError) Error() string {
+	verb := "were"
+	if e.Got == 1 {
+		verb = "was"
+	}
+	return fmt.Sprintf("query expects %s but %d %s provided", plural(e.Expected, "parameter"), e.Got, verb)
+}
+
+func (e *ParameterCountError) Unwrap() error {
+	return ErrParameterMismatch
+}
+
+// plural formats n with noun, adding an s unless n is one
+func plural(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+// ParameterTypeError reports a parameter whose value can't be sent as the type the query expects
+type ParameterTypeError struct {
+	Index    int    // 1-based, matching the query's $n placeholder
+	Expected string // SQL type name Postgres inferred for the placeholder, e.g. "integer"
+	Value    interface{}
+}
+
+func (e *ParameterTypeError) Error() string {
+	return fmt.Sprintf("parameter $%d expects %s but got %s", e.Index, e.Expected, describeValue(e.Value))
+}
+
+func (e *ParameterTypeError) Unwrap() error {
+	return ErrParameterTypeMismatch
+}
+
+// describeValue names the JSON kind of a parameter value, with the value itself when it is short
+func describeValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return fmt.Sprintf("string %q", v)
+	case float64:
+		return "number " + strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		return fmt.Sprintf("boolean %t", v)
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+// checkParams describes sql on q's connection and checks params against the parameters Postgres
+// expects, so a value that can't be sent is reported by its position instead of as an encoding
+// or input syntax error. It costs a round trip, so queries with neither params nor placeholders skip
+// it, and a prepared statement is checked against the description it was prepared with
+func (c *Client) checkParams(ctx context.Context, q querier, sql string, prepared *pgconn.StatementDescription, params []interface{}) error {
+	if len(params) == 0 && !sqlutil.HasPlaceholders(sql) {
+		return nil
+	}
+
+	description := prepared
+	if description == nil {
+		// An unnamed statement is only described; the connection's cache keeps the one that runs
+		var err error
+		if description, err = q.Conn().Prepare(ctx, "", sql); err != nil {
+			return err
+		}
+	}
+	if len(description.ParamOIDs) != len(params) {
+		return &ParameterCountError{Expected: len(description.ParamOIDs), Got: len(params)}
+	}
+
+	typeMap := q.Conn().TypeMap()
+	for i, oid := range description.ParamOIDs {
+		if paramFits(typeMap, oid, params[i]) {
+			continue
+		}
+		// A failed lookup only leaves the internal type name
+		_ = c.resolveTypeNames(ctx, q, []typeKey{{oid: oid, typmod: -1}})
+		return &ParameterTypeError{Index: i + 1, Expected: c.sqlTypeName(oid, -1), Value: params[i]}
+	}
+	return nil
+}
+
+// paramFits reports whether value can be sent for a parameter of type oid
+// Strings are sent as text for Postgres to parse, so only numeric types are checked here; other
+// values are left to pgx's encoder, which rejects them the same way when the query runs
+func paramFits(typeMap *pgtype.Map, oid uint32, value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case string:
+		switch {
+		case isIntegerType(oid):
+			_, err := parseInteger(strings.TrimSpace(v))
+			return err == nil
+		case isFloatType(oid):
+			_, err := strconv.ParseFloat(strings.ReplaceAll(strings.TrimSpace(v), "_", ""), 64)
+			return err == nil
+		}
+		return true
+	case float64:
+		// pgx sends a fraction as text, which Postgres refuses for an integer
+		if isIntegerType(oid) && v != math.Trunc(v) {
+			return false
+		}
+	}
+
+	if _, err := typeMap.Encode(oid, pgtype.BinaryFormatCode, value, nil); err == nil {
+		return true
+	}
+	_, err := typeMap.Encode(oid, pgtype.TextFormatCode, value, nil)
+	return err == nil
+}
+
+// parseInteger parses s the way Postgres reads an integer literal
+// Plain digits are decimal even with leading zeros; base 0 is only used for the 0x, 0o and 0b
+// prefixes that Postgres 16 accepts, where it also allows the underscores between digits
+func parseInteger(s string) (int64, error) {
+	digits := strings.TrimLeft(s, "+-")
+	if len(digits) > 2 && digits[0] == '0' && strings.ContainsRune("xXoObB", rune(digits[1])) {
+		return strconv.ParseInt(s, 0, 64)
+	}
+	return strconv.ParseInt(strings.ReplaceAll(s, "_", ""), 10, 64)
+}
+
+// isIntegerType reports whether oid is one of Postgres's integer types
+func isIntegerType(oid uint32) bool {
+	switch oid {
+	case pgtype.Int2OID, pgtype.Int4OID, pgtype.Int8OID, pgtype.OIDOID:
+		return true
+	}
+	return false
+}
+
+// isFloatType reports whether oid is a floating-point or arbitrary-precision number type
+func isFloatType(oid uint32) bool {
+	switch oid {
+	case pgtype.Float4OID, pgtype.Float8OID, pgtype.NumericOID:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package postgres
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+func TestParameterCountError(t *testing.T) {
+	tests := []struct {
+		expected, got int
+		want          string
+	}{
+		{2, 1, "query expects 2 parameters but 1 was provided"},
+		{1, 3, "query expects 1 parameter but 3 were provided"},
+		{0, 2, "query expects 0 parameters but 2 were provided"},
+	}
+
+	for _, tt := range tests {
+		err := error(&ParameterCountError{Expected: tt.expected, Got: tt.got})
+		if err.Error() != tt.want {
+			t.Errorf("Expected %q, got %q", tt.want, err.Error())
+		}
+		if !errors.Is(err, ErrParameterMismatch) {
+			t.Errorf("Expected %q to match ErrParameterMismatch", err)
+		}
+	}
+}
+
+func TestParameterTypeError(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		want  string
+	}{
+		{"forty", `parameter $2 expects integer but got string "forty"`},
+		{1.5, "parameter $2 expects integer but got number 1.5"},
+		{true, "parameter $2 expects integer but got boolean true"},
+		{[]interface{}{1.0}, "parameter $2 expects integer but got array"},
+		{map[string]interface{}{"a": 1.0}, "parameter $2 expects integer but got object"},
+	}
+
+	for _, tt := range tests {
+		err := error(&ParameterTypeError{Index: 2, Expected: "integer", Value: tt.value})
+		if err.Error() != tt.want {
+			t.Errorf("Expected %q, got %q", tt.want, err.Error())
+		}
+		if !errors.Is(err, ErrParameterTypeMismatch) {
+			t.Errorf("Expected %q to match ErrParameterTypeMismatch", err)
+		}
+	}
+}
+
+func TestParamFits(t *testing.T) {
+	typeMap := pgtype.NewMap()
+	tests := []struct {
+		name  string
+		oid   uint32
+		value interface{}
+		want  bool
+	}{
+		{"null", pgtype.Int4OID, nil, true},
+		{"number for integer", pgtype.Int4OID, 42.0, true},
+		{"fraction for integer", pgtype.Int8OID, 1.5, false},
+		{"numeric string for integer", pgtype.Int4OID, " 42 ", true},
+		{"hex string for integer", pgtype.Int4OID, "0x2A", true},
+		{"negative hex string for integer", pgtype.Int4OID, "-0x1F", true},
+		{"leading zero is decimal", pgtype.Int4OID, "08", true},
+		{"leading zeros", pgtype.Int4OID, "007", true},
+		{"underscores for integer", pgtype.Int8OID, "1_000", true},
+		{"bad hex string for integer", pgtype.Int4OID, "0xZZ", false},
+		{"word for integer", pgtype.Int4OID, "forty", false},
+		{"boolean for integer", pgtype.Int4OID, true, false},
+		{"array for integer", pgtype.Int4OID, []interface{}{1.0}, false},
+		{"numeric string for numeric", pgtype.NumericOID, "1_000.25", true},
+		{"NaN for float", pgtype.Float8OID, "NaN", true},
+		{"word for numeric", pgtype.NumericOID, "lots", false},
+		{"fraction for float", pgtype.Float8OID, 1.5, true},
+		{"string for boolean", pgtype.BoolOID, "yes", true},
+		{"number for boolean", pgtype.BoolOID, 1.0, false},
+		{"number for text", pgtype.TextOID, 42.0, false},
+		{"string for uuid", pgtype.UUIDOID, "not checked here", true},
+		{"object for jsonb", pgtype.JSONBOID, map[string]interface{}{"a": 1.0}, true},
+		{"array for integer array", pgtype.Int4ArrayOID, []interface{}{1.0, 2.0}, true},
+		{"number for integer array", pgtype.Int4ArrayOID, 1.0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := paramFits(typeMap, tt.oid, tt.value); got != tt.want {
+				t.Errorf("paramFits(%d, %#v) = %v, want %v", tt.oid, tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseInteger(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+	}{
+		{"42", 42},
+		{"010", 10},
+		{"08", 8},
+		{"-007", -7},
+		{"+0x1F", 31},
+		{"-0x1F", -31},
+		{"0o17", 15},
+		{"0b101", 5},
+		{"1_000", 1000},
+	}
+
+	for _, tt := range tests {
+		got, err := parseInteger(tt.in)
+		if err != nil {
+			t.Errorf("parseInteger(%q) error: %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseInteger(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/protocol"
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/sqlutil"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// ErrStatementNotFound is returned when a statement connection holds no statement with the given name
+var ErrStatementNotFound = errors.New("prepared statement not found")
+
+// PreparedStatement describes a statement checked by Prepare
+type PreparedStatement struct {
+	ParamTypes []string              // SQL type names of $1, $2, ... in order, e.g. "integer"
+	Columns    []protocol.ColumnInfo // result columns; empty for statements that return no rows
+}
+
+// Prepare parses and plans sql on a pool connection without running it, returning the
+// types of its parameters and result columns
+func (c *Client) Prepare(ctx context.Context, sql string) (*PreparedStatement, error) {
+	conn, err := c.acquire(ctx)
+	if err != nil {
+		return nil, c.handleQueryError(ctx, err)
+	}
+	defer conn.Release()
+
+	// An unnamed statement is only described; the connection's cache keeps the one that runs
+	description, err := conn.Conn().Prepare(ctx, "", sql)
+	if err != nil {
+		return nil, c.handleQueryError(ctx, err)
+	}
+	return c.describeStatement(ctx, conn, description), nil
+}
+
+// describeStatement returns the parameter and result column types of a statement Postgres has
+// described, looking up type names on q's connection
+func (c *Client) describeStatement(ctx context.Context, q querier, description *pgconn.StatementDescription) *PreparedStatement {
+	// Parameters have no type modifier
+	keys := make([]typeKey, 0, len(description.ParamOIDs)+len(description.Fields))
+	for _, oid := range description.ParamOIDs {
+		keys = append(keys, typeKey{oid: oid, typmod: -1})
+	}
+	for _, fd := range description.Fields {
+		keys = append(keys, typeKey{oid: fd.DataTypeOID, typmod: fd.TypeModifier})
+	}
+	// A failed lookup only leaves internal type names
+	_ = c.resolveTypeNames(ctx, q, keys)
+
+	statement := &PreparedStatement{
+		ParamTypes: make([]string, len(description.ParamOIDs)),
+		Columns:    make([]protocol.ColumnInfo, len(description.Fields)),
+	}
+	for i, oid := range description.ParamOIDs {
+		statement.ParamTypes[i] = c.sqlTypeName(oid, -1)
+	}
+	for i, fd := range description.Fields {
+		statement.Columns[i] = c.describeColumn(fd)
+	}
+	// Name columns as the statement's results will
+	uniqueColumnNames(statement.Columns)
+	return statement
+}
+
+// StatementConn is a pool connection held for named prepared statements
+// Postgres keeps a prepared statement on the connection that prepared it, so running one by name
+// skips parsing and planning it again. Statements run one at a time; the connection returns to
+// the pool on Close
+type StatementConn interface {
+	// Prepare prepares sql under name, replacing any statement with that name
+	Prepare(ctx context.Context, name, sql string) (*PreparedStatement, error)
+	// ExecuteQuery and StreamQuery run the statement prepared under name, as Client's run SQL
+	ExecuteQuery(ctx context.Context, name string, params []interface{}) (*QueryResult, error)
+	StreamQuery(ctx context.Context, name string, params []interface{}, batchSize int, fn RowBatchFunc) (*QueryResult, error)
+	Deallocate(ctx context.Context, name string) error
+	// Close deallocates every statement and returns the connection to the pool
+	Close(ctx context.Context) error
+}
+
+// pgStatementConn implements StatementConn on an acquired pool connection
+type pgStatementConn struct {
+	client     *Client
+	mu         sync.Mutex  // a connection can only run one query at a time
+	conn       *queuedConn // nil after a failed reconnect or once closed
+	closed     bool
+	statements map[string]heldStatement
+	next       int // numbers the names statements are prepared under
+}
+
+// heldStatement is a statement prepared on a statement connection
+// Postgres knows it by key rather than the client's name, so replacing a statement can prepare
+// the new one before deallocating the old, and a name can't clash with SQL that pgx caches by its text
+type heldStatement struct {
+	key string
+	sql string
+}
+
+// NewStatementConn acquires a connection from the pool to hold prepared statements
+func (c *Client) NewStatementConn(ctx context.Context) (StatementConn, error) {
+	conn, err := c.acquire(ctx)
+	if err != nil {
+		return nil, c.handleQueryError(ctx, err)
+	}
+	return &pgStatementConn{client: c, conn: conn, statements: make(map[string]heldStatement)}, nil
+}
+
+// Prepare prepares sql under name, replacing any statement with that name
+// A failed prepare leaves the statement it would have replaced in place
+func (s *pgStatementConn) Prepare(ctx context.Context, name, sql string) (*PreparedStatement, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.reconnect(ctx); err != nil {
+		return nil, err
+	}
+
+	s.next++
+	statement := heldStatement{key: "proxy_" + strconv.Itoa(s.next), sql: sql}
+	description, err := s.conn.Conn().Prepare(ctx, statement.key, sql)
+	if err != nil {
+		return nil, s.client.handleQueryError(ctx, err)
+	}
+	if old, ok := s.statements[name]; ok {
+		s.deallocate(ctx, old)
+	}
+	s.statements[name] = statement
+	return s.client.describeStatement(ctx, s.conn, description), nil
+}
+
+// ExecuteQuery runs the statement prepared under name and returns all of its rows
+// The number of rows returned is capped by the limit set with WithMaxRows, if any
+func (s *pgStatementConn) ExecuteQuery(ctx context.Context, name string, params []interface{}) (*QueryResult, error) {
+	resultRows := []map[string]interface{}{}
+	result, err := s.query(ctx, name, params, 0, MaxRowsFromContext(ctx), func(_ []protocol.ColumnInfo, rows []map[string]interface{}) error {
+		resultRows = append(resultRows, rows...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result.Rows = resultRows
+	return result, nil
+}
+
+// StreamQuery runs the statement prepared under name, passing its rows to fn in batches
+func (s *pgStatementConn) StreamQuery(ctx context.Context, name string, params []interface{}, batchSize int, fn RowBatchFunc) (*QueryResult, error) {
+	return s.query(ctx, name, params, batchSize, 0, fn)
+}
+
+// query runs a prepared statement the way Client.query runs SQL: in a transaction of its own when
+// it needs one, and canceled at the row limit when that can't roll back a write
+func (s *pgStatementConn) query(ctx context.Context, name string, params []interface{}, batchSize, maxRows int, fn RowBatchFunc) (*QueryResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statement, ok := s.statements[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrStatementNotFound, name)
+	}
+	if err := s.reconnect(ctx); err != nil {
+		return nil, err
+	}
+	// pgx returns its record of a statement it already holds without a round trip
+	description, err := s.conn.Conn().Prepare(ctx, statement.key, statement.sql)
+	if err != nil {
+		return nil, s.client.handleQueryError(ctx, err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	limit := rowLimit{maxRows: maxRows}
+	if s.client.readOnly || sqlutil.IsReadOnly(statement.sql) {
+		limit.stop = cancel
+	}
+	return s.client.executeAlone(ctx, s.conn, statement.sql, description, params, batchSize, limit, fn)
+}
+
+// Deallocate removes the statement prepared under name
+func (s *pgStatementConn) Deallocate(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statement, ok := s.statements[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrStatementNotFound, name)
+	}
+	delete(s.statements, name)
+	s.deallocate(ctx, statement)
+	return nil
+}
+
+// deallocate removes a statement from the connection
+// If that fails the connection is closed rather than left holding it, and the next query reconnects
+func (s *pgStatementConn) deallocate(ctx context.Context, statement heldStatement) {
+	if s.conn == nil {
+		return
+	}
+	if err := s.conn.Conn().Deallocate(ctx, statement.key); err != nil {
+		_ = s.conn.Conn().Close(ctx)
+	}
+}
+
+// reconnect replaces a connection the database dropped, preparing every statement again on
+// the new one, so statements survive a database restart
+func (s *pgStatementConn) reconnect(ctx context.Context) error {
+	if s.closed {
+		return errors.New("statement connection is closed")
+	}
+	if s.conn != nil && !s.conn.Conn().IsClosed() {
+		return nil
+	}
+
+	if s.conn != nil {
+		s.conn.Release()
+		s.conn = nil
+	}
+	conn, err := s.client.acquire(ctx)
+	if err != nil {
+		return s.client.handleQueryError(ctx, err)
+	}
+	for _, statement := range s.statements {
+		if _, err := conn.Conn().Prepare(ctx, statement.key, statement.sql); err != nil {
+			conn.Release()
+			return s.client.handleQueryError(ctx, err)
+		}
+	}
+	s.conn = conn
+	return nil
+}
+
+// Close deallocates every statement and returns the connection to the pool
+// A connection that can't deallocate them is closed instead, so they don't outlive the session
+func (s *pgStatementConn) Close(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.conn == nil {
+		return nil
+	}
+	defer s.conn.Release()
+
+	for name, statement := range s.statements {
+		delete(s.statements, name)
+		if err := s.conn.Conn().Deallocate(ctx, statement.key); err != nil {
+			_ = s.conn.Conn().Close(ctx)
+			return s.client.handleQueryError(ctx, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestClient_Integration_Prepare(t *testing.T) {
+	url, ok := getTestDatabaseURL()
+	if !ok {
+		t.Skip("Skipping integration test: TEST_POSTGRES_URL not set")
+	}
+
+	ctx := context.Background()
+	client, err := NewClient(ctx, url, DefaultOptions())
+	if err != nil {
+		t.Fatalf("NewClient() failed: %v", err)
+	}
+	defer client.Close()
+
+	statement, err := client.Prepare(ctx, "SELECT $1::int + 1 AS next, $2::text AS label")
+	if err != nil {
+		t.Fatalf("Prepare() failed: %v", err)
+	}
+	if len(statement.ParamTypes) != 2 || statement.ParamTypes[0] != "integer" || statement.ParamTypes[1] != "text" {
+		t.Errorf("Unexpected parameter types: %v", statement.ParamTypes)
+	}
+	if len(statement.Columns) != 2 || statement.Columns[0].Name != "next" || statement.Columns[1].DataType != "text" {
+		t.Errorf("Unexpected columns: %+v", statement.Columns)
+	}
+
+	statement, err = client.Prepare(ctx, "SELECT 1 AS id, 2 AS id")
+	if err != nil {
+		t.Fatalf("Prepare() failed: %v", err)
+	}
+	if len(statement.Columns) != 2 || statement.Columns[0].Name != "id" || statement.Columns[1].Name != "id_1" {
+		t.Errorf("Expected duplicate columns to be named as in results, got %+v", statement.Columns)
+	}
+
+	// Preparing doesn't run the statement
+	if _, err := client.Prepare(ctx, "SELECT 1/0"); err != nil {
+		t.Errorf("Expected a statement that fails at run time to prepare, got %v", err)
+	}
+
+	_, err = client.Prepare(ctx, "SELEC 1")
+	var dbErr *DatabaseError
+	if !errors.As(err, &dbErr) || dbErr.Code != "42601" {
+		t.Errorf("Expected a syntax error, got %v", err)
+	}
+}
+
+func TestStatementConn_Integration(t *testing.T) {
+	url, ok := getTestDatabaseURL()
+	if !ok {
+		t.Skip("Skipping integration test: TEST_POSTGRES_URL not set")
+	}
+
+	ctx := context.Background()
+	client, err := NewClient(ctx, url, DefaultOptions())
+	if err != nil {
+		t.Fatalf("NewClient() failed: %v", err)
+	}
+	defer client.Close()
+
+	conn, err := client.NewStatementConn(ctx)
+	if err != nil {
+		t.Fatalf("NewStatementConn() failed: %v", err)
+	}
+	defer conn.Close(ctx)
+
+	statement, err := conn.Prepare(ctx, "next", "SELECT $1::int + 1 AS next")
+	if err != nil {
+		t.Fatalf("Prepare() failed: %v", err)
+	}
+	if len(statement.ParamTypes) != 1 || statement.ParamTypes[0] != "integer" {
+		t.Errorf("Unexpected parameter types: %v", statement.ParamTypes)
+	}
+
+	result, err := conn.ExecuteQuery(ctx, "next", []interface{}{41})
+	if err != nil {
+		t.Fatalf("ExecuteQuery() failed: %v", err)
+	}
+	if len(result.Rows) != 1 || result.Rows[0]["next"] != int32(42) {
+		t.Errorf("Expected 42, got %+v", result.Rows)
+	}
+
+	// Parameters are checked against the types the statement was prepared with
+	result, err = conn.ExecuteQuery(ctx, "next", []interface{}{"x"})
+	var typeErr *ParameterTypeError
+	if !errors.As(err, &typeErr) {
+		t.Errorf("Expected a parameter type error, got %v %+v", err, result)
+	}
+
+	// Replacing a statement keeps its name
+	if _, err := conn.Prepare(ctx, "next", "SELECT $1::int + 2 AS next"); err != nil {
+		t.Fatalf("Prepare() failed: %v", err)
+	}
+	result, err = conn.ExecuteQuery(ctx, "next", []interface{}{40})
+	if err != nil || len(result.Rows) != 1 || result.Rows[0]["next"] != int32(42) {
+		t.Errorf("Expected the replaced statement to run, got %+v, %v", result, err)
+	}
+
+	// A failed prepare leaves the statement it would have replaced
+	if _, err := conn.Prepare(ctx, "next", "SELEC 1"); err == nil {
+		t.Error("Expected a syntax error")
+	}
+	if _, err := conn.ExecuteQuery(ctx, "next", []interface{}{40}); err != nil {
+		t.Errorf("Expected the earlier statement to survive a failed prepare, got %v", err)
+	}
+
+	if err := conn.Deallocate(ctx, "next"); err != nil {
+		t.Fatalf("Deallocate() failed: %v", err)
+	}
+	if _, err := conn.ExecuteQuery(ctx, "next", nil); !errors.Is(err, ErrStatementNotFound) {
+		t.Errorf("Expected ErrStatementNotFound after deallocating, got %v", err)
+	}
+	if err := conn.Deallocate(ctx, "next"); !errors.Is(err, ErrStatementNotFound) {
+		t.Errorf("Expected ErrStatementNotFound deallocating twice, got %v", err)
+	}
+}
+
+// BenchmarkClient_PreparedVsAdHoc compares running a statement by name on a statement connection
+// with sending its SQL each time, which the pool describes again before running it
+// Run with: TEST_POSTGRES_URL=... go test -run '^$' -bench PreparedVsAdHoc ./pkg/postgres
+func BenchmarkClient_PreparedVsAdHoc(b *testing.B) {
+	url, ok := getTestDatabaseURL()
+	if !ok {
+		b.Skip("Skipping benchmark: TEST_POSTGRES_URL not set")
+	}
+
+	ctx := context.Background()
+	client, err := NewClient(ctx, url, DefaultOptions())
+	if err != nil {
+		b.Fatalf("NewClient() failed: %v", err)
+	}
+	defer client.Close()
+
+	const sql = "SELECT c.relname, n.nspname FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace WHERE c.oid = $1"
+
+	b.Run("prepared", func(b *testing.B) {
+		conn, err := client.NewStatementConn(ctx)
+		if err != nil {
+			b.Fatalf("NewStatementConn() failed: %v", err)
+		}
+		defer conn.Close(ctx)
+		if _, err := conn.Prepare(ctx, "relation", sql); err != nil {
+			b.Fatalf("Prepare() failed: %v", err)
+		}
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := conn.ExecuteQuery(ctx, "relation", []interface{}{1259}); err != nil {
+				b.Fatalf("ExecuteQuery() failed: %v", err)
+			}
+		}
+	})
+
+	b.Run("ad-hoc", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := client.ExecuteQuery(ctx, sql, []interface{}{1259}); err != nil {
+				b.Fatalf("ExecuteQuery() failed: %v", err)
+			}
+		}
+	})
+}
@@ -0,0 +1,94 @@
+package postgres
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// queryQueue bounds how many queries wait for a pool connection
+// Without it a query arriving while every connection is busy waits inside the pool for as long as
+// its timeout allows, and a burst of them shows up only as latency. With it, one that would have
+// to wait behind a full queue fails straight away with ErrServerBusy
+type queryQueue struct {
+	slots   chan struct{} // one per pool connection, held while a query has one
+	depth   int64         // most queries that may wait for a slot
+	waiting atomic.Int64
+}
+
+func newQueryQueue(conns int32, depth int) *queryQueue {
+	return &queryQueue{slots: make(chan struct{}, conns), depth: int64(depth)}
+}
+
+// enter waits for a free connection slot, or returns ErrServerBusy if too many queries are waiting
+func (q *queryQueue) enter(ctx context.Context) error {
+	if q == nil {
+		return nil
+	}
+	select {
+	case q.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	if q.waiting.Add(1) > q.depth {
+		q.waiting.Add(-1)
+		return ErrServerBusy
+	}
+	defer q.waiting.Add(-1)
+	select {
+	case q.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// leave frees the slot taken by enter
+func (q *queryQueue) leave() {
+	if q != nil {
+		<-q.slots
+	}
+}
+
+// queued returns how many queries are waiting for a slot
+func (q *queryQueue) queued() int32 {
+	if q == nil {
+		return 0
+	}
+	return int32(q.waiting.Load())
+}
+
+// poolConn names the embedded pool connection so its Conn method stays reachable
+type poolConn = pgxpool.Conn
+
+// queuedConn is a pool connection taken through the query queue
+type queuedConn struct {
+	*poolConn
+	queue    *queryQueue
+	released sync.Once
+}
+
+// Release returns the connection to the pool and gives its slot to the next query in the queue
+// Like pgxpool's, it does nothing after the first call
+func (c *queuedConn) Release() {
+	c.released.Do(func() {
+		c.poolConn.Release()
+		c.queue.leave()
+	})
+}
+
+// acquire takes a pool connection, first waiting its turn in the query queue
+func (c *Client) acquire(ctx context.Context) (*queuedConn, error) {
+	if err := c.queue.enter(ctx); err != nil {
+		return nil, err
+	}
+	conn, err := c.currentPool().Acquire(ctx)
+	if err != nil {
+		c.queue.leave()
+		return nil, err
+	}
+	return &queuedConn{poolConn: conn, queue: c.queue}, nil
+}
@@ -0,0 +1,96 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestQueryQueue_Busy tests that queries wait for a slot until the queue is full, then fail fast
+func TestQueryQueue_Busy(t *testing.T) {
+	q := newQueryQueue(1, 1)
+	ctx := context.Background()
+
+	if err := q.enter(ctx); err != nil {
+		t.Fatalf("Expected the first query to get a slot, got %v", err)
+	}
+
+	// The second query waits for the slot the first holds
+	entered := make(chan error, 1)
+	go func() { entered <- q.enter(ctx) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for q.queued() != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if queued := q.queued(); queued != 1 {
+		t.Fatalf("Expected 1 queued query, got %d", queued)
+	}
+
+	// The queue is full, so a third is turned away
+	if err := q.enter(ctx); !errors.Is(err, ErrServerBusy) {
+		t.Errorf("Expected ErrServerBusy, got %v", err)
+	}
+
+	q.leave()
+	select {
+	case err := <-entered:
+		if err != nil {
+			t.Errorf("Expected the queued query to get the slot, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the queued query to get the freed slot")
+	}
+	if queued := q.queued(); queued != 0 {
+		t.Errorf("Expected an empty queue, got %d", queued)
+	}
+}
+
+// TestQueryQueue_Canceled tests that a query stops waiting when its context ends
+func TestQueryQueue_Canceled(t *testing.T) {
+	q := newQueryQueue(1, 5)
+	if err := q.enter(context.Background()); err != nil {
+		t.Fatalf("Expected a slot, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := q.enter(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	if queued := q.queued(); queued != 0 {
+		t.Errorf("Expected the timed out query to leave the queue, got %d", queued)
+	}
+}
+
+// TestQueryQueue_Nil tests that a client without a queue never rejects queries
+func TestQueryQueue_Nil(t *testing.T) {
+	var q *queryQueue
+	for i := 0; i < 3; i++ {
+		if err := q.enter(context.Background()); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+	q.leave()
+	if queued := q.queued(); queued != 0 {
+		t.Errorf("Expected 0 queued, got %d", queued)
+	}
+}
+
+// TestClient_QueueFull tests that introspection and pings wait in the query queue like queries
+// The client has no pool, so reaching it would panic
+func TestClient_QueueFull(t *testing.T) {
+	client := &Client{queue: newQueryQueue(1, 0)}
+	ctx := context.Background()
+	if err := client.queue.enter(ctx); err != nil {
+		t.Fatalf("Expected a slot, got %v", err)
+	}
+	defer client.queue.leave()
+
+	if _, err := client.IntrospectSchema(ctx, nil); !errors.Is(err, ErrServerBusy) {
+		t.Errorf("Expected introspection to get ErrServerBusy, got %v", err)
+	}
+	if err := client.Ping(ctx); !errors.Is(err, ErrServerBusy) {
+		t.Errorf("Expected ping to get ErrServerBusy, got %v", err)
+	}
+}
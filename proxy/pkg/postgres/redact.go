@@ -0,0 +1,55 @@
+package postgres
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// redactedPassword replaces passwords in connection strings and errors
+const redactedPassword = "****"
+
+var (
+	// keywordPassword matches password=... in a keyword/value connection string,
+	// with the value either single-quoted (allowing \' escapes) or running to the next space
+	keywordPassword = regexp.MustCompile(`(password\s*=\s*)('(?:[^'\\]|\\.)*'|\S+)`)
+
+	// urlPassword matches the password in user:password@ for URLs too malformed to parse
+	urlPassword = regexp.MustCompile(`(://[^:/@]*:)[^@]*@`)
+)
+
+// RedactConnString returns connString with its password replaced by ****,
+// so it can be printed or logged. Both URLs and keyword/value strings are handled
+func RedactConnString(connString string) string {
+	if strings.Contains(connString, "://") {
+		if u, err := url.Parse(connString); err == nil {
+			// Redacted writes the password as xxxxx; url would escape the asterisks
+			return strings.Replace(u.Redacted(), ":xxxxx@", ":"+redactedPassword+"@", 1)
+		}
+		return urlPassword.ReplaceAllString(connString, "${1}"+redactedPassword+"@")
+	}
+	return keywordPassword.ReplaceAllString(connString, "${1}"+redactedPassword)
+}
+
+// redactedError hides a password that appears in an error's message
+// Unwrap keeps the original error available to errors.Is and errors.As
+type redactedError struct {
+	err      error
+	password string
+}
+
+func (e *redactedError) Error() string {
+	return strings.ReplaceAll(e.err.Error(), e.password, redactedPassword)
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// redactError returns err with any occurrence of password in its message replaced by ****
+func redactError(err error, password string) error {
+	if err == nil || password == "" || !strings.Contains(err.Error(), password) {
+		return err
+	}
+	return &redactedError{err: err, password: password}
+}
@@ -0,0 +1,132 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/protocol"
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/sqlutil"
+	"github.com/jackc/pgx/v5"
+)
+
+// StatementResult is the outcome of one statement in a script
+type StatementResult struct {
+	SQL string
+	QueryResult
+}
+
+// ScriptResult holds the results of a multi-statement script in execution order
+type ScriptResult struct {
+	Statements    []StatementResult
+	Transactional bool // statements ran in a single transaction
+	Committed     bool // the statements' effects were committed
+	ExecutionTime time.Duration
+}
+
+// ScriptError reports which statement of a script failed
+type ScriptError struct {
+	Index      int // zero-based index of the failed statement
+	Total      int // number of statements in the script
+	SQL        string
+	Committed  int  // statements whose effects were committed before the failure
+	RolledBack bool // the script ran in a transaction that was rolled back
+	Err        error
+}
+
+func (e *ScriptError) Error() string {
+	return fmt.Sprintf("statement %d of %d failed: %v", e.Index+1, e.Total, e.Err)
+}
+
+func (e *ScriptError) Unwrap() error {
+	return e.Err
+}
+
+// Outcome describes what happened to the rest of the script
+func (e *ScriptError) Outcome() string {
+	if e.RolledBack {
+		return "transaction rolled back, no statements committed"
+	}
+	return fmt.Sprintf("%d earlier statement(s) committed, %d not run", e.Committed, e.Total-e.Index-1)
+}
+
+// ExecuteScript runs statements one after another on a single connection, so session
+// state such as SET and temporary tables carries over between them
+// Each statement commits on its own unless transactional is set, in which case they run
+// in one transaction that is rolled back entirely if any statement fails. Execution stops
+// at the first failure, which is returned as a *ScriptError alongside the results of the
+// statements that succeeded. Each statement's rows are capped by the limit set with WithMaxRows
+func (c *Client) ExecuteScript(ctx context.Context, statements []string, transactional bool) (*ScriptResult, error) {
+	startTime := time.Now()
+
+	conn, err := c.acquire(ctx)
+	if err != nil {
+		return nil, c.handleQueryError(ctx, err)
+	}
+	defer conn.Release()
+
+	var q querier = conn
+	var tx pgx.Tx
+	if transactional || c.readOnly {
+		// The script's deadline caps each of its statements
+		tx, err = conn.BeginTx(ctx, pgx.TxOptions{BeginQuery: beginStatement(ctx, c.readOnly)})
+		if err != nil {
+			return nil, c.handleQueryError(ctx, err)
+		}
+		// No-op once the transaction has been committed
+		defer func() { _ = tx.Rollback(context.Background()) }()
+		q = tx
+	}
+
+	result := &ScriptResult{
+		Statements:    make([]StatementResult, 0, len(statements)),
+		Transactional: transactional,
+	}
+	maxRows := MaxRowsFromContext(ctx)
+	for i, sql := range statements {
+		// Outside a transaction a read-only statement can be stopped at the row limit without affecting the others
+		statementCtx, cancel := context.WithCancel(ctx)
+		limit := rowLimit{maxRows: maxRows}
+		if tx == nil && sqlutil.IsReadOnly(sql) {
+			limit.stop = cancel
+		}
+
+		rows := []map[string]interface{}{}
+		keepRows := func(_ []protocol.ColumnInfo, batch []map[string]interface{}) error {
+			rows = batch
+			return nil
+		}
+		var statementResult *QueryResult
+		if tx == nil {
+			// Each statement commits on its own, in a transaction that carries its statement_timeout
+			statementResult, err = c.executeAlone(statementCtx, conn, sql, nil, nil, 0, limit, keepRows)
+		} else {
+			statementResult, err = c.executeOn(statementCtx, q, sql, nil, nil, 0, limit, keepRows)
+		}
+		cancel()
+		if err != nil {
+			scriptErr := &ScriptError{Index: i, Total: len(statements), SQL: sql, Err: err}
+			if tx == nil {
+				scriptErr.Committed = i
+			}
+			scriptErr.RolledBack = transactional
+			return result, scriptErr
+		}
+
+		statementResult.Rows = rows
+		result.Statements = append(result.Statements, StatementResult{SQL: sql, QueryResult: *statementResult})
+	}
+
+	switch {
+	case transactional:
+		if err := tx.Commit(ctx); err != nil {
+			return result, fmt.Errorf("failed to commit script, transaction rolled back: %w", c.handleQueryError(ctx, err))
+		}
+		result.Committed = true
+	case tx == nil:
+		result.Committed = true
+	}
+
+	result.ExecutionTime = time.Since(startTime)
+	return result, nil
+}
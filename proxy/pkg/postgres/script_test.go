@@ -0,0 +1,202 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// TestScriptError tests the message and outcome reported for a failed script statement
+func TestScriptError(t *testing.T) {
+	cause := errors.New("relation \"missing\" does not exist")
+	err := &ScriptError{Index: 2, Total: 5, SQL: "SELECT * FROM missing", Committed: 2, Err: cause}
+
+	if err.Error() != `statement 3 of 5 failed: relation "missing" does not exist` {
+		t.Errorf("Unexpected error message: %s", err.Error())
+	}
+	if !errors.Is(err, cause) {
+		t.Error("Expected ScriptError to unwrap to its cause")
+	}
+	if err.Outcome() != "2 earlier statement(s) committed, 2 not run" {
+		t.Errorf("Unexpected outcome: %s", err.Outcome())
+	}
+
+	rolledBack := &ScriptError{Index: 2, Total: 5, RolledBack: true, Err: cause}
+	if rolledBack.Outcome() != "transaction rolled back, no statements committed" {
+		t.Errorf("Unexpected outcome: %s", rolledBack.Outcome())
+	}
+}
+
+func TestClient_Integration_ExecuteScript(t *testing.T) {
+	url, ok := getTestDatabaseURL()
+	if !ok {
+		t.Skip("Skipping integration test: TEST_POSTGRES_URL not set")
+	}
+
+	ctx := context.Background()
+	client, err := NewClient(ctx, url, DefaultOptions())
+	if err != nil {
+		t.Fatalf("NewClient() failed: %v", err)
+	}
+	defer client.Close()
+
+	// Temporary tables only survive if every statement runs on the same connection
+	result, err := client.ExecuteScript(ctx, []string{
+		"CREATE TEMP TABLE test_script (id int, name text)",
+		"INSERT INTO test_script VALUES (1, 'a'), (2, 'b')",
+		"SELECT name FROM test_script ORDER BY id",
+	}, false)
+	if err != nil {
+		t.Fatalf("ExecuteScript() failed: %v", err)
+	}
+
+	if len(result.Statements) != 3 {
+		t.Fatalf("Expected 3 statement results, got %d", len(result.Statements))
+	}
+	if result.Statements[1].RowsAffected != 2 {
+		t.Errorf("Expected insert to affect 2 rows, got %d", result.Statements[1].RowsAffected)
+	}
+	for i, want := range []string{"CREATE TABLE", "INSERT", "SELECT"} {
+		if result.Statements[i].Command != want {
+			t.Errorf("Statement %d: expected command %s, got %s", i, want, result.Statements[i].Command)
+		}
+	}
+	selected := result.Statements[2]
+	if selected.RowCount != 2 || selected.Rows[0]["name"] != "a" {
+		t.Errorf("Unexpected select result: %+v", selected.Rows)
+	}
+	if result.Transactional || !result.Committed {
+		t.Errorf("Expected a committed, non-transactional script, got %+v", result)
+	}
+}
+
+func TestClient_Integration_ExecuteScript_MaxRowsWrite(t *testing.T) {
+	url, ok := getTestDatabaseURL()
+	if !ok {
+		t.Skip("Skipping integration test: TEST_POSTGRES_URL not set")
+	}
+
+	ctx := context.Background()
+	client, err := NewClient(ctx, url, DefaultOptions())
+	if err != nil {
+		t.Fatalf("NewClient() failed: %v", err)
+	}
+	defer client.Close()
+
+	// Stopping the INSERT at the row limit would roll it back
+	result, err := client.ExecuteScript(WithMaxRows(ctx, 5), []string{
+		"CREATE TEMP TABLE test_script_limit (id int)",
+		"INSERT INTO test_script_limit SELECT generate_series(1, 50) RETURNING id",
+		"SELECT count(*) AS n FROM test_script_limit",
+	}, false)
+	if err != nil {
+		t.Fatalf("ExecuteScript() failed: %v", err)
+	}
+	if inserted := result.Statements[1]; !inserted.Truncated || inserted.RowsAffected != 50 {
+		t.Errorf("Expected a truncated insert affecting 50 rows, got %+v", inserted.QueryResult)
+	}
+	if n := result.Statements[2].Rows[0]["n"]; n != int64(50) {
+		t.Errorf("Expected 50 rows written, got %v", n)
+	}
+}
+
+func TestClient_Integration_ExecuteScript_Failure(t *testing.T) {
+	url, ok := getTestDatabaseURL()
+	if !ok {
+		t.Skip("Skipping integration test: TEST_POSTGRES_URL not set")
+	}
+
+	ctx := context.Background()
+	client, err := NewClient(ctx, url, DefaultOptions())
+	if err != nil {
+		t.Fatalf("NewClient() failed: %v", err)
+	}
+	defer client.Close()
+
+	result, err := client.ExecuteScript(ctx, []string{
+		"SELECT 1",
+		"SELECT 2",
+		"SELECT * FROM test_script_missing_table",
+		"SELECT 4",
+	}, false)
+
+	var scriptErr *ScriptError
+	if !errors.As(err, &scriptErr) {
+		t.Fatalf("Expected *ScriptError, got %v", err)
+	}
+	if scriptErr.Index != 2 || scriptErr.Committed != 2 {
+		t.Errorf("Expected failure at index 2 with 2 committed, got index %d with %d committed", scriptErr.Index, scriptErr.Committed)
+	}
+	if !strings.Contains(err.Error(), "test_script_missing_table") {
+		t.Errorf("Expected error to mention the missing table, got %v", err)
+	}
+	if len(result.Statements) != 2 {
+		t.Errorf("Expected results for the 2 statements that succeeded, got %d", len(result.Statements))
+	}
+}
+
+func TestClient_Integration_ExecuteScript_Transactional(t *testing.T) {
+	url, ok := getTestDatabaseURL()
+	if !ok {
+		t.Skip("Skipping integration test: TEST_POSTGRES_URL not set")
+	}
+
+	ctx := context.Background()
+	client, err := NewClient(ctx, url, DefaultOptions())
+	if err != nil {
+		t.Fatalf("NewClient() failed: %v", err)
+	}
+	defer client.Close()
+
+	_, err = client.ExecuteQuery(ctx, "CREATE TABLE IF NOT EXISTS test_script_tx (id int PRIMARY KEY)", nil)
+	if err != nil {
+		t.Fatalf("Failed to create test table: %v", err)
+	}
+	defer func() {
+		_, _ = client.ExecuteQuery(ctx, "DROP TABLE IF EXISTS test_script_tx", nil)
+	}()
+
+	// The duplicate key fails the third statement, so the first insert must be rolled back too
+	_, err = client.ExecuteScript(ctx, []string{
+		"INSERT INTO test_script_tx VALUES (1)",
+		"INSERT INTO test_script_tx VALUES (2)",
+		"INSERT INTO test_script_tx VALUES (1)",
+	}, true)
+
+	var scriptErr *ScriptError
+	if !errors.As(err, &scriptErr) {
+		t.Fatalf("Expected *ScriptError, got %v", err)
+	}
+	if !scriptErr.RolledBack || scriptErr.Committed != 0 || scriptErr.Index != 2 {
+		t.Errorf("Expected rolled back failure at index 2, got %+v", scriptErr)
+	}
+
+	count, err := client.ExecuteQuery(ctx, "SELECT count(*) AS n FROM test_script_tx", nil)
+	if err != nil {
+		t.Fatalf("Failed to count rows: %v", err)
+	}
+	if count.Rows[0]["n"] != int64(0) {
+		t.Errorf("Expected no rows after rollback, got %v", count.Rows[0]["n"])
+	}
+
+	// A successful transactional script commits everything
+	result, err := client.ExecuteScript(ctx, []string{
+		"INSERT INTO test_script_tx VALUES (1)",
+		"INSERT INTO test_script_tx VALUES (2)",
+	}, true)
+	if err != nil {
+		t.Fatalf("ExecuteScript() failed: %v", err)
+	}
+	if !result.Transactional || !result.Committed {
+		t.Errorf("Expected a committed transactional script, got %+v", result)
+	}
+
+	count, err = client.ExecuteQuery(ctx, "SELECT count(*) AS n FROM test_script_tx", nil)
+	if err != nil {
+		t.Fatalf("Failed to count rows: %v", err)
+	}
+	if count.Rows[0]["n"] != int64(2) {
+		t.Errorf("Expected 2 committed rows, got %v", count.Rows[0]["n"])
+	}
+}
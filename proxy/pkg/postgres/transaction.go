@@ -0,0 +1,133 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/protocol"
+	"github.com/jackc/pgx/v5"
+)
+
+// ErrTransactionRolledBack is returned by Commit when Postgres rolled the transaction back
+// instead, typically because a statement in it failed
+var ErrTransactionRolledBack = errors.New("transaction was rolled back")
+
+// Transaction is an open transaction pinned to a single pool connection
+// Queries run one at a time; the connection returns to the pool on Commit or Rollback
+type Transaction interface {
+	ExecuteQuery(ctx context.Context, sql string, params []interface{}) (*QueryResult, error)
+	StreamQuery(ctx context.Context, sql string, params []interface{}, batchSize int, fn RowBatchFunc) (*QueryResult, error)
+	Commit(ctx context.Context) error
+	Rollback(ctx context.Context) error
+}
+
+// pgTransaction implements Transaction on an acquired pool connection
+type pgTransaction struct {
+	client *Client
+	mu     sync.Mutex // a connection can only run one query at a time
+	conn   *queuedConn
+	tx     pgx.Tx
+	// a query set statement_timeout for its deadline, which lasts until the transaction ends
+	timeoutSet bool
+}
+
+// BeginTransaction acquires a connection from the pool and starts a transaction on it
+// In read-only mode the transaction is read-only
+func (c *Client) BeginTransaction(ctx context.Context) (Transaction, error) {
+	conn, err := c.acquire(ctx)
+	if err != nil {
+		return nil, c.handleQueryError(ctx, err)
+	}
+
+	txOptions := pgx.TxOptions{}
+	if c.readOnly {
+		txOptions.AccessMode = pgx.ReadOnly
+	}
+	tx, err := conn.BeginTx(ctx, txOptions)
+	if err != nil {
+		conn.Release()
+		return nil, c.handleQueryError(ctx, err)
+	}
+
+	return &pgTransaction{client: c, conn: conn, tx: tx}, nil
+}
+
+// ExecuteQuery runs a query inside the transaction and returns all of its rows
+// The number of rows returned is capped by the limit set with WithMaxRows, if any
+func (t *pgTransaction) ExecuteQuery(ctx context.Context, sql string, params []interface{}) (*QueryResult, error) {
+	resultRows := []map[string]interface{}{}
+	result, err := t.query(ctx, sql, params, 0, MaxRowsFromContext(ctx), func(_ []protocol.ColumnInfo, rows []map[string]interface{}) error {
+		resultRows = append(resultRows, rows...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result.Rows = resultRows
+	return result, nil
+}
+
+// StreamQuery runs a query inside the transaction, passing its rows to fn in batches
+func (t *pgTransaction) StreamQuery(ctx context.Context, sql string, params []interface{}, batchSize int, fn RowBatchFunc) (*QueryResult, error) {
+	return t.query(ctx, sql, params, batchSize, 0, fn)
+}
+
+// query runs a query on the transaction's connection
+// Canceling the query would abort the transaction, so rows past maxRows are discarded rather than stopped
+func (t *pgTransaction) query(ctx context.Context, sql string, params []interface{}, batchSize, maxRows int, fn RowBatchFunc) (*QueryResult, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := t.setStatementTimeout(ctx); err != nil {
+		return nil, err
+	}
+	return t.client.executeOn(ctx, t.tx, sql, nil, params, batchSize, rowLimit{maxRows: maxRows}, fn)
+}
+
+// setStatementTimeout makes the server stop the next query at ctx's deadline even if the cancel
+// request is lost. A query without a deadline gets the server's own timeout back
+func (t *pgTransaction) setStatementTimeout(ctx context.Context) error {
+	setting := "DEFAULT"
+	timeout, ok := statementTimeout(ctx)
+	switch {
+	case ok:
+		setting = strconv.FormatInt(timeout, 10)
+	case !t.timeoutSet:
+		return nil
+	}
+	if _, err := t.tx.Exec(ctx, "SET LOCAL statement_timeout = "+setting); err != nil {
+		return t.client.handleQueryError(ctx, err)
+	}
+	t.timeoutSet = ok
+	return nil
+}
+
+// Commit commits the transaction and releases its connection
+func (t *pgTransaction) Commit(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer t.conn.Release()
+
+	if err := t.tx.Commit(ctx); err != nil {
+		if errors.Is(err, pgx.ErrTxCommitRollback) {
+			return ErrTransactionRolledBack
+		}
+		return t.client.handleQueryError(ctx, err)
+	}
+	return nil
+}
+
+// Rollback aborts the transaction and releases its connection
+func (t *pgTransaction) Rollback(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer t.conn.Release()
+
+	if err := t.tx.Rollback(ctx); err != nil {
+		return t.client.handleQueryError(ctx, err)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestClient_Integration_Transaction(t *testing.T) {
+	url, ok := getTestDatabaseURL()
+	if !ok {
+		t.Skip("Skipping integration test: TEST_POSTGRES_URL not set")
+	}
+
+	ctx := context.Background()
+	client, err := NewClient(ctx, url, DefaultOptions())
+	if err != nil {
+		t.Fatalf("NewClient() failed: %v", err)
+	}
+	defer client.Close()
+
+	_, err = client.ExecuteQuery(ctx, "CREATE TABLE IF NOT EXISTS test_transaction (id int PRIMARY KEY)", nil)
+	if err != nil {
+		t.Fatalf("Failed to create test table: %v", err)
+	}
+	defer func() {
+		_, _ = client.ExecuteQuery(ctx, "DROP TABLE IF EXISTS test_transaction", nil)
+	}()
+
+	count := func() int64 {
+		t.Helper()
+		result, err := client.ExecuteQuery(ctx, "SELECT count(*) AS n FROM test_transaction", nil)
+		if err != nil {
+			t.Fatalf("Failed to count rows: %v", err)
+		}
+		return result.Rows[0]["n"].(int64)
+	}
+
+	// Rolled back work is discarded
+	tx, err := client.BeginTransaction(ctx)
+	if err != nil {
+		t.Fatalf("BeginTransaction() failed: %v", err)
+	}
+	if _, err := tx.ExecuteQuery(ctx, "INSERT INTO test_transaction VALUES (1)", nil); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	if err := tx.Rollback(ctx); err != nil {
+		t.Fatalf("Rollback() failed: %v", err)
+	}
+	if n := count(); n != 0 {
+		t.Errorf("Expected no rows after rollback, got %d", n)
+	}
+
+	// Committed work is visible outside the transaction, and only after the commit
+	tx, err = client.BeginTransaction(ctx)
+	if err != nil {
+		t.Fatalf("BeginTransaction() failed: %v", err)
+	}
+	if _, err := tx.ExecuteQuery(ctx, "INSERT INTO test_transaction VALUES (1)", nil); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	if n := count(); n != 0 {
+		t.Errorf("Expected uncommitted rows to be invisible, got %d", n)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		t.Fatalf("Commit() failed: %v", err)
+	}
+	if n := count(); n != 1 {
+		t.Errorf("Expected 1 row after commit, got %d", n)
+	}
+
+	// A failed statement aborts the transaction, so committing rolls it back
+	tx, err = client.BeginTransaction(ctx)
+	if err != nil {
+		t.Fatalf("BeginTransaction() failed: %v", err)
+	}
+	if _, err := tx.ExecuteQuery(ctx, "INSERT INTO test_transaction VALUES (2)", nil); err != nil {
+		t.Fatalf("Insert failed: %v", err)
+	}
+	if _, err := tx.ExecuteQuery(ctx, "INSERT INTO test_transaction VALUES (1)", nil); err == nil {
+		t.Fatal("Expected duplicate key error")
+	}
+	if err := tx.Commit(ctx); !errors.Is(err, ErrTransactionRolledBack) {
+		t.Errorf("Expected ErrTransactionRolledBack, got %v", err)
+	}
+	if n := count(); n != 1 {
+		t.Errorf("Expected the failed transaction to leave 1 row, got %d", n)
+	}
+}
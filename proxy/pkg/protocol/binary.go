@@ -0,0 +1,298 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// binaryResultMagic starts every binary result, followed by the format version
+var binaryResultMagic = []byte("PMR1")
+
+// Column encodings in a binary result
+const (
+	binaryInt    byte = 1 // int64 per row
+	binaryFloat  byte = 2 // float64 per row
+	binaryBool   byte = 3 // one byte per row
+	binaryString byte = 4 // uint32 length per row, then the bytes of every row
+	binaryJSON   byte = 5 // uint32 length, then a JSON array of the column's values
+)
+
+// EncodeBinaryResult encodes a result in the compact columnar form clients can ask for
+// instead of JSON. The layout, with every number little-endian, is:
+//
+//	"PMR1"
+//	uint32 length, then the result as JSON without its rows
+//	uint32 number of rows
+//	for each column, in the order of the header's columns:
+//	  a type byte, then for int, float, bool and string columns a NULL bitmap
+//	  of (rows+7)/8 bytes, where bit i%8 of byte i/8 is set when row i is NULL,
+//	  followed by the values; NULL rows hold a zero value
+//
+// A column whose values don't all share one of the fixed types is sent as JSON
+func EncodeBinaryResult(result ResultPayload) ([]byte, error) {
+	rows := result.Rows
+	result.Rows = nil
+	header, err := json.Marshal(result)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal result header: %w", err)
+	}
+
+	buf := append([]byte{}, binaryResultMagic...)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(header)))
+	buf = append(buf, header...)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(rows)))
+
+	for _, column := range result.Columns {
+		values := make([]interface{}, len(rows))
+		for i, row := range rows {
+			values[i] = row[column.Name]
+		}
+		if buf, err = appendColumn(buf, values); err != nil {
+			return nil, fmt.Errorf("failed to encode column %s: %w", column.Name, err)
+		}
+	}
+	return buf, nil
+}
+
+// appendColumn encodes one column's values with the most compact encoding that fits all of them
+func appendColumn(buf []byte, values []interface{}) ([]byte, error) {
+	kind := columnKind(values)
+	buf = append(buf, kind)
+	if kind == binaryJSON {
+		data, err := json.Marshal(values)
+		if err != nil {
+			return nil, err
+		}
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(data)))
+		return append(buf, data...), nil
+	}
+
+	bitmap := make([]byte, (len(values)+7)/8)
+	for i, value := range values {
+		if value == nil {
+			bitmap[i/8] |= 1 << (i % 8)
+		}
+	}
+	buf = append(buf, bitmap...)
+
+	var text []byte
+	for _, value := range values {
+		switch kind {
+		case binaryInt:
+			n, _ := toInt64(value)
+			buf = binary.LittleEndian.AppendUint64(buf, uint64(n))
+		case binaryFloat:
+			f, _ := toFloat64(value)
+			buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(f))
+		case binaryBool:
+			b, _ := value.(bool)
+			if b {
+				buf = append(buf, 1)
+			} else {
+				buf = append(buf, 0)
+			}
+		case binaryString:
+			s, _ := value.(string)
+			buf = binary.LittleEndian.AppendUint32(buf, uint32(len(s)))
+			text = append(text, s...)
+		}
+	}
+	return append(buf, text...), nil
+}
+
+// columnKind picks the encoding shared by every non-NULL value, or JSON if there is none
+func columnKind(values []interface{}) byte {
+	kind := byte(0)
+	for _, value := range values {
+		if value == nil {
+			continue
+		}
+		var k byte
+		switch value.(type) {
+		case int, int8, int16, int32, int64, uint8, uint16, uint32:
+			k = binaryInt
+		case float32, float64:
+			k = binaryFloat
+		case bool:
+			k = binaryBool
+		case string:
+			k = binaryString
+		default:
+			return binaryJSON
+		}
+		if kind != 0 && k != kind {
+			return binaryJSON
+		}
+		kind = k
+	}
+	if kind == 0 {
+		return binaryJSON // every value is NULL
+	}
+	return kind
+}
+
+// toInt64 converts the integer types columnKind accepts
+func toInt64(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// toFloat64 converts the float types columnKind accepts
+func toFloat64(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// errShortBinaryResult is returned when a binary result ends early
+var errShortBinaryResult = errors.New("binary result is truncated")
+
+// DecodeBinaryResult reverses EncodeBinaryResult
+// Integers decode as int64, floats as float64, and JSON columns as encoding/json decodes them
+func DecodeBinaryResult(data []byte) (ResultPayload, error) {
+	var result ResultPayload
+	r := binaryReader{data: data}
+
+	if magic := r.next(len(binaryResultMagic)); string(magic) != string(binaryResultMagic) {
+		return result, errors.New("not a binary result")
+	}
+	header := r.next(int(r.uint32()))
+	if r.err != nil {
+		return result, r.err
+	}
+	if err := json.Unmarshal(header, &result); err != nil {
+		return result, fmt.Errorf("failed to parse result header: %w", err)
+	}
+
+	rowCount := int(r.uint32())
+	if r.err != nil {
+		return result, r.err
+	}
+	result.Rows = make([]map[string]interface{}, rowCount)
+	for i := range result.Rows {
+		result.Rows[i] = make(map[string]interface{}, len(result.Columns))
+	}
+
+	for _, column := range result.Columns {
+		values, err := r.column(rowCount)
+		if err != nil {
+			return result, fmt.Errorf("failed to decode column %s: %w", column.Name, err)
+		}
+		for i, value := range values {
+			result.Rows[i][column.Name] = value
+		}
+	}
+	return result, nil
+}
+
+// binaryReader reads a binary result, remembering the first error
+type binaryReader struct {
+	data []byte
+	err  error
+}
+
+// next returns the following n bytes
+func (r *binaryReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.data) {
+		r.err = errShortBinaryResult
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *binaryReader) uint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *binaryReader) uint64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+// column reads one column of n values
+func (r *binaryReader) column(n int) ([]interface{}, error) {
+	kind := r.next(1)
+	if r.err != nil {
+		return nil, r.err
+	}
+	values := make([]interface{}, n)
+	if kind[0] == binaryJSON {
+		data := r.next(int(r.uint32()))
+		if r.err != nil {
+			return nil, r.err
+		}
+		if err := json.Unmarshal(data, &values); err != nil {
+			return nil, err
+		}
+		if len(values) != n {
+			return nil, fmt.Errorf("expected %d values, got %d", n, len(values))
+		}
+		return values, nil
+	}
+
+	bitmap := r.next((n + 7) / 8)
+	isNull := func(i int) bool { return bitmap[i/8]&(1<<(i%8)) != 0 }
+	var lengths []int
+	for i := 0; i < n && r.err == nil; i++ {
+		switch kind[0] {
+		case binaryInt:
+			values[i] = int64(r.uint64())
+		case binaryFloat:
+			values[i] = math.Float64frombits(r.uint64())
+		case binaryBool:
+			if b := r.next(1); b != nil {
+				values[i] = b[0] == 1
+			}
+		case binaryString:
+			lengths = append(lengths, int(r.uint32()))
+		default:
+			return nil, fmt.Errorf("unknown column encoding %d", kind[0])
+		}
+	}
+	for i, length := range lengths {
+		values[i] = string(r.next(length))
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	for i := range values {
+		if isNull(i) {
+			values[i] = nil
+		}
+	}
+	return values, nil
+}
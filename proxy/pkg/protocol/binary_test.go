@@ -0,0 +1,136 @@
+package protocol
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestBinaryResult_RoundTrip(t *testing.T) {
+	total := int64(42)
+	tests := []struct {
+		name   string
+		result ResultPayload
+		want   []map[string]interface{} // rows as they decode
+	}{
+		{
+			name: "typed columns with NULLs",
+			result: ResultPayload{
+				Columns: []ColumnInfo{{Name: "id", DataType: "integer"}, {Name: "price", DataType: "double precision"},
+					{Name: "active", DataType: "boolean"}, {Name: "name", DataType: "text"}},
+				Rows: []map[string]interface{}{
+					{"id": int32(1), "price": 9.5, "active": true, "name": "widget"},
+					{"id": nil, "price": nil, "active": false, "name": nil},
+					{"id": int32(-3), "price": float32(0.25), "active": nil, "name": "héllo"},
+				},
+				RowCount:      3,
+				Command:       "SELECT",
+				ExecutionTime: 12,
+				Truncated:     true,
+				Total:         &total,
+			},
+			want: []map[string]interface{}{
+				{"id": int64(1), "price": 9.5, "active": true, "name": "widget"},
+				{"id": nil, "price": nil, "active": false, "name": nil},
+				{"id": int64(-3), "price": 0.25, "active": nil, "name": "héllo"},
+			},
+		},
+		{
+			name: "mixed and nested values fall back to JSON",
+			result: ResultPayload{
+				Columns: []ColumnInfo{{Name: "mixed"}, {Name: "tags"}, {Name: "empty"}},
+				Rows: []map[string]interface{}{
+					{"mixed": int64(1), "tags": []interface{}{"a", "b"}, "empty": nil},
+					{"mixed": "two", "tags": nil, "empty": nil},
+				},
+				RowCount: 2,
+			},
+			want: []map[string]interface{}{
+				{"mixed": float64(1), "tags": []interface{}{"a", "b"}, "empty": nil},
+				{"mixed": "two", "tags": nil, "empty": nil},
+			},
+		},
+		{
+			name:   "no rows",
+			result: ResultPayload{Columns: []ColumnInfo{{Name: "id"}}, Command: "SELECT"},
+			want:   []map[string]interface{}{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := EncodeBinaryResult(tt.result)
+			if err != nil {
+				t.Fatalf("EncodeBinaryResult() failed: %v", err)
+			}
+			got, err := DecodeBinaryResult(data)
+			if err != nil {
+				t.Fatalf("DecodeBinaryResult() failed: %v", err)
+			}
+			if !reflect.DeepEqual(got.Rows, tt.want) {
+				t.Errorf("Rows = %v, want %v", got.Rows, tt.want)
+			}
+			want := tt.result
+			got.Rows, want.Rows = nil, nil
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Header = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestDecodeBinaryResult_Malformed(t *testing.T) {
+	data, err := EncodeBinaryResult(ResultPayload{
+		Columns: []ColumnInfo{{Name: "n"}},
+		Rows:    []map[string]interface{}{{"n": int64(1)}, {"n": int64(2)}},
+	})
+	if err != nil {
+		t.Fatalf("EncodeBinaryResult() failed: %v", err)
+	}
+
+	for _, bad := range [][]byte{nil, []byte("{}"), data[:len(data)-1], data[:10]} {
+		if _, err := DecodeBinaryResult(bad); err == nil {
+			t.Errorf("Expected an error decoding %d bytes", len(bad))
+		}
+	}
+}
+
+// numericResult builds a result of rows numeric rows, the kind of data binary results are for
+func numericResult(rows int) ResultPayload {
+	result := ResultPayload{
+		Columns: []ColumnInfo{{Name: "id", DataType: "bigint"}, {Name: "x", DataType: "double precision"},
+			{Name: "y", DataType: "double precision"}, {Name: "count", DataType: "integer"}},
+		Rows:     make([]map[string]interface{}, rows),
+		RowCount: rows,
+	}
+	for i := range result.Rows {
+		result.Rows[i] = map[string]interface{}{
+			"id": int64(i), "x": float64(i) * 1.5, "y": float64(i) / 7, "count": int32(i % 1000),
+		}
+	}
+	return result
+}
+
+func BenchmarkEncodeResult_JSON(b *testing.B) {
+	msg := NewQueryResult("q1", numericResult(10000).Rows, numericResult(0).Columns, "SELECT", 0, false)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.SetBytes(int64(len(data)))
+	}
+}
+
+func BenchmarkEncodeResult_Binary(b *testing.B) {
+	result := numericResult(10000)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		data, err := EncodeBinaryResult(result)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.SetBytes(int64(len(data)))
+	}
+}
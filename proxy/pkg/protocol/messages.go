@@ -8,12 +8,50 @@ const (
 	TypeQuery      = "query"
 	TypeIntrospect = "introspect"
 	TypePing       = "ping"
+	TypeCancel     = "cancel"
+	TypeListen     = "listen"
+	TypeUnlisten   = "unlisten"
+	TypeBegin      = "begin"
+	TypeCommit     = "commit"
+	TypeRollback   = "rollback"
+	TypeExport     = "export"
+	TypePrepare    = "prepare"
+	TypeDeallocate = "deallocate"
+	TypeDescribe   = "describe"
+	TypeCopyOut    = "copy_out"
+	TypePreview    = "preview"
+	// The server answers a capabilities request with a message of the same type
+	TypeCapabilities = "capabilities"
 
 	// Server -> Client
-	TypeResult = "result"
-	TypeError  = "error"
-	TypeSchema = "schema"
-	TypePong   = "pong"
+	TypeResult         = "result"
+	TypeResultChunk    = "result_chunk"
+	TypeScriptResult   = "script_result"
+	TypeError          = "error"
+	TypeSchema         = "schema"
+	TypePong           = "pong"
+	TypeCanceled       = "canceled"
+	TypeListening      = "listening"
+	TypeUnlistened     = "unlistened"
+	TypeNotification   = "notification"
+	TypeTransaction    = "transaction"
+	TypePlan           = "plan"
+	TypeExportComplete = "export_complete"
+	TypePrepared       = "prepared"
+	TypeDeallocated    = "deallocated"
+	TypeValidation     = "validation"
+	TypeDescription    = "description"
+	TypeHello          = "hello"
+)
+
+// ExportFormatCSV is the export format for comma-separated values with a header row
+const ExportFormatCSV = "csv"
+
+// Transaction statuses reported in transaction messages
+const (
+	TransactionOpen       = "open"
+	TransactionCommitted  = "committed"
+	TransactionRolledBack = "rolled_back"
 )
 
 // Message is the base structure for all messages
@@ -39,34 +77,176 @@ type ServerMessage struct {
 
 // QueryPayload contains query execution details
 type QueryPayload struct {
+	SQL       string        `json:"sql"`
+	Params    []interface{} `json:"params,omitempty"`
+	Timeout   int           `json:"timeout,omitempty"`   // milliseconds
+	Stream    bool          `json:"stream,omitempty"`    // send rows as result_chunk messages
+	BatchSize int           `json:"batchSize,omitempty"` // rows per chunk when streaming
+	Multi     bool          `json:"multi,omitempty"`     // run SQL as a script of ;-separated statements
+	// Run a multi-statement script in one transaction, rolling back everything if a statement fails
+	Transactional bool `json:"transactional,omitempty"`
+	Explain       bool `json:"explain,omitempty"` // return the query plan instead of running the query
+	Analyze       bool `json:"analyze,omitempty"` // with explain, run the query to include actual timings
+	MaxRows       int  `json:"maxRows,omitempty"` // cap on rows returned, within the server's ceiling
+	// Pagination of a single SELECT: return at most limit rows after skipping offset, and with
+	// wantTotal also count every row the query matches
+	Limit     int  `json:"limit,omitempty"`
+	Offset    int  `json:"offset,omitempty"`
+	WantTotal bool `json:"wantTotal,omitempty"`
+	// Run a statement registered with a prepare message instead of sql; params still apply
+	StatementName string `json:"statementName,omitempty"`
+	Database      string `json:"database,omitempty"` // named database to run on instead of the connection's
+	// Values for :name placeholders in sql, which are rewritten to positional parameters;
+	// use instead of params
+	NamedParams map[string]interface{} `json:"namedParams,omitempty"`
+	// Check the query with the database without running it, replying with a validation message
+	Validate bool `json:"validate,omitempty"`
+}
+
+// ResultPayload contains query results
+type ResultPayload struct {
+	Rows                []map[string]interface{} `json:"rows"`
+	Columns             []ColumnInfo             `json:"columns"`
+	RowCount            int                      `json:"rowCount"`
+	Command             string                   `json:"command,omitempty"`   // statement type from the command tag, e.g. "SELECT", "INSERT" or "CREATE TABLE"
+	ExecutionTime       int64                    `json:"executionTime"`       // milliseconds
+	ExecutionTimeMicros int64                    `json:"executionTimeMicros"` // the same in microseconds, so sub-millisecond queries aren't 0
+	Timing              *QueryTiming             `json:"timing,omitempty"`    // where the execution time went
+	Streamed            bool                     `json:"streamed,omitempty"`  // rows were sent in preceding result_chunk messages
+	Truncated           bool                     `json:"truncated,omitempty"` // the query had more rows than its row limit
+	Total               *int64                   `json:"total,omitempty"`     // rows the whole query matches, when wantTotal was set
+}
+
+// QueryTiming splits a result's execution time between Postgres and the proxy, in microseconds
+// A slow fetch means the query is slow in Postgres; slow conversion means the proxy is the bottleneck
+type QueryTiming struct {
+	FirstRowMicros   int64 `json:"firstRowMicros"`   // until the first row arrived, or the query finished if it returned none
+	FetchMicros      int64 `json:"fetchMicros"`      // waiting for Postgres to plan and run the query and send its rows
+	ConversionMicros int64 `json:"conversionMicros"` // decoding rows and converting their values in the proxy
+}
+
+// ScriptResultPayload contains the results of a multi-statement script
+type ScriptResultPayload struct {
+	Statements          []StatementResult `json:"statements"`
+	Transactional       bool              `json:"transactional"`       // statements ran in a single transaction
+	Committed           bool              `json:"committed"`           // false if the changes were rolled back (e.g. read-only mode)
+	ExecutionTime       int64             `json:"executionTime"`       // milliseconds, for the whole script
+	ExecutionTimeMicros int64             `json:"executionTimeMicros"` // the same in microseconds
+}
+
+// StatementResult is the result of one statement in a script
+type StatementResult struct {
+	SQL          string `json:"sql"`
+	RowsAffected int64  `json:"rowsAffected"`
+	ResultPayload
+}
+
+// ExportPayload requests a query's results as a file
+// The file arrives in binary messages before the export_complete message
+type ExportPayload struct {
 	SQL     string        `json:"sql"`
 	Params  []interface{} `json:"params,omitempty"`
+	Format  string        `json:"format,omitempty"`  // ExportFormatCSV, the default
 	Timeout int           `json:"timeout,omitempty"` // milliseconds
+	// Named database to run on instead of the connection's
+	Database string `json:"database,omitempty"`
 }
 
-// ResultPayload contains query results
-type ResultPayload struct {
-	Rows          []map[string]interface{} `json:"rows"`
-	Columns       []ColumnInfo             `json:"columns"`
-	RowCount      int                      `json:"rowCount"`
-	ExecutionTime int64                    `json:"executionTime"` // milliseconds
+// CopyOutPayload requests a query's results as CSV written by Postgres' COPY
+// The file arrives in binary messages before the export_complete message, as with ExportPayload
+type CopyOutPayload struct {
+	SQL     string `json:"sql"`               // a single query; COPY can't bind parameters
+	Timeout int    `json:"timeout,omitempty"` // milliseconds
+	// Named database to run on instead of the connection's
+	Database string `json:"database,omitempty"`
+}
+
+// PreviewPayload asks for the first rows of a table or view without the client writing SQL
+// The answer is an ordinary result message
+type PreviewPayload struct {
+	Schema   string `json:"schema,omitempty"` // empty looks the table up on the search path
+	Table    string `json:"table"`
+	Limit    int    `json:"limit,omitempty"`    // rows to return; zero means the server's default
+	Database string `json:"database,omitempty"` // named database to run on instead of the connection's
+}
+
+// IntrospectPayload optionally scopes schema introspection
+type IntrospectPayload struct {
+	Database string   `json:"database,omitempty"` // named database to introspect instead of the connection's
+	Schemas  []string `json:"schemas,omitempty"`  // only these schemas; empty means every non-system schema
+}
+
+// ExportCompletePayload ends an export once all of its data has been sent
+type ExportCompletePayload struct {
+	Format              string `json:"format"`
+	RowCount            int    `json:"rowCount"`
+	Bytes               int64  `json:"bytes"`               // total size of the exported data
+	ExecutionTime       int64  `json:"executionTime"`       // milliseconds
+	ExecutionTimeMicros int64  `json:"executionTimeMicros"` // the same in microseconds
+}
+
+// PlanPayload contains a query plan from EXPLAIN (FORMAT JSON)
+type PlanPayload struct {
+	Plan                interface{} `json:"plan"`                // the plan exactly as Postgres returned it
+	Analyzed            bool        `json:"analyzed"`            // the query was executed, so the plan has actual timings
+	ExecutionTime       int64       `json:"executionTime"`       // milliseconds
+	ExecutionTimeMicros int64       `json:"executionTimeMicros"` // the same in microseconds
+}
+
+// ResultChunkPayload contains a batch of rows from a streamed query
+// Columns are only included in the first chunk
+type ResultChunkPayload struct {
+	Columns []ColumnInfo             `json:"columns,omitempty"`
+	Rows    []map[string]interface{} `json:"rows"`
+	Offset  int                      `json:"offset"` // index of the first row in this chunk
 }
 
-// ColumnInfo describes a result column
+// ColumnInfo describes a result column or, in a schema message, a table column
 type ColumnInfo struct {
-	Name     string `json:"name"`
-	DataType string `json:"dataType"`
-	TypeOID  uint32 `json:"typeOid,omitempty"`
+	Name string `json:"name"`
+	// The SQL type name with any modifier, as format_type writes it, e.g. "integer" or
+	// "character varying(255)"; the same in query results and introspection
+	DataType     string `json:"dataType"`
+	InternalType string `json:"internalType,omitempty"` // Postgres' own name for the type, e.g. "int4" or "_text"
+	TypeOID      uint32 `json:"typeOid,omitempty"`
+	// Introspection only: query results can't tell whether a column allows NULL, so leave it unset
 	Nullable bool   `json:"nullable,omitempty"`
+	Encoding string `json:"encoding,omitempty"` // set when values need decoding, e.g. EncodingBase64 for bytea
+
+	// Query results only: the table and column number a result column was read from, matching
+	// TableInfo.OID and the column's position in it. Zero for computed columns and expressions
+	TableOID    uint32 `json:"tableOid,omitempty"`
+	TableColumn uint16 `json:"tableColumn,omitempty"`
+
+	// Introspection only: DefaultValue is the default expression as SQL text (e.g. "now()", "NULL")
+	// and is only meaningful when HasDefault is set
+	HasDefault   bool   `json:"hasDefault,omitempty"`
+	DefaultValue string `json:"defaultValue,omitempty"`
+	IsIdentity   bool   `json:"isIdentity,omitempty"`  // GENERATED ... AS IDENTITY
+	IsGenerated  bool   `json:"isGenerated,omitempty"` // GENERATED ALWAYS AS (...) STORED
+	// Introspection only: the column's 1-based number in its table, as a result column's
+	// TableColumn reports it. Dropped columns leave gaps, so it can exceed the column count
+	OrdinalPosition int `json:"ordinalPosition,omitempty"`
 }
 
+// EncodingBase64 marks a column whose values are base64-encoded binary data
+const EncodingBase64 = "base64"
+
 // ErrorPayload contains error details
 type ErrorPayload struct {
-	Code     string `json:"code"`
-	Message  string `json:"message"`
-	Detail   string `json:"detail,omitempty"`
-	Hint     string `json:"hint,omitempty"`
-	Position int    `json:"position,omitempty"`
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	Detail     string `json:"detail,omitempty"`
+	Hint       string `json:"hint,omitempty"`
+	Position   int    `json:"position,omitempty"`
+	Statement  int    `json:"statement,omitempty"`  // 1-based index of the failed statement in a script
+	RolledBack bool   `json:"rolledBack,omitempty"` // a transactional script was rolled back
+	// Zero-based index of a row whose value couldn't be converted, and its column. A streamed
+	// query has sent every row before it in result_chunk messages
+	Row    *int   `json:"row,omitempty"`
+	Column string `json:"column,omitempty"`
+	// 1-based index of a parameter whose value doesn't fit the type the query expects
+	Parameter int `json:"parameter,omitempty"`
 }
 
 // SchemaPayload contains database schema information
@@ -77,17 +257,226 @@ type SchemaPayload struct {
 
 // TableInfo describes a database table
 type TableInfo struct {
-	Schema  string       `json:"schema"`
-	Name    string       `json:"name"`
-	Type    string       `json:"type"` // 'r' = table, 'v' = view, 'm' = materialized view
-	Columns []ColumnInfo `json:"columns"`
+	OID    uint32 `json:"oid"`
+	Schema string `json:"schema"`
+	Name   string `json:"name"`
+	Type   string `json:"type"` // "table", "partitioned table", "foreign table", "view" or "materialized view"
+	// For materialized views, whether they hold data; false until the first REFRESH
+	// of one created WITH NO DATA. Nil for other types
+	Populated *bool `json:"populated,omitempty"`
+	// Approximate row count from the planner statistics, not an exact COUNT(*).
+	// 0 for views and for tables with no statistics yet
+	EstimatedRows int64        `json:"estimatedRows"`
+	Columns       []ColumnInfo `json:"columns"`
+	PrimaryKey    []string     `json:"primaryKey"` // column names in key order; empty if the table has none
+	ForeignKeys   []ForeignKey `json:"foreignKeys"`
+	// Check constraints in name order, whether declared on a column or the table
+	CheckConstraints []CheckInfo `json:"checkConstraints"`
+	// UNIQUE constraints in name order. Unique indexes created without a constraint are only in Indexes
+	UniqueConstraints []UniqueInfo `json:"uniqueConstraints"`
+	Indexes           []IndexInfo  `json:"indexes"`
+	// For partitioned tables, their direct partitions in name order
+	Partitions []PartitionInfo `json:"partitions,omitempty"`
+}
+
+// PartitionInfo describes one partition of a partitioned table
+type PartitionInfo struct {
+	Schema string `json:"schema"`
+	Name   string `json:"name"`
+	Bound  string `json:"bound"` // e.g. "FOR VALUES FROM ('2024-01-01') TO ('2024-02-01')" or "DEFAULT"
+}
+
+// IndexInfo describes an index on a table
+// Expression index columns hold the expression text, e.g. "lower(email)"
+type IndexInfo struct {
+	Name       string   `json:"name"`
+	Columns    []string `json:"columns"` // key columns only, excluding INCLUDE columns
+	Unique     bool     `json:"unique"`
+	Primary    bool     `json:"primary"`
+	Partial    bool     `json:"partial"`
+	Definition string   `json:"definition"` // full CREATE INDEX statement
+}
+
+// ForeignKey describes a foreign key constraint on a table
+// Columns and ReferencedColumns are paired by position
+type ForeignKey struct {
+	Name              string   `json:"name"`
+	Columns           []string `json:"columns"`
+	ReferencedSchema  string   `json:"referencedSchema"`
+	ReferencedTable   string   `json:"referencedTable"`
+	ReferencedColumns []string `json:"referencedColumns"`
+	OnDelete          string   `json:"onDelete"` // e.g. "NO ACTION", "CASCADE", "SET NULL"
+	OnUpdate          string   `json:"onUpdate"`
+}
+
+// CheckInfo describes a check constraint on a table
+type CheckInfo struct {
+	Name       string   `json:"name"`
+	Columns    []string `json:"columns"`    // columns the expression reads, in table order; empty if none
+	Definition string   `json:"definition"` // e.g. "CHECK (price > 0::numeric)"
+}
+
+// UniqueInfo describes a UNIQUE constraint on a table
+type UniqueInfo struct {
+	Name    string   `json:"name"`
+	Columns []string `json:"columns"` // in key order
+	// Deferrable constraints can't be the target of ON CONFLICT
+	Deferrable bool `json:"deferrable,omitempty"`
 }
 
 // FunctionInfo describes a database function
+// Overloads share a name and are told apart by their arguments
 type FunctionInfo struct {
-	Schema     string `json:"schema"`
-	Name       string `json:"name"`
-	ReturnType string `json:"returnType"`
+	Schema     string        `json:"schema"`
+	Name       string        `json:"name"`
+	ReturnType string        `json:"returnType"`
+	Arguments  []FunctionArg `json:"arguments"`  // in declaration order, including OUT and TABLE columns
+	Language   string        `json:"language"`   // e.g. "sql", "plpgsql", "c", "internal"
+	ReturnsSet bool          `json:"returnsSet"` // returns SETOF or TABLE, so it is called in FROM
+}
+
+// Argument modes of a FunctionArg
+const (
+	ArgModeIn       = "in"
+	ArgModeOut      = "out"
+	ArgModeInOut    = "inout"
+	ArgModeVariadic = "variadic"
+	ArgModeTable    = "table" // a column of a RETURNS TABLE result
+)
+
+// FunctionArg describes one argument of a function
+type FunctionArg struct {
+	Name       string `json:"name,omitempty"` // empty for unnamed arguments
+	Type       string `json:"type"`
+	Mode       string `json:"mode"`                 // one of the ArgMode constants
+	HasDefault bool   `json:"hasDefault,omitempty"` // can be left out of a call
+}
+
+// CancelPayload identifies an in-flight query to cancel
+type CancelPayload struct {
+	QueryID string `json:"queryId"`
+}
+
+// CanceledPayload acknowledges that a cancel request was delivered
+type CanceledPayload struct {
+	QueryID string `json:"queryId"`
+}
+
+// ListenPayload names a LISTEN/NOTIFY channel to subscribe to or unsubscribe from
+// It is also the payload of the listening and unlistened acknowledgments
+type ListenPayload struct {
+	Channel string `json:"channel"`
+}
+
+// PreparePayload registers a statement under a name so later queries can run it by name
+type PreparePayload struct {
+	Name string `json:"name"`
+	SQL  string `json:"sql"`
+}
+
+// PreparedPayload acknowledges a prepared statement and describes what it takes and returns
+type PreparedPayload struct {
+	Name       string       `json:"name"`
+	ParamTypes []string     `json:"paramTypes"` // type names of $1, $2, ... in order
+	Columns    []ColumnInfo `json:"columns"`    // empty for statements that return no rows
+}
+
+// ValidationPayload reports that a query was checked without running it and describes what it would return
+// Invalid queries get an error message instead
+type ValidationPayload struct {
+	Valid      bool         `json:"valid"`
+	ParamTypes []string     `json:"paramTypes"` // type names of $1, $2, ... in order
+	Columns    []ColumnInfo `json:"columns"`    // empty for statements that return no rows
+}
+
+// DescribePayload asks for the parameter and column types of a statement without running it
+type DescribePayload struct {
+	SQL      string `json:"sql"`
+	Database string `json:"database,omitempty"` // named database to describe on instead of the connection's
+}
+
+// DescriptionPayload lists the types a described statement takes and returns
+type DescriptionPayload struct {
+	ParamTypes []string     `json:"paramTypes"` // type names of $1, $2, ... in order
+	Columns    []ColumnInfo `json:"columns"`    // empty for statements that return no rows
+}
+
+// Protocol versions the server speaks
+// A client that doesn't say which version it speaks is treated as speaking version 1
+const (
+	ProtocolVersion    = 1 // newest version, offered in hello
+	MinProtocolVersion = 1 // oldest version still accepted
+)
+
+// HelloPayload is sent by the server as soon as a WebSocket connects, before any request
+type HelloPayload struct {
+	Version         string       `json:"version"`         // proxy version, the same as build.version
+	Build           BuildInfo    `json:"build"`           // commit, build date and Go version
+	ProtocolVersion int          `json:"protocolVersion"` // newest protocol version the server speaks
+	Database        string       `json:"database"`        // the registered database the connection's queries run on
+	DatabaseName    string       `json:"databaseName"`    // the Postgres database that registered database connects to
+	DatabaseState   string       `json:"databaseState"`   // "connected", "reconnecting" or "disconnected"
+	Capabilities    Capabilities `json:"capabilities"`
+}
+
+// BuildInfo identifies the proxy build, so a bug report can say exactly what was running
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`    // git commit the proxy was built from, or "unknown"
+	BuildDate string `json:"buildDate"` // when it was built or committed, or "unknown"
+	GoVersion string `json:"goVersion"`
+}
+
+// Capabilities lists the optional features the server offers, so a client can hide what it can't use
+// A feature missing from an older server's list decodes as false
+type Capabilities struct {
+	Streaming    bool `json:"streaming"`    // queries can stream rows as result_chunk messages
+	Cancel       bool `json:"cancel"`       // running queries can be cancelled
+	Transactions bool `json:"transactions"` // begin, commit and rollback
+	Listen       bool `json:"listen"`       // LISTEN/NOTIFY forwarding
+	Export       bool `json:"export"`       // export and copy_out
+	Prepare      bool `json:"prepare"`      // prepared statements, describe and validate
+	Scripts      bool `json:"scripts"`      // multi-statement scripts
+	Explain      bool `json:"explain"`      // query plans
+	ReadOnly     bool `json:"readOnly"`     // writes are rejected
+	RateLimited  bool `json:"rateLimited"`  // queries can be rejected with RATE_LIMITED
+	// results can be sent in the binary form of EncodeBinaryResult
+	BinaryResults bool `json:"binaryResults"`
+	Compression   bool `json:"compression"` // permessage-deflate is offered
+}
+
+// CapabilitiesRequest asks for the server's features, optionally saying which protocol version the client speaks
+type CapabilitiesRequest struct {
+	ProtocolVersion int  `json:"protocolVersion,omitempty"` // zero means version 1
+	BinaryResults   bool `json:"binaryResults,omitempty"`   // send result messages on this connection in binary form
+}
+
+// CapabilitiesPayload answers a capabilities request
+type CapabilitiesPayload struct {
+	Version string `json:"version"` // proxy version
+	// Protocol version both sides speak: the client's, or the server's newest if the client's is newer
+	ProtocolVersion int          `json:"protocolVersion"`
+	Capabilities    Capabilities `json:"capabilities"`
+	Warning         string       `json:"warning,omitempty"` // set when the client speaks a newer version
+	// result messages on this connection are now sent in binary form
+	BinaryResults bool `json:"binaryResults,omitempty"`
+}
+
+// StatementPayload names a prepared statement to deallocate
+// It is also the payload of the deallocated acknowledgment
+type StatementPayload struct {
+	Name string `json:"name"`
+}
+
+// NotificationPayload carries a NOTIFY message received on a subscribed channel
+type NotificationPayload struct {
+	Channel string `json:"channel"`
+	Payload string `json:"payload"`
+}
+
+// TransactionPayload reports the state of the connection's explicit transaction
+type TransactionPayload struct {
+	Status string `json:"status"` // TransactionOpen, TransactionCommitted, or TransactionRolledBack
 }
 
 // PingPayload represents a ping request (empty)
@@ -95,19 +484,108 @@ type PingPayload struct{}
 
 // PongPayload represents a pong response
 type PongPayload struct {
-	Timestamp time.Time `json:"timestamp"`
+	Timestamp time.Time   `json:"timestamp"`
+	Pool      *PoolStatus `json:"pool,omitempty"` // the connection's database pool, when known
+}
+
+// PoolStatus describes how busy a database connection pool is
+type PoolStatus struct {
+	Total    int32 `json:"total"`    // open connections, whether idle, in use, or still connecting
+	Idle     int32 `json:"idle"`     // connections waiting to be used
+	Acquired int32 `json:"acquired"` // connections currently running a query or transaction
+	Max      int32 `json:"max"`      // the most connections the pool will open
+	Queued   int32 `json:"queued"`   // queries waiting for a connection
 }
 
 // NewQueryResult creates a result message
-func NewQueryResult(id string, rows []map[string]interface{}, columns []ColumnInfo, executionTime time.Duration) ServerMessage {
+// command is the statement type and truncated marks a result cut off at its row limit
+func NewQueryResult(id string, rows []map[string]interface{}, columns []ColumnInfo, command string, executionTime time.Duration, truncated bool) ServerMessage {
+	return ServerMessage{
+		ID:   id,
+		Type: TypeResult,
+		Payload: ResultPayload{
+			Rows:                rows,
+			Columns:             columns,
+			RowCount:            len(rows),
+			Command:             command,
+			ExecutionTime:       executionTime.Milliseconds(),
+			ExecutionTimeMicros: executionTime.Microseconds(),
+			Truncated:           truncated,
+		},
+	}
+}
+
+// NewResultChunk creates a message carrying one batch of a streamed result
+func NewResultChunk(id string, columns []ColumnInfo, rows []map[string]interface{}, offset int) ServerMessage {
+	return ServerMessage{
+		ID:   id,
+		Type: TypeResultChunk,
+		Payload: ResultChunkPayload{
+			Columns: columns,
+			Rows:    rows,
+			Offset:  offset,
+		},
+	}
+}
+
+// NewStreamedResult creates the final message of a streamed result
+// The rows themselves were delivered in the preceding result_chunk messages
+func NewStreamedResult(id string, columns []ColumnInfo, rowCount int, command string, executionTime time.Duration) ServerMessage {
 	return ServerMessage{
 		ID:   id,
 		Type: TypeResult,
 		Payload: ResultPayload{
-			Rows:          rows,
-			Columns:       columns,
-			RowCount:      len(rows),
-			ExecutionTime: executionTime.Milliseconds(),
+			Rows:                []map[string]interface{}{},
+			Columns:             columns,
+			RowCount:            rowCount,
+			Command:             command,
+			ExecutionTime:       executionTime.Milliseconds(),
+			ExecutionTimeMicros: executionTime.Microseconds(),
+			Streamed:            true,
+		},
+	}
+}
+
+// NewScriptResult creates a message with the results of a multi-statement script
+func NewScriptResult(id string, statements []StatementResult, transactional, committed bool, executionTime time.Duration) ServerMessage {
+	return ServerMessage{
+		ID:   id,
+		Type: TypeScriptResult,
+		Payload: ScriptResultPayload{
+			Statements:          statements,
+			Transactional:       transactional,
+			Committed:           committed,
+			ExecutionTime:       executionTime.Milliseconds(),
+			ExecutionTimeMicros: executionTime.Microseconds(),
+		},
+	}
+}
+
+// NewPlan creates a message with the plan of an explained query
+func NewPlan(id string, plan interface{}, analyzed bool, executionTime time.Duration) ServerMessage {
+	return ServerMessage{
+		ID:   id,
+		Type: TypePlan,
+		Payload: PlanPayload{
+			Plan:                plan,
+			Analyzed:            analyzed,
+			ExecutionTime:       executionTime.Milliseconds(),
+			ExecutionTimeMicros: executionTime.Microseconds(),
+		},
+	}
+}
+
+// NewExportComplete creates the message that ends an export
+func NewExportComplete(id, format string, rowCount int, bytes int64, executionTime time.Duration) ServerMessage {
+	return ServerMessage{
+		ID:   id,
+		Type: TypeExportComplete,
+		Payload: ExportCompletePayload{
+			Format:              format,
+			RowCount:            rowCount,
+			Bytes:               bytes,
+			ExecutionTime:       executionTime.Milliseconds(),
+			ExecutionTimeMicros: executionTime.Microseconds(),
 		},
 	}
 }
@@ -125,6 +603,51 @@ func NewError(id string, code, message, detail string) ServerMessage {
 	}
 }
 
+// NewErrorWithHint creates an error message with a hint suggesting how to fix the problem
+func NewErrorWithHint(id string, code, message, hint string) ServerMessage {
+	return ServerMessage{
+		ID:   id,
+		Type: TypeError,
+		Payload: ErrorPayload{
+			Code:    code,
+			Message: message,
+			Hint:    hint,
+		},
+	}
+}
+
+// NewDatabaseError creates an error message from an error Postgres reported
+// position is the 1-based character offset of the error in the query, or zero if unknown
+func NewDatabaseError(id string, code, message, detail, hint string, position int) ServerMessage {
+	return ServerMessage{
+		ID:   id,
+		Type: TypeError,
+		Payload: ErrorPayload{
+			Code:     code,
+			Message:  message,
+			Detail:   detail,
+			Hint:     hint,
+			Position: position,
+		},
+	}
+}
+
+// NewStatementError creates an error message for a failed statement in a script
+// statement is the 1-based index of the statement that failed
+func NewStatementError(id string, code, message, detail string, statement int, rolledBack bool) ServerMessage {
+	return ServerMessage{
+		ID:   id,
+		Type: TypeError,
+		Payload: ErrorPayload{
+			Code:       code,
+			Message:    message,
+			Detail:     detail,
+			Statement:  statement,
+			RolledBack: rolledBack,
+		},
+	}
+}
+
 // NewSchemaResult creates a schema message
 func NewSchemaResult(id string, tables []TableInfo, functions []FunctionInfo) ServerMessage {
 	return ServerMessage{
@@ -137,6 +660,142 @@ func NewSchemaResult(id string, tables []TableInfo, functions []FunctionInfo) Se
 	}
 }
 
+// NewCanceled creates a cancel acknowledgment message
+func NewCanceled(id string, queryID string) ServerMessage {
+	return ServerMessage{
+		ID:   id,
+		Type: TypeCanceled,
+		Payload: CanceledPayload{
+			QueryID: queryID,
+		},
+	}
+}
+
+// NewListening creates a message acknowledging a channel subscription
+func NewListening(id string, channel string) ServerMessage {
+	return ServerMessage{
+		ID:   id,
+		Type: TypeListening,
+		Payload: ListenPayload{
+			Channel: channel,
+		},
+	}
+}
+
+// NewUnlistened creates a message acknowledging a channel unsubscription
+func NewUnlistened(id string, channel string) ServerMessage {
+	return ServerMessage{
+		ID:   id,
+		Type: TypeUnlistened,
+		Payload: ListenPayload{
+			Channel: channel,
+		},
+	}
+}
+
+// NewPrepared creates a message acknowledging a prepared statement
+func NewPrepared(id, name string, paramTypes []string, columns []ColumnInfo) ServerMessage {
+	return ServerMessage{
+		ID:   id,
+		Type: TypePrepared,
+		Payload: PreparedPayload{
+			Name:       name,
+			ParamTypes: paramTypes,
+			Columns:    columns,
+		},
+	}
+}
+
+// NewValidation creates a message describing a query that passed validation
+func NewValidation(id string, paramTypes []string, columns []ColumnInfo) ServerMessage {
+	return ServerMessage{
+		ID:   id,
+		Type: TypeValidation,
+		Payload: ValidationPayload{
+			Valid:      true,
+			ParamTypes: paramTypes,
+			Columns:    columns,
+		},
+	}
+}
+
+// NewDescription creates a message describing a statement's parameters and result columns
+func NewDescription(id string, paramTypes []string, columns []ColumnInfo) ServerMessage {
+	return ServerMessage{
+		ID:   id,
+		Type: TypeDescription,
+		Payload: DescriptionPayload{
+			ParamTypes: paramTypes,
+			Columns:    columns,
+		},
+	}
+}
+
+// NewDeallocated creates a message acknowledging a deallocated statement
+func NewDeallocated(id, name string) ServerMessage {
+	return ServerMessage{
+		ID:   id,
+		Type: TypeDeallocated,
+		Payload: StatementPayload{
+			Name: name,
+		},
+	}
+}
+
+// NewHello creates the message greeting a newly connected client
+func NewHello(build BuildInfo, database, databaseName, databaseState string, capabilities Capabilities) ServerMessage {
+	return ServerMessage{
+		Type: TypeHello,
+		Payload: HelloPayload{
+			Version:         build.Version,
+			Build:           build,
+			ProtocolVersion: ProtocolVersion,
+			Database:        database,
+			DatabaseName:    databaseName,
+			DatabaseState:   databaseState,
+			Capabilities:    capabilities,
+		},
+	}
+}
+
+// NewCapabilities creates a message listing the server's features in reply to a capabilities request
+func NewCapabilities(id, version string, protocolVersion int, capabilities Capabilities, warning string, binaryResults bool) ServerMessage {
+	return ServerMessage{
+		ID:   id,
+		Type: TypeCapabilities,
+		Payload: CapabilitiesPayload{
+			Version:         version,
+			ProtocolVersion: protocolVersion,
+			Capabilities:    capabilities,
+			Warning:         warning,
+			BinaryResults:   binaryResults,
+		},
+	}
+}
+
+// NewNotification creates a message forwarding a notification
+// Notifications are unsolicited, so they carry no message ID
+func NewNotification(channel, payload string) ServerMessage {
+	return ServerMessage{
+		Type: TypeNotification,
+		Payload: NotificationPayload{
+			Channel: channel,
+			Payload: payload,
+		},
+	}
+}
+
+// NewTransactionStatus creates a message reporting that a transaction was opened, committed, or rolled back
+func NewTransactionStatus(id string, status string) ServerMessage {
+	return ServerMessage{
+		ID:   id,
+		Type: TypeTransaction,
+		Payload: TransactionPayload{
+			Status: status,
+		},
+	}
+}
+
 // NewPong creates a pong message
 func NewPong(id string) ServerMessage {
 	return ServerMessage{
@@ -147,3 +806,15 @@ func NewPong(id string) ServerMessage {
 		},
 	}
 }
+
+// NewPongWithPool creates a pong message that reports connection pool statistics
+func NewPongWithPool(id string, pool PoolStatus) ServerMessage {
+	return ServerMessage{
+		ID:   id,
+		Type: TypePong,
+		Payload: PongPayload{
+			Timestamp: time.Now(),
+			Pool:      &pool,
+		},
+	}
+}
@@ -2,6 +2,7 @@ package protocol
 
 import (
 	"encoding/json"
+	"strings"
 	"testing"
 	"time"
 )
@@ -217,8 +218,8 @@ func TestResultPayloadSerialization(t *testing.T) {
 			{"id": float64(2), "name": "Bob", "active": false},
 		},
 		Columns: []ColumnInfo{
-			{Name: "id", DataType: "integer", TypeOID: 23, Nullable: false},
-			{Name: "name", DataType: "text", TypeOID: 25, Nullable: true},
+			{Name: "id", DataType: "integer", TypeOID: 23, Nullable: false, TableOID: 16384, TableColumn: 1},
+			{Name: "name", DataType: "text", TypeOID: 25, Nullable: true, TableOID: 16384, TableColumn: 2},
 			{Name: "active", DataType: "boolean", TypeOID: 16, Nullable: false},
 		},
 		RowCount:      2,
@@ -265,6 +266,27 @@ func TestResultPayloadSerialization(t *testing.T) {
 		if col.Nullable != payload.Columns[i].Nullable {
 			t.Errorf("Column %d nullable mismatch: got %v, want %v", i, col.Nullable, payload.Columns[i].Nullable)
 		}
+		if col.TableOID != payload.Columns[i].TableOID || col.TableColumn != payload.Columns[i].TableColumn {
+			t.Errorf("Column %d source mismatch: got %d.%d, want %d.%d", i, col.TableOID, col.TableColumn, payload.Columns[i].TableOID, payload.Columns[i].TableColumn)
+		}
+	}
+
+	// Computed columns have no source table, so the fields are left out
+	computed, err := json.Marshal(payload.Columns[2])
+	if err != nil {
+		t.Fatalf("Failed to marshal ColumnInfo: %v", err)
+	}
+	if strings.Contains(string(computed), "tableOid") || strings.Contains(string(computed), "tableColumn") {
+		t.Errorf("Expected source table fields to be omitted, got %s", computed)
+	}
+
+	// A query faster than a millisecond still reports how long it took
+	fast, err := json.Marshal(NewQueryResult("fast", nil, nil, "SELECT", 250*time.Microsecond, false).Payload)
+	if err != nil {
+		t.Fatalf("Failed to marshal ResultPayload: %v", err)
+	}
+	if !strings.Contains(string(fast), `"executionTime":0,"executionTimeMicros":250`) {
+		t.Errorf("Expected 0ms and 250µs, got %s", fast)
 	}
 }
 
@@ -307,6 +329,51 @@ func TestErrorPayloadSerialization(t *testing.T) {
 	}
 }
 
+// TestColumnInfoSerialization tests the JSON names of the core column fields and that they round-trip
+func TestColumnInfoSerialization(t *testing.T) {
+	tests := []struct {
+		name   string
+		column ColumnInfo
+		want   string
+	}{
+		{
+			name:   "nullable column",
+			column: ColumnInfo{Name: "email", DataType: "text", TypeOID: 25, Nullable: true},
+			want:   `{"name":"email","dataType":"text","typeOid":25,"nullable":true}`,
+		},
+		{
+			name:   "not null column",
+			column: ColumnInfo{Name: "id", DataType: "integer", TypeOID: 23},
+			want:   `{"name":"id","dataType":"integer","typeOid":23}`,
+		},
+		{
+			name:   "unknown type",
+			column: ColumnInfo{Name: "value", DataType: "unknown"},
+			want:   `{"name":"value","dataType":"unknown"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := json.Marshal(tt.column)
+			if err != nil {
+				t.Fatalf("Failed to marshal ColumnInfo: %v", err)
+			}
+			if string(data) != tt.want {
+				t.Errorf("Marshal() = %s, want %s", data, tt.want)
+			}
+
+			var result ColumnInfo
+			if err := json.Unmarshal(data, &result); err != nil {
+				t.Fatalf("Failed to unmarshal ColumnInfo: %v", err)
+			}
+			if result != tt.column {
+				t.Errorf("Round trip = %+v, want %+v", result, tt.column)
+			}
+		})
+	}
+}
+
 func TestSchemaPayloadSerialization(t *testing.T) {
 	payload := SchemaPayload{
 		Tables: []TableInfo{
@@ -318,6 +385,17 @@ func TestSchemaPayloadSerialization(t *testing.T) {
 					{Name: "id", DataType: "integer", TypeOID: 23, Nullable: false},
 					{Name: "email", DataType: "text", TypeOID: 25, Nullable: true},
 				},
+				PrimaryKey: []string{"id"},
+				CheckConstraints: []CheckInfo{
+					{Name: "users_email_check", Columns: []string{"email"}, Definition: "CHECK (email ~~ '%@%'::text)"},
+				},
+				UniqueConstraints: []UniqueInfo{
+					{Name: "users_tenant_name_key", Columns: []string{"tenant_id", "name"}},
+				},
+				Indexes: []IndexInfo{
+					{Name: "users_pkey", Columns: []string{"id"}, Unique: true, Primary: true, Definition: "CREATE UNIQUE INDEX users_pkey ON public.users USING btree (id)"},
+					{Name: "users_email_idx", Columns: []string{"lower(email)"}, Unique: true, Definition: "CREATE UNIQUE INDEX users_email_idx ON public.users USING btree (lower(email))"},
+				},
 			},
 			{
 				Schema: "public",
@@ -327,6 +405,18 @@ func TestSchemaPayloadSerialization(t *testing.T) {
 					{Name: "id", DataType: "integer", TypeOID: 23, Nullable: false},
 					{Name: "title", DataType: "text", TypeOID: 25, Nullable: false},
 				},
+				PrimaryKey: []string{},
+				ForeignKeys: []ForeignKey{
+					{
+						Name:              "posts_author_fk",
+						Columns:           []string{"author_id"},
+						ReferencedSchema:  "public",
+						ReferencedTable:   "users",
+						ReferencedColumns: []string{"id"},
+						OnDelete:          "CASCADE",
+						OnUpdate:          "NO ACTION",
+					},
+				},
 			},
 		},
 		Functions: []FunctionInfo{
@@ -361,6 +451,37 @@ func TestSchemaPayloadSerialization(t *testing.T) {
 		if len(table.Columns) != len(payload.Tables[i].Columns) {
 			t.Errorf("Table %d columns length mismatch: got %d, want %d", i, len(table.Columns), len(payload.Tables[i].Columns))
 		}
+		if len(table.PrimaryKey) != len(payload.Tables[i].PrimaryKey) {
+			t.Errorf("Table %d primary key length mismatch: got %d, want %d", i, len(table.PrimaryKey), len(payload.Tables[i].PrimaryKey))
+		}
+		if len(table.Indexes) != len(payload.Tables[i].Indexes) {
+			t.Errorf("Table %d indexes length mismatch: got %d, want %d", i, len(table.Indexes), len(payload.Tables[i].Indexes))
+		}
+		if len(table.ForeignKeys) != len(payload.Tables[i].ForeignKeys) {
+			t.Errorf("Table %d foreign keys length mismatch: got %d, want %d", i, len(table.ForeignKeys), len(payload.Tables[i].ForeignKeys))
+		}
+	}
+
+	if checks := result.Tables[0].CheckConstraints; len(checks) != 1 || checks[0].Name != "users_email_check" ||
+		len(checks[0].Columns) != 1 || checks[0].Definition != "CHECK (email ~~ '%@%'::text)" {
+		t.Errorf("Check constraint mismatch: got %+v", checks)
+	}
+
+	if uniques := result.Tables[0].UniqueConstraints; len(uniques) != 1 || len(uniques[0].Columns) != 2 || uniques[0].Deferrable {
+		t.Errorf("Unique constraint mismatch: got %+v", uniques)
+	}
+	if contains(string(data), "deferrable") {
+		t.Errorf("JSON should not contain 'deferrable' when unset, got %s", data)
+	}
+
+	fk := result.Tables[1].ForeignKeys[0]
+	if fk.ReferencedTable != "users" || fk.OnDelete != "CASCADE" || len(fk.ReferencedColumns) != 1 {
+		t.Errorf("Foreign key mismatch: got %+v", fk)
+	}
+
+	// Tables without a primary key serialize an empty array rather than null
+	if !contains(string(data), `"primaryKey":[]`) {
+		t.Errorf("Expected empty primaryKey array in JSON, got %s", data)
 	}
 
 	// Verify functions
@@ -412,7 +533,7 @@ func TestHelperFunctions(t *testing.T) {
 		}
 		duration := 100 * time.Millisecond
 
-		msg := NewQueryResult("test-id", rows, columns, duration)
+		msg := NewQueryResult("test-id", rows, columns, "SELECT", duration, true)
 
 		if msg.ID != "test-id" {
 			t.Errorf("ID mismatch: got %s, want test-id", msg.ID)
@@ -428,8 +549,14 @@ func TestHelperFunctions(t *testing.T) {
 		if payload.RowCount != 1 {
 			t.Errorf("RowCount mismatch: got %d, want 1", payload.RowCount)
 		}
-		if payload.ExecutionTime != 100 {
-			t.Errorf("ExecutionTime mismatch: got %d, want 100", payload.ExecutionTime)
+		if payload.ExecutionTime != 100 || payload.ExecutionTimeMicros != 100000 {
+			t.Errorf("ExecutionTime mismatch: got %dms and %dµs, want 100ms", payload.ExecutionTime, payload.ExecutionTimeMicros)
+		}
+		if payload.Command != "SELECT" {
+			t.Errorf("Command mismatch: got %s, want SELECT", payload.Command)
+		}
+		if !payload.Truncated {
+			t.Error("Expected Truncated to be set")
 		}
 	})
 
@@ -502,6 +629,261 @@ func TestHelperFunctions(t *testing.T) {
 		if time.Since(payload.Timestamp) > time.Second {
 			t.Error("Timestamp is not recent")
 		}
+		if payload.Pool != nil {
+			t.Error("Expected no pool statistics")
+		}
+	})
+
+	t.Run("NewPongWithPool", func(t *testing.T) {
+		msg := NewPongWithPool("test-id", PoolStatus{Total: 4, Idle: 1, Acquired: 3, Max: 10, Queued: 2})
+
+		data, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatalf("Failed to marshal pong: %v", err)
+		}
+		if !strings.Contains(string(data), `"pool":{"total":4,"idle":1,"acquired":3,"max":10,"queued":2}`) {
+			t.Errorf("Expected pool statistics in %s", data)
+		}
+	})
+
+	t.Run("NewResultChunk", func(t *testing.T) {
+		rows := []map[string]interface{}{
+			{"id": 3},
+			{"id": 4},
+		}
+		columns := []ColumnInfo{
+			{Name: "id", DataType: "int4"},
+		}
+
+		msg := NewResultChunk("test-id", columns, rows, 2)
+
+		if msg.Type != TypeResultChunk {
+			t.Errorf("Type mismatch: got %s, want %s", msg.Type, TypeResultChunk)
+		}
+
+		payload, ok := msg.Payload.(ResultChunkPayload)
+		if !ok {
+			t.Fatal("Payload is not ResultChunkPayload")
+		}
+		if payload.Offset != 2 {
+			t.Errorf("Offset mismatch: got %d, want 2", payload.Offset)
+		}
+		if len(payload.Rows) != 2 {
+			t.Errorf("Rows length mismatch: got %d, want 2", len(payload.Rows))
+		}
+	})
+
+	t.Run("NewStreamedResult", func(t *testing.T) {
+		columns := []ColumnInfo{
+			{Name: "id", DataType: "int4"},
+		}
+
+		msg := NewStreamedResult("test-id", columns, 1500, "SELECT", 250*time.Millisecond)
+
+		if msg.Type != TypeResult {
+			t.Errorf("Type mismatch: got %s, want %s", msg.Type, TypeResult)
+		}
+
+		payload, ok := msg.Payload.(ResultPayload)
+		if !ok {
+			t.Fatal("Payload is not ResultPayload")
+		}
+		if !payload.Streamed {
+			t.Error("Expected Streamed to be true")
+		}
+		if payload.RowCount != 1500 {
+			t.Errorf("RowCount mismatch: got %d, want 1500", payload.RowCount)
+		}
+		if payload.Command != "SELECT" {
+			t.Errorf("Command mismatch: got %s, want SELECT", payload.Command)
+		}
+		if payload.Rows == nil || len(payload.Rows) != 0 {
+			t.Errorf("Expected empty non-nil rows, got %v", payload.Rows)
+		}
+		if payload.ExecutionTime != 250 {
+			t.Errorf("ExecutionTime mismatch: got %d, want 250", payload.ExecutionTime)
+		}
+	})
+
+	t.Run("NewCanceled", func(t *testing.T) {
+		msg := NewCanceled("cancel-1", "query-1")
+
+		if msg.ID != "cancel-1" {
+			t.Errorf("ID mismatch: got %s, want cancel-1", msg.ID)
+		}
+		if msg.Type != TypeCanceled {
+			t.Errorf("Type mismatch: got %s, want %s", msg.Type, TypeCanceled)
+		}
+
+		payload, ok := msg.Payload.(CanceledPayload)
+		if !ok {
+			t.Fatal("Payload is not CanceledPayload")
+		}
+		if payload.QueryID != "query-1" {
+			t.Errorf("QueryID mismatch: got %s, want query-1", payload.QueryID)
+		}
+	})
+
+	t.Run("NewScriptResult", func(t *testing.T) {
+		statements := []StatementResult{
+			{SQL: "DELETE FROM t", RowsAffected: 3, ResultPayload: ResultPayload{Rows: []map[string]interface{}{}}},
+		}
+		msg := NewScriptResult("script-1", statements, true, true, 20*time.Millisecond)
+
+		if msg.Type != TypeScriptResult {
+			t.Errorf("Type mismatch: got %s, want %s", msg.Type, TypeScriptResult)
+		}
+
+		data, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatalf("Failed to marshal: %v", err)
+		}
+		// Statement results flatten the embedded result fields
+		if !contains(string(data), `"statements":[{"sql":"DELETE FROM t","rowsAffected":3,"rows":[],`) {
+			t.Errorf("Unexpected JSON: %s", data)
+		}
+		if !contains(string(data), `"transactional":true,"committed":true,"executionTime":20,"executionTimeMicros":20000}`) {
+			t.Errorf("Expected script execution time in JSON, got %s", data)
+		}
+	})
+
+	t.Run("NewErrorWithHint", func(t *testing.T) {
+		msg := NewErrorWithHint("test-id", "READ_ONLY_VIOLATION", "DELETE statements are not allowed in read-only mode", "Restart without --read-only")
+
+		payload, ok := msg.Payload.(ErrorPayload)
+		if !ok {
+			t.Fatal("Payload is not ErrorPayload")
+		}
+		if msg.Type != TypeError || payload.Hint != "Restart without --read-only" || payload.Detail != "" {
+			t.Errorf("Unexpected error message: %+v", msg)
+		}
+
+		data, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatalf("Marshal failed: %v", err)
+		}
+		if !strings.Contains(string(data), `"hint":"Restart without --read-only"`) {
+			t.Errorf("Expected hint in JSON, got %s", data)
+		}
+	})
+
+	t.Run("NewDatabaseError", func(t *testing.T) {
+		msg := NewDatabaseError("test-id", "42703", `column "nme" does not exist`, "", `Perhaps you meant to reference the column "users.name".`, 8)
+
+		payload, ok := msg.Payload.(ErrorPayload)
+		if !ok {
+			t.Fatal("Payload is not ErrorPayload")
+		}
+		if msg.Type != TypeError || payload.Code != "42703" || payload.Position != 8 || payload.Hint == "" {
+			t.Errorf("Unexpected error message: %+v", msg)
+		}
+	})
+
+	t.Run("NewStatementError", func(t *testing.T) {
+		msg := NewStatementError("script-1", "QUERY_ERROR", "statement 2 of 3 failed", "transaction rolled back, no statements committed", 2, true)
+
+		payload, ok := msg.Payload.(ErrorPayload)
+		if !ok {
+			t.Fatal("Payload is not ErrorPayload")
+		}
+		if msg.Type != TypeError || payload.Statement != 2 || payload.Code != "QUERY_ERROR" || !payload.RolledBack {
+			t.Errorf("Unexpected error message: %+v", msg)
+		}
+	})
+
+	t.Run("NewTransactionStatus", func(t *testing.T) {
+		msg := NewTransactionStatus("commit-1", TransactionCommitted)
+
+		if msg.ID != "commit-1" {
+			t.Errorf("ID mismatch: got %s, want commit-1", msg.ID)
+		}
+		if msg.Type != TypeTransaction {
+			t.Errorf("Type mismatch: got %s, want %s", msg.Type, TypeTransaction)
+		}
+
+		payload, ok := msg.Payload.(TransactionPayload)
+		if !ok {
+			t.Fatal("Payload is not TransactionPayload")
+		}
+		if payload.Status != TransactionCommitted {
+			t.Errorf("Status mismatch: got %s, want %s", payload.Status, TransactionCommitted)
+		}
+	})
+
+	t.Run("NewPlan", func(t *testing.T) {
+		plan := []interface{}{map[string]interface{}{"Plan": map[string]interface{}{"Node Type": "Seq Scan"}}}
+		msg := NewPlan("explain-1", plan, true, 12*time.Millisecond)
+
+		if msg.ID != "explain-1" {
+			t.Errorf("ID mismatch: got %s, want explain-1", msg.ID)
+		}
+		if msg.Type != TypePlan {
+			t.Errorf("Type mismatch: got %s, want %s", msg.Type, TypePlan)
+		}
+
+		data, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatalf("Failed to marshal: %v", err)
+		}
+		want := `{"id":"explain-1","type":"plan","payload":{"plan":[{"Plan":{"Node Type":"Seq Scan"}}],"analyzed":true,"executionTime":12,"executionTimeMicros":12000}}`
+		if string(data) != want {
+			t.Errorf("Serialization mismatch:\ngot:  %s\nwant: %s", data, want)
+		}
+	})
+
+	t.Run("NewExportComplete", func(t *testing.T) {
+		msg := NewExportComplete("export-1", ExportFormatCSV, 3, 42, 15*time.Millisecond)
+
+		data, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatalf("Failed to marshal: %v", err)
+		}
+		want := `{"id":"export-1","type":"export_complete","payload":{"format":"csv","rowCount":3,"bytes":42,"executionTime":15,"executionTimeMicros":15000}}`
+		if string(data) != want {
+			t.Errorf("Serialization mismatch:\ngot:  %s\nwant: %s", data, want)
+		}
+	})
+
+	t.Run("NewListening and NewUnlistened", func(t *testing.T) {
+		for _, msg := range []ServerMessage{NewListening("listen-1", "jobs"), NewUnlistened("listen-1", "jobs")} {
+			if msg.ID != "listen-1" {
+				t.Errorf("ID mismatch: got %s, want listen-1", msg.ID)
+			}
+
+			payload, ok := msg.Payload.(ListenPayload)
+			if !ok {
+				t.Fatal("Payload is not ListenPayload")
+			}
+			if payload.Channel != "jobs" {
+				t.Errorf("Channel mismatch: got %s, want jobs", payload.Channel)
+			}
+		}
+
+		if msg := NewListening("listen-1", "jobs"); msg.Type != TypeListening {
+			t.Errorf("Type mismatch: got %s, want %s", msg.Type, TypeListening)
+		}
+		if msg := NewUnlistened("listen-1", "jobs"); msg.Type != TypeUnlistened {
+			t.Errorf("Type mismatch: got %s, want %s", msg.Type, TypeUnlistened)
+		}
+	})
+
+	t.Run("NewNotification", func(t *testing.T) {
+		msg := NewNotification("jobs", `{"id":42}`)
+
+		if msg.ID != "" {
+			t.Errorf("Notifications should have no ID, got %s", msg.ID)
+		}
+		if msg.Type != TypeNotification {
+			t.Errorf("Type mismatch: got %s, want %s", msg.Type, TypeNotification)
+		}
+
+		payload, ok := msg.Payload.(NotificationPayload)
+		if !ok {
+			t.Fatal("Payload is not NotificationPayload")
+		}
+		if payload.Channel != "jobs" || payload.Payload != `{"id":42}` {
+			t.Errorf("Payload mismatch: got %+v", payload)
+		}
 	})
 }
 
@@ -525,6 +907,25 @@ func TestJSONOmitEmpty(t *testing.T) {
 		}
 	})
 
+	t.Run("TableInfo omits populated except for materialized views", func(t *testing.T) {
+		data, err := json.Marshal(TableInfo{Name: "users", Type: "table"})
+		if err != nil {
+			t.Fatalf("Failed to marshal: %v", err)
+		}
+		if contains(string(data), "populated") {
+			t.Error("JSON should not contain 'populated' field for a table")
+		}
+
+		populated := false
+		data, err = json.Marshal(TableInfo{Name: "totals", Type: "materialized view", Populated: &populated})
+		if err != nil {
+			t.Fatalf("Failed to marshal: %v", err)
+		}
+		if !contains(string(data), `"populated":false`) {
+			t.Errorf("JSON should report an unpopulated materialized view, got %s", data)
+		}
+	})
+
 	t.Run("ErrorPayload omits empty fields", func(t *testing.T) {
 		payload := ErrorPayload{
 			Code:    "ERROR",
@@ -546,6 +947,51 @@ func TestJSONOmitEmpty(t *testing.T) {
 		if contains(jsonStr, "position") {
 			t.Error("JSON should not contain 'position' field when zero")
 		}
+		if contains(jsonStr, "statement") {
+			t.Error("JSON should not contain 'statement' field when zero")
+		}
+		if contains(jsonStr, "rolledBack") {
+			t.Error("JSON should not contain 'rolledBack' field when false")
+		}
+	})
+
+	t.Run("ColumnInfo omits encoding unless set", func(t *testing.T) {
+		data, err := json.Marshal(ColumnInfo{Name: "name", DataType: "text"})
+		if err != nil {
+			t.Fatalf("Failed to marshal: %v", err)
+		}
+		if contains(string(data), "encoding") {
+			t.Error("JSON should not contain 'encoding' field when empty")
+		}
+
+		data, err = json.Marshal(ColumnInfo{Name: "data", DataType: "bytea", Encoding: EncodingBase64})
+		if err != nil {
+			t.Fatalf("Failed to marshal: %v", err)
+		}
+		if !contains(string(data), `"encoding":"base64"`) {
+			t.Errorf("JSON should contain base64 encoding marker, got %s", data)
+		}
+	})
+
+	t.Run("ColumnInfo omits introspection-only fields", func(t *testing.T) {
+		data, err := json.Marshal(ColumnInfo{Name: "id", DataType: "integer", TypeOID: 23})
+		if err != nil {
+			t.Fatalf("Failed to marshal: %v", err)
+		}
+		jsonStr := string(data)
+		for _, field := range []string{"hasDefault", "defaultValue", "isIdentity", "isGenerated", "ordinalPosition"} {
+			if contains(jsonStr, field) {
+				t.Errorf("JSON should not contain '%s' field when unset", field)
+			}
+		}
+
+		data, err = json.Marshal(ColumnInfo{Name: "note", DataType: "text", HasDefault: true, DefaultValue: "NULL"})
+		if err != nil {
+			t.Fatalf("Failed to marshal: %v", err)
+		}
+		if !contains(string(data), `"hasDefault":true,"defaultValue":"NULL"`) {
+			t.Errorf("JSON should contain explicit NULL default, got %s", data)
+		}
 	})
 }
 
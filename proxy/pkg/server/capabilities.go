@@ -0,0 +1,46 @@
+package server
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/protocol"
+)
+
+// handleCapabilities lists the server's features and settles which protocol version to speak
+// A client too old for the server is refused. A newer one is told to fall back to the server's
+// newest version, since it may use messages the server doesn't know. A WebSocket client can also
+// switch its results to binary form here
+func (s *Server) handleCapabilities(sess *session, msg protocol.ClientMessage) protocol.ServerMessage {
+	var payload protocol.CapabilitiesRequest
+	if err := decodePayload(msg.Payload, &payload); err != nil {
+		return protocol.NewError(msg.ID, "INVALID_PAYLOAD", "Failed to parse capabilities payload", err.Error())
+	}
+
+	version := payload.ProtocolVersion
+	if version == 0 {
+		version = 1
+	}
+	var warning string
+	switch {
+	case version < 0:
+		return protocol.NewError(msg.ID, "INVALID_PAYLOAD", "protocolVersion cannot be negative", "")
+	case version < protocol.MinProtocolVersion:
+		return protocol.NewErrorWithHint(msg.ID, "UNSUPPORTED_PROTOCOL_VERSION",
+			fmt.Sprintf("Protocol version %d is no longer supported; the proxy needs at least version %d", version, protocol.MinProtocolVersion),
+			"Upgrade the frontend to one that matches this proxy")
+	case version > protocol.ProtocolVersion:
+		warning = fmt.Sprintf("The client speaks protocol version %d but the proxy only speaks up to version %d; features added since are unavailable",
+			version, protocol.ProtocolVersion)
+		log.Printf("Client asked for protocol version %d; falling back to %d", version, protocol.ProtocolVersion)
+		version = protocol.ProtocolVersion
+	}
+
+	// Binary results need a WebSocket to send binary messages on
+	binaryResults := payload.BinaryResults && sess != nil
+	if binaryResults {
+		sess.binaryResults.Store(true)
+	}
+
+	return protocol.NewCapabilities(msg.ID, s.opts.Build.Version, version, s.capabilities, warning, binaryResults)
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/auth"
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/postgres"
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/protocol"
+	"github.com/gorilla/websocket"
+)
+
+func TestHandleMessage_Capabilities(t *testing.T) {
+	tests := []struct {
+		name            string
+		readOnly        bool
+		maxQPS          int
+		wantReadOnly    bool
+		wantRateLimited bool
+	}{
+		{name: "defaults"},
+		{name: "read-only", readOnly: true, wantReadOnly: true},
+		{name: "rate limited", maxQPS: 10, wantRateLimited: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Build.Version = "1.2.3"
+			opts.ReadOnly = tt.readOnly
+			opts.MaxQueriesPerSecond = tt.maxQPS
+			server := NewServer("secret", &MockPostgresClient{}, opts)
+
+			response := server.handleMessage(protocol.ClientMessage{ID: "caps", Type: protocol.TypeCapabilities})
+
+			payload, ok := response.Payload.(protocol.CapabilitiesPayload)
+			if !ok || response.Type != protocol.TypeCapabilities || response.ID != "caps" {
+				t.Fatalf("Expected capabilities for caps, got %+v", response)
+			}
+			if payload.Version != "1.2.3" || payload.ProtocolVersion != protocol.ProtocolVersion {
+				t.Errorf("Unexpected versions: %+v", payload)
+			}
+			capabilities := payload.Capabilities
+			if !capabilities.Streaming || !capabilities.Cancel || !capabilities.Transactions || !capabilities.Export {
+				t.Errorf("Expected the always-on features to be reported, got %+v", capabilities)
+			}
+			if capabilities.ReadOnly != tt.wantReadOnly || capabilities.RateLimited != tt.wantRateLimited {
+				t.Errorf("Unexpected capabilities: %+v", capabilities)
+			}
+		})
+	}
+}
+
+func TestHandleMessage_CapabilitiesProtocolVersion(t *testing.T) {
+	tests := []struct {
+		name        string
+		payload     interface{}
+		wantVersion int
+		wantWarning bool
+		wantCode    string
+	}{
+		{name: "no payload", payload: nil, wantVersion: 1},
+		{name: "unset version", payload: protocol.CapabilitiesRequest{}, wantVersion: 1},
+		{name: "current version", payload: protocol.CapabilitiesRequest{ProtocolVersion: protocol.ProtocolVersion}, wantVersion: protocol.ProtocolVersion},
+		{
+			name:        "newer client",
+			payload:     protocol.CapabilitiesRequest{ProtocolVersion: protocol.ProtocolVersion + 1},
+			wantVersion: protocol.ProtocolVersion,
+			wantWarning: true,
+		},
+		{name: "negative version", payload: protocol.CapabilitiesRequest{ProtocolVersion: -1}, wantCode: "INVALID_PAYLOAD"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewServer("secret", &MockPostgresClient{}, DefaultOptions())
+
+			response := server.handleMessage(protocol.ClientMessage{ID: "caps", Type: protocol.TypeCapabilities, Payload: tt.payload})
+
+			if tt.wantCode != "" {
+				errorPayload, ok := response.Payload.(protocol.ErrorPayload)
+				if !ok || errorPayload.Code != tt.wantCode {
+					t.Errorf("Expected %s error, got %+v", tt.wantCode, response.Payload)
+				}
+				return
+			}
+			payload, ok := response.Payload.(protocol.CapabilitiesPayload)
+			if !ok {
+				t.Fatalf("Expected capabilities, got %+v", response)
+			}
+			if payload.ProtocolVersion != tt.wantVersion {
+				t.Errorf("ProtocolVersion = %d, want %d", payload.ProtocolVersion, tt.wantVersion)
+			}
+			if (payload.Warning != "") != tt.wantWarning {
+				t.Errorf("Unexpected warning %q", payload.Warning)
+			}
+		})
+	}
+}
+
+func TestHandleConnection_BinaryResults(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	mockClient := &MockPostgresClient{
+		ExecuteQueryFunc: func(ctx context.Context, sql string, params []interface{}) (*postgres.QueryResult, error) {
+			return &postgres.QueryResult{
+				Columns:  []protocol.ColumnInfo{{Name: "id", DataType: "integer"}, {Name: "score", DataType: "double precision"}},
+				Rows:     []map[string]interface{}{{"id": int32(1), "score": 0.5}, {"id": int32(2), "score": nil}},
+				RowCount: 2,
+				Command:  "SELECT",
+			}, nil
+		},
+	}
+	ws := dialTestServer(t, NewServer(secret, mockClient, DefaultOptions()))
+
+	sendMessage(t, ws, "caps", protocol.TypeCapabilities, protocol.CapabilitiesRequest{BinaryResults: true})
+	var capabilities protocol.CapabilitiesPayload
+	readResponse(t, ws, &capabilities)
+	if !capabilities.BinaryResults || !capabilities.Capabilities.BinaryResults {
+		t.Fatalf("Expected binary results to be switched on, got %+v", capabilities)
+	}
+
+	sendMessage(t, ws, "q1", protocol.TypeQuery, protocol.QueryPayload{SQL: "SELECT id, score FROM scores"})
+	if err := ws.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("Failed to set read deadline: %v", err)
+	}
+	messageType, message, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatalf("Failed to read result: %v", err)
+	}
+	id, data, found := bytes.Cut(message, []byte("\n"))
+	if messageType != websocket.BinaryMessage || !found || string(id) != "q1" {
+		t.Fatalf("Expected a binary result framed with q1, got %q", message)
+	}
+	result, err := protocol.DecodeBinaryResult(data)
+	if err != nil {
+		t.Fatalf("Failed to decode binary result: %v", err)
+	}
+	if result.RowCount != 2 || result.Command != "SELECT" || result.Rows[0]["id"] != int64(1) || result.Rows[1]["score"] != nil {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+
+	// Errors stay JSON
+	sendMessage(t, ws, "q2", protocol.TypeQuery, protocol.QueryPayload{SQL: ""})
+	var errorPayload protocol.ErrorPayload
+	if response := readResponse(t, ws, &errorPayload); response.Type != protocol.TypeError {
+		t.Errorf("Expected a JSON error, got %s", response.Type)
+	}
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// Conn is the write side of a WebSocket connection and is safe for concurrent use
+// gorilla/websocket allows only one writer at a time, so everything sent to a client,
+// from query results to notifications and pings, must go through a Conn
+type Conn struct {
+	ws        *websocket.Conn
+	mu        sync.Mutex
+	writeWait time.Duration // how long one message may take to send before the connection is closed
+}
+
+// NewConn wraps an upgraded WebSocket connection
+func NewConn(ws *websocket.Conn) *Conn {
+	return &Conn{ws: ws, writeWait: defaultWriteWait}
+}
+
+// WriteMessage sends a server message as a JSON text message
+func (c *Conn) WriteMessage(msg protocol.ServerMessage) error {
+	// Marshal before taking the lock so a large result doesn't hold up other writers
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	return c.write(websocket.TextMessage, data)
+}
+
+// WriteBinary sends a binary message
+func (c *Conn) WriteBinary(data []byte) error {
+	return c.write(websocket.BinaryMessage, data)
+}
+
+// write sends one data message, giving up after writeWait
+// A client that stops reading would otherwise hold the lock forever and stall every writer
+// behind it. A failed write leaves the connection unusable, so it is closed, which ends the
+// read loop and releases the session's queries, transaction and listener
+func (c *Conn) write(messageType int, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.ws.SetWriteDeadline(time.Now().Add(c.writeWait)); err != nil {
+		_ = c.ws.Close()
+		return err
+	}
+	if err := c.ws.WriteMessage(messageType, data); err != nil {
+		_ = c.ws.Close()
+		return err
+	}
+	return nil
+}
+
+// WriteControl sends a ping, pong or close frame, giving up after defaultWriteWait
+// gorilla/websocket lets control frames be written alongside other writes, so this doesn't
+// wait for a large message to finish
+func (c *Conn) WriteControl(messageType int, data []byte) error {
+	return c.ws.WriteControl(messageType, data, time.Now().Add(defaultWriteWait))
+}
+
+// Close closes the underlying connection without sending a close frame
+func (c *Conn) Close() error {
+	return c.ws.Close()
+}
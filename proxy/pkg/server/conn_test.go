@@ -0,0 +1,162 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/protocol"
+	"github.com/gorilla/websocket"
+)
+
+func TestConn_ConcurrentWrites(t *testing.T) {
+	const writers, perWriter = 20, 50
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{}
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Failed to upgrade: %v", err)
+			return
+		}
+		conn := NewConn(ws)
+
+		var wg sync.WaitGroup
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < perWriter; j++ {
+					id := fmt.Sprintf("%d-%d", i, j)
+					var err error
+					switch j % 3 {
+					case 0:
+						err = conn.WriteMessage(protocol.NewPong(id))
+					case 1:
+						err = conn.WriteBinary([]byte(id))
+					default:
+						err = conn.WriteControl(websocket.PingMessage, []byte(id))
+					}
+					if err != nil {
+						t.Errorf("Write %s failed: %v", id, err)
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+		if err := conn.WriteMessage(protocol.NewPong("done")); err != nil {
+			t.Errorf("Final write failed: %v", err)
+		}
+
+		// Let the client read everything before the handler returns and the connection closes
+		_, _, _ = ws.ReadMessage()
+	}))
+	defer testServer.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(testServer.URL, "http")
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer func() {
+		if err := ws.Close(); err != nil {
+			t.Logf("Error closing websocket: %v", err)
+		}
+	}()
+
+	pings := 0
+	ws.SetPingHandler(func(string) error {
+		pings++
+		return nil
+	})
+	if err := ws.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("Failed to set read deadline: %v", err)
+	}
+
+	// Every message must arrive intact; interleaved frames would fail to parse or decode
+	seen := make(map[string]bool)
+	for !seen["done"] {
+		messageType, data, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatalf("Failed to read message %d: %v", len(seen)+1, err)
+		}
+		id := string(data)
+		if messageType == websocket.TextMessage {
+			response := decodeServerMessage(t, data, nil)
+			if response.Type != protocol.TypePong {
+				t.Fatalf("Expected pong, got %s", response.Type)
+			}
+			id = response.ID
+		}
+		if seen[id] {
+			t.Fatalf("Message %s received twice", id)
+		}
+		seen[id] = true
+	}
+	if want := writers*(perWriter-perWriter/3) + 1; len(seen) != want {
+		t.Errorf("Expected %d messages, got %d", want, len(seen))
+	}
+	if pings != writers*(perWriter/3) {
+		t.Errorf("Expected %d pings, got %d", writers*(perWriter/3), pings)
+	}
+}
+
+func TestConn_WriteTimeoutClosesConnection(t *testing.T) {
+	result := make(chan error, 1)
+	closed := make(chan error, 1)
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{}
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Failed to upgrade: %v", err)
+			return
+		}
+		conn := NewConn(ws)
+		conn.writeWait = 50 * time.Millisecond
+
+		// The client never reads, so the socket buffers fill and a write eventually times out
+		chunk := make([]byte, 1<<20)
+		for {
+			if err := conn.WriteBinary(chunk); err != nil {
+				result <- err
+				break
+			}
+		}
+		_, _, err = ws.ReadMessage()
+		closed <- err
+	}))
+	defer testServer.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(testServer.URL, "http")
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer func() {
+		_ = ws.Close()
+	}()
+
+	select {
+	case err := <-result:
+		var netErr interface{ Timeout() bool }
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			t.Errorf("Expected a write timeout, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Write to a client that stopped reading never gave up")
+	}
+
+	select {
+	case err := <-closed:
+		if err == nil {
+			t.Error("Expected reads to fail once the write timed out")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Connection was not closed after the write timed out")
+	}
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/protocol"
+)
+
+// DefaultDatabase is the name of the database passed to NewServer
+// Connections and queries that don't pick a database use it
+const DefaultDatabase = "default"
+
+// databasePathPrefix selects a connection's database, as in /db/analytics
+const databasePathPrefix = "/db/"
+
+// databaseNamePattern restricts names to what fits in a URL path segment without escaping
+var databaseNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// ValidateDatabaseName checks that a name can be used to select a database
+func ValidateDatabaseName(name string) error {
+	if !databaseNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid database name %q: use letters, digits, underscores and hyphens", name)
+	}
+	return nil
+}
+
+// AddDatabase makes another database available under name
+// Clients select it with a database field in their payloads or by connecting to /db/<name>.
+// Call it before the server starts handling requests
+func (s *Server) AddDatabase(name string, client PostgresClient) error {
+	if err := ValidateDatabaseName(name); err != nil {
+		return err
+	}
+	if _, exists := s.databases[name]; exists {
+		return fmt.Errorf("database %q is already registered", name)
+	}
+	s.databases[name] = client
+	return nil
+}
+
+// clientFor returns the database a request runs on
+// An empty name means the connection's database, or the default one without a connection
+func (s *Server) clientFor(sess *session, name string) (PostgresClient, bool) {
+	if name == "" {
+		if sess != nil && sess.db != nil {
+			return sess.db, true
+		}
+		return s.pgClient, true
+	}
+	client, ok := s.databases[name]
+	return client, ok
+}
+
+// databaseFromPath returns the database name selected by a connection's URL path, if any
+func databaseFromPath(path string) string {
+	name, ok := strings.CutPrefix(path, databasePathPrefix)
+	if !ok {
+		return ""
+	}
+	return strings.TrimSuffix(name, "/")
+}
+
+// databaseNames lists the registered databases in order
+func (s *Server) databaseNames() []string {
+	names := make([]string, 0, len(s.databases))
+	for name := range s.databases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// unknownDatabase reports a reference to a database that isn't registered
+func (s *Server) unknownDatabase(id, name string) protocol.ServerMessage {
+	return protocol.NewErrorWithHint(id, "UNKNOWN_DATABASE", fmt.Sprintf("Unknown database: %s", name),
+		"Available databases: "+strings.Join(s.databaseNames(), ", "))
+}
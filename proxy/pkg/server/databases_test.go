@@ -0,0 +1,210 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/auth"
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/postgres"
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/protocol"
+	"github.com/gorilla/websocket"
+)
+
+func TestAddDatabase(t *testing.T) {
+	server := NewServer("unused", &MockPostgresClient{}, DefaultOptions())
+
+	if err := server.AddDatabase("analytics", &MockPostgresClient{}); err != nil {
+		t.Fatalf("Expected analytics to be added, got %v", err)
+	}
+	for _, name := range []string{"analytics", DefaultDatabase, "", "my db", "a/b"} {
+		if err := server.AddDatabase(name, &MockPostgresClient{}); err == nil {
+			t.Errorf("Expected AddDatabase(%q) to fail", name)
+		}
+	}
+}
+
+func TestDatabaseFromPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "/", want: ""},
+		{path: "", want: ""},
+		{path: "/db/analytics", want: "analytics"},
+		{path: "/db/analytics/", want: "analytics"},
+		{path: "/other", want: ""},
+	}
+
+	for _, tt := range tests {
+		if got := databaseFromPath(tt.path); got != tt.want {
+			t.Errorf("databaseFromPath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+// namedResultClient returns a mock whose queries report which database ran them in the column name
+func namedResultClient(name string) *MockPostgresClient {
+	return &MockPostgresClient{
+		ExecuteQueryFunc: func(ctx context.Context, sql string, params []interface{}) (*postgres.QueryResult, error) {
+			return &postgres.QueryResult{Columns: []protocol.ColumnInfo{{Name: name}}}, nil
+		},
+		IntrospectSchemaFunc: func(ctx context.Context, schemas []string) (*protocol.SchemaPayload, error) {
+			return &protocol.SchemaPayload{Tables: []protocol.TableInfo{{Name: name}}}, nil
+		},
+	}
+}
+
+func TestHandleQuery_Database(t *testing.T) {
+	server := NewServer("unused", namedResultClient("main"), DefaultOptions())
+	if err := server.AddDatabase("analytics", namedResultClient("analytics")); err != nil {
+		t.Fatalf("AddDatabase failed: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		database   string
+		wantColumn string
+		wantCode   string
+	}{
+		{name: "default database", wantColumn: "main"},
+		{name: "default by name", database: DefaultDatabase, wantColumn: "main"},
+		{name: "named database", database: "analytics", wantColumn: "analytics"},
+		{name: "unknown database", database: "missing", wantCode: "UNKNOWN_DATABASE"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := server.runQuery(context.Background(), nil, nil, "q", protocol.QueryPayload{SQL: "SELECT 1", Database: tt.database})
+			if tt.wantCode != "" {
+				errorPayload, ok := response.Payload.(protocol.ErrorPayload)
+				if !ok || errorPayload.Code != tt.wantCode {
+					t.Fatalf("Expected %s error, got %+v", tt.wantCode, response)
+				}
+				if !strings.Contains(errorPayload.Hint, "analytics, default") {
+					t.Errorf("Expected the hint to list the databases, got %q", errorPayload.Hint)
+				}
+				return
+			}
+			result, ok := response.Payload.(protocol.ResultPayload)
+			if !ok {
+				t.Fatalf("Expected a result, got %+v", response)
+			}
+			if result.Columns[0].Name != tt.wantColumn {
+				t.Errorf("Expected the query to run on %s, got %s", tt.wantColumn, result.Columns[0].Name)
+			}
+		})
+	}
+}
+
+func TestHandleQuery_DatabaseInTransaction(t *testing.T) {
+	server := NewServer("unused", namedResultClient("main"), DefaultOptions())
+	if err := server.AddDatabase("analytics", namedResultClient("analytics")); err != nil {
+		t.Fatalf("AddDatabase failed: %v", err)
+	}
+	sess := newSession(nil)
+	tx := &MockTransaction{}
+
+	response := server.runQuery(context.Background(), sess, tx, "q", protocol.QueryPayload{SQL: "SELECT 1", Database: "analytics"})
+	if errorPayload, ok := response.Payload.(protocol.ErrorPayload); !ok || errorPayload.Code != "INVALID_PAYLOAD" {
+		t.Errorf("Expected INVALID_PAYLOAD for another database inside a transaction, got %+v", response)
+	}
+
+	response = server.runQuery(context.Background(), sess, tx, "q", protocol.QueryPayload{SQL: "SELECT 1", Database: DefaultDatabase})
+	if response.Type != protocol.TypeResult {
+		t.Errorf("Expected the connection's own database to be allowed, got %+v", response)
+	}
+}
+
+func TestHandleQuery_StatementOnOtherDatabase(t *testing.T) {
+	server := NewServer("unused", namedResultClient("main"), DefaultOptions())
+	if err := server.AddDatabase("analytics", namedResultClient("analytics")); err != nil {
+		t.Fatalf("AddDatabase failed: %v", err)
+	}
+	sess := newSession(nil)
+	if _, err := sess.prepare(context.Background(), "s", "SELECT 1", func() (postgres.StatementConn, error) {
+		return &MockStatementConn{client: namedResultClient("main")}, nil
+	}); err != nil {
+		t.Fatalf("prepare failed: %v", err)
+	}
+
+	response := server.runQuery(context.Background(), sess, nil, "q", protocol.QueryPayload{StatementName: "s", Database: "analytics"})
+	if errorPayload, ok := response.Payload.(protocol.ErrorPayload); !ok || errorPayload.Code != "INVALID_PAYLOAD" {
+		t.Errorf("Expected INVALID_PAYLOAD for a statement run on another database, got %+v", response)
+	}
+
+	response = server.runQuery(context.Background(), sess, nil, "q", protocol.QueryPayload{StatementName: "s", Database: DefaultDatabase})
+	if response.Type != protocol.TypeResult {
+		t.Errorf("Expected the connection's own database to be allowed, got %+v", response)
+	}
+}
+
+func TestHandleIntrospect_Database(t *testing.T) {
+	server := NewServer("unused", namedResultClient("main"), DefaultOptions())
+	if err := server.AddDatabase("analytics", namedResultClient("analytics")); err != nil {
+		t.Fatalf("AddDatabase failed: %v", err)
+	}
+
+	response := server.handleIntrospect(context.Background(), nil, protocol.ClientMessage{ID: "i", Type: protocol.TypeIntrospect, Payload: protocol.IntrospectPayload{Database: "analytics"}})
+	schema, ok := response.Payload.(protocol.SchemaPayload)
+	if !ok || schema.Tables[0].Name != "analytics" {
+		t.Errorf("Expected the analytics schema, got %+v", response)
+	}
+
+	response = server.handleIntrospect(context.Background(), nil, protocol.ClientMessage{ID: "i", Type: protocol.TypeIntrospect, Payload: protocol.IntrospectPayload{Database: "missing"}})
+	if errorPayload, ok := response.Payload.(protocol.ErrorPayload); !ok || errorPayload.Code != "UNKNOWN_DATABASE" {
+		t.Errorf("Expected UNKNOWN_DATABASE, got %+v", response)
+	}
+}
+
+func TestHandleConnection_DatabasePath(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	server := NewServer(secret, namedResultClient("main"), DefaultOptions())
+	if err := server.AddDatabase("analytics", namedResultClient("analytics")); err != nil {
+		t.Fatalf("AddDatabase failed: %v", err)
+	}
+	testServer := httptest.NewServer(http.HandlerFunc(server.HandleConnection))
+	defer testServer.Close()
+	baseURL := "ws" + strings.TrimPrefix(testServer.URL, "http")
+
+	ws, _, err := websocket.DefaultDialer.Dial(baseURL+"/db/analytics?secret="+secret, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer func() {
+		if err := ws.Close(); err != nil {
+			t.Logf("Error closing websocket: %v", err)
+		}
+	}()
+
+	if hello := readHello(t, ws); hello.Database != "analytics" {
+		t.Errorf("Expected the hello to name analytics, got %q", hello.Database)
+	}
+
+	sendMessage(t, ws, "q", protocol.TypeQuery, protocol.QueryPayload{SQL: "SELECT 1"})
+	var result protocol.ResultPayload
+	readResponse(t, ws, &result)
+	if len(result.Columns) != 1 || result.Columns[0].Name != "analytics" {
+		t.Errorf("Expected the query to run on analytics, got %+v", result.Columns)
+	}
+
+	// A database field still overrides the connection's database
+	sendMessage(t, ws, "q2", protocol.TypeQuery, protocol.QueryPayload{SQL: "SELECT 1", Database: DefaultDatabase})
+	readResponse(t, ws, &result)
+	if len(result.Columns) != 1 || result.Columns[0].Name != "main" {
+		t.Errorf("Expected the query to run on the default database, got %+v", result.Columns)
+	}
+
+	_, resp, err := websocket.DefaultDialer.Dial(baseURL+"/db/missing?secret="+secret, nil)
+	if err == nil {
+		t.Fatal("Expected connecting to an unknown database to fail")
+	}
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status %d, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
@@ -0,0 +1,230 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/export"
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/postgres"
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/protocol"
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/sqlutil"
+)
+
+// handleExport runs a query and sends its results to the client as a file
+// The file is streamed in binary messages, each holding the export's ID and a newline followed
+// by the next piece of the file, so exports aren't limited by the buffered row cap. The returned
+// message ends the export: export_complete, or an error if the query failed part-way.
+// If tx is not nil the query runs inside that transaction
+func (s *Server) handleExport(ctx context.Context, sess *session, tx postgres.Transaction, msg protocol.ClientMessage) (response protocol.ServerMessage) {
+	var payload protocol.ExportPayload
+	defer func(start time.Time) {
+		s.metrics.observeQuery(response, time.Since(start))
+		s.logQuery(msg.ID, payload.SQL, len(payload.Params), response, time.Since(start))
+	}(time.Now())
+
+	payloadBytes, err := json.Marshal(msg.Payload)
+	if err != nil {
+		return protocol.NewError(msg.ID, "INVALID_PAYLOAD", "Failed to parse payload", err.Error())
+	}
+
+	if err := json.Unmarshal(payloadBytes, &payload); err != nil {
+		return protocol.NewError(msg.ID, "INVALID_PAYLOAD", "Failed to unmarshal export payload", err.Error())
+	}
+
+	if payload.SQL == "" {
+		return protocol.NewError(msg.ID, "EMPTY_QUERY", "SQL query cannot be empty", "")
+	}
+	if payload.Format == "" {
+		payload.Format = protocol.ExportFormatCSV
+	}
+	if payload.Format != protocol.ExportFormatCSV {
+		return protocol.NewError(msg.ID, "UNSUPPORTED_FORMAT", fmt.Sprintf("Unsupported export format: %s", payload.Format), "")
+	}
+	// The ID frames every binary message, so it can't contain the separator
+	if strings.Contains(msg.ID, "\n") {
+		return protocol.NewError(msg.ID, "INVALID_PAYLOAD", "Export IDs cannot contain newlines", "")
+	}
+
+	if s.opts.ReadOnly && sqlutil.IsMutating(payload.SQL) {
+		return protocol.NewErrorWithHint(msg.ID, "READ_ONLY_VIOLATION",
+			fmt.Sprintf("%s statements are not allowed in read-only mode", sqlutil.FirstKeyword(payload.SQL)), readOnlyHint)
+	}
+
+	if timeout := s.queryTimeout(payload.Timeout); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	db, ok := s.clientFor(sess, payload.Database)
+	if !ok {
+		return s.unknownDatabase(msg.ID, payload.Database)
+	}
+	if current, _ := s.clientFor(sess, ""); tx != nil && db != current {
+		return protocol.NewError(msg.ID, "INVALID_PAYLOAD", "Exports in a transaction must run on the connection's database", "")
+	}
+
+	var exec queryExecutor = db
+	if tx != nil {
+		exec = tx
+	}
+
+	var buf bytes.Buffer
+	w := export.NewCSVWriter(&buf)
+	var sent int64
+	headerWritten := false
+
+	// flush sends whatever has been written since the last call
+	flush := func() error {
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		if buf.Len() == 0 {
+			return nil
+		}
+		if err := sess.sendBinary(msg.ID, buf.Bytes()); err != nil {
+			return fmt.Errorf("failed to send export data: %w", err)
+		}
+		sent += int64(buf.Len())
+		buf.Reset()
+		return nil
+	}
+
+	batchSize := s.opts.StreamBatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultStreamBatchSize
+	}
+	result, err := exec.StreamQuery(ctx, payload.SQL, payload.Params, batchSize,
+		func(columns []protocol.ColumnInfo, rows []map[string]interface{}) error {
+			if !headerWritten {
+				if err := w.WriteHeader(columns); err != nil {
+					return err
+				}
+				headerWritten = true
+			}
+			if err := w.WriteRows(columns, rows); err != nil {
+				return err
+			}
+			return flush()
+		})
+	if err != nil {
+		return queryError(msg.ID, err)
+	}
+
+	// Empty results never reach the callback but still get a header
+	if !headerWritten && len(result.Columns) > 0 {
+		if err := w.WriteHeader(result.Columns); err != nil {
+			return protocol.NewError(msg.ID, "EXPORT_ERROR", "Failed to write export", err.Error())
+		}
+		if err := flush(); err != nil {
+			return protocol.NewError(msg.ID, "EXPORT_ERROR", "Failed to write export", err.Error())
+		}
+	}
+
+	return protocol.NewExportComplete(msg.ID, payload.Format, result.RowCount, sent, result.ExecutionTime)
+}
+
+// copyChunkSize is how much COPY data is gathered before it's sent in a binary message
+// Postgres sends a message per row, which would make for far too many WebSocket frames
+const copyChunkSize = 64 * 1024
+
+// errCopyTooLarge stops a COPY once it has produced more than Options.MaxCopyBytes
+var errCopyTooLarge = errors.New("copy output exceeded the size limit")
+
+// handleCopyOut runs a query with COPY and sends the CSV Postgres writes to the client
+// It's framed like an export, in binary messages followed by export_complete, but skips
+// decoding every row, so it's much faster for large tables. Output is capped at
+// Options.MaxCopyBytes; past that the copy is stopped and an error ends it
+func (s *Server) handleCopyOut(ctx context.Context, sess *session, tx postgres.Transaction, msg protocol.ClientMessage) (response protocol.ServerMessage) {
+	var payload protocol.CopyOutPayload
+	defer func(start time.Time) {
+		s.metrics.observeQuery(response, time.Since(start))
+		s.logQuery(msg.ID, payload.SQL, 0, response, time.Since(start))
+	}(time.Now())
+
+	if err := decodePayload(msg.Payload, &payload); err != nil {
+		return protocol.NewError(msg.ID, "INVALID_PAYLOAD", "Failed to parse copy_out payload", err.Error())
+	}
+
+	if payload.SQL == "" {
+		return protocol.NewError(msg.ID, "EMPTY_QUERY", "SQL query cannot be empty", "")
+	}
+	// The ID frames every binary message, so it can't contain the separator
+	if strings.Contains(msg.ID, "\n") {
+		return protocol.NewError(msg.ID, "INVALID_PAYLOAD", "Export IDs cannot contain newlines", "")
+	}
+	if len(sqlutil.SplitStatements(payload.SQL)) != 1 || !sqlutil.IsSelect(payload.SQL) {
+		return protocol.NewError(msg.ID, "INVALID_PAYLOAD", "copy_out takes a single SELECT, WITH, VALUES or TABLE query", "")
+	}
+	if tx != nil {
+		return protocol.NewErrorWithHint(msg.ID, "INVALID_PAYLOAD", "copy_out cannot run inside a transaction",
+			"Send an export message instead, which runs in the open transaction")
+	}
+
+	db, ok := s.clientFor(sess, payload.Database)
+	if !ok {
+		return s.unknownDatabase(msg.ID, payload.Database)
+	}
+
+	if timeout := s.queryTimeout(payload.Timeout); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	w := &copyWriter{sess: sess, id: msg.ID, limit: s.opts.MaxCopyBytes}
+	result, err := db.CopyOut(ctx, sqlutil.CopyToCSV(payload.SQL), w)
+	if errors.Is(err, errCopyTooLarge) {
+		return protocol.NewErrorWithHint(msg.ID, "EXPORT_TOO_LARGE",
+			fmt.Sprintf("The copy produced more than %d bytes and was stopped", s.opts.MaxCopyBytes),
+			"Select fewer rows or columns, or restart the proxy with a larger --max-copy-bytes")
+	}
+	if err == nil {
+		err = w.flush()
+	}
+	if err != nil {
+		return queryError(msg.ID, err)
+	}
+
+	return protocol.NewExportComplete(msg.ID, protocol.ExportFormatCSV, int(result.RowCount), w.sent, result.ExecutionTime)
+}
+
+// copyWriter gathers COPY output into binary messages of about copyChunkSize
+type copyWriter struct {
+	sess  *session
+	id    string
+	buf   []byte
+	sent  int64
+	limit int64 // bytes allowed in total; zero means no limit
+}
+
+func (w *copyWriter) Write(p []byte) (int, error) {
+	if w.limit > 0 && w.sent+int64(len(w.buf)+len(p)) > w.limit {
+		return 0, errCopyTooLarge
+	}
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= copyChunkSize {
+		if err := w.flush(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// flush sends whatever has been written since the last call
+func (w *copyWriter) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	if err := w.sess.sendBinary(w.id, w.buf); err != nil {
+		return fmt.Errorf("failed to send export data: %w", err)
+	}
+	w.sent += int64(len(w.buf))
+	w.buf = w.buf[:0]
+	return nil
+}
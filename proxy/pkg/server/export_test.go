@@ -0,0 +1,265 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/auth"
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/postgres"
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/protocol"
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/sqlutil"
+	"github.com/gorilla/websocket"
+)
+
+// readExport reads binary export messages for id until the closing JSON message arrives
+// It returns the reassembled file and the closing message
+func readExport(t *testing.T, ws *websocket.Conn, id string, v interface{}) ([]byte, protocol.ServerMessage) {
+	t.Helper()
+
+	var data []byte
+	for {
+		if err := ws.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			t.Fatalf("Failed to set read deadline: %v", err)
+		}
+		messageType, message, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatalf("Failed to read message: %v", err)
+		}
+		if messageType == websocket.TextMessage {
+			response := decodeServerMessage(t, message, v)
+			return data, response
+		}
+
+		prefix, chunk, found := bytes.Cut(message, []byte("\n"))
+		if !found || string(prefix) != id {
+			t.Fatalf("Expected binary message framed with ID %s, got %q", id, message)
+		}
+		data = append(data, chunk...)
+	}
+}
+
+func TestHandleConnection_ExportCSV(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	mockClient := &MockPostgresClient{StreamQueryFunc: streamRows(5, 0)}
+	opts := DefaultOptions()
+	opts.StreamBatchSize = 2
+	ws := dialTestServer(t, NewServer(secret, mockClient, opts))
+
+	sendMessage(t, ws, "export-1", protocol.TypeExport, protocol.ExportPayload{SQL: "SELECT n FROM numbers", Format: protocol.ExportFormatCSV})
+
+	var payload protocol.ExportCompletePayload
+	data, response := readExport(t, ws, "export-1", &payload)
+
+	if response.Type != protocol.TypeExportComplete || response.ID != "export-1" {
+		t.Fatalf("Expected export_complete for export-1, got %s %s", response.Type, response.ID)
+	}
+	want := "n\n0\n1\n2\n3\n4\n"
+	if string(data) != want {
+		t.Errorf("CSV mismatch:\ngot:  %q\nwant: %q", data, want)
+	}
+	if payload.RowCount != 5 || payload.Bytes != int64(len(want)) || payload.Format != protocol.ExportFormatCSV {
+		t.Errorf("Unexpected export summary: %+v", payload)
+	}
+}
+
+func TestHandleConnection_ExportEmptyResult(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	mockClient := &MockPostgresClient{
+		StreamQueryFunc: func(ctx context.Context, sql string, params []interface{}, batchSize int, fn postgres.RowBatchFunc) (*postgres.QueryResult, error) {
+			return &postgres.QueryResult{Columns: []protocol.ColumnInfo{{Name: "id"}, {Name: "name"}}}, nil
+		},
+	}
+	ws := dialTestServer(t, NewServer(secret, mockClient, DefaultOptions()))
+
+	// The format defaults to CSV
+	sendMessage(t, ws, "export-1", protocol.TypeExport, protocol.ExportPayload{SQL: "SELECT id, name FROM users WHERE false"})
+
+	data, response := readExport(t, ws, "export-1", nil)
+	if response.Type != protocol.TypeExportComplete {
+		t.Fatalf("Expected export_complete, got %s", response.Type)
+	}
+	if string(data) != "id,name\n" {
+		t.Errorf("Expected only a header row, got %q", data)
+	}
+}
+
+func TestHandleConnection_ExportErrors(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	mockClient := &MockPostgresClient{StreamQueryFunc: streamRows(10, 3)}
+	opts := DefaultOptions()
+	opts.ReadOnly = true
+	ws := dialTestServer(t, NewServer(secret, mockClient, opts))
+
+	tests := []struct {
+		name     string
+		id       string
+		payload  protocol.ExportPayload
+		wantCode string
+	}{
+		{
+			name:     "empty SQL",
+			id:       "export-1",
+			payload:  protocol.ExportPayload{},
+			wantCode: "EMPTY_QUERY",
+		},
+		{
+			name:     "unsupported format",
+			id:       "export-2",
+			payload:  protocol.ExportPayload{SQL: "SELECT 1", Format: "xlsx"},
+			wantCode: "UNSUPPORTED_FORMAT",
+		},
+		{
+			name:     "newline in ID",
+			id:       "export\n3",
+			payload:  protocol.ExportPayload{SQL: "SELECT 1"},
+			wantCode: "INVALID_PAYLOAD",
+		},
+		{
+			name:     "write in read-only mode",
+			id:       "export-4",
+			payload:  protocol.ExportPayload{SQL: "DELETE FROM users"},
+			wantCode: "READ_ONLY_VIOLATION",
+		},
+		{
+			name:     "failure part-way",
+			id:       "export-5",
+			payload:  protocol.ExportPayload{SQL: "SELECT n FROM numbers"},
+			wantCode: "QUERY_ERROR",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sendMessage(t, ws, tt.id, protocol.TypeExport, tt.payload)
+
+			var errorPayload protocol.ErrorPayload
+			_, response := readExport(t, ws, tt.id, &errorPayload)
+			if response.Type != protocol.TypeError || errorPayload.Code != tt.wantCode {
+				t.Errorf("Expected %s error, got %s %+v", tt.wantCode, response.Type, errorPayload)
+			}
+		})
+	}
+}
+
+// copyRows returns a CopyOut mock that writes a header and n rows, one Write per row as Postgres sends them
+func copyRows(n int) func(ctx context.Context, sql string, w io.Writer) (*postgres.CopyResult, error) {
+	return func(ctx context.Context, sql string, w io.Writer) (*postgres.CopyResult, error) {
+		if _, err := io.WriteString(w, "n\n"); err != nil {
+			return nil, err
+		}
+		for i := 0; i < n; i++ {
+			if _, err := fmt.Fprintf(w, "%d\n", i); err != nil {
+				return nil, err
+			}
+		}
+		return &postgres.CopyResult{RowCount: int64(n)}, nil
+	}
+}
+
+func TestHandleConnection_CopyOut(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	const rows = 20000 // enough output for several binary messages
+	var gotSQL string
+	copyOut := copyRows(rows)
+	mockClient := &MockPostgresClient{
+		CopyOutFunc: func(ctx context.Context, sql string, w io.Writer) (*postgres.CopyResult, error) {
+			gotSQL = sql
+			return copyOut(ctx, sql, w)
+		},
+	}
+	ws := dialTestServer(t, NewServer(secret, mockClient, DefaultOptions()))
+
+	sendMessage(t, ws, "copy-1", protocol.TypeCopyOut, protocol.CopyOutPayload{SQL: "SELECT n FROM numbers;"})
+
+	var payload protocol.ExportCompletePayload
+	data, response := readExport(t, ws, "copy-1", &payload)
+
+	if response.Type != protocol.TypeExportComplete || response.ID != "copy-1" {
+		t.Fatalf("Expected export_complete for copy-1, got %s %s", response.Type, response.ID)
+	}
+	if want := sqlutil.CopyToCSV("SELECT n FROM numbers"); gotSQL != want {
+		t.Errorf("SQL = %q, want %q", gotSQL, want)
+	}
+	var want strings.Builder
+	_, _ = copyRows(rows)(context.Background(), "", &want)
+	if string(data) != want.String() {
+		t.Errorf("Expected %d bytes of CSV, got %d", want.Len(), len(data))
+	}
+	if payload.RowCount != rows || payload.Bytes != int64(want.Len()) || payload.Format != protocol.ExportFormatCSV {
+		t.Errorf("Unexpected export summary: %+v", payload)
+	}
+}
+
+func TestHandleConnection_CopyOutErrors(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	mockClient := &MockPostgresClient{
+		CopyOutFunc: func(ctx context.Context, sql string, w io.Writer) (*postgres.CopyResult, error) {
+			if strings.Contains(sql, "missing") {
+				return nil, &postgres.DatabaseError{Code: "42P01", Message: `relation "missing" does not exist`}
+			}
+			return copyRows(100)(ctx, sql, w)
+		},
+	}
+	opts := DefaultOptions()
+	opts.MaxCopyBytes = 50
+	ws := dialTestServer(t, NewServer(secret, mockClient, opts))
+
+	tests := []struct {
+		name     string
+		id       string
+		payload  protocol.CopyOutPayload
+		wantCode string
+	}{
+		{name: "empty SQL", id: "copy-1", payload: protocol.CopyOutPayload{}, wantCode: "EMPTY_QUERY"},
+		{name: "newline in ID", id: "copy\n2", payload: protocol.CopyOutPayload{SQL: "SELECT 1"}, wantCode: "INVALID_PAYLOAD"},
+		{name: "not a query", id: "copy-3", payload: protocol.CopyOutPayload{SQL: "DELETE FROM users"}, wantCode: "INVALID_PAYLOAD"},
+		{name: "several statements", id: "copy-4", payload: protocol.CopyOutPayload{SQL: "SELECT 1; SELECT 2"}, wantCode: "INVALID_PAYLOAD"},
+		{name: "unknown database", id: "copy-5", payload: protocol.CopyOutPayload{SQL: "SELECT 1", Database: "other"}, wantCode: "UNKNOWN_DATABASE"},
+		{name: "database error", id: "copy-6", payload: protocol.CopyOutPayload{SQL: "SELECT * FROM missing"}, wantCode: "42P01"},
+		{name: "over the size limit", id: "copy-7", payload: protocol.CopyOutPayload{SQL: "SELECT n FROM numbers"}, wantCode: "EXPORT_TOO_LARGE"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sendMessage(t, ws, tt.id, protocol.TypeCopyOut, tt.payload)
+
+			var errorPayload protocol.ErrorPayload
+			data, response := readExport(t, ws, tt.id, &errorPayload)
+			if response.Type != protocol.TypeError || errorPayload.Code != tt.wantCode {
+				t.Errorf("Expected %s error, got %s %+v", tt.wantCode, response.Type, errorPayload)
+			}
+			if int64(len(data)) > opts.MaxCopyBytes {
+				t.Errorf("Expected at most %d bytes before the error, got %d", opts.MaxCopyBytes, len(data))
+			}
+		})
+	}
+
+	// COPY runs on its own pool connection, so it can't see an open transaction
+	sendMessage(t, ws, "begin", protocol.TypeBegin, nil)
+	readResponse(t, ws, nil)
+	sendMessage(t, ws, "copy-8", protocol.TypeCopyOut, protocol.CopyOutPayload{SQL: "SELECT 1"})
+	var errorPayload protocol.ErrorPayload
+	if _, response := readExport(t, ws, "copy-8", &errorPayload); response.Type != protocol.TypeError || errorPayload.Code != "INVALID_PAYLOAD" {
+		t.Errorf("Expected INVALID_PAYLOAD inside a transaction, got %s %+v", response.Type, errorPayload)
+	}
+}
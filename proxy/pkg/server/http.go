@@ -0,0 +1,138 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/auth"
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/postgres"
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// maxQueryBodySize bounds the JSON body accepted by the HTTP query endpoint
+const maxQueryBodySize = 1 << 20
+
+// HandleQuery runs a single query sent as a JSON QueryPayload in a POST body
+// It is for clients that don't want a WebSocket, such as scripts and curl. The secret is
+// taken from an "Authorization: Bearer" header or the secret query parameter. The response
+// body is the payload the WebSocket would have sent: a ResultPayload on success, or an
+// ErrorPayload with a non-2xx status. Results are always buffered, never streamed
+func (s *Server) HandleQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSON(w, http.StatusMethodNotAllowed, protocol.ErrorPayload{Code: "METHOD_NOT_ALLOWED", Message: "Use POST to run a query"})
+		return
+	}
+
+	clientSecret := requestSecret(r)
+	if !auth.ValidateSecret(clientSecret) || !auth.CompareSecret(clientSecret, s.secret) {
+		writeJSON(w, http.StatusUnauthorized, protocol.ErrorPayload{Code: "UNAUTHORIZED", Message: "Invalid secret"})
+		return
+	}
+
+	var payload protocol.QueryPayload
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxQueryBodySize)).Decode(&payload); err != nil {
+		writeJSON(w, http.StatusBadRequest, protocol.ErrorPayload{Code: "INVALID_PAYLOAD", Message: "Failed to parse query payload", Detail: err.Error()})
+		return
+	}
+
+	// The query timeout bounds how long this takes, not the server's write timeout
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	// The request context ends if the client disconnects, which cancels the query
+	response := s.runQuery(r.Context(), nil, nil, "", payload)
+	if errorPayload, ok := response.Payload.(protocol.ErrorPayload); ok {
+		writeJSON(w, errorStatus(errorPayload.Code), errorPayload)
+		return
+	}
+	writeJSON(w, http.StatusOK, response.Payload)
+}
+
+// healthResponse is the body of a health check response
+type healthResponse struct {
+	Status string `json:"status"` // "ok", "reconnecting" or "unavailable"
+}
+
+// HandleHealth reports whether the databases are reachable, for liveness and readiness probes
+// It needs no secret and says nothing about the databases beyond whether every ping succeeded
+func (s *Server) HandleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeJSON(w, http.StatusMethodNotAllowed, protocol.ErrorPayload{Code: "METHOD_NOT_ALLOWED", Message: "Use GET for health checks"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), defaultHealthTimeout)
+	defer cancel()
+
+	for _, name := range s.databaseNames() {
+		// Say so while the pool is being replaced, rather than waiting for a ping to time out
+		if s.databases[name].State() == postgres.StateReconnecting {
+			log.Printf("Health check failed for database %s: reconnecting", name)
+			writeJSON(w, http.StatusServiceUnavailable, healthResponse{Status: "reconnecting"})
+			return
+		}
+		if err := s.databases[name].Ping(ctx); err != nil {
+			log.Printf("Health check failed for database %s: %v", name, err)
+			writeJSON(w, http.StatusServiceUnavailable, healthResponse{Status: "unavailable"})
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, healthResponse{Status: "ok"})
+}
+
+// HandleVersion reports which build of the proxy is running
+// Like the health check it needs no secret, so operators can check a deployment from outside
+func (s *Server) HandleVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeJSON(w, http.StatusMethodNotAllowed, protocol.ErrorPayload{Code: "METHOD_NOT_ALLOWED", Message: "Use GET for version information"})
+		return
+	}
+	writeJSON(w, http.StatusOK, s.opts.Build)
+}
+
+// requestSecret returns the secret sent with a request, trying the Authorization header, then a
+// secret.<secret> WebSocket subprotocol, then the secret query parameter. Browsers can't set headers
+// on a WebSocket, so the subprotocol is how they keep the secret out of the URL
+func requestSecret(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	for _, subprotocol := range websocket.Subprotocols(r) {
+		if token, ok := strings.CutPrefix(subprotocol, secretSubprotocolPrefix); ok {
+			return token
+		}
+	}
+	return r.URL.Query().Get("secret")
+}
+
+// errorStatus maps an error code to the HTTP status that best describes it
+func errorStatus(code string) int {
+	switch code {
+	case "READ_ONLY_VIOLATION":
+		return http.StatusForbidden
+	case "QUERY_CANCELED", "QUERY_TIMEOUT":
+		return http.StatusRequestTimeout
+	case "UNKNOWN_DATABASE":
+		return http.StatusNotFound
+	case "CONNECTION_LOST", "SERVER_BUSY":
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// writeJSON writes v as a JSON response body with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write HTTP response: %v", err)
+	}
+}
@@ -0,0 +1,308 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/auth"
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/postgres"
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/protocol"
+)
+
+func TestHandleQuery_HTTP(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	mockClient := &MockPostgresClient{
+		ExecuteQueryFunc: func(ctx context.Context, sql string, params []interface{}) (*postgres.QueryResult, error) {
+			switch sql {
+			case "SELECT * FROM missing":
+				return nil, errors.New(`relation "missing" does not exist`)
+			case "SELECT pg_sleep(60)":
+				return nil, postgres.ErrQueryTimeout
+			case "SELECT pg_cancel_backend(pg_backend_pid())":
+				return nil, postgres.ErrQueryCanceled
+			case "SELECT pg_terminate_backend(pg_backend_pid())":
+				return nil, fmt.Errorf("%w: conn closed", postgres.ErrConnectionLost)
+			case "SELECT 'busy'":
+				return nil, postgres.ErrServerBusy
+			case "SELECT $1, $2":
+				return nil, &postgres.ParameterCountError{Expected: 2, Got: len(params)}
+			}
+			if len(params) != 1 || params[0] != float64(7) {
+				t.Errorf("Expected params [7], got %v", params)
+			}
+			return &postgres.QueryResult{
+				Rows:    []map[string]interface{}{{"id": 7}},
+				Columns: []protocol.ColumnInfo{{Name: "id", DataType: "integer"}},
+			}, nil
+		},
+	}
+	opts := DefaultOptions()
+	opts.ReadOnly = true
+	server := NewServer(secret, mockClient, opts)
+
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		header     string
+		body       string
+		wantStatus int
+		wantCode   string
+	}{
+		{
+			name:       "bearer token",
+			method:     http.MethodPost,
+			target:     "/query",
+			header:     "Bearer " + secret,
+			body:       `{"sql": "SELECT * FROM users WHERE id = $1", "params": [7]}`,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "secret query parameter",
+			method:     http.MethodPost,
+			target:     "/query?secret=" + secret,
+			body:       `{"sql": "SELECT * FROM users WHERE id = $1", "params": [7]}`,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "wrong secret",
+			method:     http.MethodPost,
+			target:     "/query",
+			header:     "Bearer not-the-secret",
+			body:       `{"sql": "SELECT 1"}`,
+			wantStatus: http.StatusUnauthorized,
+			wantCode:   "UNAUTHORIZED",
+		},
+		{
+			name:       "missing secret",
+			method:     http.MethodPost,
+			target:     "/query",
+			body:       `{"sql": "SELECT 1"}`,
+			wantStatus: http.StatusUnauthorized,
+			wantCode:   "UNAUTHORIZED",
+		},
+		{
+			name:       "wrong method",
+			method:     http.MethodGet,
+			target:     "/query?secret=" + secret,
+			wantStatus: http.StatusMethodNotAllowed,
+			wantCode:   "METHOD_NOT_ALLOWED",
+		},
+		{
+			name:       "malformed body",
+			method:     http.MethodPost,
+			target:     "/query?secret=" + secret,
+			body:       `{"sql":`,
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "INVALID_PAYLOAD",
+		},
+		{
+			name:       "empty SQL",
+			method:     http.MethodPost,
+			target:     "/query?secret=" + secret,
+			body:       `{"sql": ""}`,
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "EMPTY_QUERY",
+		},
+		{
+			name:       "read-only violation",
+			method:     http.MethodPost,
+			target:     "/query?secret=" + secret,
+			body:       `{"sql": "DELETE FROM users"}`,
+			wantStatus: http.StatusForbidden,
+			wantCode:   "READ_ONLY_VIOLATION",
+		},
+		{
+			name:       "database error",
+			method:     http.MethodPost,
+			target:     "/query?secret=" + secret,
+			body:       `{"sql": "SELECT * FROM missing"}`,
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "QUERY_ERROR",
+		},
+		{
+			name:       "timed out",
+			method:     http.MethodPost,
+			target:     "/query?secret=" + secret,
+			body:       `{"sql": "SELECT pg_sleep(60)"}`,
+			wantStatus: http.StatusRequestTimeout,
+			wantCode:   "QUERY_TIMEOUT",
+		},
+		{
+			name:       "canceled",
+			method:     http.MethodPost,
+			target:     "/query?secret=" + secret,
+			body:       `{"sql": "SELECT pg_cancel_backend(pg_backend_pid())"}`,
+			wantStatus: http.StatusRequestTimeout,
+			wantCode:   "QUERY_CANCELED",
+		},
+		{
+			name:       "connection lost",
+			method:     http.MethodPost,
+			target:     "/query?secret=" + secret,
+			body:       `{"sql": "SELECT pg_terminate_backend(pg_backend_pid())"}`,
+			wantStatus: http.StatusServiceUnavailable,
+			wantCode:   "CONNECTION_LOST",
+		},
+		{
+			name:       "server busy",
+			method:     http.MethodPost,
+			target:     "/query?secret=" + secret,
+			body:       `{"sql": "SELECT 'busy'"}`,
+			wantStatus: http.StatusServiceUnavailable,
+			wantCode:   "SERVER_BUSY",
+		},
+		{
+			name:       "wrong parameter count",
+			method:     http.MethodPost,
+			target:     "/query?secret=" + secret,
+			body:       `{"sql": "SELECT $1, $2", "params": [7]}`,
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "PARAMETER_MISMATCH",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+
+			server.HandleQuery(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tt.wantStatus, rec.Code, rec.Body.String())
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Expected JSON content type, got %q", ct)
+			}
+
+			if tt.wantCode != "" {
+				var errorPayload protocol.ErrorPayload
+				if err := json.Unmarshal(rec.Body.Bytes(), &errorPayload); err != nil {
+					t.Fatalf("Failed to decode error: %v", err)
+				}
+				if errorPayload.Code != tt.wantCode {
+					t.Errorf("Expected error code %s, got %s", tt.wantCode, errorPayload.Code)
+				}
+				return
+			}
+
+			var result protocol.ResultPayload
+			if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+				t.Fatalf("Failed to decode result: %v", err)
+			}
+			if result.RowCount != 1 || len(result.Columns) != 1 || result.Columns[0].Name != "id" {
+				t.Errorf("Unexpected result: %+v", result)
+			}
+		})
+	}
+}
+
+func TestRequestSecret(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/query?secret=from-query", nil)
+	if got := requestSecret(req); got != "from-query" {
+		t.Errorf("Expected the query parameter secret, got %q", got)
+	}
+
+	req.Header.Set("Sec-WebSocket-Protocol", Subprotocol+", secret.from-subprotocol")
+	if got := requestSecret(req); got != "from-subprotocol" {
+		t.Errorf("Expected the subprotocol to take precedence over the query, got %q", got)
+	}
+
+	req.Header.Set("Authorization", "Bearer from-header")
+	if got := requestSecret(req); got != "from-header" {
+		t.Errorf("Expected the header to take precedence, got %q", got)
+	}
+}
+
+func TestHandleHealth(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		pingErr      error
+		otherPingErr error // from a second database added with AddDatabase
+		state        postgres.ConnectionState
+		wantStatus   int
+		wantBody     string
+	}{
+		{name: "database reachable", method: http.MethodGet, wantStatus: http.StatusOK, wantBody: `{"status":"ok"}`},
+		{name: "database unreachable", method: http.MethodGet, pingErr: errors.New("connection refused"), wantStatus: http.StatusServiceUnavailable, wantBody: `{"status":"unavailable"}`},
+		{name: "other database unreachable", method: http.MethodGet, otherPingErr: errors.New("connection refused"), wantStatus: http.StatusServiceUnavailable, wantBody: `{"status":"unavailable"}`},
+		{name: "reconnecting", method: http.MethodGet, state: postgres.StateReconnecting, wantStatus: http.StatusServiceUnavailable, wantBody: `{"status":"reconnecting"}`},
+		{name: "head request", method: http.MethodHead, wantStatus: http.StatusOK},
+		{name: "wrong method", method: http.MethodPost, wantStatus: http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockClient := &MockPostgresClient{
+				PingFunc: func(ctx context.Context) error {
+					if _, ok := ctx.Deadline(); !ok {
+						t.Error("Expected the ping to have a deadline")
+					}
+					return tt.pingErr
+				},
+				StateFunc: func() postgres.ConnectionState {
+					if tt.state != "" {
+						return tt.state
+					}
+					return postgres.StateConnected
+				},
+			}
+			server := NewServer("unused", mockClient, DefaultOptions())
+			other := &MockPostgresClient{PingFunc: func(ctx context.Context) error { return tt.otherPingErr }}
+			if err := server.AddDatabase("other", other); err != nil {
+				t.Fatalf("AddDatabase failed: %v", err)
+			}
+
+			// No secret is needed
+			rec := httptest.NewRecorder()
+			server.HandleHealth(rec, httptest.NewRequest(tt.method, "/healthz", nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d", tt.wantStatus, rec.Code)
+			}
+			if tt.wantBody != "" && strings.TrimSpace(rec.Body.String()) != tt.wantBody {
+				t.Errorf("Expected body %s, got %s", tt.wantBody, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestHandleVersion(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Build = protocol.BuildInfo{Version: "1.2.3", Commit: "abc123", BuildDate: "2024-01-02T03:04:05Z", GoVersion: "go1.22.0"}
+	server := NewServer("unused", &MockPostgresClient{}, opts)
+
+	// No secret is needed
+	rec := httptest.NewRecorder()
+	server.HandleVersion(rec, httptest.NewRequest(http.MethodGet, "/version", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rec.Code)
+	}
+	var build protocol.BuildInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &build); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if build != opts.Build {
+		t.Errorf("Expected %+v, got %+v", opts.Build, build)
+	}
+
+	rec = httptest.NewRecorder()
+	server.HandleVersion(rec, httptest.NewRequest(http.MethodPost, "/version", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/metrics"
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/postgres"
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/protocol"
+)
+
+// queryDurationBuckets are the histogram bounds for query durations, in seconds
+var queryDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// serverMetrics instruments queries, introspection, and connections
+type serverMetrics struct {
+	registry            metrics.Registry
+	queries             *metrics.Counter
+	queryErrors         *metrics.LabeledCounter
+	queryDuration       *metrics.Histogram
+	introspections      *metrics.Counter
+	introspectionErrors *metrics.Counter
+	connections         *metrics.Gauge
+}
+
+// newServerMetrics creates the server's metrics, including pool gauges read from pgClient
+func newServerMetrics(pgClient PostgresClient) *serverMetrics {
+	m := &serverMetrics{
+		queries:             &metrics.Counter{},
+		queryErrors:         metrics.NewLabeledCounter("code"),
+		queryDuration:       metrics.NewHistogram(queryDurationBuckets),
+		introspections:      &metrics.Counter{},
+		introspectionErrors: &metrics.Counter{},
+		connections:         &metrics.Gauge{},
+	}
+
+	m.registry.Register("postgres_proxy_queries_total", "Queries and exports handled, including ones that failed.", m.queries)
+	m.registry.Register("postgres_proxy_query_errors_total", "Failed queries and exports by error code.", m.queryErrors)
+	m.registry.Register("postgres_proxy_query_duration_seconds", "Time taken to handle a query or export.", m.queryDuration)
+	m.registry.Register("postgres_proxy_introspections_total", "Schema introspection requests handled.", m.introspections)
+	m.registry.Register("postgres_proxy_introspection_errors_total", "Schema introspection requests that failed.", m.introspectionErrors)
+	m.registry.Register("postgres_proxy_websocket_connections", "Open WebSocket connections.", m.connections)
+
+	pool := func(stat func(s postgres.PoolStats) int32) metrics.GaugeFunc {
+		return func() float64 { return float64(stat(pgClient.Stats())) }
+	}
+	m.registry.Register("postgres_proxy_pool_acquired_connections", "Pool connections currently in use.", pool(func(s postgres.PoolStats) int32 { return s.Acquired }))
+	m.registry.Register("postgres_proxy_pool_idle_connections", "Pool connections waiting to be used.", pool(func(s postgres.PoolStats) int32 { return s.Idle }))
+	m.registry.Register("postgres_proxy_pool_total_connections", "Open pool connections.", pool(func(s postgres.PoolStats) int32 { return s.Total }))
+	m.registry.Register("postgres_proxy_pool_max_connections", "Maximum pool connections.", pool(func(s postgres.PoolStats) int32 { return s.Max }))
+	m.registry.Register("postgres_proxy_query_queue_depth", "Queries waiting for a pool connection.", pool(func(s postgres.PoolStats) int32 { return s.Queued }))
+
+	return m
+}
+
+// observeQuery records a handled query or export and how long it took
+func (m *serverMetrics) observeQuery(response protocol.ServerMessage, duration time.Duration) {
+	m.queries.Inc()
+	m.queryDuration.Observe(duration.Seconds())
+	if errorPayload, ok := response.Payload.(protocol.ErrorPayload); ok {
+		m.queryErrors.Inc(errorPayload.Code)
+	}
+}
+
+// observeIntrospection records a handled introspection request
+func (m *serverMetrics) observeIntrospection(response protocol.ServerMessage) {
+	m.introspections.Inc()
+	if response.Type == protocol.TypeError {
+		m.introspectionErrors.Inc()
+	}
+}
+
+// HandleMetrics serves the server's metrics in the Prometheus text format
+// Like the health check it needs no secret; it exposes counts and timings, never SQL or data
+func (s *Server) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := s.metrics.registry.Write(w); err != nil {
+		log.Printf("Failed to write metrics: %v", err)
+	}
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/auth"
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/postgres"
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/protocol"
+)
+
+func TestHandleMetrics(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	mockClient := &MockPostgresClient{
+		ExecuteQueryFunc: func(ctx context.Context, sql string, params []interface{}) (*postgres.QueryResult, error) {
+			if sql == "SELECT * FROM missing" {
+				return nil, errors.New(`relation "missing" does not exist`)
+			}
+			return &postgres.QueryResult{}, nil
+		},
+		IntrospectSchemaFunc: func(ctx context.Context, schemas []string) (*protocol.SchemaPayload, error) {
+			return nil, errors.New("permission denied")
+		},
+		StatsFunc: func() postgres.PoolStats {
+			return postgres.PoolStats{Total: 3, Idle: 1, Acquired: 2, Max: 5}
+		},
+	}
+	server := NewServer(secret, mockClient, DefaultOptions())
+
+	for _, payload := range []protocol.QueryPayload{{SQL: "SELECT 1"}, {SQL: "SELECT * FROM missing"}, {SQL: ""}} {
+		server.handleMessage(protocol.ClientMessage{ID: "q", Type: protocol.TypeQuery, Payload: payload})
+	}
+	server.handleMessage(protocol.ClientMessage{ID: "i", Type: protocol.TypeIntrospect})
+
+	// An open WebSocket is counted until it closes
+	ws := dialTestServer(t, server)
+	sendMessage(t, ws, "ping-1", protocol.TypePing, nil)
+	readResponse(t, ws, nil)
+
+	rec := httptest.NewRecorder()
+	server.HandleMetrics(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Expected text/plain content type, got %q", ct)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		"postgres_proxy_queries_total 3\n",
+		`postgres_proxy_query_errors_total{code="EMPTY_QUERY"} 1` + "\n",
+		`postgres_proxy_query_errors_total{code="QUERY_ERROR"} 1` + "\n",
+		"postgres_proxy_query_duration_seconds_count 3\n",
+		"postgres_proxy_introspections_total 1\n",
+		"postgres_proxy_introspection_errors_total 1\n",
+		"postgres_proxy_websocket_connections 1\n",
+		"postgres_proxy_pool_acquired_connections 2\n",
+		"postgres_proxy_pool_idle_connections 1\n",
+		"postgres_proxy_pool_total_connections 3\n",
+		"postgres_proxy_pool_max_connections 5\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", want, body)
+		}
+	}
+
+	if err := ws.Close(); err != nil {
+		t.Fatalf("Failed to close connection: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for server.metrics.connections.Value() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the connection gauge to drop after the client disconnected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/postgres"
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/protocol"
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/sqlutil"
+)
+
+// errTooManyStatements is returned when a connection already holds maxPreparedStatements statements
+var errTooManyStatements = errors.New("too many prepared statements")
+
+// handlePrepare prepares a statement under a name on a database connection the session holds
+// Queries then run it by setting statementName, which stands in for its SQL on the connection's database
+func (s *Server) handlePrepare(ctx context.Context, sess *session, msg protocol.ClientMessage) protocol.ServerMessage {
+	var payload protocol.PreparePayload
+	if err := decodePayload(msg.Payload, &payload); err != nil {
+		return protocol.NewError(msg.ID, "INVALID_PAYLOAD", "Failed to parse prepare payload", err.Error())
+	}
+
+	if payload.Name == "" {
+		return protocol.NewError(msg.ID, "INVALID_PAYLOAD", "Prepare request must include a name", "")
+	}
+	statements := sqlutil.SplitStatements(payload.SQL)
+	if len(statements) == 0 {
+		return protocol.NewError(msg.ID, "EMPTY_QUERY", "SQL query cannot be empty", "")
+	}
+	if len(statements) > 1 {
+		return protocol.NewError(msg.ID, "INVALID_PAYLOAD", "Only a single statement can be prepared", "")
+	}
+
+	if s.opts.ReadOnly && sqlutil.IsMutating(payload.SQL) {
+		return protocol.NewErrorWithHint(msg.ID, "READ_ONLY_VIOLATION",
+			fmt.Sprintf("%s statements are not allowed in read-only mode", sqlutil.FirstKeyword(payload.SQL)), readOnlyHint)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultPrepareTimeout)
+	defer cancel()
+
+	db, _ := s.clientFor(sess, "")
+	statement, err := sess.prepare(ctx, payload.Name, payload.SQL, func() (postgres.StatementConn, error) {
+		return db.NewStatementConn(ctx)
+	})
+	if errors.Is(err, errTooManyStatements) {
+		return protocol.NewErrorWithHint(msg.ID, "TOO_MANY_STATEMENTS",
+			fmt.Sprintf("A connection can hold at most %d prepared statements", maxPreparedStatements),
+			"Deallocate statements that are no longer needed")
+	}
+	if err != nil {
+		return queryError(msg.ID, err)
+	}
+
+	return protocol.NewPrepared(msg.ID, payload.Name, statement.ParamTypes, statement.Columns)
+}
+
+// handleDescribe returns the parameter and result column types of a statement without running it
+// Nothing is registered, so the client can describe SQL while it is still being edited
+func (s *Server) handleDescribe(ctx context.Context, sess *session, msg protocol.ClientMessage) protocol.ServerMessage {
+	var payload protocol.DescribePayload
+	if err := decodePayload(msg.Payload, &payload); err != nil {
+		return protocol.NewError(msg.ID, "INVALID_PAYLOAD", "Failed to parse describe payload", err.Error())
+	}
+
+	statements := sqlutil.SplitStatements(payload.SQL)
+	if len(statements) == 0 {
+		return protocol.NewError(msg.ID, "EMPTY_QUERY", "SQL query cannot be empty", "")
+	}
+	if len(statements) > 1 {
+		return protocol.NewError(msg.ID, "INVALID_PAYLOAD", "Only a single statement can be described", "")
+	}
+
+	db, ok := s.clientFor(sess, payload.Database)
+	if !ok {
+		return s.unknownDatabase(msg.ID, payload.Database)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultPrepareTimeout)
+	defer cancel()
+
+	statement, err := db.Prepare(ctx, payload.SQL)
+	if err != nil {
+		return queryError(msg.ID, err)
+	}
+	return protocol.NewDescription(msg.ID, statement.ParamTypes, statement.Columns)
+}
+
+// handleDeallocate removes a prepared statement from the database
+// The session's statement connection goes back to the pool with its last statement
+func (s *Server) handleDeallocate(ctx context.Context, sess *session, msg protocol.ClientMessage) protocol.ServerMessage {
+	var payload protocol.StatementPayload
+	if err := decodePayload(msg.Payload, &payload); err != nil {
+		return protocol.NewError(msg.ID, "INVALID_PAYLOAD", "Failed to parse deallocate payload", err.Error())
+	}
+
+	if payload.Name == "" {
+		return protocol.NewError(msg.ID, "INVALID_PAYLOAD", "Deallocate request must include a name", "")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultPrepareTimeout)
+	defer cancel()
+
+	found, err := sess.deallocate(ctx, payload.Name)
+	if !found {
+		return protocol.NewError(msg.ID, "STATEMENT_NOT_FOUND", fmt.Sprintf("No prepared statement named %s", payload.Name), "")
+	}
+	// The statement is gone either way; a connection that failed to drop it was closed
+	if err != nil {
+		log.Printf("Failed to deallocate prepared statement %s: %v", payload.Name, err)
+	}
+
+	return protocol.NewDeallocated(msg.ID, payload.Name)
+}
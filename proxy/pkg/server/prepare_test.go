@@ -0,0 +1,270 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/auth"
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/postgres"
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/protocol"
+)
+
+func TestHandleConnection_PreparedStatement(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+
+	const sql = "SELECT name FROM users WHERE id = $1"
+	executed := make(chan string, 1)
+	conns := make(chan *MockStatementConn, 1)
+	var mockClient *MockPostgresClient
+	mockClient = &MockPostgresClient{
+		PrepareFunc: func(ctx context.Context, sql string) (*postgres.PreparedStatement, error) {
+			return &postgres.PreparedStatement{
+				ParamTypes: []string{"integer"},
+				Columns:    []protocol.ColumnInfo{{Name: "name", DataType: "text"}},
+			}, nil
+		},
+		ExecuteQueryFunc: func(ctx context.Context, sql string, params []interface{}) (*postgres.QueryResult, error) {
+			executed <- fmt.Sprintf("%s %v", sql, params)
+			return &postgres.QueryResult{Rows: []map[string]interface{}{{"name": "Alice"}}}, nil
+		},
+		NewStatementConnFunc: func(ctx context.Context) (postgres.StatementConn, error) {
+			conn := &MockStatementConn{client: mockClient}
+			conns <- conn
+			return conn, nil
+		},
+	}
+	ws := dialTestServer(t, NewServer(secret, mockClient, DefaultOptions()))
+
+	sendMessage(t, ws, "prepare-1", protocol.TypePrepare, protocol.PreparePayload{Name: "user_by_id", SQL: sql})
+	var prepared protocol.PreparedPayload
+	response := readResponse(t, ws, &prepared)
+	if response.Type != protocol.TypePrepared || prepared.Name != "user_by_id" {
+		t.Fatalf("Expected prepared acknowledgment, got %s %+v", response.Type, prepared)
+	}
+	if len(prepared.ParamTypes) != 1 || prepared.ParamTypes[0] != "integer" || len(prepared.Columns) != 1 {
+		t.Errorf("Unexpected statement description: %+v", prepared)
+	}
+
+	sendMessage(t, ws, "q1", protocol.TypeQuery, protocol.QueryPayload{StatementName: "user_by_id", Params: []interface{}{7}})
+	var result protocol.ResultPayload
+	if response := readResponse(t, ws, &result); response.Type != protocol.TypeResult {
+		t.Fatalf("Expected result, got %s", response.Type)
+	}
+	if got := <-executed; got != sql+" [7]" {
+		t.Errorf("Executed %q, want the prepared SQL with its params", got)
+	}
+	conn := <-conns
+	if ran, _ := conn.state(); len(ran) != 1 || ran[0] != "user_by_id" {
+		t.Errorf("Expected the statement to run by name on the session's connection, ran %v", ran)
+	}
+
+	sendMessage(t, ws, "deallocate-1", protocol.TypeDeallocate, protocol.StatementPayload{Name: "user_by_id"})
+	var deallocated protocol.StatementPayload
+	if response := readResponse(t, ws, &deallocated); response.Type != protocol.TypeDeallocated || deallocated.Name != "user_by_id" {
+		t.Fatalf("Expected deallocated acknowledgment, got %s %+v", response.Type, deallocated)
+	}
+	if _, closed := conn.state(); !closed {
+		t.Error("Expected the statement connection to go back to the pool with its last statement")
+	}
+
+	sendMessage(t, ws, "q2", protocol.TypeQuery, protocol.QueryPayload{StatementName: "user_by_id"})
+	var errorPayload protocol.ErrorPayload
+	readResponse(t, ws, &errorPayload)
+	if errorPayload.Code != "STATEMENT_NOT_FOUND" {
+		t.Errorf("Expected STATEMENT_NOT_FOUND after deallocating, got %s", errorPayload.Code)
+	}
+}
+
+func TestHandleConnection_Describe(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+
+	const sql = "SELECT id, name FROM users WHERE created_at > $1"
+	described := make(chan string, 1)
+	mockClient := &MockPostgresClient{
+		PrepareFunc: func(ctx context.Context, sql string) (*postgres.PreparedStatement, error) {
+			described <- sql
+			return &postgres.PreparedStatement{
+				ParamTypes: []string{"timestamp with time zone"},
+				Columns:    []protocol.ColumnInfo{{Name: "id", DataType: "integer"}, {Name: "name", DataType: "text"}},
+			}, nil
+		},
+		ExecuteQueryFunc: func(ctx context.Context, sql string, params []interface{}) (*postgres.QueryResult, error) {
+			t.Errorf("Expected describe not to run the query, got %q", sql)
+			return &postgres.QueryResult{}, nil
+		},
+	}
+	ws := dialTestServer(t, NewServer(secret, mockClient, DefaultOptions()))
+
+	sendMessage(t, ws, "describe-1", protocol.TypeDescribe, protocol.DescribePayload{SQL: sql})
+	var description protocol.DescriptionPayload
+	response := readResponse(t, ws, &description)
+	if response.Type != protocol.TypeDescription || response.ID != "describe-1" {
+		t.Fatalf("Expected a description for describe-1, got %s %+v", response.Type, description)
+	}
+	if len(description.ParamTypes) != 1 || description.ParamTypes[0] != "timestamp with time zone" {
+		t.Errorf("Unexpected parameter types: %v", description.ParamTypes)
+	}
+	if len(description.Columns) != 2 || description.Columns[1].DataType != "text" {
+		t.Errorf("Unexpected columns: %+v", description.Columns)
+	}
+	if got := <-described; got != sql {
+		t.Errorf("Described %q, want %q", got, sql)
+	}
+
+	// Nothing was registered, so the SQL can't be run by name
+	sendMessage(t, ws, "q1", protocol.TypeQuery, protocol.QueryPayload{StatementName: "describe-1"})
+	var errorPayload protocol.ErrorPayload
+	readResponse(t, ws, &errorPayload)
+	if errorPayload.Code != "STATEMENT_NOT_FOUND" {
+		t.Errorf("Expected STATEMENT_NOT_FOUND, got %s", errorPayload.Code)
+	}
+}
+
+func TestHandleConnection_PrepareErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		msgType    string
+		payload    interface{}
+		readOnly   bool
+		prepareErr error
+		wantCode   string
+	}{
+		{name: "missing name", msgType: protocol.TypePrepare, payload: protocol.PreparePayload{SQL: "SELECT 1"}, wantCode: "INVALID_PAYLOAD"},
+		{name: "empty sql", msgType: protocol.TypePrepare, payload: protocol.PreparePayload{Name: "s", SQL: " ; "}, wantCode: "EMPTY_QUERY"},
+		{name: "several statements", msgType: protocol.TypePrepare, payload: protocol.PreparePayload{Name: "s", SQL: "SELECT 1; SELECT 2"}, wantCode: "INVALID_PAYLOAD"},
+		{name: "write in read-only mode", msgType: protocol.TypePrepare, payload: protocol.PreparePayload{Name: "s", SQL: "DELETE FROM users"}, readOnly: true, wantCode: "READ_ONLY_VIOLATION"},
+		{
+			name:       "database error",
+			msgType:    protocol.TypePrepare,
+			payload:    protocol.PreparePayload{Name: "s", SQL: "SELEC 1"},
+			prepareErr: &postgres.DatabaseError{Code: "42601", Message: `syntax error at or near "SELEC"`},
+			wantCode:   "42601",
+		},
+		{name: "describe empty sql", msgType: protocol.TypeDescribe, payload: protocol.DescribePayload{SQL: ""}, wantCode: "EMPTY_QUERY"},
+		{name: "describe several statements", msgType: protocol.TypeDescribe, payload: protocol.DescribePayload{SQL: "SELECT 1; SELECT 2"}, wantCode: "INVALID_PAYLOAD"},
+		{name: "describe unknown database", msgType: protocol.TypeDescribe, payload: protocol.DescribePayload{SQL: "SELECT 1", Database: "missing"}, wantCode: "UNKNOWN_DATABASE"},
+		{
+			name:       "describe database error",
+			msgType:    protocol.TypeDescribe,
+			payload:    protocol.DescribePayload{SQL: "SELECT * FROM missing"},
+			prepareErr: &postgres.DatabaseError{Code: "42P01", Message: `relation "missing" does not exist`},
+			wantCode:   "42P01",
+		},
+		{name: "deallocate without name", msgType: protocol.TypeDeallocate, payload: protocol.StatementPayload{}, wantCode: "INVALID_PAYLOAD"},
+		{name: "deallocate unknown", msgType: protocol.TypeDeallocate, payload: protocol.StatementPayload{Name: "missing"}, wantCode: "STATEMENT_NOT_FOUND"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secret, err := auth.GenerateSecret()
+			if err != nil {
+				t.Fatalf("Failed to generate secret: %v", err)
+			}
+			mockClient := &MockPostgresClient{
+				PrepareFunc: func(ctx context.Context, sql string) (*postgres.PreparedStatement, error) {
+					if tt.prepareErr != nil {
+						return nil, tt.prepareErr
+					}
+					return &postgres.PreparedStatement{}, nil
+				},
+			}
+			opts := DefaultOptions()
+			opts.ReadOnly = tt.readOnly
+			ws := dialTestServer(t, NewServer(secret, mockClient, opts))
+
+			sendMessage(t, ws, "m1", tt.msgType, tt.payload)
+			var errorPayload protocol.ErrorPayload
+			response := readResponse(t, ws, &errorPayload)
+			if response.Type != protocol.TypeError || errorPayload.Code != tt.wantCode {
+				t.Errorf("Expected %s error, got %s %+v", tt.wantCode, response.Type, errorPayload)
+			}
+		})
+	}
+}
+
+func TestHandleQuery_StatementNameValidation(t *testing.T) {
+	server := NewServer("secret", &MockPostgresClient{}, DefaultOptions())
+
+	tests := []struct {
+		name    string
+		payload protocol.QueryPayload
+	}{
+		{name: "sql and statement name", payload: protocol.QueryPayload{SQL: "SELECT 1", StatementName: "s"}},
+		{name: "no connection to hold statements", payload: protocol.QueryPayload{StatementName: "s"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := server.handleMessage(protocol.ClientMessage{ID: "q1", Type: protocol.TypeQuery, Payload: tt.payload})
+
+			errorPayload, ok := response.Payload.(protocol.ErrorPayload)
+			if !ok || errorPayload.Code != "INVALID_PAYLOAD" {
+				t.Errorf("Expected INVALID_PAYLOAD error, got %+v", response.Payload)
+			}
+		})
+	}
+}
+
+// TestSession_PrepareLimit tests that a session holds a bounded number of prepared statements
+func TestSession_PrepareLimit(t *testing.T) {
+	sess := newSession(nil)
+	conn := &MockStatementConn{client: &MockPostgresClient{}}
+	open := func() (postgres.StatementConn, error) { return conn, nil }
+	ctx := context.Background()
+	for i := 0; i < maxPreparedStatements; i++ {
+		if _, err := sess.prepare(ctx, fmt.Sprintf("s%d", i), "SELECT 1", open); err != nil {
+			t.Fatalf("prepare(%d) failed below the limit: %v", i, err)
+		}
+	}
+
+	if _, err := sess.prepare(ctx, "one_too_many", "SELECT 1", open); !errors.Is(err, errTooManyStatements) {
+		t.Errorf("Expected errTooManyStatements once the limit is reached, got %v", err)
+	}
+	if _, err := sess.prepare(ctx, "s0", "SELECT 2", open); err != nil {
+		t.Errorf("Expected replacing an existing statement to succeed at the limit, got %v", err)
+	}
+	if sql, _, _ := sess.statement("s0"); sql != "SELECT 2" {
+		t.Errorf("Expected the replaced statement, got %q", sql)
+	}
+}
+
+// TestSession_StatementConnRelease tests that the statement connection goes back to the pool
+// when a prepare leaves it empty and when the session closes
+func TestSession_StatementConnRelease(t *testing.T) {
+	ctx := context.Background()
+	prepareErr := &postgres.DatabaseError{Code: "42601", Message: "syntax error"}
+	client := &MockPostgresClient{
+		PrepareFunc: func(ctx context.Context, sql string) (*postgres.PreparedStatement, error) {
+			if sql == "SELEC 1" {
+				return nil, prepareErr
+			}
+			return &postgres.PreparedStatement{}, nil
+		},
+	}
+
+	sess := newSession(nil)
+	failed := &MockStatementConn{client: client}
+	if _, err := sess.prepare(ctx, "s", "SELEC 1", func() (postgres.StatementConn, error) { return failed, nil }); !errors.Is(err, prepareErr) {
+		t.Fatalf("Expected the prepare error, got %v", err)
+	}
+	if _, closed := failed.state(); !closed {
+		t.Error("Expected a connection opened for a failed prepare to be released")
+	}
+
+	held := &MockStatementConn{client: client}
+	if _, err := sess.prepare(ctx, "s", "SELECT 1", func() (postgres.StatementConn, error) { return held, nil }); err != nil {
+		t.Fatalf("prepare failed: %v", err)
+	}
+	sess.close()
+	if _, closed := held.state(); !closed {
+		t.Error("Expected closing the session to release its statement connection")
+	}
+}
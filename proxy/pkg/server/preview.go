@@ -0,0 +1,41 @@
+package server
+
+import (
+	"context"
+
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/postgres"
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/protocol"
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/sqlutil"
+)
+
+// DefaultPreviewRows is how many rows a preview returns when it doesn't set a limit
+const DefaultPreviewRows = 100
+
+// handlePreview returns the first rows of a table so a schema browser can show them
+// The server writes the SQL with the names quoted, then runs it as an ordinary query,
+// so timeouts, row limits and read-only mode apply as usual. One row more than the
+// limit is read to tell whether the result is truncated
+func (s *Server) handlePreview(ctx context.Context, sess *session, tx postgres.Transaction, msg protocol.ClientMessage) protocol.ServerMessage {
+	var payload protocol.PreviewPayload
+	if err := decodePayload(msg.Payload, &payload); err != nil {
+		return protocol.NewError(msg.ID, "INVALID_PAYLOAD", "Failed to parse preview payload", err.Error())
+	}
+
+	if payload.Table == "" {
+		return protocol.NewError(msg.ID, "INVALID_PAYLOAD", "Preview request must include a table", "")
+	}
+	if payload.Limit < 0 {
+		return protocol.NewError(msg.ID, "INVALID_PAYLOAD", "limit cannot be negative", "")
+	}
+	limit := payload.Limit
+	if limit == 0 {
+		limit = DefaultPreviewRows
+	}
+
+	return s.runQuery(ctx, sess, tx, msg.ID, protocol.QueryPayload{
+		SQL:      sqlutil.PreviewTable(payload.Schema, payload.Table),
+		Params:   []interface{}{limit + 1},
+		MaxRows:  limit,
+		Database: payload.Database,
+	})
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/auth"
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/postgres"
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/protocol"
+)
+
+func TestHandlePreview(t *testing.T) {
+	tests := []struct {
+		name        string
+		payload     protocol.PreviewPayload
+		wantSQL     string
+		wantParams  []interface{}
+		wantMaxRows int
+		wantCode    string
+	}{
+		{
+			name:        "default limit",
+			payload:     protocol.PreviewPayload{Schema: "public", Table: "users"},
+			wantSQL:     `SELECT * FROM "public"."users" LIMIT $1`,
+			wantParams:  []interface{}{DefaultPreviewRows + 1},
+			wantMaxRows: DefaultPreviewRows,
+		},
+		{
+			name:        "names needing quotes",
+			payload:     protocol.PreviewPayload{Schema: "Sales", Table: `order "items"`, Limit: 5},
+			wantSQL:     `SELECT * FROM "Sales"."order ""items""" LIMIT $1`,
+			wantParams:  []interface{}{6},
+			wantMaxRows: 5,
+		},
+		{
+			name:        "search path",
+			payload:     protocol.PreviewPayload{Table: "users", Limit: 10},
+			wantSQL:     `SELECT * FROM "users" LIMIT $1`,
+			wantParams:  []interface{}{11},
+			wantMaxRows: 10,
+		},
+		{
+			name:     "missing table",
+			payload:  protocol.PreviewPayload{Schema: "public"},
+			wantCode: "INVALID_PAYLOAD",
+		},
+		{
+			name:     "negative limit",
+			payload:  protocol.PreviewPayload{Table: "users", Limit: -1},
+			wantCode: "INVALID_PAYLOAD",
+		},
+		{
+			name:     "unknown database",
+			payload:  protocol.PreviewPayload{Table: "users", Database: "missing"},
+			wantCode: "UNKNOWN_DATABASE",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotSQL string
+			var gotParams []interface{}
+			var gotMaxRows int
+			mockClient := &MockPostgresClient{
+				ExecuteQueryFunc: func(ctx context.Context, sql string, params []interface{}) (*postgres.QueryResult, error) {
+					gotSQL, gotParams, gotMaxRows = sql, params, postgres.MaxRowsFromContext(ctx)
+					return &postgres.QueryResult{Truncated: true}, nil
+				},
+			}
+			server := NewServer("secret", mockClient, DefaultOptions())
+
+			response := server.handlePreview(context.Background(), nil, nil, protocol.ClientMessage{ID: "p1", Type: protocol.TypePreview, Payload: tt.payload})
+
+			if tt.wantCode != "" {
+				errorPayload, ok := response.Payload.(protocol.ErrorPayload)
+				if !ok || errorPayload.Code != tt.wantCode {
+					t.Errorf("Expected %s error, got %+v", tt.wantCode, response.Payload)
+				}
+				return
+			}
+			result, ok := response.Payload.(protocol.ResultPayload)
+			if !ok || response.ID != "p1" {
+				t.Fatalf("Expected a result for p1, got %+v", response)
+			}
+			if !result.Truncated {
+				t.Error("Expected the result to say more rows exist")
+			}
+			if gotSQL != tt.wantSQL {
+				t.Errorf("SQL = %q, want %q", gotSQL, tt.wantSQL)
+			}
+			if !reflect.DeepEqual(gotParams, tt.wantParams) {
+				t.Errorf("Params = %v, want %v", gotParams, tt.wantParams)
+			}
+			if gotMaxRows != tt.wantMaxRows {
+				t.Errorf("Max rows = %d, want %d", gotMaxRows, tt.wantMaxRows)
+			}
+		})
+	}
+}
+
+func TestHandleConnection_Preview(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	mockClient := &MockPostgresClient{
+		ExecuteQueryFunc: func(ctx context.Context, sql string, params []interface{}) (*postgres.QueryResult, error) {
+			return &postgres.QueryResult{
+				Columns:  []protocol.ColumnInfo{{Name: "id"}},
+				Rows:     []map[string]interface{}{{"id": 1}},
+				RowCount: 1,
+			}, nil
+		},
+	}
+	ws := dialTestServer(t, NewServer(secret, mockClient, DefaultOptions()))
+
+	sendMessage(t, ws, "preview-1", protocol.TypePreview, protocol.PreviewPayload{Schema: "public", Table: "users"})
+	var result protocol.ResultPayload
+	response := readResponse(t, ws, &result)
+	if response.Type != protocol.TypeResult || response.ID != "preview-1" || result.RowCount != 1 {
+		t.Errorf("Expected a result for preview-1, got %s %+v", response.Type, result)
+	}
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/protocol"
+)
+
+// logQuery writes one line for a handled query or export when query logging is on
+// The SQL is cut to LogQueryLength characters; parameter values are never logged
+func (s *Server) logQuery(id, sql string, params int, response protocol.ServerMessage, duration time.Duration) {
+	if !s.opts.LogQueries {
+		return
+	}
+	log.Print(formatQueryLog(id, truncateSQL(sql, s.opts.LogQueryLength), params, response, duration))
+}
+
+// formatQueryLog renders a query log line as space-separated key=value pairs
+func formatQueryLog(id, sql string, params int, response protocol.ServerMessage, duration time.Duration) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "query id=%q sql=%q params=%d rows=%d duration=%s",
+		id, sql, params, responseRowCount(response), duration.Round(time.Microsecond))
+	if errorPayload, ok := response.Payload.(protocol.ErrorPayload); ok {
+		fmt.Fprintf(&b, " error=%s", errorPayload.Code)
+	}
+	return b.String()
+}
+
+// truncateSQL shortens sql to at most limit characters, marking the cut with an ellipsis
+// A limit of zero keeps the whole query
+func truncateSQL(sql string, limit int) string {
+	sql = strings.Join(strings.Fields(sql), " ")
+	runes := []rune(sql)
+	if limit <= 0 || len(runes) <= limit {
+		return sql
+	}
+	return string(runes[:limit]) + "…"
+}
+
+// responseRowCount returns how many rows a response carried, summed over a script's statements
+func responseRowCount(response protocol.ServerMessage) int {
+	switch payload := response.Payload.(type) {
+	case protocol.ResultPayload:
+		return payload.RowCount
+	case protocol.ScriptResultPayload:
+		rows := 0
+		for _, statement := range payload.Statements {
+			rows += statement.RowCount
+		}
+		return rows
+	case protocol.ExportCompletePayload:
+		return payload.RowCount
+	}
+	return 0
+}
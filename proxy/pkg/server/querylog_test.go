@@ -0,0 +1,94 @@
+package server
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/protocol"
+)
+
+func TestTruncateSQL(t *testing.T) {
+	tests := []struct {
+		name  string
+		sql   string
+		limit int
+		want  string
+	}{
+		{name: "short query", sql: "SELECT 1", limit: 20, want: "SELECT 1"},
+		{name: "truncated", sql: "SELECT * FROM users", limit: 8, want: "SELECT *…"},
+		{name: "no limit", sql: "SELECT * FROM users", limit: 0, want: "SELECT * FROM users"},
+		{name: "whitespace collapsed", sql: "SELECT *\n  FROM users\n", limit: 0, want: "SELECT * FROM users"},
+		{name: "multi-byte characters", sql: "SELECT 'héllo'", limit: 10, want: "SELECT 'hé…"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := truncateSQL(tt.sql, tt.limit); got != tt.want {
+				t.Errorf("truncateSQL(%q, %d) = %q, want %q", tt.sql, tt.limit, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatQueryLog(t *testing.T) {
+	tests := []struct {
+		name     string
+		response protocol.ServerMessage
+		want     string
+	}{
+		{
+			name:     "result",
+			response: protocol.NewQueryResult("q1", []map[string]interface{}{{"n": 1}, {"n": 2}}, nil, "SELECT", time.Millisecond, false),
+			want:     `query id="q1" sql="SELECT n FROM t" params=1 rows=2 duration=1.5ms`,
+		},
+		{
+			name: "script",
+			response: protocol.NewScriptResult("q1", []protocol.StatementResult{
+				{ResultPayload: protocol.ResultPayload{RowCount: 2}},
+				{ResultPayload: protocol.ResultPayload{RowCount: 3}},
+			}, false, true, time.Millisecond),
+			want: `query id="q1" sql="SELECT n FROM t" params=1 rows=5 duration=1.5ms`,
+		},
+		{
+			name:     "error",
+			response: protocol.NewError("q1", "QUERY_ERROR", "boom", ""),
+			want:     `query id="q1" sql="SELECT n FROM t" params=1 rows=0 duration=1.5ms error=QUERY_ERROR`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := formatQueryLog("q1", "SELECT n FROM t", 1, tt.response, 1500*time.Microsecond)
+			if got != tt.want {
+				t.Errorf("formatQueryLog() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogQuery(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	response := protocol.NewQueryResult("q1", nil, nil, "SELECT", time.Millisecond, false)
+
+	quiet := NewServer("secret", &MockPostgresClient{}, DefaultOptions())
+	quiet.logQuery("q1", "SELECT secret_column FROM t", 0, response, time.Millisecond)
+	if buf.Len() != 0 {
+		t.Errorf("Expected no query log without LogQueries, got %q", buf.String())
+	}
+
+	opts := DefaultOptions()
+	opts.LogQueries = true
+	opts.LogQueryLength = 6
+	server := NewServer("secret", &MockPostgresClient{}, opts)
+	server.logQuery("q1", "SELECT secret_column FROM t", 0, response, time.Millisecond)
+	if !strings.Contains(buf.String(), `sql="SELECT…"`) {
+		t.Errorf("Expected truncated SQL in query log, got %q", buf.String())
+	}
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/protocol"
+)
+
+// rateLimiter is a token bucket refilled at a steady rate
+// It holds up to one second's worth of tokens, so short bursts pass while a sustained flood is slowed
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // tokens added per second
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+// newRateLimiter returns a limiter allowing perSecond requests a second, or nil if perSecond is not positive
+func newRateLimiter(perSecond int) *rateLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	limiter := &rateLimiter{
+		rate:   float64(perSecond),
+		burst:  float64(perSecond),
+		tokens: float64(perSecond),
+		now:    time.Now,
+	}
+	limiter.last = limiter.now()
+	return limiter
+}
+
+// allow takes a token if one is available
+// Otherwise it reports how long until the next token, and takes nothing
+func (l *rateLimiter) allow() (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	if l.tokens >= 1 {
+		l.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// rateLimited reports a message rejected by the connection's rate limit
+func rateLimited(id string, wait time.Duration) protocol.ServerMessage {
+	// Round up so retrying after the hinted delay succeeds
+	retry := wait.Truncate(time.Millisecond)
+	if retry < wait {
+		retry += time.Millisecond
+	}
+	return protocol.NewErrorWithHint(id, "RATE_LIMITED", "Too many queries on this connection",
+		fmt.Sprintf("Retry in %v", retry))
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/auth"
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/protocol"
+)
+
+func TestNewRateLimiter_Disabled(t *testing.T) {
+	for _, perSecond := range []int{0, -1} {
+		limiter := newRateLimiter(perSecond)
+		if limiter != nil {
+			t.Fatalf("Expected no limiter for %d per second", perSecond)
+		}
+		for i := 0; i < 100; i++ {
+			if ok, _ := limiter.allow(); !ok {
+				t.Fatalf("Expected a nil limiter to allow everything")
+			}
+		}
+	}
+}
+
+func TestRateLimiter_Allow(t *testing.T) {
+	now := time.Unix(0, 0)
+	limiter := newRateLimiter(4)
+	limiter.now = func() time.Time { return now }
+	limiter.last = now
+
+	// A full bucket allows a burst of one second's worth
+	for i := 0; i < 4; i++ {
+		if ok, _ := limiter.allow(); !ok {
+			t.Fatalf("Expected request %d of the burst to be allowed", i+1)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		advance  time.Duration
+		wantOK   bool
+		wantWait time.Duration
+	}{
+		{name: "empty bucket", wantWait: 250 * time.Millisecond},
+		{name: "partly refilled", advance: 100 * time.Millisecond, wantWait: 150 * time.Millisecond},
+		{name: "one token refilled", advance: 150 * time.Millisecond, wantOK: true},
+		{name: "empty again", wantWait: 250 * time.Millisecond},
+		{name: "refill is capped at the burst", advance: time.Minute, wantOK: true},
+	}
+
+	for _, tt := range tests {
+		now = now.Add(tt.advance)
+		ok, wait := limiter.allow()
+		if ok != tt.wantOK || wait != tt.wantWait {
+			t.Errorf("%s: allow() = %v, %v, want %v, %v", tt.name, ok, wait, tt.wantOK, tt.wantWait)
+		}
+	}
+
+	// Three more fit in what's left of the capped bucket, then it's empty
+	for i := 0; i < 3; i++ {
+		if ok, _ := limiter.allow(); !ok {
+			t.Fatalf("Expected request %d after refilling to be allowed", i+1)
+		}
+	}
+	if ok, _ := limiter.allow(); ok {
+		t.Error("Expected the bucket to hold no more than the burst")
+	}
+}
+
+func TestRateLimited(t *testing.T) {
+	tests := []struct {
+		wait     time.Duration
+		wantHint string
+	}{
+		{wait: 250 * time.Millisecond, wantHint: "Retry in 250ms"},
+		{wait: 1500 * time.Microsecond, wantHint: "Retry in 2ms"},
+		{wait: 1500 * time.Millisecond, wantHint: "Retry in 1.5s"},
+	}
+
+	for _, tt := range tests {
+		response := rateLimited("q", tt.wait)
+		errorPayload, ok := response.Payload.(protocol.ErrorPayload)
+		if !ok || errorPayload.Code != "RATE_LIMITED" {
+			t.Fatalf("Expected a RATE_LIMITED error, got %+v", response)
+		}
+		if errorPayload.Hint != tt.wantHint {
+			t.Errorf("rateLimited(%v) hint = %q, want %q", tt.wait, errorPayload.Hint, tt.wantHint)
+		}
+	}
+}
+
+func TestHandleConnection_MaxQueriesPerSecond(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	opts := DefaultOptions()
+	opts.MaxQueriesPerSecond = 2
+	server := NewServer(secret, &MockPostgresClient{}, opts)
+	ws := dialTestServer(t, server)
+
+	for i := 1; i <= 3; i++ {
+		sendMessage(t, ws, fmt.Sprintf("query-%d", i), protocol.TypeQuery, protocol.QueryPayload{SQL: "SELECT 1"})
+	}
+	sendMessage(t, ws, "ping", protocol.TypePing, nil)
+
+	if err := ws.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("Failed to set read deadline: %v", err)
+	}
+	responses := make(map[string]protocol.ServerMessage)
+	for i := 0; i < 4; i++ {
+		var response protocol.ServerMessage
+		if err := ws.ReadJSON(&response); err != nil {
+			t.Fatalf("Failed to read response %d: %v", i+1, err)
+		}
+		responses[response.ID] = response
+	}
+
+	for _, id := range []string{"query-1", "query-2"} {
+		if responses[id].Type != protocol.TypeResult {
+			t.Errorf("Expected %s to run, got %+v", id, responses[id])
+		}
+	}
+	if responses["ping"].Type != protocol.TypePong {
+		t.Errorf("Expected pings not to be limited, got %+v", responses["ping"])
+	}
+	payloadBytes, _ := json.Marshal(responses["query-3"].Payload)
+	var errorPayload protocol.ErrorPayload
+	if err := json.Unmarshal(payloadBytes, &errorPayload); err != nil {
+		t.Fatalf("Failed to unmarshal error payload: %v", err)
+	}
+	if errorPayload.Code != "RATE_LIMITED" || errorPayload.Hint == "" {
+		t.Errorf("Expected RATE_LIMITED with a hint for query-3, got %+v", errorPayload)
+	}
+
+	// Another connection has its own allowance
+	other := dialTestServer(t, server)
+	sendMessage(t, other, "query-4", protocol.TypeQuery, protocol.QueryPayload{SQL: "SELECT 1"})
+	var result protocol.ResultPayload
+	if response := readResponse(t, other, &result); response.Type != protocol.TypeResult {
+		t.Errorf("Expected a query on another connection to run, got %+v", response)
+	}
+}
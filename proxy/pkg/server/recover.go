@@ -0,0 +1,27 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/protocol"
+)
+
+// panicResponse logs a panic recovered while handling message id, with its stack,
+// and turns it into an INTERNAL_ERROR so the client isn't left waiting
+func panicResponse(id string, p any) protocol.ServerMessage {
+	log.Printf("Panic while handling message %s: %v\n%s", id, p, debug.Stack())
+	return protocol.NewError(id, "INTERNAL_ERROR", "Internal error while handling the message", fmt.Sprint(p))
+}
+
+// recovered calls handle, answering with an INTERNAL_ERROR if it panics
+// Handlers running in their own goroutine need it, since a panic there would end the process
+func recovered(id string, handle func() protocol.ServerMessage) (response protocol.ServerMessage) {
+	defer func() {
+		if p := recover(); p != nil {
+			response = panicResponse(id, p)
+		}
+	}()
+	return handle()
+}
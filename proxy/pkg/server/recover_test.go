@@ -0,0 +1,77 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/auth"
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/postgres"
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/protocol"
+)
+
+func TestRecovered(t *testing.T) {
+	response := recovered("q", func() protocol.ServerMessage {
+		var m map[string]int
+		m["boom"]++
+		return protocol.NewPong("q")
+	})
+	errorPayload, ok := response.Payload.(protocol.ErrorPayload)
+	if !ok || response.ID != "q" || errorPayload.Code != "INTERNAL_ERROR" {
+		t.Fatalf("Expected INTERNAL_ERROR for q, got %+v", response)
+	}
+	if errorPayload.Detail == "" {
+		t.Error("Expected the panic value in the detail")
+	}
+
+	response = recovered("p", func() protocol.ServerMessage {
+		return protocol.NewPong("p")
+	})
+	if response.Type != protocol.TypePong {
+		t.Errorf("Expected the handler's response without a panic, got %+v", response)
+	}
+}
+
+func TestHandleConnection_PanicRecovery(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	mockClient := &MockPostgresClient{
+		ExecuteQueryFunc: func(ctx context.Context, sql string, params []interface{}) (*postgres.QueryResult, error) {
+			if sql == "SELECT panic" {
+				panic("unexpected value type")
+			}
+			return &postgres.QueryResult{}, nil
+		},
+		IntrospectSchemaFunc: func(ctx context.Context, schemas []string) (*protocol.SchemaPayload, error) {
+			panic("unexpected schema")
+		},
+	}
+	ws := dialTestServer(t, NewServer(secret, mockClient, DefaultOptions()))
+
+	// Queries panic in their own goroutine, introspection on the read loop
+	tests := []struct {
+		id      string
+		msgType string
+		payload interface{}
+	}{
+		{id: "query", msgType: protocol.TypeQuery, payload: protocol.QueryPayload{SQL: "SELECT panic"}},
+		{id: "introspect", msgType: protocol.TypeIntrospect, payload: protocol.IntrospectPayload{}},
+	}
+
+	for _, tt := range tests {
+		sendMessage(t, ws, tt.id, tt.msgType, tt.payload)
+		var errorPayload protocol.ErrorPayload
+		response := readResponse(t, ws, &errorPayload)
+		if response.ID != tt.id || errorPayload.Code != "INTERNAL_ERROR" {
+			t.Errorf("Expected INTERNAL_ERROR for %s, got %s for %s", tt.id, errorPayload.Code, response.ID)
+		}
+	}
+
+	// The connection keeps working after the panics
+	sendMessage(t, ws, "after", protocol.TypeQuery, protocol.QueryPayload{SQL: "SELECT 1"})
+	var result protocol.ResultPayload
+	if response := readResponse(t, ws, &result); response.ID != "after" || response.Type != protocol.TypeResult {
+		t.Errorf("Expected a result for the next query, got %s for %s", response.Type, response.ID)
+	}
+}
@@ -0,0 +1,535 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/postgres"
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// session holds the state of a single WebSocket connection
+type session struct {
+	ws   *websocket.Conn // read side, used only by the connection's read loop and keep-alive
+	conn *Conn           // every write goes through here
+	db   PostgresClient  // database selected when connecting; nil means the default
+
+	// The read deadline is the earlier of these; zero means unset. Pongs push out the first
+	// and messages the second. Both are only touched by the read loop, which runs the pong handler
+	pongDeadline time.Time
+	idleDeadline time.Time
+
+	mu       sync.Mutex
+	running  map[string]context.CancelFunc // in-flight queries keyed by message ID
+	draining bool                          // set on server shutdown; no new queries are accepted
+	idle     chan struct{}                 // closed once the last query finishes while draining
+	wg       sync.WaitGroup
+	slots    chan struct{} // bounds the queries running at once; nil means no limit
+	limiter  *rateLimiter  // caps how fast queries are accepted; nil means no limit
+
+	binaryResults atomic.Bool // send result messages in binary form, as asked for in a capabilities request
+
+	listenMu    sync.Mutex
+	listener    postgres.Listener // opened on the first LISTEN, closed with the last UNLISTEN
+	channels    map[string]bool
+	listenOrder sequence // listens and unlistens, which take effect in the order they arrive
+
+	txMu sync.Mutex
+	tx   *openTx // explicit transaction started with a begin message
+
+	stmtMu     sync.Mutex
+	stmtConn   postgres.StatementConn // opened on the first prepare, closed with the last deallocate
+	statements map[string]string      // SQL of prepared statements keyed by name
+	stmtOrder  sequence               // prepares and deallocates, which queries sent after them wait for
+}
+
+// sequence orders messages that each run in their own goroutine but must take effect in the
+// order they arrived. It is only used from the read loop
+type sequence struct {
+	last chan struct{} // closed once the last message queued has finished; nil if there was none
+}
+
+// next queues a message behind the one before it
+// The message waits for prev to close before it runs and closes done when it finishes
+func (q *sequence) next() (prev <-chan struct{}, done chan struct{}) {
+	prev, done = q.after(), make(chan struct{})
+	q.last = done
+	return prev, done
+}
+
+// after returns a channel that is closed once every message queued so far has finished
+func (q *sequence) after() <-chan struct{} {
+	if q.last == nil {
+		finished := make(chan struct{})
+		close(finished)
+		return finished
+	}
+	return q.last
+}
+
+// openTx tracks an explicit transaction and the queries running in it
+// It is reserved when the begin message arrives, so queries sent right after it run in the
+// transaction, and tx and err are only set once ready is closed
+type openTx struct {
+	tx       postgres.Transaction
+	err      error         // why the transaction failed to begin
+	ready    chan struct{} // closed once the begin has finished, successfully or not
+	id       string        // ID of the begin message
+	queries  sync.WaitGroup
+	active   int
+	lastUsed time.Time
+	timer    *time.Timer // rolls the transaction back once it has been idle too long
+}
+
+// newSession creates the state for a newly upgraded connection
+func newSession(ws *websocket.Conn) *session {
+	return &session{
+		ws:         ws,
+		conn:       NewConn(ws),
+		running:    make(map[string]context.CancelFunc),
+		channels:   make(map[string]bool),
+		statements: make(map[string]string),
+	}
+}
+
+// send writes a message to the client; safe for concurrent use
+// Results go out in binary form once the client has asked for that in a capabilities request
+func (sess *session) send(msg protocol.ServerMessage) error {
+	if result, ok := msg.Payload.(protocol.ResultPayload); ok && sess.binaryResults.Load() {
+		data, err := protocol.EncodeBinaryResult(result)
+		if err != nil {
+			return err
+		}
+		return sess.sendBinary(msg.ID, data)
+	}
+	return sess.conn.WriteMessage(msg)
+}
+
+// sendBinary writes a binary message to the client prefixed with the ID it belongs to and a newline
+// Safe for concurrent use
+func (sess *session) sendBinary(id string, data []byte) error {
+	message := make([]byte, 0, len(id)+1+len(data))
+	message = append(message, id...)
+	message = append(message, '\n')
+	message = append(message, data...)
+	return sess.conn.WriteBinary(message)
+}
+
+// keepAlive pings the client every interval and closes the connection if it stops answering
+// Each pong pushes the read deadline two intervals out, so a peer that misses two pings in a row
+// fails the next read. The returned function stops the pings
+func (sess *session) keepAlive(interval time.Duration) (stop func()) {
+	pongWait := 2 * interval
+	sess.pongDeadline = time.Now().Add(pongWait)
+	_ = sess.setReadDeadline()
+	sess.ws.SetPongHandler(func(string) error {
+		sess.pongDeadline = time.Now().Add(pongWait)
+		return sess.setReadDeadline()
+	})
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := sess.conn.WriteControl(websocket.PingMessage, nil); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// extendIdle gives the client another timeout to send its next message; zero disables the idle timeout
+func (sess *session) extendIdle(timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+	sess.idleDeadline = time.Now().Add(timeout)
+	_ = sess.setReadDeadline()
+}
+
+// idleExpired reports whether a read timed out because the client sent nothing, rather than missing pongs
+func (sess *session) idleExpired() bool {
+	return !sess.idleDeadline.IsZero() && !time.Now().Before(sess.idleDeadline)
+}
+
+// setReadDeadline applies the earlier of the keep-alive and idle deadlines
+func (sess *session) setReadDeadline() error {
+	deadline := sess.pongDeadline
+	if deadline.IsZero() || (!sess.idleDeadline.IsZero() && sess.idleDeadline.Before(deadline)) {
+		deadline = sess.idleDeadline
+	}
+	return sess.ws.SetReadDeadline(deadline)
+}
+
+// track registers the cancel function of an in-flight query
+// Returns false if a query with the same ID is already running or the session is draining
+func (sess *session) track(id string, cancel context.CancelFunc) bool {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	if _, exists := sess.running[id]; exists || sess.draining {
+		return false
+	}
+	sess.running[id] = cancel
+	return true
+}
+
+// acquireSlot waits until the session may run another query
+// Returns false if ctx is done first, such as when the query is cancelled while waiting
+func (sess *session) acquireSlot(ctx context.Context) bool {
+	if sess.slots == nil {
+		return true
+	}
+	select {
+	case sess.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// releaseSlot frees the slot taken by acquireSlot
+func (sess *session) releaseSlot() {
+	if sess.slots != nil {
+		<-sess.slots
+	}
+}
+
+// untrack removes a finished query and releases its context
+func (sess *session) untrack(id string) {
+	sess.mu.Lock()
+	cancel, ok := sess.running[id]
+	delete(sess.running, id)
+	if ok && sess.draining && len(sess.running) == 0 {
+		close(sess.idle)
+	}
+	sess.mu.Unlock()
+
+	if ok {
+		cancel()
+	}
+}
+
+// cancel aborts an in-flight query, returning false if it isn't running
+func (sess *session) cancel(id string) bool {
+	sess.mu.Lock()
+	cancel, ok := sess.running[id]
+	sess.mu.Unlock()
+
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// drain stops the session accepting queries and returns a channel that is closed
+// once the queries already running have finished
+func (sess *session) drain() <-chan struct{} {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	if !sess.draining {
+		sess.draining = true
+		sess.idle = make(chan struct{})
+		if len(sess.running) == 0 {
+			close(sess.idle)
+		}
+	}
+	return sess.idle
+}
+
+// isDraining reports whether the session has stopped accepting queries
+func (sess *session) isDraining() bool {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.draining
+}
+
+// goAway waits for in-flight queries to finish, or ctx to be done, then sends a close frame
+// telling the client the server is shutting down. The read loop ends when the client answers
+func (sess *session) goAway(ctx context.Context) {
+	select {
+	case <-sess.drain():
+	case <-ctx.Done():
+	}
+	_ = sess.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, shutdownReason))
+}
+
+// listen subscribes the session to a notification channel, opening its listener if needed
+func (sess *session) listen(ctx context.Context, channel string, open func() (postgres.Listener, error)) error {
+	sess.listenMu.Lock()
+	defer sess.listenMu.Unlock()
+
+	if sess.listener == nil {
+		listener, err := open()
+		if err != nil {
+			return err
+		}
+		sess.listener = listener
+	}
+
+	if err := sess.listener.Listen(ctx, channel); err != nil {
+		return err
+	}
+	sess.channels[channel] = true
+	return nil
+}
+
+// unlisten unsubscribes the session from a channel, returning false if it wasn't subscribed
+// The listener connection is released once no channels remain
+func (sess *session) unlisten(ctx context.Context, channel string) (bool, error) {
+	sess.listenMu.Lock()
+	defer sess.listenMu.Unlock()
+
+	if !sess.channels[channel] {
+		return false, nil
+	}
+
+	if err := sess.listener.Unlisten(ctx, channel); err != nil {
+		return true, err
+	}
+	delete(sess.channels, channel)
+
+	if len(sess.channels) == 0 {
+		err := sess.listener.Close()
+		sess.listener = nil
+		return true, err
+	}
+	return true, nil
+}
+
+// prepare prepares a named statement on the session's statement connection, opening it if
+// needed, and replaces any statement with the same name. It fails with errTooManyStatements if
+// the session already holds maxPreparedStatements other statements
+func (sess *session) prepare(ctx context.Context, name, sql string, open func() (postgres.StatementConn, error)) (*postgres.PreparedStatement, error) {
+	sess.stmtMu.Lock()
+	defer sess.stmtMu.Unlock()
+
+	if _, exists := sess.statements[name]; !exists && len(sess.statements) >= maxPreparedStatements {
+		return nil, errTooManyStatements
+	}
+
+	if sess.stmtConn == nil {
+		conn, err := open()
+		if err != nil {
+			return nil, err
+		}
+		sess.stmtConn = conn
+	}
+
+	statement, err := sess.stmtConn.Prepare(ctx, name, sql)
+	if err != nil {
+		sess.releaseStatements(ctx)
+		return nil, err
+	}
+	sess.statements[name] = sql
+	return statement, nil
+}
+
+// statement returns the SQL of a prepared statement and the connection that holds it
+func (sess *session) statement(name string) (string, postgres.StatementConn, bool) {
+	sess.stmtMu.Lock()
+	defer sess.stmtMu.Unlock()
+
+	sql, ok := sess.statements[name]
+	return sql, sess.stmtConn, ok
+}
+
+// deallocate removes a prepared statement, returning false if it wasn't prepared
+// The statement connection goes back to the pool with the last statement
+func (sess *session) deallocate(ctx context.Context, name string) (bool, error) {
+	sess.stmtMu.Lock()
+	defer sess.stmtMu.Unlock()
+
+	if _, ok := sess.statements[name]; !ok {
+		return false, nil
+	}
+	delete(sess.statements, name)
+
+	err := sess.stmtConn.Deallocate(ctx, name)
+	if releaseErr := sess.releaseStatements(ctx); err == nil {
+		err = releaseErr
+	}
+	return true, err
+}
+
+// releaseStatements closes the statement connection once it holds no statements
+// The caller holds stmtMu
+func (sess *session) releaseStatements(ctx context.Context) error {
+	if sess.stmtConn == nil || len(sess.statements) > 0 {
+		return nil
+	}
+	err := sess.stmtConn.Close(ctx)
+	sess.stmtConn = nil
+	return err
+}
+
+// reserveTx claims the session's transaction for a begin message, returning nil if one is already open
+// The begin must finish the reservation with startTx or abortTx
+func (sess *session) reserveTx(id string) *openTx {
+	sess.txMu.Lock()
+	defer sess.txMu.Unlock()
+
+	if sess.tx != nil {
+		return nil
+	}
+	sess.tx = &openTx{id: id, ready: make(chan struct{}), lastUsed: time.Now()}
+	return sess.tx
+}
+
+// startTx completes a reservation with the transaction that was begun
+// onIdle is called with the transaction once it has gone idleTimeout without a query
+// running; by then the session has already forgotten it. A zero idleTimeout disables this
+func (sess *session) startTx(open *openTx, tx postgres.Transaction, idleTimeout time.Duration, onIdle func(*openTx)) {
+	sess.txMu.Lock()
+	defer sess.txMu.Unlock()
+
+	open.tx = tx
+	open.lastUsed = time.Now()
+	close(open.ready)
+	// A commit or rollback may already have detached it
+	if idleTimeout > 0 && sess.tx == open {
+		open.timer = time.AfterFunc(idleTimeout, func() {
+			if sess.expireTx(open, idleTimeout) {
+				onIdle(open)
+			}
+		})
+	}
+}
+
+// abortTx releases a reservation whose begin failed; it does nothing once the begin has finished
+func (sess *session) abortTx(open *openTx, err error) {
+	sess.txMu.Lock()
+	defer sess.txMu.Unlock()
+
+	select {
+	case <-open.ready:
+		return
+	default:
+	}
+	open.err = err
+	close(open.ready)
+	if sess.tx == open {
+		sess.tx = nil
+	}
+}
+
+// wait returns the transaction once its begin has finished, or why it couldn't be begun
+func (open *openTx) wait(ctx context.Context) (postgres.Transaction, error) {
+	select {
+	case <-open.ready:
+		return open.tx, open.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// inTx reports whether an explicit transaction is open
+func (sess *session) inTx() bool {
+	sess.txMu.Lock()
+	defer sess.txMu.Unlock()
+	return sess.tx != nil
+}
+
+// acquireTx returns the open transaction, if any, and marks a query as running in it
+// Every non-nil result must be handed back with releaseTx
+func (sess *session) acquireTx() *openTx {
+	sess.txMu.Lock()
+	defer sess.txMu.Unlock()
+
+	open := sess.tx
+	if open == nil {
+		return nil
+	}
+	open.active++
+	open.queries.Add(1)
+	if open.timer != nil {
+		open.timer.Stop()
+	}
+	return open
+}
+
+// releaseTx marks a query in the transaction as finished, restarting its idle timer
+func (sess *session) releaseTx(open *openTx, idleTimeout time.Duration) {
+	sess.txMu.Lock()
+	defer sess.txMu.Unlock()
+
+	open.active--
+	open.lastUsed = time.Now()
+	open.queries.Done()
+	if open.active == 0 && sess.tx == open && open.timer != nil {
+		open.timer.Reset(idleTimeout)
+	}
+}
+
+// endTx detaches the open transaction so it can be committed or rolled back
+// Callers should wait on its queries before finishing it. Returns nil if none is open
+func (sess *session) endTx() *openTx {
+	sess.txMu.Lock()
+	defer sess.txMu.Unlock()
+
+	open := sess.tx
+	if open != nil && open.timer != nil {
+		open.timer.Stop()
+	}
+	sess.tx = nil
+	return open
+}
+
+// expireTx detaches a transaction that is still open and has been idle for idleTimeout
+func (sess *session) expireTx(open *openTx, idleTimeout time.Duration) bool {
+	sess.txMu.Lock()
+	defer sess.txMu.Unlock()
+
+	// The timer may have fired just as a query started or finished
+	if sess.tx != open || open.active > 0 || time.Since(open.lastUsed) < idleTimeout {
+		return false
+	}
+	sess.tx = nil
+	return true
+}
+
+// close cancels every in-flight query, waits for their handlers to finish, rolls back any open
+// transaction, and releases the listener and statement connections
+func (sess *session) close() {
+	sess.mu.Lock()
+	for _, cancel := range sess.running {
+		cancel()
+	}
+	sess.mu.Unlock()
+
+	sess.wg.Wait()
+
+	// Handlers have finished, so any begin has too
+	if open := sess.endTx(); open != nil && open.tx != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), defaultTransactionTimeout)
+		_ = open.tx.Rollback(ctx)
+		cancel()
+	}
+
+	sess.listenMu.Lock()
+	if sess.listener != nil {
+		_ = sess.listener.Close()
+		sess.listener = nil
+	}
+	sess.listenMu.Unlock()
+
+	sess.stmtMu.Lock()
+	defer sess.stmtMu.Unlock()
+	if sess.stmtConn != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), defaultPrepareTimeout)
+		_ = sess.stmtConn.Close(ctx)
+		cancel()
+		sess.stmtConn = nil
+	}
+}
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/postgres"
+)
+
+func TestSession_TrackAndCancel(t *testing.T) {
+	sess := newSession(nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if !sess.track("query-1", cancel) {
+		t.Fatal("Expected first track to succeed")
+	}
+
+	if sess.track("query-1", func() {}) {
+		t.Error("Expected tracking a duplicate ID to fail")
+	}
+
+	if !sess.cancel("query-1") {
+		t.Error("Expected cancel of a running query to succeed")
+	}
+	if ctx.Err() == nil {
+		t.Error("Expected query context to be canceled")
+	}
+
+	if sess.cancel("query-2") {
+		t.Error("Expected cancel of an unknown query to fail")
+	}
+}
+
+func TestSession_Untrack(t *testing.T) {
+	sess := newSession(nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sess.track("query-1", cancel)
+	sess.untrack("query-1")
+
+	if ctx.Err() == nil {
+		t.Error("Expected untrack to release the query context")
+	}
+	if sess.cancel("query-1") {
+		t.Error("Expected cancel after untrack to fail")
+	}
+	if !sess.track("query-1", func() {}) {
+		t.Error("Expected ID to be reusable after untrack")
+	}
+}
+
+func TestSession_AcquireSlot(t *testing.T) {
+	sess := newSession(nil)
+	if !sess.acquireSlot(context.Background()) {
+		t.Error("Expected a session without a limit to always get a slot")
+	}
+	sess.releaseSlot()
+
+	sess.slots = make(chan struct{}, 1)
+	if !sess.acquireSlot(context.Background()) {
+		t.Fatal("Expected the first slot to be free")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if sess.acquireSlot(ctx) {
+		t.Fatal("Expected acquiring a second slot to wait until ctx is done")
+	}
+
+	sess.releaseSlot()
+	if !sess.acquireSlot(context.Background()) {
+		t.Error("Expected the released slot to be free again")
+	}
+}
+
+func TestSession_Drain(t *testing.T) {
+	sess := newSession(nil)
+	sess.track("query-1", func() {})
+
+	idle := sess.drain()
+	if !sess.isDraining() {
+		t.Error("Expected session to be draining")
+	}
+	if sess.track("query-2", func() {}) {
+		t.Error("Expected tracking to fail while draining")
+	}
+
+	select {
+	case <-idle:
+		t.Fatal("Expected drain to wait for the running query")
+	default:
+	}
+
+	sess.untrack("query-1")
+	select {
+	case <-idle:
+	case <-time.After(time.Second):
+		t.Fatal("Expected drain to finish once the query was untracked")
+	}
+
+	// Draining an idle session finishes straight away
+	select {
+	case <-sess.drain():
+	default:
+		t.Error("Expected a second drain to be done already")
+	}
+}
+
+func TestSession_CloseCancelsRunningQueries(t *testing.T) {
+	sess := newSession(nil)
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	sess.track("query-1", cancel1)
+	sess.track("query-2", cancel2)
+
+	sess.close()
+
+	if ctx1.Err() == nil || ctx2.Err() == nil {
+		t.Error("Expected close to cancel all running queries")
+	}
+}
+
+func TestSession_TransactionIdleExpiry(t *testing.T) {
+	sess := newSession(nil)
+	tx := &MockTransaction{}
+
+	expired := make(chan *openTx, 1)
+	reserved := sess.reserveTx("begin-1")
+	if reserved == nil {
+		t.Fatal("Expected reserveTx to succeed")
+	}
+	if sess.reserveTx("begin-2") != nil {
+		t.Error("Expected a second reserveTx to fail while one is open")
+	}
+	sess.startTx(reserved, tx, 20*time.Millisecond, func(open *openTx) { expired <- open })
+
+	// A running query keeps the transaction alive past the timeout
+	open := sess.acquireTx()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-expired:
+		t.Fatal("Transaction expired while a query was running")
+	default:
+	}
+	sess.releaseTx(open, 20*time.Millisecond)
+
+	select {
+	case got := <-expired:
+		if got.id != "begin-1" || got.tx != tx {
+			t.Errorf("Unexpected expired transaction: %+v", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the idle transaction to expire")
+	}
+
+	if sess.inTx() || sess.acquireTx() != nil {
+		t.Error("Expected no transaction after expiry")
+	}
+}
+
+func TestSession_EndTxStopsIdleTimer(t *testing.T) {
+	sess := newSession(nil)
+
+	sess.startTx(sess.reserveTx("begin-1"), &MockTransaction{}, 20*time.Millisecond, func(*openTx) {
+		t.Error("Expected an ended transaction not to expire")
+	})
+	if open := sess.endTx(); open == nil || open.id != "begin-1" {
+		t.Fatalf("Expected endTx to return the open transaction, got %+v", open)
+	}
+	if sess.endTx() != nil {
+		t.Error("Expected endTx to return nil once the transaction has ended")
+	}
+	time.Sleep(50 * time.Millisecond)
+}
+
+func TestSession_ReservedTransaction(t *testing.T) {
+	sess := newSession(nil)
+	tx := &MockTransaction{}
+
+	// A query claiming the transaction before the begin finishes waits for it
+	reserved := sess.reserveTx("begin-1")
+	open := sess.acquireTx()
+	if open != reserved {
+		t.Fatal("Expected a query to claim the reserved transaction")
+	}
+	got := make(chan postgres.Transaction, 1)
+	go func() {
+		claimed, _ := open.wait(context.Background())
+		got <- claimed
+	}()
+	sess.startTx(reserved, tx, 0, nil)
+	if claimed := <-got; claimed != tx {
+		t.Errorf("Expected the begun transaction, got %v", claimed)
+	}
+	sess.releaseTx(open, 0)
+	sess.endTx()
+
+	// A failed begin frees the session for another and reports why to waiting queries
+	reserved = sess.reserveTx("begin-2")
+	beginErr := errors.New("connection refused")
+	sess.abortTx(reserved, beginErr)
+	if _, err := reserved.wait(context.Background()); !errors.Is(err, beginErr) {
+		t.Errorf("Expected the begin error, got %v", err)
+	}
+	if sess.inTx() {
+		t.Error("Expected no transaction after the begin failed")
+	}
+
+	// Aborting a begun transaction does nothing
+	reserved = sess.reserveTx("begin-3")
+	sess.startTx(reserved, tx, 0, nil)
+	sess.abortTx(reserved, beginErr)
+	if claimed, err := reserved.wait(context.Background()); err != nil || claimed != tx || !sess.inTx() {
+		t.Errorf("Expected the transaction to stay open, got %v, %v", claimed, err)
+	}
+}
@@ -3,21 +3,241 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/MPJHorner/PostgresMaster/proxy/pkg/auth"
 	"github.com/MPJHorner/PostgresMaster/proxy/pkg/postgres"
 	"github.com/MPJHorner/PostgresMaster/proxy/pkg/protocol"
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/sqlutil"
 	"github.com/gorilla/websocket"
 )
 
 // PostgresClient defines the interface for Postgres operations
 type PostgresClient interface {
 	ExecuteQuery(ctx context.Context, sql string, params []interface{}) (*postgres.QueryResult, error)
-	IntrospectSchema(ctx context.Context) (*protocol.SchemaPayload, error)
+	StreamQuery(ctx context.Context, sql string, params []interface{}, batchSize int, fn postgres.RowBatchFunc) (*postgres.QueryResult, error)
+	ExecuteScript(ctx context.Context, statements []string, transactional bool) (*postgres.ScriptResult, error)
+	IntrospectSchema(ctx context.Context, schemas []string) (*protocol.SchemaPayload, error)
+	NewListener(ctx context.Context, fn postgres.NotificationFunc) (postgres.Listener, error)
+	BeginTransaction(ctx context.Context) (postgres.Transaction, error)
+	Prepare(ctx context.Context, sql string) (*postgres.PreparedStatement, error)
+	NewStatementConn(ctx context.Context) (postgres.StatementConn, error)
+	CopyOut(ctx context.Context, sql string, w io.Writer) (*postgres.CopyResult, error)
+	Ping(ctx context.Context) error
+	Stats() postgres.PoolStats
+	State() postgres.ConnectionState
+	DatabaseName() string
+}
+
+// queryExecutor runs queries either on the pool or inside an explicit transaction
+type queryExecutor interface {
+	ExecuteQuery(ctx context.Context, sql string, params []interface{}) (*postgres.QueryResult, error)
+	StreamQuery(ctx context.Context, sql string, params []interface{}, batchSize int, fn postgres.RowBatchFunc) (*postgres.QueryResult, error)
+}
+
+// Subprotocol is the WebSocket subprotocol the proxy speaks
+// A browser sending its secret as a secret.<secret> subprotocol must offer this one too, since
+// the handshake fails unless the server picks one of the subprotocols the browser offered
+const Subprotocol = "postgres-proxy"
+
+// secretSubprotocolPrefix marks the subprotocol that carries the secret
+const secretSubprotocolPrefix = "secret."
+
+// readOnlyHint tells the user why a write was rejected before it reached the database
+const readOnlyHint = "The proxy was started with --read-only; restart it without that flag to run writes"
+
+// shutdownReason is sent in the close frame when the server shuts down
+const shutdownReason = "server shutting down"
+
+// idleReason is sent in the close frame when a client has been idle for longer than IdleTimeout
+const idleReason = "idle timeout"
+
+// Defaults used when the client or operator doesn't choose
+const (
+	DefaultStreamBatchSize        = 500
+	DefaultQueryTimeout           = 30 * time.Second
+	DefaultMaxQueryTimeout        = 5 * time.Minute
+	DefaultIdleTransactionTimeout = 5 * time.Minute
+	DefaultMaxRows                = 10000
+	DefaultMaxRowsCeiling         = 1000000
+	DefaultLogQueryLength         = 200
+	DefaultPingInterval           = 30 * time.Second
+	DefaultIdleTimeout            = 0
+	DefaultMaxConcurrentQueries   = 4
+	DefaultMaxQueriesPerSecond    = 0
+	DefaultMaxConnections         = 0
+	DefaultMaxCopyBytes           = 1 << 30 // 1 GiB
+	DefaultMaxMessageBytes        = 1 << 20 // 1 MiB
+	defaultIntrospectTimeout      = 30 * time.Second
+	defaultListenTimeout          = 10 * time.Second
+	defaultTransactionTimeout     = 10 * time.Second // for BEGIN, COMMIT and ROLLBACK themselves
+	defaultHealthTimeout          = 2 * time.Second
+	defaultPrepareTimeout         = 10 * time.Second
+	maxPreparedStatements         = 100 // per connection
+	defaultWriteWait              = 10 * time.Second
+)
+
+// errBeginCanceled is why a begin cancelled before it reached the database left no transaction
+var errBeginCanceled = fmt.Errorf("%w before the transaction began", postgres.ErrQueryCanceled)
+
+// DefaultAllowedOrigins are the browser origins allowed to connect when none are configured:
+// the usual local dev server ports
+var DefaultAllowedOrigins = []string{
+	"http://localhost:5173",
+	"http://localhost:3000",
+	"http://127.0.0.1:5173",
+	"http://127.0.0.1:3000",
+}
+
+// AllowAllOrigins in AllowedOrigins lets any browser origin connect; meant for development
+const AllowAllOrigins = "*"
+
+// Options configures the behavior of a Server
+type Options struct {
+	ReadOnly            bool          // Reject statements that modify data, schema, or privileges
+	StreamBatchSize     int           // Rows per result_chunk for streamed queries
+	DefaultQueryTimeout time.Duration // Applied when a query doesn't specify a timeout; zero disables
+	MaxQueryTimeout     time.Duration // Upper bound on any query timeout, including client requests; zero disables
+	// Roll back an explicit transaction after this long without a query; zero disables
+	IdleTransactionTimeout time.Duration
+	MaxRows                int // Rows returned by a buffered query that doesn't set maxRows; zero disables
+	MaxRowsCeiling         int // Upper bound on any row limit, including client requests; zero disables
+	// Browser origins allowed to open a WebSocket, matched exactly, or AllowAllOrigins.
+	// Clients that send no Origin header, such as scripts, are always allowed
+	AllowedOrigins []string
+	// Send a WebSocket ping this often and close the connection if no pong arrives within two
+	// intervals, so peers that vanished behind a proxy are noticed; zero disables
+	PingInterval time.Duration
+	// Close a connection after this long without a message from the client, such as a forgotten
+	// tab. Pongs don't count, and nor do running queries, so it needs a MaxQueryTimeout and must
+	// be at least that long. Zero disables
+	IdleTimeout    time.Duration
+	LogQueries     bool // Log every query with its SQL, row count and duration
+	LogQueryLength int  // Characters of SQL kept in a query log line; zero logs the whole query
+	// Queries, exports and other messages that reach the database one connection may run at
+	// once; later ones wait for a free slot and can be cancelled while they wait. Zero removes the limit
+	MaxConcurrentQueries int
+	// Queries, exports, prepares and introspections one connection may send per second, with
+	// bursts up to the same number; more get a RATE_LIMITED error. Zero removes the limit
+	MaxQueriesPerSecond int
+	// WebSocket connections open at once; further upgrades are refused with 503. Zero removes the limit
+	MaxConnections int
+	// Bytes of CSV a copy_out may produce before it's stopped with an error; zero removes the limit
+	MaxCopyBytes int64
+	// Proxy build reported in the hello message and by /version
+	Build protocol.BuildInfo
+	// Offer permessage-deflate so clients that support it get compressed messages
+	Compression bool
+	// Largest message a client may send; a bigger one closes the connection. Zero removes the limit
+	MaxMessageBytes int64
+}
+
+// DefaultOptions returns the options used when nothing is overridden
+func DefaultOptions() Options {
+	return Options{
+		StreamBatchSize:        DefaultStreamBatchSize,
+		DefaultQueryTimeout:    DefaultQueryTimeout,
+		MaxQueryTimeout:        DefaultMaxQueryTimeout,
+		IdleTransactionTimeout: DefaultIdleTransactionTimeout,
+		MaxRows:                DefaultMaxRows,
+		MaxRowsCeiling:         DefaultMaxRowsCeiling,
+		AllowedOrigins:         DefaultAllowedOrigins,
+		LogQueryLength:         DefaultLogQueryLength,
+		PingInterval:           DefaultPingInterval,
+		IdleTimeout:            DefaultIdleTimeout,
+		MaxConcurrentQueries:   DefaultMaxConcurrentQueries,
+		MaxQueriesPerSecond:    DefaultMaxQueriesPerSecond,
+		MaxConnections:         DefaultMaxConnections,
+		MaxCopyBytes:           DefaultMaxCopyBytes,
+		MaxMessageBytes:        DefaultMaxMessageBytes,
+	}
+}
+
+// Validate checks that the options are consistent
+func (o Options) Validate() error {
+	if o.StreamBatchSize < 0 {
+		return fmt.Errorf("stream batch size cannot be negative, got %d", o.StreamBatchSize)
+	}
+	if o.DefaultQueryTimeout < 0 {
+		return fmt.Errorf("default query timeout cannot be negative, got %v", o.DefaultQueryTimeout)
+	}
+	if o.MaxQueryTimeout < 0 {
+		return fmt.Errorf("max query timeout cannot be negative, got %v", o.MaxQueryTimeout)
+	}
+	if o.IdleTransactionTimeout < 0 {
+		return fmt.Errorf("idle transaction timeout cannot be negative, got %v", o.IdleTransactionTimeout)
+	}
+	if o.MaxQueryTimeout > 0 && o.DefaultQueryTimeout > o.MaxQueryTimeout {
+		return fmt.Errorf("default query timeout (%v) cannot exceed max query timeout (%v)", o.DefaultQueryTimeout, o.MaxQueryTimeout)
+	}
+	if o.MaxRows < 0 {
+		return fmt.Errorf("max rows cannot be negative, got %d", o.MaxRows)
+	}
+	if o.MaxRowsCeiling < 0 {
+		return fmt.Errorf("max rows ceiling cannot be negative, got %d", o.MaxRowsCeiling)
+	}
+	if o.MaxRowsCeiling > 0 && o.MaxRows > o.MaxRowsCeiling {
+		return fmt.Errorf("max rows (%d) cannot exceed max rows ceiling (%d)", o.MaxRows, o.MaxRowsCeiling)
+	}
+	if o.PingInterval < 0 {
+		return fmt.Errorf("ping interval cannot be negative, got %v", o.PingInterval)
+	}
+	if o.IdleTimeout < 0 {
+		return fmt.Errorf("idle timeout cannot be negative, got %v", o.IdleTimeout)
+	}
+	if o.IdleTimeout > 0 && o.MaxQueryTimeout == 0 {
+		return fmt.Errorf("idle timeout (%v) needs a max query timeout, or it could close a connection waiting for a query that has no time limit", o.IdleTimeout)
+	}
+	if o.IdleTimeout > 0 && o.IdleTimeout < o.MaxQueryTimeout {
+		return fmt.Errorf("idle timeout (%v) cannot be shorter than max query timeout (%v), or it could close a connection waiting for a query", o.IdleTimeout, o.MaxQueryTimeout)
+	}
+	if o.LogQueryLength < 0 {
+		return fmt.Errorf("log query length cannot be negative, got %d", o.LogQueryLength)
+	}
+	if o.MaxConcurrentQueries < 0 {
+		return fmt.Errorf("max concurrent queries cannot be negative, got %d", o.MaxConcurrentQueries)
+	}
+	if o.MaxQueriesPerSecond < 0 {
+		return fmt.Errorf("max queries per second cannot be negative, got %d", o.MaxQueriesPerSecond)
+	}
+	if o.MaxConnections < 0 {
+		return fmt.Errorf("max connections cannot be negative, got %d", o.MaxConnections)
+	}
+	if o.MaxCopyBytes < 0 {
+		return fmt.Errorf("max copy bytes cannot be negative, got %d", o.MaxCopyBytes)
+	}
+	if o.MaxMessageBytes < 0 {
+		return fmt.Errorf("max message bytes cannot be negative, got %d", o.MaxMessageBytes)
+	}
+	for _, origin := range o.AllowedOrigins {
+		if err := validateOrigin(origin); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateOrigin checks that an allowed origin is AllowAllOrigins or a scheme and host with nothing else
+func validateOrigin(origin string) error {
+	if origin == AllowAllOrigins {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+		u.Path != "" || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return fmt.Errorf("invalid allowed origin %q: expected a scheme and host such as http://localhost:4321", origin)
+	}
+	return nil
 }
 
 // Server represents a WebSocket server
@@ -25,36 +245,99 @@ type Server struct {
 	secret   string
 	upgrader websocket.Upgrader
 	pgClient PostgresClient
+	// Every database clients can select by name, including pgClient as DefaultDatabase
+	databases map[string]PostgresClient
+	opts      Options
+	metrics   *serverMetrics
+	// Optional features, fixed by the options the server was started with
+	capabilities protocol.Capabilities
+
+	sessMu   sync.Mutex
+	sessions map[*session]struct{} // open WebSocket connections, told to go away on shutdown
+	closing  bool
+	connWG   sync.WaitGroup
+	active   atomic.Int64 // connections being upgraded or open, checked against MaxConnections
 }
 
 // NewServer creates a new WebSocket server
-func NewServer(secret string, pgClient PostgresClient) *Server {
+func NewServer(secret string, pgClient PostgresClient, opts Options) *Server {
 	return &Server{
-		secret:   secret,
-		pgClient: pgClient,
+		secret:    secret,
+		pgClient:  pgClient,
+		databases: map[string]PostgresClient{DefaultDatabase: pgClient},
+		opts:      opts,
+		metrics:   newServerMetrics(pgClient),
+		capabilities: protocol.Capabilities{
+			Streaming:     true,
+			Cancel:        true,
+			Transactions:  true,
+			Listen:        true,
+			Export:        true,
+			Prepare:       true,
+			Scripts:       true,
+			Explain:       true,
+			ReadOnly:      opts.ReadOnly,
+			RateLimited:   opts.MaxQueriesPerSecond > 0,
+			BinaryResults: true,
+			Compression:   opts.Compression,
+		},
+		sessions: make(map[*session]struct{}),
 		upgrader: websocket.Upgrader{
-			CheckOrigin: func(r *http.Request) bool {
-				// Allow connections from localhost only
-				origin := r.Header.Get("Origin")
-				return origin == "http://localhost:5173" ||
-					origin == "http://localhost:3000" ||
-					origin == "http://127.0.0.1:5173" ||
-					origin == "http://127.0.0.1:3000" ||
-					origin == "" // Allow non-browser clients
-			},
+			CheckOrigin:       originChecker(opts.AllowedOrigins),
+			Subprotocols:      []string{Subprotocol},
+			EnableCompression: opts.Compression,
 		},
 	}
 }
 
+// originChecker returns a CheckOrigin function that only accepts the allowed origins
+// Rejections are logged, since the browser only reports a failed upgrade
+func originChecker(allowed []string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true // Allow non-browser clients
+		}
+		for _, a := range allowed {
+			if a == AllowAllOrigins || strings.EqualFold(a, origin) {
+				return true
+			}
+		}
+		log.Printf("Rejected WebSocket connection from origin %q; allow it with --allowed-origins", origin)
+		return false
+	}
+}
+
 // HandleConnection upgrades HTTP connection to WebSocket and handles messages
 func (s *Server) HandleConnection(w http.ResponseWriter, r *http.Request) {
-	// Extract secret from query parameter
-	clientSecret := r.URL.Query().Get("secret")
-	if !auth.ValidateSecret(clientSecret) || clientSecret != s.secret {
+	// The secret may come in a header, a subprotocol or the query string
+	clientSecret := requestSecret(r)
+	if !auth.ValidateSecret(clientSecret) || !auth.CompareSecret(clientSecret, s.secret) {
 		http.Error(w, "Invalid secret", http.StatusUnauthorized)
 		return
 	}
 
+	// A path like /db/analytics picks the database the connection's queries run on
+	dbName := databaseFromPath(r.URL.Path)
+	db, ok := s.clientFor(nil, dbName)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown database: %s", dbName), http.StatusNotFound)
+		return
+	}
+	if dbName == "" {
+		dbName = DefaultDatabase
+	}
+
+	// Claim a connection before upgrading so a storm of clients can't get past the limit together
+	active := s.active.Add(1)
+	defer s.active.Add(-1)
+	if limit := s.opts.MaxConnections; limit > 0 && active > int64(limit) {
+		log.Printf("Rejected WebSocket connection: %d connections already open; raise the limit with --max-connections", limit)
+		http.Error(w, fmt.Sprintf("Too many connections: the proxy allows %d at once; close another tab or try again later", limit),
+			http.StatusServiceUnavailable)
+		return
+	}
+
 	// Upgrade connection to WebSocket
 	conn, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -66,24 +349,64 @@ func (s *Server) HandleConnection(w http.ResponseWriter, r *http.Request) {
 			log.Printf("Error closing connection: %v", err)
 		}
 	}()
+	// Set before anything is written, since it can't change while a write is in progress.
+	// It has no effect unless the client negotiated compression
+	conn.EnableWriteCompression(s.opts.Compression)
+	// A bigger message is refused as its header arrives, so it's never buffered
+	if s.opts.MaxMessageBytes > 0 {
+		conn.SetReadLimit(s.opts.MaxMessageBytes)
+	}
+
+	log.Printf("Client connected to database %s", db.DatabaseName())
+	s.metrics.connections.Inc()
+	defer s.metrics.connections.Dec()
+
+	sess := newSession(conn)
+	sess.db = db
+	if s.opts.MaxConcurrentQueries > 0 {
+		sess.slots = make(chan struct{}, s.opts.MaxConcurrentQueries)
+	}
+	sess.limiter = newRateLimiter(s.opts.MaxQueriesPerSecond)
+	if !s.addSession(sess) {
+		_ = sess.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, shutdownReason))
+		return
+	}
+	defer s.removeSession(sess)
+	defer sess.close()
 
-	log.Println("Client connected")
+	if s.opts.PingInterval > 0 {
+		stop := sess.keepAlive(s.opts.PingInterval)
+		defer stop()
+	}
+
+	// Greet the client so it can adapt to the server before sending anything
+	if err := sess.send(protocol.NewHello(s.opts.Build, dbName, db.DatabaseName(), string(db.State()), s.capabilities)); err != nil {
+		log.Printf("Failed to send hello: %v", err)
+		return
+	}
 
 	// Message handling loop
+	sess.extendIdle(s.opts.IdleTimeout)
 	for {
 		var msg protocol.ClientMessage
 		if err := conn.ReadJSON(&msg); err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && sess.idleExpired() {
+				log.Printf("Closing connection: no message for %v; raise the limit with --idle-timeout", s.opts.IdleTimeout)
+				_ = sess.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, idleReason))
+			} else if errors.As(err, &netErr) && netErr.Timeout() {
+				log.Println("Closing connection: client stopped answering pings")
+			} else if errors.Is(err, websocket.ErrReadLimit) {
+				// gorilla/websocket has already sent a 1009 "message too big" close frame
+				log.Printf("Closing connection: client sent a message over %d bytes; raise the limit with --max-message-bytes", s.opts.MaxMessageBytes)
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("WebSocket error: %v", err)
 			}
 			break
 		}
+		sess.extendIdle(s.opts.IdleTimeout)
 
-		// Handle message based on type
-		response := s.handleMessage(msg)
-
-		// Send response
-		if err := conn.WriteJSON(response); err != nil {
+		if err := s.dispatch(sess, msg); err != nil {
 			log.Printf("Failed to send response: %v", err)
 			break
 		}
@@ -92,22 +415,267 @@ func (s *Server) HandleConnection(w http.ResponseWriter, r *http.Request) {
 	log.Println("Client disconnected")
 }
 
+// addSession registers an open connection so Shutdown can close it
+// Returns false once the server is shutting down
+func (s *Server) addSession(sess *session) bool {
+	s.sessMu.Lock()
+	defer s.sessMu.Unlock()
+
+	if s.closing {
+		return false
+	}
+	s.sessions[sess] = struct{}{}
+	s.connWG.Add(1)
+	return true
+}
+
+// removeSession forgets a connection once its handler has finished
+func (s *Server) removeSession(sess *session) {
+	s.sessMu.Lock()
+	delete(s.sessions, sess)
+	s.sessMu.Unlock()
+	s.connWG.Done()
+}
+
+// Shutdown gracefully closes every WebSocket connection
+// http.Server.Shutdown doesn't track upgraded connections, so call this alongside it.
+// Clients get a close frame with a "server shutting down" reason once their running queries
+// finish; connections still open when ctx is done are closed abruptly
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.sessMu.Lock()
+	s.closing = true
+	sessions := make([]*session, 0, len(s.sessions))
+	for sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	s.sessMu.Unlock()
+
+	for _, sess := range sessions {
+		go sess.goAway(ctx)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.connWG.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		for _, sess := range sessions {
+			_ = sess.conn.Close()
+		}
+		return ctx.Err()
+	}
+}
+
+// dispatch handles a message in the context of its connection
+// Queries run in the background so the read loop stays free to receive cancel requests,
+// at most Options.MaxConcurrentQueries at a time per connection
+// A panic in a handler is answered with an INTERNAL_ERROR and the connection carries on
+func (s *Server) dispatch(sess *session, msg protocol.ClientMessage) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = sess.send(panicResponse(msg.ID, p))
+		}
+	}()
+
+	switch msg.Type {
+	case protocol.TypeQuery, protocol.TypeExport, protocol.TypeCopyOut, protocol.TypePreview, protocol.TypePrepare, protocol.TypeDescribe, protocol.TypeIntrospect:
+		// Only messages that reach the database count; cancel and ping must always get through
+		if ok, wait := sess.limiter.allow(); !ok {
+			return sess.send(rateLimited(msg.ID, wait))
+		}
+	}
+
+	switch msg.Type {
+	case protocol.TypeQuery, protocol.TypeExport, protocol.TypeCopyOut, protocol.TypePreview,
+		protocol.TypePrepare, protocol.TypeDescribe, protocol.TypeIntrospect, protocol.TypeBegin,
+		protocol.TypeListen, protocol.TypeUnlisten, protocol.TypeDeallocate:
+		ctx, cancel := context.WithCancel(context.Background())
+		if !sess.track(msg.ID, cancel) {
+			cancel()
+			if sess.isDraining() {
+				return sess.send(protocol.NewErrorWithHint(msg.ID, "SERVER_SHUTTING_DOWN",
+					"The server is shutting down", "Reconnect once the proxy is back up"))
+			}
+			return sess.send(protocol.NewErrorWithHint(msg.ID, "DUPLICATE_QUERY_ID",
+				fmt.Sprintf("A query with ID %s is already running", msg.ID), "Give each message a unique id"))
+		}
+
+		var open, begun *openTx
+		var prev <-chan struct{} // closed once the messages this one must follow have finished
+		var done chan struct{}   // closed once this message has finished, for the messages that follow it
+		switch msg.Type {
+		case protocol.TypeBegin:
+			// Reserve the transaction now so queries sent right after the begin run in it
+			if begun = sess.reserveTx(msg.ID); begun == nil {
+				sess.untrack(msg.ID)
+				return sess.send(protocol.NewError(msg.ID, "TRANSACTION_ALREADY_OPEN", "A transaction is already open on this connection", ""))
+			}
+		case protocol.TypeQuery, protocol.TypeExport, protocol.TypeCopyOut, protocol.TypePreview:
+			// Claim the transaction now so a commit sent right after this query waits for it
+			open = sess.acquireTx()
+			if msg.Type == protocol.TypeQuery {
+				// A query sent right after a prepare can run the statement
+				prev = sess.stmtOrder.after()
+			}
+		case protocol.TypeListen, protocol.TypeUnlisten:
+			// Keep their order so an unlisten sent right after a listen finds the channel
+			prev, done = sess.listenOrder.next()
+		case protocol.TypePrepare, protocol.TypeDeallocate:
+			// Keep their order so a deallocate sent right after a prepare finds the statement
+			prev, done = sess.stmtOrder.next()
+		}
+
+		sess.wg.Add(1)
+		go func() {
+			defer sess.wg.Done()
+			defer sess.untrack(msg.ID)
+			if begun != nil {
+				// Covers a begin cancelled before it got a slot, or one that panicked
+				defer sess.abortTx(begun, errBeginCanceled)
+			}
+
+			// Wait for a begin sent just before this query, without holding a slot the begin may need
+			var tx postgres.Transaction
+			if open != nil {
+				defer sess.releaseTx(open, s.opts.IdleTransactionTimeout)
+				var err error
+				if tx, err = open.wait(ctx); err != nil {
+					if sendErr := sess.send(transactionNotBegun(msg.ID, err)); sendErr != nil {
+						log.Printf("Failed to send query result: %v", sendErr)
+					}
+					return
+				}
+			}
+			if done != nil {
+				defer close(done)
+			}
+			if prev != nil {
+				select {
+				case <-prev:
+				case <-ctx.Done():
+					err := fmt.Errorf("%w while waiting for an earlier message on this connection to finish", postgres.ErrQueryCanceled)
+					if sendErr := sess.send(queryError(msg.ID, err)); sendErr != nil {
+						log.Printf("Failed to send query result: %v", sendErr)
+					}
+					return
+				}
+			}
+
+			if !sess.acquireSlot(ctx) {
+				err := fmt.Errorf("%w while waiting for another query on this connection to finish", postgres.ErrQueryCanceled)
+				if sendErr := sess.send(queryError(msg.ID, err)); sendErr != nil {
+					log.Printf("Failed to send query result: %v", sendErr)
+				}
+				return
+			}
+			defer sess.releaseSlot()
+
+			handle := s.handleQuery
+			switch msg.Type {
+			case protocol.TypeExport:
+				handle = s.handleExport
+			case protocol.TypeCopyOut:
+				handle = s.handleCopyOut
+			case protocol.TypePreview:
+				handle = s.handlePreview
+			case protocol.TypePrepare:
+				handle = withoutTx(s.handlePrepare)
+			case protocol.TypeDeallocate:
+				handle = withoutTx(s.handleDeallocate)
+			case protocol.TypeDescribe:
+				handle = withoutTx(s.handleDescribe)
+			case protocol.TypeIntrospect:
+				handle = withoutTx(s.handleIntrospect)
+			case protocol.TypeListen:
+				handle = withoutTx(s.handleListen)
+			case protocol.TypeUnlisten:
+				handle = withoutTx(s.handleUnlisten)
+			case protocol.TypeBegin:
+				handle = func(ctx context.Context, sess *session, _ postgres.Transaction, msg protocol.ClientMessage) protocol.ServerMessage {
+					return s.handleBegin(ctx, sess, begun, msg)
+				}
+			}
+			response := recovered(msg.ID, func() protocol.ServerMessage {
+				return handle(ctx, sess, tx, msg)
+			})
+			if err := sess.send(response); err != nil {
+				log.Printf("Failed to send query result: %v", err)
+			}
+		}()
+		return nil
+	case protocol.TypeCommit, protocol.TypeRollback:
+		open := sess.endTx()
+		if open == nil {
+			return sess.send(protocol.NewError(msg.ID, "NO_TRANSACTION", "No transaction is open", ""))
+		}
+
+		// Finishing waits for queries already sent in the transaction, so keep the read loop free
+		sess.wg.Add(1)
+		go func() {
+			defer sess.wg.Done()
+
+			response := recovered(msg.ID, func() protocol.ServerMessage {
+				return s.handleEndTransaction(open, msg)
+			})
+			if err := sess.send(response); err != nil {
+				log.Printf("Failed to send transaction status: %v", err)
+			}
+		}()
+		return nil
+	case protocol.TypeCancel:
+		return sess.send(s.handleCancel(sess, msg))
+	case protocol.TypeCapabilities:
+		return sess.send(s.handleCapabilities(sess, msg))
+	case protocol.TypePing:
+		return sess.send(s.handlePing(sess, msg))
+	default:
+		return sess.send(s.handleMessage(msg))
+	}
+}
+
+// withoutTx adapts a handler that never runs in the connection's transaction to dispatch's handler type
+func withoutTx(handle func(context.Context, *session, protocol.ClientMessage) protocol.ServerMessage) func(context.Context, *session, postgres.Transaction, protocol.ClientMessage) protocol.ServerMessage {
+	return func(ctx context.Context, sess *session, _ postgres.Transaction, msg protocol.ClientMessage) protocol.ServerMessage {
+		return handle(ctx, sess, msg)
+	}
+}
+
 // handleMessage routes messages to appropriate handlers
 func (s *Server) handleMessage(msg protocol.ClientMessage) protocol.ServerMessage {
 	switch msg.Type {
 	case protocol.TypePing:
-		return protocol.NewPong(msg.ID)
+		return s.handlePing(nil, msg)
 	case protocol.TypeQuery:
-		return s.handleQuery(msg)
+		return s.handleQuery(context.Background(), nil, nil, msg)
 	case protocol.TypeIntrospect:
-		return s.handleIntrospect(msg)
+		return s.handleIntrospect(context.Background(), nil, msg)
+	case protocol.TypeCapabilities:
+		return s.handleCapabilities(nil, msg)
 	default:
 		return protocol.NewError(msg.ID, "INVALID_MESSAGE_TYPE", fmt.Sprintf("Unknown message type: %s", msg.Type), "")
 	}
 }
 
+// handlePing answers a ping with the state of the connection's database pool
+func (s *Server) handlePing(sess *session, msg protocol.ClientMessage) protocol.ServerMessage {
+	db, _ := s.clientFor(sess, "")
+	stats := db.Stats()
+	return protocol.NewPongWithPool(msg.ID, protocol.PoolStatus{
+		Total:    stats.Total,
+		Idle:     stats.Idle,
+		Acquired: stats.Acquired,
+		Max:      stats.Max,
+		Queued:   stats.Queued,
+	})
+}
+
 // handleQuery processes query execution requests
-func (s *Server) handleQuery(msg protocol.ClientMessage) protocol.ServerMessage {
+func (s *Server) handleQuery(ctx context.Context, sess *session, tx postgres.Transaction, msg protocol.ClientMessage) protocol.ServerMessage {
 	// Parse the payload
 	payloadBytes, err := json.Marshal(msg.Payload)
 	if err != nil {
@@ -119,38 +687,602 @@ func (s *Server) handleQuery(msg protocol.ClientMessage) protocol.ServerMessage
 		return protocol.NewError(msg.ID, "INVALID_PAYLOAD", "Failed to unmarshal query payload", err.Error())
 	}
 
+	return s.runQuery(ctx, sess, tx, msg.ID, payload)
+}
+
+// runQuery validates and executes a query independently of the transport it arrived on
+// The query is aborted if ctx is canceled. Streaming requires a session to send
+// chunks on; without one (sess is nil) results are always buffered. If tx is not
+// nil the query runs inside that transaction
+func (s *Server) runQuery(ctx context.Context, sess *session, tx postgres.Transaction, id string, payload protocol.QueryPayload) (response protocol.ServerMessage) {
+	defer func(start time.Time) {
+		s.metrics.observeQuery(response, time.Since(start))
+		s.logQuery(id, payload.SQL, len(payload.Params), response, time.Since(start))
+	}(time.Now())
+
+	// A prepared statement stands in for the query's SQL
+	var statementConn postgres.StatementConn
+	if payload.StatementName != "" {
+		if payload.SQL != "" {
+			return protocol.NewError(id, "INVALID_PAYLOAD", "Send either sql or statementName, not both", "")
+		}
+		if sess == nil {
+			return protocol.NewError(id, "INVALID_PAYLOAD", "Prepared statements are only available over a WebSocket connection", "")
+		}
+		sql, conn, ok := sess.statement(payload.StatementName)
+		if !ok {
+			return protocol.NewErrorWithHint(id, "STATEMENT_NOT_FOUND",
+				fmt.Sprintf("No prepared statement named %s", payload.StatementName), "Send a prepare message first")
+		}
+		payload.SQL, statementConn = sql, conn
+	}
+
 	// Validate SQL is not empty
 	if payload.SQL == "" {
-		return protocol.NewError(msg.ID, "EMPTY_QUERY", "SQL query cannot be empty", "")
+		return protocol.NewError(id, "EMPTY_QUERY", "SQL query cannot be empty", "")
+	}
+
+	if len(payload.NamedParams) > 0 {
+		if len(payload.Params) > 0 || payload.StatementName != "" {
+			return protocol.NewError(id, "INVALID_PAYLOAD", "namedParams cannot be combined with params or statementName", "")
+		}
+		sql, params, err := sqlutil.BindNamed(payload.SQL, payload.NamedParams)
+		if err != nil {
+			return protocol.NewErrorWithHint(id, "INVALID_PAYLOAD", err.Error(), "Add a value for it to namedParams")
+		}
+		payload.SQL, payload.Params = sql, params
 	}
 
-	// Create context with timeout if specified
-	ctx := context.Background()
-	if payload.Timeout > 0 {
+	db, ok := s.clientFor(sess, payload.Database)
+	if !ok {
+		return s.unknownDatabase(id, payload.Database)
+	}
+	current, _ := s.clientFor(sess, "")
+	if tx != nil && db != current {
+		return protocol.NewError(id, "INVALID_PAYLOAD", "Queries in a transaction must run on the connection's database", "")
+	}
+	// Statements are prepared against the connection's database, so their SQL may mean something else on another
+	if payload.StatementName != "" && db != current {
+		return protocol.NewError(id, "INVALID_PAYLOAD", "Prepared statements must run on the connection's database", "")
+	}
+
+	if payload.Analyze && !payload.Explain {
+		return protocol.NewError(id, "INVALID_PAYLOAD", "analyze requires explain", "")
+	}
+
+	if payload.Validate {
+		if payload.Multi || payload.Explain || payload.Stream || payload.Limit != 0 || payload.Offset != 0 || payload.WantTotal {
+			return protocol.NewError(id, "INVALID_PAYLOAD", "validate cannot be combined with multi, explain, stream or pagination", "")
+		}
+		if tx != nil {
+			return protocol.NewError(id, "INVALID_PAYLOAD", "Queries cannot be validated inside an open transaction", "")
+		}
+	}
+
+	// Scripts are split up front so every statement gets checked
+	statements := []string{payload.SQL}
+	if payload.Multi {
+		if payload.Explain {
+			return protocol.NewError(id, "INVALID_PAYLOAD", "Multi-statement scripts cannot be explained", "")
+		}
+		if tx != nil {
+			return protocol.NewError(id, "INVALID_PAYLOAD", "Multi-statement scripts cannot run inside an open transaction", "")
+		}
+		if len(payload.Params) > 0 {
+			return protocol.NewError(id, "INVALID_PAYLOAD", "Parameters are not supported in multi-statement scripts", "")
+		}
+		statements = sqlutil.SplitStatements(payload.SQL)
+		if len(statements) == 0 {
+			return protocol.NewError(id, "EMPTY_QUERY", "SQL script contains no statements", "")
+		}
+	}
+
+	paginated := payload.Limit != 0 || payload.Offset != 0
+	if paginated || payload.WantTotal {
+		if message := paginationError(payload); message != "" {
+			return protocol.NewError(id, "INVALID_PAYLOAD", message, "")
+		}
+	}
+
+	// Reject obvious writes up front; the database enforces the rest
+	// A plain EXPLAIN or a validation doesn't run the statement, so it's safe to check writes
+	if s.opts.ReadOnly && !payload.Validate && (!payload.Explain || payload.Analyze) {
+		for _, statement := range statements {
+			if sqlutil.IsMutating(statement) {
+				return protocol.NewErrorWithHint(id, "READ_ONLY_VIOLATION",
+					fmt.Sprintf("%s statements are not allowed in read-only mode", sqlutil.FirstKeyword(statement)), readOnlyHint)
+			}
+		}
+	}
+
+	// Bound the query so it can't tie up a pool connection forever
+	if timeout := s.queryTimeout(payload.Timeout); timeout > 0 {
 		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ctx, time.Duration(payload.Timeout)*time.Millisecond)
+		ctx, cancel = context.WithTimeout(ctx, timeout)
 		defer cancel()
 	}
 
+	// Buffered results are held in memory, so cap how many rows they can return
+	ctx = postgres.WithMaxRows(ctx, s.maxRows(payload.MaxRows))
+
+	if payload.Validate {
+		return validateQuery(ctx, db, id, payload)
+	}
+
+	if payload.Multi {
+		return s.executeScript(ctx, db, id, statements, payload.Transactional)
+	}
+
+	var exec queryExecutor = db
+	if tx != nil {
+		exec = tx
+	}
+
+	if payload.Explain {
+		return s.explainQuery(ctx, exec, id, payload)
+	}
+
+	// The total is counted before the page is read; outside a transaction rows changed in
+	// between can make them disagree
+	var total *int64
+	if payload.WantTotal {
+		count, err := countRows(ctx, exec, payload)
+		if err != nil {
+			return queryError(id, err)
+		}
+		total = &count
+	}
+
+	query := payload
+	if paginated {
+		query.SQL = sqlutil.Paginate(payload.SQL, len(payload.Params))
+		var limit interface{} // NULL means no limit, for an offset on its own
+		if payload.Limit > 0 {
+			limit = payload.Limit
+		}
+		query.Params = append(append([]interface{}{}, payload.Params...), limit, payload.Offset)
+	}
+
+	// Outside a transaction a prepared statement runs by name on the connection that prepared it;
+	// a transaction or a page runs its SQL instead
+	if statementConn != nil && tx == nil && !paginated {
+		exec = statementConn
+		query.SQL = payload.StatementName
+	}
+
+	if payload.Stream && sess != nil {
+		return withTotal(s.streamQuery(ctx, sess, exec, id, query), total)
+	}
+
 	// Execute the query
-	result, err := s.pgClient.ExecuteQuery(ctx, payload.SQL, payload.Params)
+	result, err := exec.ExecuteQuery(ctx, query.SQL, query.Params)
 	if err != nil {
-		return protocol.NewError(msg.ID, "QUERY_ERROR", err.Error(), "")
+		return queryError(id, err)
 	}
 
 	// Return the result
-	return protocol.NewQueryResult(msg.ID, result.Rows, result.Columns, result.ExecutionTime)
+	return withTotal(withTiming(protocol.NewQueryResult(id, result.Rows, result.Columns, result.Command, result.ExecutionTime, result.Truncated), result.Timing), total)
+}
+
+// paginationError explains why a query can't be paginated, or returns "" if it can
+// The query is wrapped in a subquery, so it must be a single SELECT without its own row limit
+func paginationError(payload protocol.QueryPayload) string {
+	switch {
+	case payload.Limit < 0 || payload.Offset < 0:
+		return "limit and offset cannot be negative"
+	case payload.Multi:
+		return "Multi-statement scripts cannot be paginated"
+	case payload.Explain:
+		return "Explained queries cannot be paginated"
+	case len(sqlutil.SplitStatements(payload.SQL)) != 1 || !sqlutil.IsSelect(payload.SQL):
+		return "Only a single SELECT query can be paginated"
+	case sqlutil.HasRowLimit(payload.SQL):
+		return "Query already has a LIMIT, OFFSET or FETCH clause; remove it to paginate"
+	}
+	return ""
+}
+
+// countRows returns how many rows a query would return
+func countRows(ctx context.Context, exec queryExecutor, payload protocol.QueryPayload) (int64, error) {
+	result, err := exec.ExecuteQuery(ctx, sqlutil.Count(payload.SQL), payload.Params)
+	if err != nil {
+		return 0, err
+	}
+	if len(result.Rows) != 1 {
+		return 0, fmt.Errorf("count query returned %d rows", len(result.Rows))
+	}
+	total, ok := result.Rows[0]["total"].(int64)
+	if !ok {
+		return 0, fmt.Errorf("count query returned %T", result.Rows[0]["total"])
+	}
+	return total, nil
+}
+
+// withTotal adds the query's total row count to a result message
+// Other messages, such as errors, are returned unchanged
+func withTotal(response protocol.ServerMessage, total *int64) protocol.ServerMessage {
+	if result, ok := response.Payload.(protocol.ResultPayload); ok && total != nil {
+		result.Total = total
+		response.Payload = result
+	}
+	return response
+}
+
+// withTiming adds how a query's time was spent to its result message
+func withTiming(response protocol.ServerMessage, timing postgres.QueryTiming) protocol.ServerMessage {
+	if result, ok := response.Payload.(protocol.ResultPayload); ok {
+		result.Timing = queryTiming(timing)
+		response.Payload = result
+	}
+	return response
+}
+
+// queryTiming converts a query's timing for the protocol
+func queryTiming(timing postgres.QueryTiming) *protocol.QueryTiming {
+	return &protocol.QueryTiming{
+		FirstRowMicros:   timing.FirstRow.Microseconds(),
+		FetchMicros:      timing.Fetch.Microseconds(),
+		ConversionMicros: timing.Conversion.Microseconds(),
+	}
+}
+
+// explainQuery runs EXPLAIN on a query and returns its plan as a plan message
+func (s *Server) explainQuery(ctx context.Context, exec queryExecutor, id string, payload protocol.QueryPayload) protocol.ServerMessage {
+	result, err := exec.ExecuteQuery(ctx, sqlutil.Explain(payload.SQL, payload.Analyze), payload.Params)
+	if err != nil {
+		return queryError(id, err)
+	}
+
+	// EXPLAIN (FORMAT JSON) returns a single row with the whole plan in its one column
+	if len(result.Rows) != 1 || len(result.Columns) != 1 {
+		return protocol.NewError(id, "QUERY_ERROR", "EXPLAIN did not return a plan", "")
+	}
+	plan := result.Rows[0][result.Columns[0].Name]
+
+	return protocol.NewPlan(id, plan, payload.Analyze, result.ExecutionTime)
+}
+
+// validateQuery has the database parse and analyze a query without running it
+// Syntax errors, unknown tables and columns and type mismatches come back as ordinary
+// query errors, with the position of the problem when Postgres reports one
+func validateQuery(ctx context.Context, db PostgresClient, id string, payload protocol.QueryPayload) protocol.ServerMessage {
+	statement, err := db.Prepare(ctx, payload.SQL)
+	if err != nil {
+		return queryError(id, err)
+	}
+	return protocol.NewValidation(id, statement.ParamTypes, statement.Columns)
+}
+
+// queryTimeout returns the effective timeout for a query given the client's requested timeout in milliseconds
+// The server default applies when the client doesn't ask for one, and neither may exceed the server maximum
+func (s *Server) queryTimeout(requestedMs int) time.Duration {
+	timeout := s.opts.DefaultQueryTimeout
+	if requestedMs > 0 {
+		timeout = time.Duration(requestedMs) * time.Millisecond
+	}
+
+	if s.opts.MaxQueryTimeout > 0 && (timeout <= 0 || timeout > s.opts.MaxQueryTimeout) {
+		timeout = s.opts.MaxQueryTimeout
+	}
+	return timeout
+}
+
+// maxRows returns the effective row limit for a buffered query given the client's requested limit
+// The server default applies when the client doesn't ask for one, and neither may exceed the server ceiling
+func (s *Server) maxRows(requested int) int {
+	maxRows := s.opts.MaxRows
+	if requested > 0 {
+		maxRows = requested
+	}
+
+	if s.opts.MaxRowsCeiling > 0 && (maxRows <= 0 || maxRows > s.opts.MaxRowsCeiling) {
+		maxRows = s.opts.MaxRowsCeiling
+	}
+	return maxRows
+}
+
+// streamQuery executes a query and sends its rows to the client as result_chunk messages
+// The returned message ends the stream: a streamed result, or an error if the query failed part-way
+func (s *Server) streamQuery(ctx context.Context, sess *session, exec queryExecutor, id string, payload protocol.QueryPayload) protocol.ServerMessage {
+	batchSize := payload.BatchSize
+	if batchSize <= 0 {
+		batchSize = s.opts.StreamBatchSize
+	}
+	if batchSize <= 0 {
+		batchSize = DefaultStreamBatchSize
+	}
+
+	offset := 0
+	result, err := exec.StreamQuery(ctx, payload.SQL, payload.Params, batchSize,
+		func(columns []protocol.ColumnInfo, rows []map[string]interface{}) error {
+			// Only the first chunk carries column metadata
+			var chunkColumns []protocol.ColumnInfo
+			if offset == 0 {
+				chunkColumns = columns
+			}
+			if err := sess.send(protocol.NewResultChunk(id, chunkColumns, rows, offset)); err != nil {
+				return fmt.Errorf("failed to send result chunk: %w", err)
+			}
+			offset += len(rows)
+			return nil
+		})
+	if err != nil {
+		return queryError(id, err)
+	}
+
+	return withTiming(protocol.NewStreamedResult(id, result.Columns, result.RowCount, result.Command, result.ExecutionTime), result.Timing)
+}
+
+// executeScript runs a multi-statement script and returns the results of every statement
+func (s *Server) executeScript(ctx context.Context, db PostgresClient, id string, statements []string, transactional bool) protocol.ServerMessage {
+	result, err := db.ExecuteScript(ctx, statements, transactional)
+	if err != nil {
+		return queryError(id, err)
+	}
+
+	results := make([]protocol.StatementResult, len(result.Statements))
+	for i, statement := range result.Statements {
+		results[i] = protocol.StatementResult{
+			SQL:          statement.SQL,
+			RowsAffected: statement.RowsAffected,
+			ResultPayload: protocol.ResultPayload{
+				Rows:                statement.Rows,
+				Columns:             statement.Columns,
+				RowCount:            statement.RowCount,
+				Command:             statement.Command,
+				ExecutionTime:       statement.ExecutionTime.Milliseconds(),
+				ExecutionTimeMicros: statement.ExecutionTime.Microseconds(),
+				Timing:              queryTiming(statement.Timing),
+				Truncated:           statement.Truncated,
+			},
+		}
+	}
+
+	return protocol.NewScriptResult(id, results, result.Transactional, result.Committed, result.ExecutionTime)
+}
+
+// queryError converts a failed query into an error message with the most specific code available
+// Errors reported by Postgres use their SQLSTATE as the code and keep its detail, hint and position.
+// Failures in a script also report which statement failed and what happened to the others
+func queryError(id string, err error) protocol.ServerMessage {
+	code := "QUERY_ERROR"
+	message, detail, hint, position := err.Error(), "", "", 0
+
+	var dbErr *postgres.DatabaseError
+	if errors.As(err, &dbErr) {
+		code = dbErr.Code
+		message, detail, hint, position = dbErr.Message, dbErr.Detail, dbErr.Hint, dbErr.Position
+	}
+	switch {
+	case errors.Is(err, postgres.ErrReadOnlyViolation):
+		code = "READ_ONLY_VIOLATION"
+	case errors.Is(err, postgres.ErrQueryCanceled):
+		code = "QUERY_CANCELED"
+	case errors.Is(err, postgres.ErrQueryTimeout):
+		code = "QUERY_TIMEOUT"
+		hint = "Set a longer timeout in the message, up to --max-query-timeout"
+	case errors.Is(err, postgres.ErrConnectionLost):
+		code = "CONNECTION_LOST"
+		if hint == "" {
+			hint = "Check that the database is running; the proxy reconnects on the next query, so it is safe to retry"
+		}
+	case errors.Is(err, postgres.ErrServerBusy):
+		code = "SERVER_BUSY"
+		hint = "Every database connection is busy and the queue is full; retry shortly, or raise --max-conns or --max-queue-depth"
+	case errors.Is(err, postgres.ErrParameterMismatch):
+		code = "PARAMETER_MISMATCH"
+		hint = "Pass one value in params for each $n placeholder in the query"
+	case errors.Is(err, postgres.ErrParameterTypeMismatch):
+		code = "PARAMETER_TYPE_MISMATCH"
+	case errors.Is(err, postgres.ErrStatementNotFound):
+		code = "STATEMENT_NOT_FOUND"
+	}
+
+	var scriptErr *postgres.ScriptError
+	if !errors.As(err, &scriptErr) {
+		var rowErr *postgres.RowError
+		if errors.As(err, &rowErr) {
+			response := protocol.NewErrorWithHint(id, "CONVERSION_ERROR", message,
+				fmt.Sprintf("Cast %s to text in the query to get its values as strings", rowErr.Column))
+			payload := response.Payload.(protocol.ErrorPayload)
+			payload.Row, payload.Column = &rowErr.Row, rowErr.Column
+			response.Payload = payload
+			return response
+		}
+		var typeErr *postgres.ParameterTypeError
+		if errors.As(err, &typeErr) {
+			response := protocol.NewErrorWithHint(id, code, message,
+				fmt.Sprintf("Send $%d as %s, or cast the placeholder in the query to the type of the value sent", typeErr.Index, typeErr.Expected))
+			payload := response.Payload.(protocol.ErrorPayload)
+			payload.Parameter = typeErr.Index
+			response.Payload = payload
+			return response
+		}
+		return protocol.NewDatabaseError(id, code, message, detail, hint, position)
+	}
+
+	// Position is relative to the failed statement, not the whole script
+	if dbErr != nil {
+		message = fmt.Sprintf("statement %d of %d failed: %s", scriptErr.Index+1, scriptErr.Total, message)
+	}
+	if detail != "" {
+		detail += "\n"
+	}
+	response := protocol.NewStatementError(id, code, message, detail+scriptErr.Outcome(), scriptErr.Index+1, scriptErr.RolledBack)
+	payload := response.Payload.(protocol.ErrorPayload)
+	payload.Hint, payload.Position = hint, position
+	response.Payload = payload
+	return response
+}
+
+// handleCancel aborts an in-flight query on the same connection
+func (s *Server) handleCancel(sess *session, msg protocol.ClientMessage) protocol.ServerMessage {
+	var payload protocol.CancelPayload
+	if err := decodePayload(msg.Payload, &payload); err != nil {
+		return protocol.NewError(msg.ID, "INVALID_PAYLOAD", "Failed to parse cancel payload", err.Error())
+	}
+
+	if payload.QueryID == "" {
+		return protocol.NewError(msg.ID, "INVALID_PAYLOAD", "Cancel request must include a queryId", "")
+	}
+
+	if !sess.cancel(payload.QueryID) {
+		return protocol.NewErrorWithHint(msg.ID, "QUERY_NOT_FOUND",
+			fmt.Sprintf("No running query with ID %s", payload.QueryID), "The query may already have finished")
+	}
+
+	return protocol.NewCanceled(msg.ID, payload.QueryID)
+}
+
+// handleBegin opens the explicit transaction reserved for msg, which the connection's queries
+// run in until it ends. The transaction is rolled back if it sits idle for longer than the idle
+// transaction timeout
+func (s *Server) handleBegin(ctx context.Context, sess *session, open *openTx, msg protocol.ClientMessage) protocol.ServerMessage {
+	ctx, cancel := context.WithTimeout(ctx, defaultTransactionTimeout)
+	defer cancel()
+
+	db, _ := s.clientFor(sess, "")
+	tx, err := db.BeginTransaction(ctx)
+	if err != nil {
+		sess.abortTx(open, err)
+		return protocol.NewError(msg.ID, "TRANSACTION_ERROR", err.Error(), "")
+	}
+
+	idleTimeout := s.opts.IdleTransactionTimeout
+	sess.startTx(open, tx, idleTimeout, func(open *openTx) {
+		rollbackCtx, cancel := context.WithTimeout(context.Background(), defaultTransactionTimeout)
+		defer cancel()
+		if err := open.tx.Rollback(rollbackCtx); err != nil {
+			log.Printf("Failed to roll back idle transaction: %v", err)
+		}
+
+		message := fmt.Sprintf("Transaction rolled back after being idle for %v", idleTimeout)
+		if err := sess.send(protocol.NewError(open.id, "TRANSACTION_TIMEOUT", message, "")); err != nil {
+			log.Printf("Failed to send transaction timeout: %v", err)
+		}
+	})
+
+	return protocol.NewTransactionStatus(msg.ID, protocol.TransactionOpen)
+}
+
+// transactionNotBegun answers a message sent in a transaction whose begin failed or that was
+// cancelled while waiting for it
+func transactionNotBegun(id string, err error) protocol.ServerMessage {
+	if errors.Is(err, context.Canceled) {
+		return queryError(id, fmt.Errorf("%w while waiting for the transaction to begin", postgres.ErrQueryCanceled))
+	}
+	return protocol.NewError(id, "TRANSACTION_ERROR", "The transaction failed to begin", err.Error())
+}
+
+// handleEndTransaction commits or rolls back a transaction detached from its session
+// Queries already sent in the transaction finish first
+func (s *Server) handleEndTransaction(open *openTx, msg protocol.ClientMessage) protocol.ServerMessage {
+	open.queries.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTransactionTimeout)
+	defer cancel()
+
+	// The begin may still be running, or have failed
+	if _, err := open.wait(ctx); err != nil {
+		return transactionNotBegun(msg.ID, err)
+	}
+
+	if msg.Type == protocol.TypeRollback {
+		if err := open.tx.Rollback(ctx); err != nil {
+			return protocol.NewError(msg.ID, "TRANSACTION_ERROR", err.Error(), "")
+		}
+		return protocol.NewTransactionStatus(msg.ID, protocol.TransactionRolledBack)
+	}
+
+	err := open.tx.Commit(ctx)
+	switch {
+	case errors.Is(err, postgres.ErrTransactionRolledBack):
+		return protocol.NewTransactionStatus(msg.ID, protocol.TransactionRolledBack)
+	case err != nil:
+		return protocol.NewError(msg.ID, "TRANSACTION_ERROR", err.Error(), "")
+	}
+	return protocol.NewTransactionStatus(msg.ID, protocol.TransactionCommitted)
+}
+
+// handleListen subscribes the connection to a LISTEN/NOTIFY channel
+// Notifications are forwarded to the client as they arrive until it unlistens or disconnects
+func (s *Server) handleListen(ctx context.Context, sess *session, msg protocol.ClientMessage) protocol.ServerMessage {
+	var payload protocol.ListenPayload
+	if err := decodePayload(msg.Payload, &payload); err != nil {
+		return protocol.NewError(msg.ID, "INVALID_PAYLOAD", "Failed to parse listen payload", err.Error())
+	}
+
+	if payload.Channel == "" {
+		return protocol.NewError(msg.ID, "INVALID_PAYLOAD", "Listen request must include a channel", "")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultListenTimeout)
+	defer cancel()
+
+	err := sess.listen(ctx, payload.Channel, func() (postgres.Listener, error) {
+		db, _ := s.clientFor(sess, "")
+		return db.NewListener(ctx, func(channel, notification string) {
+			if err := sess.send(protocol.NewNotification(channel, notification)); err != nil {
+				log.Printf("Failed to send notification: %v", err)
+			}
+		})
+	})
+	if err != nil {
+		return protocol.NewError(msg.ID, "LISTEN_ERROR", err.Error(), "")
+	}
+
+	return protocol.NewListening(msg.ID, payload.Channel)
+}
+
+// handleUnlisten unsubscribes the connection from a LISTEN/NOTIFY channel
+func (s *Server) handleUnlisten(ctx context.Context, sess *session, msg protocol.ClientMessage) protocol.ServerMessage {
+	var payload protocol.ListenPayload
+	if err := decodePayload(msg.Payload, &payload); err != nil {
+		return protocol.NewError(msg.ID, "INVALID_PAYLOAD", "Failed to parse unlisten payload", err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultListenTimeout)
+	defer cancel()
+
+	subscribed, err := sess.unlisten(ctx, payload.Channel)
+	if !subscribed {
+		return protocol.NewError(msg.ID, "NOT_LISTENING",
+			fmt.Sprintf("Not listening on channel %s", payload.Channel), "")
+	}
+	if err != nil {
+		return protocol.NewError(msg.ID, "LISTEN_ERROR", err.Error(), "")
+	}
+
+	return protocol.NewUnlistened(msg.ID, payload.Channel)
 }
 
 // handleIntrospect processes schema introspection requests
-func (s *Server) handleIntrospect(msg protocol.ClientMessage) protocol.ServerMessage {
+// The payload may name the database to describe, otherwise it is the connection's,
+// and the schemas to limit it to
+func (s *Server) handleIntrospect(ctx context.Context, sess *session, msg protocol.ClientMessage) (response protocol.ServerMessage) {
+	defer func() { s.metrics.observeIntrospection(response) }()
+
+	var payload protocol.IntrospectPayload
+	if msg.Payload != nil {
+		if err := decodePayload(msg.Payload, &payload); err != nil {
+			return protocol.NewError(msg.ID, "INVALID_PAYLOAD", "Failed to unmarshal introspect payload", err.Error())
+		}
+	}
+	db, ok := s.clientFor(sess, payload.Database)
+	if !ok {
+		return s.unknownDatabase(msg.ID, payload.Database)
+	}
+
 	// Create context with reasonable timeout for introspection
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, defaultIntrospectTimeout)
 	defer cancel()
 
 	// Introspect the schema
-	schema, err := s.pgClient.IntrospectSchema(ctx)
+	schema, err := db.IntrospectSchema(ctx, payload.Schemas)
 	if err != nil {
+		if errors.Is(err, postgres.ErrServerBusy) {
+			return queryError(msg.ID, err)
+		}
 		return protocol.NewError(msg.ID, "INTROSPECTION_ERROR", err.Error(), "")
 	}
 
@@ -158,7 +1290,19 @@ func (s *Server) handleIntrospect(msg protocol.ClientMessage) protocol.ServerMes
 	return protocol.NewSchemaResult(msg.ID, schema.Tables, schema.Functions)
 }
 
+// decodePayload converts a generic message payload into a typed payload struct
+func decodePayload(payload interface{}, v interface{}) error {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(payloadBytes, v)
+}
+
 // SendMessage sends a message to the client
+//
+// Deprecated: SendMessage writes to the connection directly, which races with any other
+// writer. Wrap the connection with NewConn and use Conn.WriteMessage instead
 func SendMessage(conn *websocket.Conn, msg protocol.ServerMessage) error {
 	data, err := json.Marshal(msg)
 	if err != nil {
@@ -3,23 +3,41 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/MPJHorner/PostgresMaster/proxy/pkg/auth"
 	"github.com/MPJHorner/PostgresMaster/proxy/pkg/postgres"
 	"github.com/MPJHorner/PostgresMaster/proxy/pkg/protocol"
+	"github.com/MPJHorner/PostgresMaster/proxy/pkg/sqlutil"
 	"github.com/gorilla/websocket"
 )
 
 // MockPostgresClient implements the PostgresClient interface for testing
 type MockPostgresClient struct {
 	ExecuteQueryFunc     func(ctx context.Context, sql string, params []interface{}) (*postgres.QueryResult, error)
-	IntrospectSchemaFunc func(ctx context.Context) (*protocol.SchemaPayload, error)
+	StreamQueryFunc      func(ctx context.Context, sql string, params []interface{}, batchSize int, fn postgres.RowBatchFunc) (*postgres.QueryResult, error)
+	ExecuteScriptFunc    func(ctx context.Context, statements []string, transactional bool) (*postgres.ScriptResult, error)
+	IntrospectSchemaFunc func(ctx context.Context, schemas []string) (*protocol.SchemaPayload, error)
+	NewListenerFunc      func(ctx context.Context, fn postgres.NotificationFunc) (postgres.Listener, error)
+	BeginTransactionFunc func(ctx context.Context) (postgres.Transaction, error)
+	PrepareFunc          func(ctx context.Context, sql string) (*postgres.PreparedStatement, error)
+	NewStatementConnFunc func(ctx context.Context) (postgres.StatementConn, error)
+	CopyOutFunc          func(ctx context.Context, sql string, w io.Writer) (*postgres.CopyResult, error)
+	PingFunc             func(ctx context.Context) error
+	StatsFunc            func() postgres.PoolStats
+	StateFunc            func() postgres.ConnectionState
+	DatabaseNameFunc     func() string
 }
 
 func (m *MockPostgresClient) ExecuteQuery(ctx context.Context, sql string, params []interface{}) (*postgres.QueryResult, error) {
@@ -34,9 +52,34 @@ func (m *MockPostgresClient) ExecuteQuery(ctx context.Context, sql string, param
 	}, nil
 }
 
-func (m *MockPostgresClient) IntrospectSchema(ctx context.Context) (*protocol.SchemaPayload, error) {
+func (m *MockPostgresClient) StreamQuery(ctx context.Context, sql string, params []interface{}, batchSize int, fn postgres.RowBatchFunc) (*postgres.QueryResult, error) {
+	if m.StreamQueryFunc != nil {
+		return m.StreamQueryFunc(ctx, sql, params, batchSize, fn)
+	}
+	return &postgres.QueryResult{
+		Columns:       []protocol.ColumnInfo{},
+		RowCount:      0,
+		ExecutionTime: 0,
+	}, nil
+}
+
+func (m *MockPostgresClient) CopyOut(ctx context.Context, sql string, w io.Writer) (*postgres.CopyResult, error) {
+	if m.CopyOutFunc != nil {
+		return m.CopyOutFunc(ctx, sql, w)
+	}
+	return &postgres.CopyResult{}, nil
+}
+
+func (m *MockPostgresClient) ExecuteScript(ctx context.Context, statements []string, transactional bool) (*postgres.ScriptResult, error) {
+	if m.ExecuteScriptFunc != nil {
+		return m.ExecuteScriptFunc(ctx, statements, transactional)
+	}
+	return &postgres.ScriptResult{}, nil
+}
+
+func (m *MockPostgresClient) IntrospectSchema(ctx context.Context, schemas []string) (*protocol.SchemaPayload, error) {
 	if m.IntrospectSchemaFunc != nil {
-		return m.IntrospectSchemaFunc(ctx)
+		return m.IntrospectSchemaFunc(ctx, schemas)
 	}
 	return &protocol.SchemaPayload{
 		Tables:    []protocol.TableInfo{},
@@ -44,13 +87,231 @@ func (m *MockPostgresClient) IntrospectSchema(ctx context.Context) (*protocol.Sc
 	}, nil
 }
 
+func (m *MockPostgresClient) NewListener(ctx context.Context, fn postgres.NotificationFunc) (postgres.Listener, error) {
+	if m.NewListenerFunc != nil {
+		return m.NewListenerFunc(ctx, fn)
+	}
+	return &MockListener{notify: fn}, nil
+}
+
+func (m *MockPostgresClient) BeginTransaction(ctx context.Context) (postgres.Transaction, error) {
+	if m.BeginTransactionFunc != nil {
+		return m.BeginTransactionFunc(ctx)
+	}
+	return &MockTransaction{}, nil
+}
+
+func (m *MockPostgresClient) Prepare(ctx context.Context, sql string) (*postgres.PreparedStatement, error) {
+	if m.PrepareFunc != nil {
+		return m.PrepareFunc(ctx, sql)
+	}
+	return &postgres.PreparedStatement{ParamTypes: []string{}, Columns: []protocol.ColumnInfo{}}, nil
+}
+
+func (m *MockPostgresClient) NewStatementConn(ctx context.Context) (postgres.StatementConn, error) {
+	if m.NewStatementConnFunc != nil {
+		return m.NewStatementConnFunc(ctx)
+	}
+	return &MockStatementConn{client: m}, nil
+}
+
+func (m *MockPostgresClient) Ping(ctx context.Context) error {
+	if m.PingFunc != nil {
+		return m.PingFunc(ctx)
+	}
+	return nil
+}
+
+func (m *MockPostgresClient) Stats() postgres.PoolStats {
+	if m.StatsFunc != nil {
+		return m.StatsFunc()
+	}
+	return postgres.PoolStats{}
+}
+
+func (m *MockPostgresClient) State() postgres.ConnectionState {
+	if m.StateFunc != nil {
+		return m.StateFunc()
+	}
+	return postgres.StateConnected
+}
+
+func (m *MockPostgresClient) DatabaseName() string {
+	if m.DatabaseNameFunc != nil {
+		return m.DatabaseNameFunc()
+	}
+	return "postgres"
+}
+
+// MockTransaction implements postgres.Transaction, recording what ran in it
+type MockTransaction struct {
+	mu         sync.Mutex
+	queries    []string
+	committed  bool
+	rolledBack bool
+	commitErr  error
+}
+
+func (tx *MockTransaction) ExecuteQuery(ctx context.Context, sql string, params []interface{}) (*postgres.QueryResult, error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	tx.queries = append(tx.queries, sql)
+	return &postgres.QueryResult{Rows: []map[string]interface{}{}, Columns: []protocol.ColumnInfo{}}, nil
+}
+
+func (tx *MockTransaction) StreamQuery(ctx context.Context, sql string, params []interface{}, batchSize int, fn postgres.RowBatchFunc) (*postgres.QueryResult, error) {
+	result, err := tx.ExecuteQuery(ctx, sql, params)
+	if err != nil {
+		return nil, err
+	}
+	return result, fn(result.Columns, result.Rows)
+}
+
+func (tx *MockTransaction) Commit(ctx context.Context) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	tx.committed = true
+	return tx.commitErr
+}
+
+func (tx *MockTransaction) Rollback(ctx context.Context) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	tx.rolledBack = true
+	return nil
+}
+
+// state returns the queries run in the transaction and how it ended
+func (tx *MockTransaction) state() ([]string, bool, bool) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	return append([]string(nil), tx.queries...), tx.committed, tx.rolledBack
+}
+
+// MockStatementConn implements postgres.StatementConn on its client, recording which statements ran by name
+// Statements are described by the client's Prepare and run its ExecuteQuery and StreamQuery with their SQL
+type MockStatementConn struct {
+	client     *MockPostgresClient
+	mu         sync.Mutex
+	statements map[string]string
+	ran        []string
+	closed     bool
+}
+
+func (c *MockStatementConn) Prepare(ctx context.Context, name, sql string) (*postgres.PreparedStatement, error) {
+	statement, err := c.client.Prepare(ctx, sql)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.statements == nil {
+		c.statements = make(map[string]string)
+	}
+	c.statements[name] = sql
+	return statement, nil
+}
+
+// run records that the statement prepared under name ran and returns its SQL
+func (c *MockStatementConn) run(name string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sql, ok := c.statements[name]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", postgres.ErrStatementNotFound, name)
+	}
+	c.ran = append(c.ran, name)
+	return sql, nil
+}
+
+func (c *MockStatementConn) ExecuteQuery(ctx context.Context, name string, params []interface{}) (*postgres.QueryResult, error) {
+	sql, err := c.run(name)
+	if err != nil {
+		return nil, err
+	}
+	return c.client.ExecuteQuery(ctx, sql, params)
+}
+
+func (c *MockStatementConn) StreamQuery(ctx context.Context, name string, params []interface{}, batchSize int, fn postgres.RowBatchFunc) (*postgres.QueryResult, error) {
+	sql, err := c.run(name)
+	if err != nil {
+		return nil, err
+	}
+	return c.client.StreamQuery(ctx, sql, params, batchSize, fn)
+}
+
+func (c *MockStatementConn) Deallocate(ctx context.Context, name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.statements[name]; !ok {
+		return fmt.Errorf("%w: %s", postgres.ErrStatementNotFound, name)
+	}
+	delete(c.statements, name)
+	return nil
+}
+
+func (c *MockStatementConn) Close(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.statements = nil
+	c.closed = true
+	return nil
+}
+
+// state returns the names of the statements run and whether the connection was closed
+func (c *MockStatementConn) state() ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.ran...), c.closed
+}
+
+// MockListener implements postgres.Listener, recording subscriptions
+type MockListener struct {
+	mu       sync.Mutex
+	notify   postgres.NotificationFunc
+	channels []string
+	closed   bool
+}
+
+func (l *MockListener) Listen(ctx context.Context, channel string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.channels = append(l.channels, channel)
+	return nil
+}
+
+func (l *MockListener) Unlisten(ctx context.Context, channel string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, c := range l.channels {
+		if c == channel {
+			l.channels = append(l.channels[:i], l.channels[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (l *MockListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	return nil
+}
+
+func (l *MockListener) isClosed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closed
+}
+
 func TestNewServer(t *testing.T) {
 	secret, err := auth.GenerateSecret()
 	if err != nil {
 		t.Fatalf("Failed to generate secret: %v", err)
 	}
 	mockClient := &MockPostgresClient{}
-	server := NewServer(secret, mockClient)
+	server := NewServer(secret, mockClient, DefaultOptions())
 
 	if server == nil {
 		t.Fatal("NewServer returned nil")
@@ -71,7 +332,7 @@ func TestHandleConnection_InvalidSecret(t *testing.T) {
 		t.Fatalf("Failed to generate secret: %v", err)
 	}
 	mockClient := &MockPostgresClient{}
-	server := NewServer(secret, mockClient)
+	server := NewServer(secret, mockClient, DefaultOptions())
 
 	// Create a test HTTP request with invalid secret
 	req := httptest.NewRequest("GET", "/?secret=invalidsecret", nil)
@@ -89,13 +350,336 @@ func TestHandleConnection_InvalidSecret(t *testing.T) {
 	}
 }
 
+func TestOriginChecker(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		origin  string
+		want    bool
+	}{
+		{name: "default origin", allowed: DefaultAllowedOrigins, origin: "http://localhost:5173", want: true},
+		{name: "unlisted port", allowed: DefaultAllowedOrigins, origin: "http://localhost:4321", want: false},
+		{name: "configured origin", allowed: []string{"http://localhost:4321"}, origin: "http://localhost:4321", want: true},
+		{name: "case-insensitive match", allowed: []string{"http://LocalHost:4321"}, origin: "http://localhost:4321", want: true},
+		{name: "scheme must match", allowed: []string{"http://localhost:4321"}, origin: "https://localhost:4321", want: false},
+		{name: "wildcard", allowed: []string{AllowAllOrigins}, origin: "https://anything.example.com", want: true},
+		{name: "no Origin header", allowed: nil, origin: "", want: true},
+		{name: "nothing allowed", allowed: nil, origin: "http://localhost:5173", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if got := originChecker(tt.allowed)(req); got != tt.want {
+				t.Errorf("originChecker(%v)(%q) = %v, want %v", tt.allowed, tt.origin, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleConnection_SecretSources(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	server := NewServer(secret, &MockPostgresClient{}, DefaultOptions())
+	testServer := httptest.NewServer(http.HandlerFunc(server.HandleConnection))
+	defer testServer.Close()
+	wsURL := "ws" + strings.TrimPrefix(testServer.URL, "http")
+
+	tests := []struct {
+		name         string
+		header       http.Header
+		subprotocols []string
+		wantProtocol string
+		wantStatus   int
+	}{
+		{name: "authorization header", header: http.Header{"Authorization": {"Bearer " + secret}}},
+		{
+			name:         "subprotocol",
+			subprotocols: []string{Subprotocol, "secret." + secret},
+			wantProtocol: Subprotocol,
+		},
+		{
+			name:         "wrong subprotocol secret",
+			subprotocols: []string{Subprotocol, "secret." + strings.Repeat("0", 64)},
+			wantStatus:   http.StatusUnauthorized,
+		},
+		{name: "no secret", wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dialer := websocket.Dialer{Subprotocols: tt.subprotocols}
+			ws, resp, err := dialer.Dial(wsURL, tt.header)
+			if tt.wantStatus != 0 {
+				if err == nil {
+					ws.Close()
+					t.Fatal("Expected the connection to be refused")
+				}
+				if resp == nil || resp.StatusCode != tt.wantStatus {
+					t.Errorf("Expected status %d, got %v", tt.wantStatus, resp)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected the connection to succeed: %v", err)
+			}
+			defer ws.Close()
+			// The secret must never be echoed back as the chosen subprotocol
+			if ws.Subprotocol() != tt.wantProtocol {
+				t.Errorf("Subprotocol = %q, want %q", ws.Subprotocol(), tt.wantProtocol)
+			}
+		})
+	}
+}
+
+func TestHandleConnection_Compression(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	rows := make([]map[string]interface{}, 500)
+	for i := range rows {
+		rows[i] = map[string]interface{}{"id": i, "email": fmt.Sprintf("user%d@example.com", i)}
+	}
+	mockClient := &MockPostgresClient{
+		ExecuteQueryFunc: func(ctx context.Context, sql string, params []interface{}) (*postgres.QueryResult, error) {
+			return &postgres.QueryResult{Columns: []protocol.ColumnInfo{{Name: "id"}, {Name: "email"}}, Rows: rows, RowCount: len(rows)}, nil
+		},
+	}
+
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compression=%v", enabled), func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.Compression = enabled
+			server := NewServer(secret, mockClient, opts)
+			testServer := httptest.NewServer(http.HandlerFunc(server.HandleConnection))
+			defer testServer.Close()
+
+			dialer := websocket.Dialer{EnableCompression: true}
+			ws, resp, err := dialer.Dial("ws"+strings.TrimPrefix(testServer.URL, "http")+"?secret="+secret, nil)
+			if err != nil {
+				t.Fatalf("Failed to connect: %v", err)
+			}
+			defer ws.Close()
+
+			negotiated := strings.Contains(resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate")
+			if negotiated != enabled {
+				t.Errorf("permessage-deflate negotiated = %v, want %v", negotiated, enabled)
+			}
+			if hello := readHello(t, ws); hello.Capabilities.Compression != enabled {
+				t.Errorf("Expected the compression capability to be %v", enabled)
+			}
+
+			// Concurrent writers share the connection's write lock with the compressor
+			for i := 0; i < 3; i++ {
+				sendMessage(t, ws, fmt.Sprintf("q%d", i), protocol.TypeQuery, protocol.QueryPayload{SQL: "SELECT id, email FROM users"})
+			}
+			for i := 0; i < 3; i++ {
+				var result protocol.ResultPayload
+				if response := readResponse(t, ws, &result); response.Type != protocol.TypeResult || result.RowCount != len(rows) {
+					t.Fatalf("Expected a full result, got %s with %d rows", response.Type, result.RowCount)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleConnection_MaxMessageBytes(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	executed := make(chan string, 1)
+	mockClient := &MockPostgresClient{
+		ExecuteQueryFunc: func(ctx context.Context, sql string, params []interface{}) (*postgres.QueryResult, error) {
+			executed <- sql
+			return &postgres.QueryResult{}, nil
+		},
+	}
+	opts := DefaultOptions()
+	opts.MaxMessageBytes = 1024
+	ws := dialTestServer(t, NewServer(secret, mockClient, opts))
+
+	// A message under the limit is handled as usual
+	sendMessage(t, ws, "small", protocol.TypeQuery, protocol.QueryPayload{SQL: "SELECT 1"})
+	readResponse(t, ws, nil)
+	<-executed
+
+	sendMessage(t, ws, "big", protocol.TypeQuery, protocol.QueryPayload{SQL: "SELECT '" + strings.Repeat("x", 2048) + "'"})
+	if err := ws.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("Failed to set read deadline: %v", err)
+	}
+	_, _, err = ws.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Fatalf("Expected a message too big close, got %v", err)
+	}
+	select {
+	case sql := <-executed:
+		t.Errorf("Expected the oversized query not to run, got %d bytes of SQL", len(sql))
+	default:
+	}
+}
+
+func TestHandleConnection_RejectedOrigin(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	opts := DefaultOptions()
+	opts.AllowedOrigins = []string{"http://localhost:4321"}
+	server := NewServer(secret, &MockPostgresClient{}, opts)
+
+	testServer := httptest.NewServer(http.HandlerFunc(server.HandleConnection))
+	defer testServer.Close()
+	wsURL := "ws" + strings.TrimPrefix(testServer.URL, "http") + "?secret=" + secret
+
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": {"http://localhost:5173"}})
+	if err == nil {
+		t.Fatal("Expected connection from an unlisted origin to fail")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected 403 Forbidden, got %v", resp)
+	}
+
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": {"http://localhost:4321"}})
+	if err != nil {
+		t.Fatalf("Expected connection from the allowed origin to succeed: %v", err)
+	}
+	ws.Close()
+}
+
+func TestHandleConnection_KeepAlivePings(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	opts := DefaultOptions()
+	opts.PingInterval = 20 * time.Millisecond
+	ws := dialTestServer(t, NewServer(secret, &MockPostgresClient{}, opts))
+
+	pings := make(chan struct{}, 10)
+	ws.SetPingHandler(func(data string) error {
+		select {
+		case pings <- struct{}{}:
+		default:
+		}
+		return ws.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+
+	// Control frames are handled while reading, so read in the background
+	go func() {
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-pings:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Timed out waiting for ping %d", i+1)
+		}
+	}
+
+	// Answering pings keeps the connection open well past the pong deadline
+	sendMessage(t, ws, "ping-1", protocol.TypePing, nil)
+	time.Sleep(100 * time.Millisecond)
+	sendMessage(t, ws, "ping-2", protocol.TypePing, nil)
+}
+
+func TestHandleConnection_KeepAliveClosesUnresponsiveClient(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	opts := DefaultOptions()
+	opts.PingInterval = 20 * time.Millisecond
+	ws := dialTestServer(t, NewServer(secret, &MockPostgresClient{}, opts))
+
+	// A client that never reads never answers pings
+	time.Sleep(200 * time.Millisecond)
+
+	if err := ws.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatalf("Failed to set read deadline: %v", err)
+	}
+	ws.SetPingHandler(func(string) error { return nil })
+	for {
+		_, _, err := ws.ReadMessage()
+		if err == nil {
+			continue
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			t.Fatal("Expected the server to close the connection, but it stayed open")
+		}
+		return
+	}
+}
+
+func TestHandleConnection_IdleTimeout(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	opts := DefaultOptions()
+	opts.MaxQueryTimeout = 0
+	opts.DefaultQueryTimeout = 0
+	opts.PingInterval = 20 * time.Millisecond
+	opts.IdleTimeout = 300 * time.Millisecond
+	ws := dialTestServer(t, NewServer(secret, &MockPostgresClient{}, opts))
+
+	// Answering pings doesn't count as activity, but messages do
+	messages := make(chan error, 10)
+	go func() {
+		for {
+			_, _, err := ws.ReadMessage()
+			messages <- err
+			if err != nil {
+				return
+			}
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		time.Sleep(150 * time.Millisecond)
+		sendMessage(t, ws, fmt.Sprintf("ping-%d", i), protocol.TypePing, nil)
+	}
+
+	// Then the client goes quiet
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case err := <-messages:
+			if err == nil {
+				continue
+			}
+			if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+				t.Fatalf("Expected a going away close, got %v", err)
+			}
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) && closeErr.Text != idleReason {
+				t.Errorf("Expected reason %q, got %q", idleReason, closeErr.Text)
+			}
+			return
+		case <-deadline:
+			t.Fatal("Expected the idle connection to be closed")
+		}
+	}
+}
+
 func TestHandleConnection_MissingSecret(t *testing.T) {
 	secret, err := auth.GenerateSecret()
 	if err != nil {
 		t.Fatalf("Failed to generate secret: %v", err)
 	}
 	mockClient := &MockPostgresClient{}
-	server := NewServer(secret, mockClient)
+	server := NewServer(secret, mockClient, DefaultOptions())
 
 	// Create a test HTTP request without secret
 	req := httptest.NewRequest("GET", "/", nil)
@@ -113,8 +697,12 @@ func TestHandleMessage_Ping(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to generate secret: %v", err)
 	}
-	mockClient := &MockPostgresClient{}
-	server := NewServer(secret, mockClient)
+	mockClient := &MockPostgresClient{
+		StatsFunc: func() postgres.PoolStats {
+			return postgres.PoolStats{Total: 3, Idle: 1, Acquired: 2, Max: 5, Queued: 4}
+		},
+	}
+	server := NewServer(secret, mockClient, DefaultOptions())
 
 	msg := protocol.ClientMessage{
 		ID:      "test-1",
@@ -131,6 +719,15 @@ func TestHandleMessage_Ping(t *testing.T) {
 	if response.ID != msg.ID {
 		t.Errorf("Expected response ID %s, got %s", msg.ID, response.ID)
 	}
+
+	payload, ok := response.Payload.(protocol.PongPayload)
+	if !ok || payload.Pool == nil {
+		t.Fatalf("Expected a pong with pool statistics, got %+v", response.Payload)
+	}
+	want := protocol.PoolStatus{Total: 3, Idle: 1, Acquired: 2, Max: 5, Queued: 4}
+	if *payload.Pool != want {
+		t.Errorf("Expected pool %+v, got %+v", want, *payload.Pool)
+	}
 }
 
 func TestHandleMessage_UnknownType(t *testing.T) {
@@ -139,7 +736,7 @@ func TestHandleMessage_UnknownType(t *testing.T) {
 		t.Fatalf("Failed to generate secret: %v", err)
 	}
 	mockClient := &MockPostgresClient{}
-	server := NewServer(secret, mockClient)
+	server := NewServer(secret, mockClient, DefaultOptions())
 
 	msg := protocol.ClientMessage{
 		ID:      "test-1",
@@ -180,10 +777,11 @@ func TestHandleQuery_Success(t *testing.T) {
 				},
 				RowCount:      1,
 				ExecutionTime: 10 * time.Millisecond,
+				Timing:        postgres.QueryTiming{FirstRow: 6 * time.Millisecond, Fetch: 7 * time.Millisecond, Conversion: 3 * time.Millisecond},
 			}, nil
 		},
 	}
-	server := NewServer(secret, mockClient)
+	server := NewServer(secret, mockClient, DefaultOptions())
 
 	payload := protocol.QueryPayload{
 		SQL:    "SELECT * FROM users",
@@ -216,6 +814,11 @@ func TestHandleQuery_Success(t *testing.T) {
 	if len(resultPayload.Columns) != 2 {
 		t.Errorf("Expected 2 columns, got %d", len(resultPayload.Columns))
 	}
+
+	wantTiming := protocol.QueryTiming{FirstRowMicros: 6000, FetchMicros: 7000, ConversionMicros: 3000}
+	if resultPayload.Timing == nil || *resultPayload.Timing != wantTiming {
+		t.Errorf("Expected timing %+v, got %+v", wantTiming, resultPayload.Timing)
+	}
 }
 
 func TestHandleQuery_EmptySQL(t *testing.T) {
@@ -224,7 +827,7 @@ func TestHandleQuery_EmptySQL(t *testing.T) {
 		t.Fatalf("Failed to generate secret: %v", err)
 	}
 	mockClient := &MockPostgresClient{}
-	server := NewServer(secret, mockClient)
+	server := NewServer(secret, mockClient, DefaultOptions())
 
 	payload := protocol.QueryPayload{
 		SQL:    "",
@@ -264,7 +867,7 @@ func TestHandleQuery_DatabaseError(t *testing.T) {
 			return nil, fmt.Errorf("table does not exist")
 		},
 	}
-	server := NewServer(secret, mockClient)
+	server := NewServer(secret, mockClient, DefaultOptions())
 
 	payload := protocol.QueryPayload{
 		SQL:    "SELECT * FROM nonexistent",
@@ -298,6 +901,70 @@ func TestHandleQuery_DatabaseError(t *testing.T) {
 	}
 }
 
+func TestHandleQuery_PostgresErrorFields(t *testing.T) {
+	dbErr := &postgres.DatabaseError{
+		Code:     "42703",
+		Message:  `column "nme" does not exist`,
+		Detail:   "The column was dropped.",
+		Hint:     `Perhaps you meant to reference the column "users.name".`,
+		Position: 8,
+	}
+
+	tests := []struct {
+		name  string
+		err   error
+		multi bool
+		want  protocol.ErrorPayload
+	}{
+		{
+			name: "query",
+			err:  dbErr,
+			want: protocol.ErrorPayload{Code: "42703", Message: dbErr.Message, Detail: dbErr.Detail, Hint: dbErr.Hint, Position: 8},
+		},
+		{
+			name:  "script statement",
+			err:   &postgres.ScriptError{Index: 1, Total: 2, Committed: 1, Err: dbErr},
+			multi: true,
+			want: protocol.ErrorPayload{
+				Code:      "42703",
+				Message:   `statement 2 of 2 failed: column "nme" does not exist`,
+				Detail:    "The column was dropped.\n1 earlier statement(s) committed, 0 not run",
+				Hint:      dbErr.Hint,
+				Position:  8,
+				Statement: 2,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockClient := &MockPostgresClient{
+				ExecuteQueryFunc: func(ctx context.Context, sql string, params []interface{}) (*postgres.QueryResult, error) {
+					return nil, tt.err
+				},
+				ExecuteScriptFunc: func(ctx context.Context, statements []string, transactional bool) (*postgres.ScriptResult, error) {
+					return &postgres.ScriptResult{}, tt.err
+				},
+			}
+			server := NewServer("secret", mockClient, DefaultOptions())
+
+			response := server.handleMessage(protocol.ClientMessage{
+				ID:      "q1",
+				Type:    protocol.TypeQuery,
+				Payload: protocol.QueryPayload{SQL: "SELECT 1; SELECT nme FROM users", Multi: tt.multi},
+			})
+
+			errorPayload, ok := response.Payload.(protocol.ErrorPayload)
+			if !ok {
+				t.Fatalf("Expected ErrorPayload in response, got %T", response.Payload)
+			}
+			if errorPayload != tt.want {
+				t.Errorf("Error payload = %+v, want %+v", errorPayload, tt.want)
+			}
+		})
+	}
+}
+
 func TestHandleQuery_WithTimeout(t *testing.T) {
 	secret, err := auth.GenerateSecret()
 	if err != nil {
@@ -318,7 +985,7 @@ func TestHandleQuery_WithTimeout(t *testing.T) {
 			}, nil
 		},
 	}
-	server := NewServer(secret, mockClient)
+	server := NewServer(secret, mockClient, DefaultOptions())
 
 	payload := protocol.QueryPayload{
 		SQL:     "SELECT 1",
@@ -339,44 +1006,417 @@ func TestHandleQuery_WithTimeout(t *testing.T) {
 	}
 }
 
-func TestHandleIntrospect_Success(t *testing.T) {
+func TestHandleQuery_ReadOnlyRejectsWrites(t *testing.T) {
 	secret, err := auth.GenerateSecret()
 	if err != nil {
 		t.Fatalf("Failed to generate secret: %v", err)
 	}
 	mockClient := &MockPostgresClient{
-		IntrospectSchemaFunc: func(ctx context.Context) (*protocol.SchemaPayload, error) {
-			return &protocol.SchemaPayload{
-				Tables: []protocol.TableInfo{
-					{
-						Schema: "public",
-						Name:   "users",
-						Type:   "table",
-						Columns: []protocol.ColumnInfo{
-							{Name: "id", DataType: "int4"},
-							{Name: "name", DataType: "text"},
-						},
-					},
-				},
-				Functions: []protocol.FunctionInfo{
-					{
-						Schema:     "public",
-						Name:       "get_user",
-						ReturnType: "users",
-					},
-				},
-			}, nil
+		ExecuteQueryFunc: func(ctx context.Context, sql string, params []interface{}) (*postgres.QueryResult, error) {
+			t.Errorf("Expected mutating query not to reach the database, got: %s", sql)
+			return nil, nil
 		},
 	}
-	server := NewServer(secret, mockClient)
-
-	msg := protocol.ClientMessage{
-		ID:      "test-1",
-		Type:    protocol.TypeIntrospect,
-		Payload: nil,
-	}
+	server := NewServer(secret, mockClient, Options{ReadOnly: true})
+
+	statements := []string{
+		"INSERT INTO users (name) VALUES ('x')",
+		"update users set name = 'y'",
+		"DELETE FROM users",
+		"DROP TABLE users",
+		"CREATE TABLE t (id int)",
+		"ALTER TABLE users ADD COLUMN age int",
+		"TRUNCATE users",
+		"GRANT SELECT ON users TO analyst",
+	}
+
+	for _, sql := range statements {
+		t.Run(sql, func(t *testing.T) {
+			msg := protocol.ClientMessage{
+				ID:      "test-1",
+				Type:    protocol.TypeQuery,
+				Payload: protocol.QueryPayload{SQL: sql},
+			}
 
-	response := server.handleMessage(msg)
+			response := server.handleMessage(msg)
+
+			errorPayload, ok := response.Payload.(protocol.ErrorPayload)
+			if !ok {
+				t.Fatalf("Expected ErrorPayload in response, got %T", response.Payload)
+			}
+			if errorPayload.Code != "READ_ONLY_VIOLATION" {
+				t.Errorf("Expected error code READ_ONLY_VIOLATION, got %s", errorPayload.Code)
+			}
+			if !strings.Contains(errorPayload.Hint, "--read-only") {
+				t.Errorf("Expected a hint mentioning --read-only, got %q", errorPayload.Hint)
+			}
+		})
+	}
+}
+
+func TestHandleQuery_Pagination(t *testing.T) {
+	tests := []struct {
+		name       string
+		payload    protocol.QueryPayload
+		wantSQL    string
+		wantParams []interface{}
+		wantTotal  *int64
+	}{
+		{
+			name:       "limit and offset",
+			payload:    protocol.QueryPayload{SQL: "SELECT * FROM users WHERE age > $1", Params: []interface{}{21}, Limit: 50, Offset: 100},
+			wantSQL:    sqlutil.Paginate("SELECT * FROM users WHERE age > $1", 1),
+			wantParams: []interface{}{float64(21), 50, 100}, // params arrive as JSON numbers
+		},
+		{
+			name:       "offset only",
+			payload:    protocol.QueryPayload{SQL: "SELECT * FROM users", Offset: 10},
+			wantSQL:    sqlutil.Paginate("SELECT * FROM users", 0),
+			wantParams: []interface{}{nil, 10},
+		},
+		{
+			name:       "with total",
+			payload:    protocol.QueryPayload{SQL: "SELECT * FROM users", Limit: 50, WantTotal: true},
+			wantSQL:    sqlutil.Paginate("SELECT * FROM users", 0),
+			wantParams: []interface{}{50, 0},
+			wantTotal:  func() *int64 { n := int64(1234); return &n }(),
+		},
+		{
+			name:      "total without a page",
+			payload:   protocol.QueryPayload{SQL: "SELECT * FROM users", WantTotal: true},
+			wantSQL:   "SELECT * FROM users",
+			wantTotal: func() *int64 { n := int64(1234); return &n }(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotSQL string
+			var gotParams []interface{}
+			mockClient := &MockPostgresClient{
+				ExecuteQueryFunc: func(ctx context.Context, sql string, params []interface{}) (*postgres.QueryResult, error) {
+					if strings.HasPrefix(sql, "SELECT count(*)") {
+						return &postgres.QueryResult{Rows: []map[string]interface{}{{"total": int64(1234)}}}, nil
+					}
+					gotSQL, gotParams = sql, params
+					return &postgres.QueryResult{Rows: []map[string]interface{}{{"id": 1}}}, nil
+				},
+			}
+			server := NewServer("secret", mockClient, DefaultOptions())
+
+			response := server.handleMessage(protocol.ClientMessage{ID: "q1", Type: protocol.TypeQuery, Payload: tt.payload})
+
+			result, ok := response.Payload.(protocol.ResultPayload)
+			if !ok {
+				t.Fatalf("Expected ResultPayload, got %+v", response.Payload)
+			}
+			if gotSQL != tt.wantSQL {
+				t.Errorf("SQL = %q, want %q", gotSQL, tt.wantSQL)
+			}
+			if !reflect.DeepEqual(gotParams, tt.wantParams) {
+				t.Errorf("Params = %v, want %v", gotParams, tt.wantParams)
+			}
+			if !reflect.DeepEqual(result.Total, tt.wantTotal) {
+				t.Errorf("Total = %v, want %v", result.Total, tt.wantTotal)
+			}
+		})
+	}
+}
+
+func TestHandleQuery_PaginationValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload protocol.QueryPayload
+	}{
+		{name: "negative limit", payload: protocol.QueryPayload{SQL: "SELECT 1", Limit: -1}},
+		{name: "negative offset", payload: protocol.QueryPayload{SQL: "SELECT 1", Offset: -5}},
+		{name: "not a select", payload: protocol.QueryPayload{SQL: "DELETE FROM users", Limit: 10}},
+		{name: "several statements", payload: protocol.QueryPayload{SQL: "SELECT 1; SELECT 2", Limit: 10}},
+		{name: "existing limit", payload: protocol.QueryPayload{SQL: "SELECT * FROM users LIMIT 5", Limit: 10}},
+		{name: "existing limit with total", payload: protocol.QueryPayload{SQL: "SELECT * FROM users LIMIT 5", WantTotal: true}},
+		{name: "script", payload: protocol.QueryPayload{SQL: "SELECT 1; SELECT 2", Multi: true, Limit: 10}},
+		{name: "explain", payload: protocol.QueryPayload{SQL: "SELECT 1", Explain: true, Limit: 10}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockClient := &MockPostgresClient{
+				ExecuteQueryFunc: func(ctx context.Context, sql string, params []interface{}) (*postgres.QueryResult, error) {
+					t.Errorf("Expected no query to run, got %q", sql)
+					return &postgres.QueryResult{}, nil
+				},
+			}
+			server := NewServer("secret", mockClient, DefaultOptions())
+
+			response := server.handleMessage(protocol.ClientMessage{ID: "q1", Type: protocol.TypeQuery, Payload: tt.payload})
+
+			errorPayload, ok := response.Payload.(protocol.ErrorPayload)
+			if !ok || errorPayload.Code != "INVALID_PAYLOAD" {
+				t.Errorf("Expected INVALID_PAYLOAD error, got %+v", response.Payload)
+			}
+		})
+	}
+}
+
+func TestHandleQuery_NamedParams(t *testing.T) {
+	tests := []struct {
+		name       string
+		payload    protocol.QueryPayload
+		wantSQL    string
+		wantParams []interface{}
+		wantCode   string
+	}{
+		{
+			name:       "rewritten to positional",
+			payload:    protocol.QueryPayload{SQL: "SELECT * FROM users WHERE id = :id OR manager_id = :id::int", NamedParams: map[string]interface{}{"id": 7}},
+			wantSQL:    "SELECT * FROM users WHERE id = $1 OR manager_id = $1::int",
+			wantParams: []interface{}{float64(7)}, // params arrive as JSON numbers
+		},
+		{
+			name:       "with pagination",
+			payload:    protocol.QueryPayload{SQL: "SELECT * FROM users WHERE name = :name", NamedParams: map[string]interface{}{"name": "alice"}, Limit: 10},
+			wantSQL:    sqlutil.Paginate("SELECT * FROM users WHERE name = $1", 1),
+			wantParams: []interface{}{"alice", 10, 0},
+		},
+		{
+			name:     "missing value",
+			payload:  protocol.QueryPayload{SQL: "SELECT :missing", NamedParams: map[string]interface{}{"id": 7}},
+			wantCode: "INVALID_PAYLOAD",
+		},
+		{
+			name:     "combined with params",
+			payload:  protocol.QueryPayload{SQL: "SELECT :id, $2", Params: []interface{}{1}, NamedParams: map[string]interface{}{"id": 7}},
+			wantCode: "INVALID_PAYLOAD",
+		},
+		{
+			name:     "in a script",
+			payload:  protocol.QueryPayload{SQL: "SELECT :id; SELECT 2", Multi: true, NamedParams: map[string]interface{}{"id": 7}},
+			wantCode: "INVALID_PAYLOAD",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotSQL string
+			var gotParams []interface{}
+			mockClient := &MockPostgresClient{
+				ExecuteQueryFunc: func(ctx context.Context, sql string, params []interface{}) (*postgres.QueryResult, error) {
+					gotSQL, gotParams = sql, params
+					return &postgres.QueryResult{}, nil
+				},
+			}
+			server := NewServer("secret", mockClient, DefaultOptions())
+
+			response := server.handleMessage(protocol.ClientMessage{ID: "q1", Type: protocol.TypeQuery, Payload: tt.payload})
+
+			if tt.wantCode != "" {
+				errorPayload, ok := response.Payload.(protocol.ErrorPayload)
+				if !ok || errorPayload.Code != tt.wantCode {
+					t.Errorf("Expected %s error, got %+v", tt.wantCode, response.Payload)
+				}
+				if gotSQL != "" {
+					t.Errorf("Expected no query to run, got %q", gotSQL)
+				}
+				return
+			}
+			if response.Type != protocol.TypeResult {
+				t.Fatalf("Expected a result, got %+v", response.Payload)
+			}
+			if gotSQL != tt.wantSQL {
+				t.Errorf("SQL = %q, want %q", gotSQL, tt.wantSQL)
+			}
+			if !reflect.DeepEqual(gotParams, tt.wantParams) {
+				t.Errorf("Params = %v, want %v", gotParams, tt.wantParams)
+			}
+		})
+	}
+}
+
+func TestHandleQuery_Validate(t *testing.T) {
+	columns := []protocol.ColumnInfo{{Name: "id", DataType: "integer"}, {Name: "name", DataType: "text"}}
+
+	tests := []struct {
+		name       string
+		opts       Options
+		payload    protocol.QueryPayload
+		prepareErr error
+		wantSQL    string
+		wantCode   string
+	}{
+		{
+			name:    "valid query",
+			payload: protocol.QueryPayload{SQL: "SELECT id, name FROM users WHERE id = $1", Validate: true},
+			wantSQL: "SELECT id, name FROM users WHERE id = $1",
+		},
+		{
+			name:    "named parameters",
+			payload: protocol.QueryPayload{SQL: "SELECT id, name FROM users WHERE id = :id", NamedParams: map[string]interface{}{"id": 7}, Validate: true},
+			wantSQL: "SELECT id, name FROM users WHERE id = $1",
+		},
+		{
+			name:    "writes in read-only mode",
+			opts:    Options{ReadOnly: true},
+			payload: protocol.QueryPayload{SQL: "DELETE FROM users RETURNING id, name", Validate: true},
+			wantSQL: "DELETE FROM users RETURNING id, name",
+		},
+		{
+			name:       "invalid query",
+			payload:    protocol.QueryPayload{SQL: "SELECT nope FROM users", Validate: true},
+			prepareErr: &postgres.DatabaseError{Code: "42703", Message: `column "nope" does not exist`, Position: 8},
+			wantSQL:    "SELECT nope FROM users",
+			wantCode:   "42703",
+		},
+		{
+			name:     "with explain",
+			payload:  protocol.QueryPayload{SQL: "SELECT 1", Validate: true, Explain: true},
+			wantCode: "INVALID_PAYLOAD",
+		},
+		{
+			name:     "with pagination",
+			payload:  protocol.QueryPayload{SQL: "SELECT 1", Validate: true, Limit: 10},
+			wantCode: "INVALID_PAYLOAD",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotSQL string
+			mockClient := &MockPostgresClient{
+				PrepareFunc: func(ctx context.Context, sql string) (*postgres.PreparedStatement, error) {
+					gotSQL = sql
+					if tt.prepareErr != nil {
+						return nil, tt.prepareErr
+					}
+					return &postgres.PreparedStatement{ParamTypes: []string{"integer"}, Columns: columns}, nil
+				},
+				ExecuteQueryFunc: func(ctx context.Context, sql string, params []interface{}) (*postgres.QueryResult, error) {
+					t.Errorf("Expected the query not to run, got %q", sql)
+					return &postgres.QueryResult{}, nil
+				},
+			}
+			server := NewServer("secret", mockClient, tt.opts)
+
+			response := server.handleMessage(protocol.ClientMessage{ID: "v1", Type: protocol.TypeQuery, Payload: tt.payload})
+
+			if gotSQL != tt.wantSQL {
+				t.Errorf("Prepared SQL = %q, want %q", gotSQL, tt.wantSQL)
+			}
+			if tt.wantCode != "" {
+				errorPayload, ok := response.Payload.(protocol.ErrorPayload)
+				if !ok || errorPayload.Code != tt.wantCode {
+					t.Errorf("Expected %s error, got %+v", tt.wantCode, response.Payload)
+				}
+				return
+			}
+			validation, ok := response.Payload.(protocol.ValidationPayload)
+			if !ok || response.Type != protocol.TypeValidation || response.ID != "v1" {
+				t.Fatalf("Expected a validation for v1, got %+v", response)
+			}
+			if !validation.Valid || !reflect.DeepEqual(validation.Columns, columns) || !reflect.DeepEqual(validation.ParamTypes, []string{"integer"}) {
+				t.Errorf("Unexpected validation: %+v", validation)
+			}
+		})
+	}
+}
+
+func TestHandleQuery_ReadOnlyAllowsSelect(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	executed := false
+	mockClient := &MockPostgresClient{
+		ExecuteQueryFunc: func(ctx context.Context, sql string, params []interface{}) (*postgres.QueryResult, error) {
+			executed = true
+			return &postgres.QueryResult{}, nil
+		},
+	}
+	server := NewServer(secret, mockClient, Options{ReadOnly: true})
+
+	msg := protocol.ClientMessage{
+		ID:      "test-1",
+		Type:    protocol.TypeQuery,
+		Payload: protocol.QueryPayload{SQL: "SELECT * FROM users"},
+	}
+
+	response := server.handleMessage(msg)
+
+	if response.Type != protocol.TypeResult {
+		t.Errorf("Expected response type %s, got %s", protocol.TypeResult, response.Type)
+	}
+	if !executed {
+		t.Error("Expected SELECT to be executed in read-only mode")
+	}
+}
+
+func TestHandleQuery_ReadOnlyDatabaseRejection(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	mockClient := &MockPostgresClient{
+		ExecuteQueryFunc: func(ctx context.Context, sql string, params []interface{}) (*postgres.QueryResult, error) {
+			return nil, fmt.Errorf("%w: cannot execute INSERT in a read-only transaction", postgres.ErrReadOnlyViolation)
+		},
+	}
+	server := NewServer(secret, mockClient, Options{ReadOnly: true})
+
+	// A data-modifying CTE slips past the keyword check but is rejected by the database
+	msg := protocol.ClientMessage{
+		ID:      "test-1",
+		Type:    protocol.TypeQuery,
+		Payload: protocol.QueryPayload{SQL: "WITH x AS (INSERT INTO users VALUES (1) RETURNING *) SELECT * FROM x"},
+	}
+
+	response := server.handleMessage(msg)
+
+	errorPayload, ok := response.Payload.(protocol.ErrorPayload)
+	if !ok {
+		t.Fatalf("Expected ErrorPayload in response, got %T", response.Payload)
+	}
+	if errorPayload.Code != "READ_ONLY_VIOLATION" {
+		t.Errorf("Expected error code READ_ONLY_VIOLATION, got %s", errorPayload.Code)
+	}
+}
+
+func TestHandleIntrospect_Success(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	mockClient := &MockPostgresClient{
+		IntrospectSchemaFunc: func(ctx context.Context, schemas []string) (*protocol.SchemaPayload, error) {
+			return &protocol.SchemaPayload{
+				Tables: []protocol.TableInfo{
+					{
+						Schema: "public",
+						Name:   "users",
+						Type:   "table",
+						Columns: []protocol.ColumnInfo{
+							{Name: "id", DataType: "int4"},
+							{Name: "name", DataType: "text"},
+						},
+					},
+				},
+				Functions: []protocol.FunctionInfo{
+					{
+						Schema:     "public",
+						Name:       "get_user",
+						ReturnType: "users",
+					},
+				},
+			}, nil
+		},
+	}
+	server := NewServer(secret, mockClient, DefaultOptions())
+
+	msg := protocol.ClientMessage{
+		ID:      "test-1",
+		Type:    protocol.TypeIntrospect,
+		Payload: nil,
+	}
+
+	response := server.handleMessage(msg)
 
 	if response.Type != protocol.TypeSchema {
 		t.Errorf("Expected response type %s, got %s", protocol.TypeSchema, response.Type)
@@ -403,11 +1443,11 @@ func TestHandleIntrospect_Error(t *testing.T) {
 		t.Fatalf("Failed to generate secret: %v", err)
 	}
 	mockClient := &MockPostgresClient{
-		IntrospectSchemaFunc: func(ctx context.Context) (*protocol.SchemaPayload, error) {
+		IntrospectSchemaFunc: func(ctx context.Context, schemas []string) (*protocol.SchemaPayload, error) {
 			return nil, fmt.Errorf("connection lost")
 		},
 	}
-	server := NewServer(secret, mockClient)
+	server := NewServer(secret, mockClient, DefaultOptions())
 
 	msg := protocol.ClientMessage{
 		ID:      "test-1",
@@ -432,13 +1472,35 @@ func TestHandleIntrospect_Error(t *testing.T) {
 	}
 }
 
+func TestHandleIntrospect_Schemas(t *testing.T) {
+	var got []string
+	server := NewServer("unused", &MockPostgresClient{
+		IntrospectSchemaFunc: func(ctx context.Context, schemas []string) (*protocol.SchemaPayload, error) {
+			got = schemas
+			return &protocol.SchemaPayload{}, nil
+		},
+	}, DefaultOptions())
+
+	server.handleIntrospect(context.Background(), nil, protocol.ClientMessage{ID: "i", Type: protocol.TypeIntrospect, Payload: map[string]interface{}{"schemas": []string{"public", "app"}}})
+	if len(got) != 2 || got[0] != "public" || got[1] != "app" {
+		t.Errorf("Expected the schema filter to reach the client, got %v", got)
+	}
+
+	server.handleIntrospect(context.Background(), nil, protocol.ClientMessage{ID: "i", Type: protocol.TypeIntrospect})
+	if got != nil {
+		t.Errorf("Expected no filter without a payload, got %v", got)
+	}
+}
+
 func TestHandleConnection_ValidWebSocket(t *testing.T) {
 	secret, err := auth.GenerateSecret()
 	if err != nil {
 		t.Fatalf("Failed to generate secret: %v", err)
 	}
 	mockClient := &MockPostgresClient{}
-	server := NewServer(secret, mockClient)
+	opts := DefaultOptions()
+	opts.Build = protocol.BuildInfo{Version: "1.2.3", Commit: "abc123"}
+	server := NewServer(secret, mockClient, opts)
 
 	// Create a test HTTP server
 	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -460,6 +1522,15 @@ func TestHandleConnection_ValidWebSocket(t *testing.T) {
 		}
 	}()
 
+	// The server speaks first
+	hello := readHello(t, ws)
+	if hello.Version != "1.2.3" || hello.Build.Commit != "abc123" {
+		t.Errorf("Expected the hello to describe the build, got %+v", hello)
+	}
+	if hello.Database != DefaultDatabase || hello.DatabaseName != "postgres" || hello.DatabaseState != "connected" || hello.ProtocolVersion != protocol.ProtocolVersion || !hello.Capabilities.Streaming || hello.Capabilities.ReadOnly {
+		t.Errorf("Unexpected hello: %+v", hello)
+	}
+
 	// Send a ping message
 	pingMsg := protocol.ClientMessage{
 		ID:      "test-ping",
@@ -531,3 +1602,1839 @@ func TestSendMessage(t *testing.T) {
 		t.Errorf("Expected message type %s, got %s", protocol.TypePong, response.Type)
 	}
 }
+
+// dialTestServer starts an httptest server for the given Server, connects a WebSocket client to it
+// and reads the hello message
+func dialTestServer(t *testing.T, server *Server) *websocket.Conn {
+	t.Helper()
+
+	ws := connectTestServer(t, server)
+	readHello(t, ws)
+	return ws
+}
+
+// connectTestServer is dialTestServer without reading the hello message
+func connectTestServer(t *testing.T, server *Server) *websocket.Conn {
+	t.Helper()
+
+	testServer := httptest.NewServer(http.HandlerFunc(server.HandleConnection))
+	t.Cleanup(testServer.Close)
+
+	wsURL := "ws" + strings.TrimPrefix(testServer.URL, "http") + "?secret=" + server.secret
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := ws.Close(); err != nil {
+			t.Logf("Error closing websocket: %v", err)
+		}
+	})
+
+	return ws
+}
+
+// readResponses reads n server messages and indexes them by type
+func readResponses(t *testing.T, ws *websocket.Conn, n int) map[string]protocol.ServerMessage {
+	t.Helper()
+
+	if err := ws.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("Failed to set read deadline: %v", err)
+	}
+
+	responses := make(map[string]protocol.ServerMessage)
+	for i := 0; i < n; i++ {
+		var response protocol.ServerMessage
+		if err := ws.ReadJSON(&response); err != nil {
+			t.Fatalf("Failed to read response %d: %v", i+1, err)
+		}
+		responses[response.Type] = response
+	}
+	return responses
+}
+
+func TestHandleConnection_CancelQuery(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	started := make(chan struct{})
+	mockClient := &MockPostgresClient{
+		ExecuteQueryFunc: func(ctx context.Context, sql string, params []interface{}) (*postgres.QueryResult, error) {
+			close(started)
+			<-ctx.Done()
+			return nil, fmt.Errorf("%w: canceling statement due to user request", postgres.ErrQueryCanceled)
+		},
+	}
+	server := NewServer(secret, mockClient, DefaultOptions())
+	ws := dialTestServer(t, server)
+
+	queryMsg := protocol.ClientMessage{
+		ID:      "slow-query",
+		Type:    protocol.TypeQuery,
+		Payload: protocol.QueryPayload{SQL: "SELECT pg_sleep(60)"},
+	}
+	if err := ws.WriteJSON(queryMsg); err != nil {
+		t.Fatalf("Failed to send query message: %v", err)
+	}
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Query was never executed")
+	}
+
+	cancelMsg := protocol.ClientMessage{
+		ID:      "cancel-1",
+		Type:    protocol.TypeCancel,
+		Payload: protocol.CancelPayload{QueryID: "slow-query"},
+	}
+	if err := ws.WriteJSON(cancelMsg); err != nil {
+		t.Fatalf("Failed to send cancel message: %v", err)
+	}
+
+	responses := readResponses(t, ws, 2)
+
+	ack, ok := responses[protocol.TypeCanceled]
+	if !ok {
+		t.Fatalf("Expected a %s acknowledgment, got %v", protocol.TypeCanceled, responses)
+	}
+	if ack.ID != "cancel-1" {
+		t.Errorf("Expected acknowledgment ID cancel-1, got %s", ack.ID)
+	}
+
+	queryResponse, ok := responses[protocol.TypeError]
+	if !ok {
+		t.Fatalf("Expected an error response for the canceled query, got %v", responses)
+	}
+	if queryResponse.ID != "slow-query" {
+		t.Errorf("Expected error for slow-query, got %s", queryResponse.ID)
+	}
+
+	payloadBytes, _ := json.Marshal(queryResponse.Payload)
+	var errorPayload protocol.ErrorPayload
+	if err := json.Unmarshal(payloadBytes, &errorPayload); err != nil {
+		t.Fatalf("Failed to unmarshal error payload: %v", err)
+	}
+	if errorPayload.Code != "QUERY_CANCELED" {
+		t.Errorf("Expected error code QUERY_CANCELED, got %s", errorPayload.Code)
+	}
+}
+
+func TestHandleConnection_SlowIntrospectionKeepsReadLoopFree(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	started := make(chan struct{})
+	mockClient := &MockPostgresClient{
+		IntrospectSchemaFunc: func(ctx context.Context, schemas []string) (*protocol.SchemaPayload, error) {
+			close(started)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+	server := NewServer(secret, mockClient, DefaultOptions())
+	ws := dialTestServer(t, server)
+
+	sendMessage(t, ws, "introspect-1", protocol.TypeIntrospect, nil)
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Introspection never started")
+	}
+
+	sendMessage(t, ws, "ping-1", protocol.TypePing, nil)
+	if response := readResponse(t, ws, nil); response.Type != protocol.TypePong {
+		t.Fatalf("Expected pong while introspection runs, got %s", response.Type)
+	}
+
+	sendMessage(t, ws, "cancel-1", protocol.TypeCancel, protocol.CancelPayload{QueryID: "introspect-1"})
+	responses := readResponses(t, ws, 2)
+	if ack, ok := responses[protocol.TypeCanceled]; !ok || ack.ID != "cancel-1" {
+		t.Errorf("Expected the cancel to be acknowledged, got %v", responses)
+	}
+	if response, ok := responses[protocol.TypeError]; !ok || response.ID != "introspect-1" {
+		t.Errorf("Expected the introspection to fail once cancelled, got %v", responses)
+	}
+}
+
+func TestHandleConnection_MaxConcurrentQueries(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	var running, peak int32
+	release := make(chan struct{})
+	mockClient := &MockPostgresClient{
+		ExecuteQueryFunc: func(ctx context.Context, sql string, params []interface{}) (*postgres.QueryResult, error) {
+			n := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			for {
+				p := atomic.LoadInt32(&peak)
+				if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+					break
+				}
+			}
+			<-release
+			return &postgres.QueryResult{}, nil
+		},
+	}
+	opts := DefaultOptions()
+	opts.MaxConcurrentQueries = 2
+	ws := dialTestServer(t, NewServer(secret, mockClient, opts))
+
+	// Fill both slots before queueing more, so query-4 is sure to be waiting
+	for i := 1; i <= 4; i++ {
+		sendMessage(t, ws, fmt.Sprintf("query-%d", i), protocol.TypeQuery, protocol.QueryPayload{SQL: "SELECT 1"})
+		for i == 2 && atomic.LoadInt32(&running) < 2 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// A queued query can be cancelled before it runs, and the read loop still answers pings
+	sendMessage(t, ws, "cancel-4", protocol.TypeCancel, protocol.CancelPayload{QueryID: "query-4"})
+	sendMessage(t, ws, "ping", protocol.TypePing, nil)
+	responses := readResponses(t, ws, 3)
+	for _, msgType := range []string{protocol.TypeCanceled, protocol.TypePong} {
+		if _, ok := responses[msgType]; !ok {
+			t.Fatalf("Expected a %s response while queries are running, got %v", msgType, responses)
+		}
+	}
+	payloadBytes, _ := json.Marshal(responses[protocol.TypeError].Payload)
+	var errorPayload protocol.ErrorPayload
+	if err := json.Unmarshal(payloadBytes, &errorPayload); err != nil {
+		t.Fatalf("Failed to unmarshal error payload: %v", err)
+	}
+	if responses[protocol.TypeError].ID != "query-4" || errorPayload.Code != "QUERY_CANCELED" {
+		t.Errorf("Expected QUERY_CANCELED for query-4, got %s for %s", errorPayload.Code, responses[protocol.TypeError].ID)
+	}
+
+	close(release)
+	for i := 0; i < 3; i++ {
+		responses := readResponses(t, ws, 1)
+		if _, ok := responses[protocol.TypeResult]; !ok {
+			t.Fatalf("Expected a query result, got %v", responses)
+		}
+	}
+	if got := atomic.LoadInt32(&peak); got != 2 {
+		t.Errorf("Expected at most 2 queries at once, peak was %d", got)
+	}
+}
+
+func TestHandleConnection_MaxConnections(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	opts := DefaultOptions()
+	opts.MaxConnections = 1
+	server := NewServer(secret, &MockPostgresClient{}, opts)
+	testServer := httptest.NewServer(http.HandlerFunc(server.HandleConnection))
+	defer testServer.Close()
+	wsURL := "ws" + strings.TrimPrefix(testServer.URL, "http") + "?secret=" + secret
+
+	first, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err == nil {
+		t.Fatal("Expected a connection over the limit to be refused")
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d, got %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "Too many connections") {
+		t.Errorf("Expected the response to explain the refusal, got %q", body)
+	}
+
+	// Disconnecting frees the connection for the next client
+	if err := first.Close(); err != nil {
+		t.Fatalf("Failed to close websocket: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for server.active.Load() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the closed connection to be released")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	second, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Expected a connection after another disconnected, got %v", err)
+	}
+	if err := second.Close(); err != nil {
+		t.Logf("Error closing websocket: %v", err)
+	}
+}
+
+func TestHandleConnection_CancelUnknownQuery(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	server := NewServer(secret, &MockPostgresClient{}, DefaultOptions())
+	ws := dialTestServer(t, server)
+
+	cancelMsg := protocol.ClientMessage{
+		ID:      "cancel-1",
+		Type:    protocol.TypeCancel,
+		Payload: protocol.CancelPayload{QueryID: "does-not-exist"},
+	}
+	if err := ws.WriteJSON(cancelMsg); err != nil {
+		t.Fatalf("Failed to send cancel message: %v", err)
+	}
+
+	responses := readResponses(t, ws, 1)
+	response, ok := responses[protocol.TypeError]
+	if !ok {
+		t.Fatalf("Expected an error response, got %v", responses)
+	}
+
+	payloadBytes, _ := json.Marshal(response.Payload)
+	var errorPayload protocol.ErrorPayload
+	if err := json.Unmarshal(payloadBytes, &errorPayload); err != nil {
+		t.Fatalf("Failed to unmarshal error payload: %v", err)
+	}
+	if errorPayload.Code != "QUERY_NOT_FOUND" {
+		t.Errorf("Expected error code QUERY_NOT_FOUND, got %s", errorPayload.Code)
+	}
+}
+
+func TestHandleConnection_PingDuringSlowQuery(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	release := make(chan struct{})
+	mockClient := &MockPostgresClient{
+		ExecuteQueryFunc: func(ctx context.Context, sql string, params []interface{}) (*postgres.QueryResult, error) {
+			<-release
+			return &postgres.QueryResult{}, nil
+		},
+	}
+	server := NewServer(secret, mockClient, DefaultOptions())
+	ws := dialTestServer(t, server)
+
+	if err := ws.WriteJSON(protocol.ClientMessage{ID: "slow", Type: protocol.TypeQuery, Payload: protocol.QueryPayload{SQL: "SELECT 1"}}); err != nil {
+		t.Fatalf("Failed to send query message: %v", err)
+	}
+	if err := ws.WriteJSON(protocol.ClientMessage{ID: "ping", Type: protocol.TypePing}); err != nil {
+		t.Fatalf("Failed to send ping message: %v", err)
+	}
+
+	// The pong must arrive while the query is still blocked
+	responses := readResponses(t, ws, 1)
+	if _, ok := responses[protocol.TypePong]; !ok {
+		t.Fatalf("Expected pong while query is running, got %v", responses)
+	}
+
+	close(release)
+	responses = readResponses(t, ws, 1)
+	if _, ok := responses[protocol.TypeResult]; !ok {
+		t.Fatalf("Expected query result after release, got %v", responses)
+	}
+}
+
+// expectShutdownClose reads until the server's close frame and checks it is a shutdown
+func expectShutdownClose(t *testing.T, ws *websocket.Conn) {
+	t.Helper()
+
+	if err := ws.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("Failed to set read deadline: %v", err)
+	}
+	_, _, err := ws.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) {
+		t.Fatalf("Expected a close frame, got %v", err)
+	}
+	if closeErr.Code != websocket.CloseGoingAway || closeErr.Text != shutdownReason {
+		t.Errorf("Expected close %d %q, got %d %q", websocket.CloseGoingAway, shutdownReason, closeErr.Code, closeErr.Text)
+	}
+}
+
+func TestServer_ShutdownClosesConnections(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	server := NewServer(secret, &MockPostgresClient{}, DefaultOptions())
+	ws := dialTestServer(t, server)
+
+	// Make sure the connection is registered before shutting down
+	sendMessage(t, ws, "ping", protocol.TypePing, nil)
+	readResponses(t, ws, 1)
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdownErr <- server.Shutdown(ctx)
+	}()
+
+	// Reading the close frame makes the client answer it, which ends the server's read loop
+	expectShutdownClose(t, ws)
+	if err := <-shutdownErr; err != nil {
+		t.Errorf("Expected clean shutdown, got %v", err)
+	}
+
+	// New connections are turned away once shutdown has started
+	ws = connectTestServer(t, server)
+	expectShutdownClose(t, ws)
+}
+
+func TestServer_ShutdownWaitsForRunningQueries(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	mockClient := &MockPostgresClient{
+		ExecuteQueryFunc: func(ctx context.Context, sql string, params []interface{}) (*postgres.QueryResult, error) {
+			close(started)
+			<-release
+			return &postgres.QueryResult{}, nil
+		},
+	}
+	server := NewServer(secret, mockClient, DefaultOptions())
+	ws := dialTestServer(t, server)
+
+	sendMessage(t, ws, "slow", protocol.TypeQuery, protocol.QueryPayload{SQL: "SELECT 1"})
+	<-started
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdownErr <- server.Shutdown(ctx)
+	}()
+
+	// Queries sent after shutdown starts are rejected
+	for !allDraining(server) {
+		time.Sleep(time.Millisecond)
+	}
+	sendMessage(t, ws, "late", protocol.TypeQuery, protocol.QueryPayload{SQL: "SELECT 2"})
+	var errorPayload protocol.ErrorPayload
+	if response := readResponse(t, ws, &errorPayload); response.Type != protocol.TypeError || response.ID != "late" {
+		t.Fatalf("Expected an error for the late query, got %s %s", response.Type, response.ID)
+	}
+	if errorPayload.Code != "SERVER_SHUTTING_DOWN" {
+		t.Errorf("Expected SERVER_SHUTTING_DOWN, got %s", errorPayload.Code)
+	}
+
+	// The running query still gets its result before the close frame
+	close(release)
+	responses := readResponses(t, ws, 1)
+	if result, ok := responses[protocol.TypeResult]; !ok || result.ID != "slow" {
+		t.Fatalf("Expected the running query's result, got %v", responses)
+	}
+	expectShutdownClose(t, ws)
+	if err := <-shutdownErr; err != nil {
+		t.Errorf("Expected clean shutdown, got %v", err)
+	}
+}
+
+// allDraining reports whether Shutdown has reached every open session
+func allDraining(server *Server) bool {
+	server.sessMu.Lock()
+	defer server.sessMu.Unlock()
+	for sess := range server.sessions {
+		if !sess.isDraining() {
+			return false
+		}
+	}
+	return true
+}
+
+func TestServer_ShutdownTimeout(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	server := NewServer(secret, &MockPostgresClient{}, DefaultOptions())
+	ws := dialTestServer(t, server)
+	sendMessage(t, ws, "ping", protocol.TypePing, nil)
+	readResponses(t, ws, 1)
+
+	// A client that never reads never answers the close frame
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+}
+
+// readResponse reads the next server message and decodes its payload into v
+func readResponse(t *testing.T, ws *websocket.Conn, v interface{}) protocol.ServerMessage {
+	t.Helper()
+
+	if err := ws.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("Failed to set read deadline: %v", err)
+	}
+
+	_, message, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	return decodeServerMessage(t, message, v)
+}
+
+// readHello reads the hello message the server sends when a WebSocket connects
+func readHello(t *testing.T, ws *websocket.Conn) protocol.HelloPayload {
+	t.Helper()
+
+	var hello protocol.HelloPayload
+	if response := readResponse(t, ws, &hello); response.Type != protocol.TypeHello {
+		t.Fatalf("Expected a hello message first, got %s", response.Type)
+	}
+	return hello
+}
+
+// decodeServerMessage parses a server message, decoding its payload into v if v is not nil
+func decodeServerMessage(t *testing.T, message []byte, v interface{}) protocol.ServerMessage {
+	t.Helper()
+
+	var response protocol.ServerMessage
+	if err := json.Unmarshal(message, &response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	if v != nil {
+		payloadBytes, _ := json.Marshal(response.Payload)
+		if err := json.Unmarshal(payloadBytes, v); err != nil {
+			t.Fatalf("Failed to unmarshal %s payload: %v", response.Type, err)
+		}
+	}
+	return response
+}
+
+// streamRows returns a StreamQueryFunc that delivers n rows in batches
+func streamRows(n int, failAfter int) func(ctx context.Context, sql string, params []interface{}, batchSize int, fn postgres.RowBatchFunc) (*postgres.QueryResult, error) {
+	return func(ctx context.Context, sql string, params []interface{}, batchSize int, fn postgres.RowBatchFunc) (*postgres.QueryResult, error) {
+		columns := []protocol.ColumnInfo{{Name: "n", DataType: "int4"}}
+		batch := []map[string]interface{}{}
+		for i := 0; i < n; i++ {
+			if failAfter > 0 && i == failAfter {
+				return nil, fmt.Errorf("connection reset while reading row %d", i)
+			}
+			batch = append(batch, map[string]interface{}{"n": i})
+			if len(batch) == batchSize {
+				if err := fn(columns, batch); err != nil {
+					return nil, err
+				}
+				batch = []map[string]interface{}{}
+			}
+		}
+		if len(batch) > 0 {
+			if err := fn(columns, batch); err != nil {
+				return nil, err
+			}
+		}
+		return &postgres.QueryResult{Columns: columns, RowCount: n}, nil
+	}
+}
+
+func TestHandleConnection_StreamQuery(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	mockClient := &MockPostgresClient{
+		ExecuteQueryFunc: func(ctx context.Context, sql string, params []interface{}) (*postgres.QueryResult, error) {
+			t.Error("Expected streamed query not to use ExecuteQuery")
+			return nil, nil
+		},
+		StreamQueryFunc: streamRows(5, 0),
+	}
+	server := NewServer(secret, mockClient, DefaultOptions())
+	ws := dialTestServer(t, server)
+
+	queryMsg := protocol.ClientMessage{
+		ID:      "stream-1",
+		Type:    protocol.TypeQuery,
+		Payload: protocol.QueryPayload{SQL: "SELECT n FROM generate_series(0, 4) n", Stream: true, BatchSize: 2},
+	}
+	if err := ws.WriteJSON(queryMsg); err != nil {
+		t.Fatalf("Failed to send query message: %v", err)
+	}
+
+	expectedOffsets := []int{0, 2, 4}
+	for i, offset := range expectedOffsets {
+		var chunk protocol.ResultChunkPayload
+		response := readResponse(t, ws, &chunk)
+
+		if response.Type != protocol.TypeResultChunk {
+			t.Fatalf("Expected response type %s, got %s", protocol.TypeResultChunk, response.Type)
+		}
+		if response.ID != "stream-1" {
+			t.Errorf("Expected response ID stream-1, got %s", response.ID)
+		}
+		if chunk.Offset != offset {
+			t.Errorf("Chunk %d: expected offset %d, got %d", i, offset, chunk.Offset)
+		}
+		if i == 0 && len(chunk.Columns) != 1 {
+			t.Errorf("Expected first chunk to carry columns, got %v", chunk.Columns)
+		}
+		if i > 0 && len(chunk.Columns) != 0 {
+			t.Errorf("Expected only the first chunk to carry columns, chunk %d had %v", i, chunk.Columns)
+		}
+	}
+
+	var result protocol.ResultPayload
+	response := readResponse(t, ws, &result)
+	if response.Type != protocol.TypeResult {
+		t.Fatalf("Expected final response type %s, got %s", protocol.TypeResult, response.Type)
+	}
+	if !result.Streamed {
+		t.Error("Expected final result to be marked as streamed")
+	}
+	if result.RowCount != 5 {
+		t.Errorf("Expected row count 5, got %d", result.RowCount)
+	}
+	if len(result.Rows) != 0 {
+		t.Errorf("Expected no rows in final result, got %d", len(result.Rows))
+	}
+}
+
+func TestHandleConnection_StreamQueryErrorMidStream(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	mockClient := &MockPostgresClient{
+		StreamQueryFunc: streamRows(10, 3),
+	}
+	server := NewServer(secret, mockClient, DefaultOptions())
+	ws := dialTestServer(t, server)
+
+	queryMsg := protocol.ClientMessage{
+		ID:      "stream-1",
+		Type:    protocol.TypeQuery,
+		Payload: protocol.QueryPayload{SQL: "SELECT * FROM big_table", Stream: true, BatchSize: 2},
+	}
+	if err := ws.WriteJSON(queryMsg); err != nil {
+		t.Fatalf("Failed to send query message: %v", err)
+	}
+
+	var chunk protocol.ResultChunkPayload
+	if response := readResponse(t, ws, &chunk); response.Type != protocol.TypeResultChunk {
+		t.Fatalf("Expected response type %s, got %s", protocol.TypeResultChunk, response.Type)
+	}
+
+	var errorPayload protocol.ErrorPayload
+	response := readResponse(t, ws, &errorPayload)
+	if response.Type != protocol.TypeError {
+		t.Fatalf("Expected trailing error, got %s", response.Type)
+	}
+	if response.ID != "stream-1" {
+		t.Errorf("Expected error for stream-1, got %s", response.ID)
+	}
+	if errorPayload.Code != "QUERY_ERROR" {
+		t.Errorf("Expected error code QUERY_ERROR, got %s", errorPayload.Code)
+	}
+}
+
+func TestHandleConnection_StreamConversionError(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	mockClient := &MockPostgresClient{
+		StreamQueryFunc: func(ctx context.Context, sql string, params []interface{}, batchSize int, fn postgres.RowBatchFunc) (*postgres.QueryResult, error) {
+			columns := []protocol.ColumnInfo{{Name: "reading", DataType: "point"}}
+			if err := fn(columns, []map[string]interface{}{{"reading": "(1,2)"}, {"reading": "(3,4)"}, {"reading": "(5,6)"}}); err != nil {
+				return nil, err
+			}
+			return nil, &postgres.RowError{Row: 3, Column: "reading", Type: "point", Err: errors.New("invalid length for point: 4")}
+		},
+	}
+	ws := dialTestServer(t, NewServer(secret, mockClient, DefaultOptions()))
+	sendMessage(t, ws, "stream-1", protocol.TypeQuery, protocol.QueryPayload{SQL: "SELECT reading FROM sensors", Stream: true})
+
+	// The rows read before the failure arrive first
+	var chunk protocol.ResultChunkPayload
+	if response := readResponse(t, ws, &chunk); response.Type != protocol.TypeResultChunk {
+		t.Fatalf("Expected response type %s, got %s", protocol.TypeResultChunk, response.Type)
+	}
+	if len(chunk.Rows) != 3 {
+		t.Errorf("Expected 3 rows before the error, got %d", len(chunk.Rows))
+	}
+
+	var errorPayload protocol.ErrorPayload
+	if response := readResponse(t, ws, &errorPayload); response.Type != protocol.TypeError {
+		t.Fatalf("Expected trailing error, got %s", response.Type)
+	}
+	if errorPayload.Code != "CONVERSION_ERROR" {
+		t.Errorf("Expected error code CONVERSION_ERROR, got %s", errorPayload.Code)
+	}
+	if errorPayload.Row == nil || *errorPayload.Row != 3 || errorPayload.Column != "reading" {
+		t.Errorf("Expected row 3, column reading, got %v, %q", errorPayload.Row, errorPayload.Column)
+	}
+	if !strings.Contains(errorPayload.Message, "(point)") || !strings.Contains(errorPayload.Hint, "reading") {
+		t.Errorf("Expected the type in the message and the column in the hint, got %q, %q", errorPayload.Message, errorPayload.Hint)
+	}
+}
+
+func TestHandleConnection_ParameterTypeMismatch(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	mockClient := &MockPostgresClient{
+		ExecuteQueryFunc: func(ctx context.Context, sql string, params []interface{}) (*postgres.QueryResult, error) {
+			return nil, &postgres.ParameterTypeError{Index: 2, Expected: "integer", Value: params[1]}
+		},
+	}
+	ws := dialTestServer(t, NewServer(secret, mockClient, DefaultOptions()))
+	sendMessage(t, ws, "query-1", protocol.TypeQuery, protocol.QueryPayload{
+		SQL:    "SELECT * FROM users WHERE name = $1 AND age = $2",
+		Params: []interface{}{"ada", "forty"},
+	})
+
+	var errorPayload protocol.ErrorPayload
+	if response := readResponse(t, ws, &errorPayload); response.Type != protocol.TypeError {
+		t.Fatalf("Expected error response, got %s", response.Type)
+	}
+	if errorPayload.Code != "PARAMETER_TYPE_MISMATCH" {
+		t.Errorf("Expected error code PARAMETER_TYPE_MISMATCH, got %s", errorPayload.Code)
+	}
+	if errorPayload.Parameter != 2 {
+		t.Errorf("Expected parameter 2, got %d", errorPayload.Parameter)
+	}
+	if want := `parameter $2 expects integer but got string "forty"`; errorPayload.Message != want {
+		t.Errorf("Expected message %q, got %q", want, errorPayload.Message)
+	}
+	if !strings.Contains(errorPayload.Hint, "$2 as integer") {
+		t.Errorf("Expected the hint to name the parameter and type, got %q", errorPayload.Hint)
+	}
+}
+
+func TestHandleMessage_StreamWithoutSessionIsBuffered(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	executed := false
+	mockClient := &MockPostgresClient{
+		ExecuteQueryFunc: func(ctx context.Context, sql string, params []interface{}) (*postgres.QueryResult, error) {
+			executed = true
+			return &postgres.QueryResult{Rows: []map[string]interface{}{{"n": 1}}, RowCount: 1}, nil
+		},
+	}
+	server := NewServer(secret, mockClient, DefaultOptions())
+
+	msg := protocol.ClientMessage{
+		ID:      "test-1",
+		Type:    protocol.TypeQuery,
+		Payload: protocol.QueryPayload{SQL: "SELECT 1", Stream: true},
+	}
+
+	response := server.handleMessage(msg)
+
+	if response.Type != protocol.TypeResult {
+		t.Errorf("Expected response type %s, got %s", protocol.TypeResult, response.Type)
+	}
+	if !executed {
+		t.Error("Expected query to fall back to buffered execution")
+	}
+}
+
+func TestQueryTimeout(t *testing.T) {
+	tests := []struct {
+		name        string
+		opts        Options
+		requestedMs int
+		expected    time.Duration
+	}{
+		{
+			name:        "server default when client doesn't specify",
+			opts:        DefaultOptions(),
+			requestedMs: 0,
+			expected:    DefaultQueryTimeout,
+		},
+		{
+			name:        "client override below the cap",
+			opts:        DefaultOptions(),
+			requestedMs: 5000,
+			expected:    5 * time.Second,
+		},
+		{
+			name:        "client override capped at the maximum",
+			opts:        DefaultOptions(),
+			requestedMs: int((24 * time.Hour).Milliseconds()),
+			expected:    DefaultMaxQueryTimeout,
+		},
+		{
+			name:        "no default and no cap runs unbounded",
+			opts:        Options{},
+			requestedMs: 0,
+			expected:    0,
+		},
+		{
+			name:        "no default still respects the cap",
+			opts:        Options{MaxQueryTimeout: time.Minute},
+			requestedMs: 0,
+			expected:    time.Minute,
+		},
+		{
+			name:        "no cap allows long client timeouts",
+			opts:        Options{DefaultQueryTimeout: time.Second},
+			requestedMs: int(time.Hour.Milliseconds()),
+			expected:    time.Hour,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewServer("", &MockPostgresClient{}, tt.opts)
+			if got := server.queryTimeout(tt.requestedMs); got != tt.expected {
+				t.Errorf("queryTimeout(%d) = %v, want %v", tt.requestedMs, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestHandleQuery_AppliesDefaultTimeout(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	mockClient := &MockPostgresClient{
+		ExecuteQueryFunc: func(ctx context.Context, sql string, params []interface{}) (*postgres.QueryResult, error) {
+			deadline, ok := ctx.Deadline()
+			if !ok {
+				t.Fatal("Expected context to have a deadline")
+			}
+			if remaining := time.Until(deadline); remaining > 2*time.Second || remaining <= 0 {
+				t.Errorf("Expected deadline about 2s away, got %v", remaining)
+			}
+			return &postgres.QueryResult{}, nil
+		},
+	}
+	opts := DefaultOptions()
+	opts.DefaultQueryTimeout = 2 * time.Second
+	server := NewServer(secret, mockClient, opts)
+
+	msg := protocol.ClientMessage{
+		ID:      "test-1",
+		Type:    protocol.TypeQuery,
+		Payload: protocol.QueryPayload{SQL: "SELECT 1"},
+	}
+
+	if response := server.handleMessage(msg); response.Type != protocol.TypeResult {
+		t.Errorf("Expected response type %s, got %s", protocol.TypeResult, response.Type)
+	}
+}
+
+func TestMaxRows(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      Options
+		requested int
+		expected  int
+	}{
+		{
+			name:      "server default when client doesn't specify",
+			opts:      DefaultOptions(),
+			requested: 0,
+			expected:  DefaultMaxRows,
+		},
+		{
+			name:      "client override above the default",
+			opts:      DefaultOptions(),
+			requested: 50000,
+			expected:  50000,
+		},
+		{
+			name:      "client override capped at the ceiling",
+			opts:      DefaultOptions(),
+			requested: 1000000000,
+			expected:  DefaultMaxRowsCeiling,
+		},
+		{
+			name:      "no default and no ceiling is unlimited",
+			opts:      Options{},
+			requested: 0,
+			expected:  0,
+		},
+		{
+			name:      "no default still respects the ceiling",
+			opts:      Options{MaxRowsCeiling: 100},
+			requested: 0,
+			expected:  100,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewServer("", &MockPostgresClient{}, tt.opts)
+			if got := server.maxRows(tt.requested); got != tt.expected {
+				t.Errorf("maxRows(%d) = %d, want %d", tt.requested, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestHandleQuery_AppliesRowLimit(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	mockClient := &MockPostgresClient{
+		ExecuteQueryFunc: func(ctx context.Context, sql string, params []interface{}) (*postgres.QueryResult, error) {
+			if got := postgres.MaxRowsFromContext(ctx); got != 2 {
+				t.Errorf("Expected a row limit of 2, got %d", got)
+			}
+			return &postgres.QueryResult{
+				Rows:      []map[string]interface{}{{"id": 1}, {"id": 2}},
+				Columns:   []protocol.ColumnInfo{{Name: "id", DataType: "integer"}},
+				RowCount:  2,
+				Truncated: true,
+			}, nil
+		},
+	}
+	server := NewServer(secret, mockClient, DefaultOptions())
+
+	response := server.handleMessage(protocol.ClientMessage{
+		ID:      "test-1",
+		Type:    protocol.TypeQuery,
+		Payload: protocol.QueryPayload{SQL: "SELECT * FROM big_table", MaxRows: 2},
+	})
+
+	payload, ok := response.Payload.(protocol.ResultPayload)
+	if !ok {
+		t.Fatalf("Expected ResultPayload, got %T", response.Payload)
+	}
+	if !payload.Truncated || payload.RowCount != 2 {
+		t.Errorf("Expected a truncated result with 2 rows, got %+v", payload)
+	}
+}
+
+func TestOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    Options
+		wantErr bool
+	}{
+		{name: "default options", opts: DefaultOptions(), wantErr: false},
+		{name: "zero options", opts: Options{}, wantErr: false},
+		{name: "negative default timeout", opts: Options{DefaultQueryTimeout: -time.Second}, wantErr: true},
+		{name: "negative max timeout", opts: Options{MaxQueryTimeout: -time.Second}, wantErr: true},
+		{name: "default above max", opts: Options{DefaultQueryTimeout: time.Hour, MaxQueryTimeout: time.Minute}, wantErr: true},
+		{name: "default with unlimited max", opts: Options{DefaultQueryTimeout: time.Hour}, wantErr: false},
+		{name: "negative batch size", opts: Options{StreamBatchSize: -1}, wantErr: true},
+		{name: "negative idle transaction timeout", opts: Options{IdleTransactionTimeout: -time.Second}, wantErr: true},
+		{name: "negative max rows", opts: Options{MaxRows: -1}, wantErr: true},
+		{name: "negative max rows ceiling", opts: Options{MaxRowsCeiling: -1}, wantErr: true},
+		{name: "max rows above ceiling", opts: Options{MaxRows: 100, MaxRowsCeiling: 10}, wantErr: true},
+		{name: "max rows without ceiling", opts: Options{MaxRows: 100}, wantErr: false},
+		{name: "allowed origins", opts: Options{AllowedOrigins: []string{"http://localhost:4321", "https://app.example.com", "*"}}, wantErr: false},
+		{name: "origin without scheme", opts: Options{AllowedOrigins: []string{"localhost:4321"}}, wantErr: true},
+		{name: "origin with path", opts: Options{AllowedOrigins: []string{"http://localhost:4321/app"}}, wantErr: true},
+		{name: "empty origin", opts: Options{AllowedOrigins: []string{""}}, wantErr: true},
+		{name: "negative log query length", opts: Options{LogQueryLength: -1}, wantErr: true},
+		{name: "negative max concurrent queries", opts: Options{MaxConcurrentQueries: -1}, wantErr: true},
+		{name: "negative max queries per second", opts: Options{MaxQueriesPerSecond: -1}, wantErr: true},
+		{name: "negative max connections", opts: Options{MaxConnections: -1}, wantErr: true},
+		{name: "negative max copy bytes", opts: Options{MaxCopyBytes: -1}, wantErr: true},
+		{name: "negative max message bytes", opts: Options{MaxMessageBytes: -1}, wantErr: true},
+		{name: "negative ping interval", opts: Options{PingInterval: -time.Second}, wantErr: true},
+		{name: "negative idle timeout", opts: Options{IdleTimeout: -time.Second}, wantErr: true},
+		{name: "idle timeout shorter than max query timeout", opts: Options{IdleTimeout: time.Minute, MaxQueryTimeout: 5 * time.Minute}, wantErr: true},
+		{name: "idle timeout without max query timeout", opts: Options{IdleTimeout: time.Minute}, wantErr: true},
+		{name: "idle timeout as long as max query timeout", opts: Options{IdleTimeout: 5 * time.Minute, MaxQueryTimeout: 5 * time.Minute}, wantErr: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.opts.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// listenTestServer starts a server whose listeners are captured for inspection
+func listenTestServer(t *testing.T) (*websocket.Conn, func() []*MockListener) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+
+	var mu sync.Mutex
+	var listeners []*MockListener
+	mockClient := &MockPostgresClient{
+		NewListenerFunc: func(ctx context.Context, fn postgres.NotificationFunc) (postgres.Listener, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			listener := &MockListener{notify: fn}
+			listeners = append(listeners, listener)
+			return listener, nil
+		},
+	}
+	server := NewServer(secret, mockClient, DefaultOptions())
+
+	return dialTestServer(t, server), func() []*MockListener {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]*MockListener(nil), listeners...)
+	}
+}
+
+func TestHandleConnection_ListenForwardsNotifications(t *testing.T) {
+	ws, listeners := listenTestServer(t)
+
+	for i, channel := range []string{"jobs", "alerts"} {
+		listenMsg := protocol.ClientMessage{
+			ID:      fmt.Sprintf("listen-%d", i),
+			Type:    protocol.TypeListen,
+			Payload: protocol.ListenPayload{Channel: channel},
+		}
+		if err := ws.WriteJSON(listenMsg); err != nil {
+			t.Fatalf("Failed to send listen message: %v", err)
+		}
+
+		var ack protocol.ListenPayload
+		response := readResponse(t, ws, &ack)
+		if response.Type != protocol.TypeListening {
+			t.Fatalf("Expected %s response, got %s", protocol.TypeListening, response.Type)
+		}
+		if response.ID != listenMsg.ID || ack.Channel != channel {
+			t.Errorf("Unexpected acknowledgment: id=%s channel=%s", response.ID, ack.Channel)
+		}
+	}
+
+	// Both channels share one listener connection
+	active := listeners()
+	if len(active) != 1 {
+		t.Fatalf("Expected 1 listener, got %d", len(active))
+	}
+
+	active[0].notify("alerts", "disk almost full")
+
+	var notification protocol.NotificationPayload
+	response := readResponse(t, ws, &notification)
+	if response.Type != protocol.TypeNotification {
+		t.Fatalf("Expected %s response, got %s", protocol.TypeNotification, response.Type)
+	}
+	if notification.Channel != "alerts" || notification.Payload != "disk almost full" {
+		t.Errorf("Unexpected notification: %+v", notification)
+	}
+}
+
+func TestHandleConnection_UnlistenReleasesListener(t *testing.T) {
+	ws, listeners := listenTestServer(t)
+
+	messages := []protocol.ClientMessage{
+		{ID: "listen-1", Type: protocol.TypeListen, Payload: protocol.ListenPayload{Channel: "jobs"}},
+		{ID: "unlisten-1", Type: protocol.TypeUnlisten, Payload: protocol.ListenPayload{Channel: "jobs"}},
+	}
+	expectedTypes := []string{protocol.TypeListening, protocol.TypeUnlistened}
+
+	for i, msg := range messages {
+		if err := ws.WriteJSON(msg); err != nil {
+			t.Fatalf("Failed to send %s message: %v", msg.Type, err)
+		}
+		var ack protocol.ListenPayload
+		if response := readResponse(t, ws, &ack); response.Type != expectedTypes[i] {
+			t.Fatalf("Expected %s response, got %s", expectedTypes[i], response.Type)
+		}
+	}
+
+	if active := listeners(); len(active) != 1 || !active[0].isClosed() {
+		t.Error("Expected the listener to be closed after the last unlisten")
+	}
+
+	// Unlistening again is an error
+	unlistenAgain := messages[1]
+	unlistenAgain.ID = "unlisten-2"
+	if err := ws.WriteJSON(unlistenAgain); err != nil {
+		t.Fatalf("Failed to send unlisten message: %v", err)
+	}
+	var errorPayload protocol.ErrorPayload
+	readResponse(t, ws, &errorPayload)
+	if errorPayload.Code != "NOT_LISTENING" {
+		t.Errorf("Expected error code NOT_LISTENING, got %s", errorPayload.Code)
+	}
+}
+
+func TestHandleConnection_ListenerClosedOnDisconnect(t *testing.T) {
+	ws, listeners := listenTestServer(t)
+
+	listenMsg := protocol.ClientMessage{
+		ID:      "listen-1",
+		Type:    protocol.TypeListen,
+		Payload: protocol.ListenPayload{Channel: "jobs"},
+	}
+	if err := ws.WriteJSON(listenMsg); err != nil {
+		t.Fatalf("Failed to send listen message: %v", err)
+	}
+	var ack protocol.ListenPayload
+	readResponse(t, ws, &ack)
+
+	if err := ws.Close(); err != nil {
+		t.Fatalf("Failed to close connection: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !listeners()[0].isClosed() {
+		if time.Now().After(deadline) {
+			t.Fatal("Listener was not closed after the client disconnected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHandleConnection_ListenAndUnlistenKeepTheirOrder(t *testing.T) {
+	ws, listeners := listenTestServer(t)
+
+	// Sent without waiting for replies; the unlisten must still find the channel
+	sendMessage(t, ws, "listen-1", protocol.TypeListen, protocol.ListenPayload{Channel: "jobs"})
+	sendMessage(t, ws, "unlisten-1", protocol.TypeUnlisten, protocol.ListenPayload{Channel: "jobs"})
+
+	responses := readResponses(t, ws, 2)
+	if response, ok := responses[protocol.TypeListening]; !ok || response.ID != "listen-1" {
+		t.Errorf("Expected listen-1 to be acknowledged, got %v", responses)
+	}
+	if response, ok := responses[protocol.TypeUnlistened]; !ok || response.ID != "unlisten-1" {
+		t.Errorf("Expected unlisten-1 to be acknowledged, got %v", responses)
+	}
+	if active := listeners(); len(active) != 1 || !active[0].isClosed() {
+		t.Error("Expected the listener to be closed after the unlisten")
+	}
+}
+
+func TestHandleConnection_SlowListenKeepsReadLoopFree(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	started := make(chan struct{})
+	mockClient := &MockPostgresClient{
+		// Like a listener waiting for a connection from an exhausted pool
+		NewListenerFunc: func(ctx context.Context, fn postgres.NotificationFunc) (postgres.Listener, error) {
+			close(started)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+	ws := dialTestServer(t, NewServer(secret, mockClient, DefaultOptions()))
+
+	sendMessage(t, ws, "listen-1", protocol.TypeListen, protocol.ListenPayload{Channel: "jobs"})
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Listen never started")
+	}
+
+	sendMessage(t, ws, "ping-1", protocol.TypePing, nil)
+	if response := readResponse(t, ws, nil); response.Type != protocol.TypePong {
+		t.Fatalf("Expected pong while the listen waits, got %s", response.Type)
+	}
+
+	sendMessage(t, ws, "cancel-1", protocol.TypeCancel, protocol.CancelPayload{QueryID: "listen-1"})
+	responses := readResponses(t, ws, 2)
+	if ack, ok := responses[protocol.TypeCanceled]; !ok || ack.ID != "cancel-1" {
+		t.Errorf("Expected the cancel to be acknowledged, got %v", responses)
+	}
+	if response, ok := responses[protocol.TypeError]; !ok || response.ID != "listen-1" {
+		t.Errorf("Expected the listen to fail once cancelled, got %v", responses)
+	}
+}
+
+func TestHandleConnection_ListenErrors(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	mockClient := &MockPostgresClient{
+		NewListenerFunc: func(ctx context.Context, fn postgres.NotificationFunc) (postgres.Listener, error) {
+			return nil, fmt.Errorf("failed to open listener connection: connection refused")
+		},
+	}
+	server := NewServer(secret, mockClient, DefaultOptions())
+	ws := dialTestServer(t, server)
+
+	testCases := []struct {
+		name         string
+		payload      protocol.ListenPayload
+		expectedCode string
+	}{
+		{"missing channel", protocol.ListenPayload{}, "INVALID_PAYLOAD"},
+		{"connection failure", protocol.ListenPayload{Channel: "jobs"}, "LISTEN_ERROR"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			msg := protocol.ClientMessage{ID: "listen-" + tc.name, Type: protocol.TypeListen, Payload: tc.payload}
+			if err := ws.WriteJSON(msg); err != nil {
+				t.Fatalf("Failed to send listen message: %v", err)
+			}
+
+			var errorPayload protocol.ErrorPayload
+			response := readResponse(t, ws, &errorPayload)
+			if response.Type != protocol.TypeError {
+				t.Fatalf("Expected error response, got %s", response.Type)
+			}
+			if errorPayload.Code != tc.expectedCode {
+				t.Errorf("Expected error code %s, got %s", tc.expectedCode, errorPayload.Code)
+			}
+		})
+	}
+}
+
+func TestHandleQuery_MultiStatementScript(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	var received []string
+	mockClient := &MockPostgresClient{
+		ExecuteScriptFunc: func(ctx context.Context, statements []string, transactional bool) (*postgres.ScriptResult, error) {
+			received = statements
+			return &postgres.ScriptResult{
+				Statements: []postgres.StatementResult{
+					{SQL: statements[0], QueryResult: postgres.QueryResult{Rows: []map[string]interface{}{}, Columns: []protocol.ColumnInfo{}, RowsAffected: 2}},
+					{SQL: statements[1], QueryResult: postgres.QueryResult{
+						Rows:         []map[string]interface{}{{"count": int64(2)}},
+						Columns:      []protocol.ColumnInfo{{Name: "count", DataType: "int8"}},
+						RowCount:     1,
+						RowsAffected: 1,
+					}},
+				},
+				ExecutionTime: 15 * time.Millisecond,
+			}, nil
+		},
+		ExecuteQueryFunc: func(ctx context.Context, sql string, params []interface{}) (*postgres.QueryResult, error) {
+			t.Error("Expected script not to run through ExecuteQuery")
+			return nil, nil
+		},
+	}
+	server := NewServer(secret, mockClient, DefaultOptions())
+
+	msg := protocol.ClientMessage{
+		ID:   "script-1",
+		Type: protocol.TypeQuery,
+		Payload: protocol.QueryPayload{
+			SQL:   "UPDATE users SET active = true WHERE id IN (1, 2);\nSELECT count(*) FROM users WHERE active;",
+			Multi: true,
+		},
+	}
+
+	response := server.handleMessage(msg)
+
+	if response.Type != protocol.TypeScriptResult {
+		t.Fatalf("Expected response type %s, got %s", protocol.TypeScriptResult, response.Type)
+	}
+
+	expectedStatements := []string{
+		"UPDATE users SET active = true WHERE id IN (1, 2)",
+		"SELECT count(*) FROM users WHERE active",
+	}
+	if strings.Join(received, "|") != strings.Join(expectedStatements, "|") {
+		t.Errorf("Expected statements %q, got %q", expectedStatements, received)
+	}
+
+	payload, ok := response.Payload.(protocol.ScriptResultPayload)
+	if !ok {
+		t.Fatalf("Expected ScriptResultPayload, got %T", response.Payload)
+	}
+	if len(payload.Statements) != 2 {
+		t.Fatalf("Expected 2 statement results, got %d", len(payload.Statements))
+	}
+	if payload.Statements[0].RowsAffected != 2 {
+		t.Errorf("Expected 2 rows affected by the update, got %d", payload.Statements[0].RowsAffected)
+	}
+	if payload.Statements[1].RowCount != 1 || payload.Statements[1].SQL != expectedStatements[1] {
+		t.Errorf("Unexpected select result: %+v", payload.Statements[1])
+	}
+	if payload.ExecutionTime != 15 || payload.ExecutionTimeMicros != 15000 {
+		t.Errorf("Expected execution time 15ms, got %dms and %dµs", payload.ExecutionTime, payload.ExecutionTimeMicros)
+	}
+}
+
+func TestHandleQuery_MultiStatementScriptFailure(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	mockClient := &MockPostgresClient{
+		ExecuteScriptFunc: func(ctx context.Context, statements []string, transactional bool) (*postgres.ScriptResult, error) {
+			return &postgres.ScriptResult{}, &postgres.ScriptError{
+				Index:     2,
+				Total:     len(statements),
+				SQL:       statements[2],
+				Committed: 2,
+				Err:       fmt.Errorf("table does not exist"),
+			}
+		},
+	}
+	server := NewServer(secret, mockClient, DefaultOptions())
+
+	msg := protocol.ClientMessage{
+		ID:   "script-1",
+		Type: protocol.TypeQuery,
+		Payload: protocol.QueryPayload{
+			SQL:   "SELECT 1; SELECT 2; SELECT * FROM missing; SELECT 4",
+			Multi: true,
+		},
+	}
+
+	response := server.handleMessage(msg)
+
+	errorPayload, ok := response.Payload.(protocol.ErrorPayload)
+	if !ok {
+		t.Fatalf("Expected ErrorPayload in response, got %T", response.Payload)
+	}
+	if errorPayload.Code != "QUERY_ERROR" {
+		t.Errorf("Expected error code QUERY_ERROR, got %s", errorPayload.Code)
+	}
+	if errorPayload.Statement != 3 {
+		t.Errorf("Expected failed statement 3, got %d", errorPayload.Statement)
+	}
+	if errorPayload.Detail != "2 earlier statement(s) committed, 1 not run" {
+		t.Errorf("Unexpected detail: %s", errorPayload.Detail)
+	}
+}
+
+func TestHandleQuery_MultiStatementScriptValidation(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	mockClient := &MockPostgresClient{
+		ExecuteScriptFunc: func(ctx context.Context, statements []string, transactional bool) (*postgres.ScriptResult, error) {
+			t.Errorf("Expected invalid script not to reach the database, got: %q", statements)
+			return nil, nil
+		},
+	}
+
+	testCases := []struct {
+		name         string
+		opts         Options
+		payload      protocol.QueryPayload
+		expectedCode string
+	}{
+		{
+			name:         "only comments",
+			opts:         DefaultOptions(),
+			payload:      protocol.QueryPayload{SQL: "-- nothing here;\n;", Multi: true},
+			expectedCode: "EMPTY_QUERY",
+		},
+		{
+			name:         "parameters",
+			opts:         DefaultOptions(),
+			payload:      protocol.QueryPayload{SQL: "SELECT $1; SELECT 2", Params: []interface{}{1}, Multi: true},
+			expectedCode: "INVALID_PAYLOAD",
+		},
+		{
+			name:         "write in read-only mode",
+			opts:         Options{ReadOnly: true},
+			payload:      protocol.QueryPayload{SQL: "SELECT 1; DELETE FROM users", Multi: true},
+			expectedCode: "READ_ONLY_VIOLATION",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := NewServer(secret, mockClient, tc.opts)
+			msg := protocol.ClientMessage{ID: "script-1", Type: protocol.TypeQuery, Payload: tc.payload}
+
+			response := server.handleMessage(msg)
+
+			errorPayload, ok := response.Payload.(protocol.ErrorPayload)
+			if !ok {
+				t.Fatalf("Expected ErrorPayload in response, got %T", response.Payload)
+			}
+			if errorPayload.Code != tc.expectedCode {
+				t.Errorf("Expected error code %s, got %s", tc.expectedCode, errorPayload.Code)
+			}
+		})
+	}
+}
+
+func TestHandleQuery_TransactionalScript(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+
+	t.Run("committed", func(t *testing.T) {
+		mockClient := &MockPostgresClient{
+			ExecuteScriptFunc: func(ctx context.Context, statements []string, transactional bool) (*postgres.ScriptResult, error) {
+				if !transactional {
+					t.Error("Expected the script to run in a transaction")
+				}
+				return &postgres.ScriptResult{Transactional: true, Committed: true}, nil
+			},
+		}
+		server := NewServer(secret, mockClient, DefaultOptions())
+
+		response := server.handleMessage(protocol.ClientMessage{
+			ID:      "script-1",
+			Type:    protocol.TypeQuery,
+			Payload: protocol.QueryPayload{SQL: "INSERT INTO t VALUES (1); INSERT INTO t VALUES (2)", Multi: true, Transactional: true},
+		})
+
+		payload, ok := response.Payload.(protocol.ScriptResultPayload)
+		if !ok {
+			t.Fatalf("Expected ScriptResultPayload, got %T", response.Payload)
+		}
+		if !payload.Transactional || !payload.Committed {
+			t.Errorf("Expected a committed transactional result, got %+v", payload)
+		}
+	})
+
+	t.Run("rolled back", func(t *testing.T) {
+		mockClient := &MockPostgresClient{
+			ExecuteScriptFunc: func(ctx context.Context, statements []string, transactional bool) (*postgres.ScriptResult, error) {
+				return &postgres.ScriptResult{Transactional: true}, &postgres.ScriptError{
+					Index:      1,
+					Total:      2,
+					RolledBack: true,
+					Err:        fmt.Errorf("duplicate key value violates unique constraint"),
+				}
+			},
+		}
+		server := NewServer(secret, mockClient, DefaultOptions())
+
+		response := server.handleMessage(protocol.ClientMessage{
+			ID:      "script-1",
+			Type:    protocol.TypeQuery,
+			Payload: protocol.QueryPayload{SQL: "INSERT INTO t VALUES (1); INSERT INTO t VALUES (1)", Multi: true, Transactional: true},
+		})
+
+		errorPayload, ok := response.Payload.(protocol.ErrorPayload)
+		if !ok {
+			t.Fatalf("Expected ErrorPayload in response, got %T", response.Payload)
+		}
+		if !errorPayload.RolledBack || errorPayload.Statement != 2 {
+			t.Errorf("Expected rolled back failure at statement 2, got %+v", errorPayload)
+		}
+		if errorPayload.Detail != "transaction rolled back, no statements committed" {
+			t.Errorf("Unexpected detail: %s", errorPayload.Detail)
+		}
+	})
+}
+
+// sendMessage writes a client message to the test connection
+func sendMessage(t *testing.T, ws *websocket.Conn, id, msgType string, payload interface{}) {
+	t.Helper()
+	if err := ws.WriteJSON(protocol.ClientMessage{ID: id, Type: msgType, Payload: payload}); err != nil {
+		t.Fatalf("Failed to send %s message: %v", msgType, err)
+	}
+}
+
+// expectTransactionStatus reads the next message and checks it reports the given transaction status
+func expectTransactionStatus(t *testing.T, ws *websocket.Conn, id, status string) {
+	t.Helper()
+	var payload protocol.TransactionPayload
+	response := readResponse(t, ws, &payload)
+	if response.Type != protocol.TypeTransaction || response.ID != id || payload.Status != status {
+		t.Fatalf("Expected %s transaction status for %s, got %s %s %+v", status, id, response.Type, response.ID, payload)
+	}
+}
+
+func TestHandleConnection_TransactionCommit(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	tx := &MockTransaction{}
+	var poolQueries []string
+	var mu sync.Mutex
+	mockClient := &MockPostgresClient{
+		BeginTransactionFunc: func(ctx context.Context) (postgres.Transaction, error) {
+			return tx, nil
+		},
+		ExecuteQueryFunc: func(ctx context.Context, sql string, params []interface{}) (*postgres.QueryResult, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			poolQueries = append(poolQueries, sql)
+			return &postgres.QueryResult{}, nil
+		},
+	}
+	server := NewServer(secret, mockClient, DefaultOptions())
+	ws := dialTestServer(t, server)
+
+	sendMessage(t, ws, "begin-1", protocol.TypeBegin, nil)
+	expectTransactionStatus(t, ws, "begin-1", protocol.TransactionOpen)
+
+	sendMessage(t, ws, "query-1", protocol.TypeQuery, protocol.QueryPayload{SQL: "UPDATE accounts SET balance = 0"})
+	if response := readResponse(t, ws, nil); response.Type != protocol.TypeResult {
+		t.Fatalf("Expected result, got %s", response.Type)
+	}
+
+	sendMessage(t, ws, "commit-1", protocol.TypeCommit, nil)
+	expectTransactionStatus(t, ws, "commit-1", protocol.TransactionCommitted)
+
+	// After the commit, queries go back to the pool
+	sendMessage(t, ws, "query-2", protocol.TypeQuery, protocol.QueryPayload{SQL: "SELECT 1"})
+	readResponse(t, ws, nil)
+
+	queries, committed, rolledBack := tx.state()
+	if len(queries) != 1 || queries[0] != "UPDATE accounts SET balance = 0" {
+		t.Errorf("Expected the update to run in the transaction, got %v", queries)
+	}
+	if !committed || rolledBack {
+		t.Errorf("Expected the transaction to be committed, got committed=%v rolledBack=%v", committed, rolledBack)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(poolQueries) != 1 || poolQueries[0] != "SELECT 1" {
+		t.Errorf("Expected only the query after commit to use the pool, got %v", poolQueries)
+	}
+}
+
+func TestHandleConnection_TransactionCommitWaitsForQueries(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	release := make(chan struct{})
+	tx := &blockingTransaction{MockTransaction: &MockTransaction{}, release: release}
+	mockClient := &MockPostgresClient{
+		BeginTransactionFunc: func(ctx context.Context) (postgres.Transaction, error) {
+			return tx, nil
+		},
+	}
+	server := NewServer(secret, mockClient, DefaultOptions())
+	ws := dialTestServer(t, server)
+
+	sendMessage(t, ws, "begin-1", protocol.TypeBegin, nil)
+	expectTransactionStatus(t, ws, "begin-1", protocol.TransactionOpen)
+
+	sendMessage(t, ws, "query-1", protocol.TypeQuery, protocol.QueryPayload{SQL: "UPDATE accounts SET balance = 0"})
+	sendMessage(t, ws, "commit-1", protocol.TypeCommit, nil)
+
+	// The read loop must stay responsive while the commit waits
+	sendMessage(t, ws, "ping-1", protocol.TypePing, nil)
+	if response := readResponse(t, ws, nil); response.Type != protocol.TypePong {
+		t.Fatalf("Expected pong while the commit waits, got %s", response.Type)
+	}
+	close(release)
+
+	if response := readResponse(t, ws, nil); response.Type != protocol.TypeResult {
+		t.Fatalf("Expected the query result before the commit, got %s", response.Type)
+	}
+	expectTransactionStatus(t, ws, "commit-1", protocol.TransactionCommitted)
+}
+
+func TestHandleConnection_QueryWaitsForBegin(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	tx := &MockTransaction{}
+	release := make(chan struct{})
+	mockClient := &MockPostgresClient{
+		BeginTransactionFunc: func(ctx context.Context) (postgres.Transaction, error) {
+			<-release
+			return tx, nil
+		},
+	}
+	opts := DefaultOptions()
+	opts.MaxConcurrentQueries = 1
+	server := NewServer(secret, mockClient, opts)
+	ws := dialTestServer(t, server)
+
+	sendMessage(t, ws, "begin-1", protocol.TypeBegin, nil)
+	sendMessage(t, ws, "query-1", protocol.TypeQuery, protocol.QueryPayload{SQL: "UPDATE accounts SET balance = 0"})
+
+	// The read loop must stay responsive while the begin waits for the database
+	sendMessage(t, ws, "ping-1", protocol.TypePing, nil)
+	if response := readResponse(t, ws, nil); response.Type != protocol.TypePong {
+		t.Fatalf("Expected pong while the begin runs, got %s", response.Type)
+	}
+	close(release)
+
+	responses := readResponses(t, ws, 2)
+	if _, ok := responses[protocol.TypeTransaction]; !ok {
+		t.Errorf("Expected the transaction to open, got %v", responses)
+	}
+	if _, ok := responses[protocol.TypeResult]; !ok {
+		t.Errorf("Expected a result for the query, got %v", responses)
+	}
+	if queries, _, _ := tx.state(); len(queries) != 1 {
+		t.Errorf("Expected the query sent after the begin to run in the transaction, got %v", queries)
+	}
+}
+
+// blockingTransaction holds queries until release is closed
+type blockingTransaction struct {
+	*MockTransaction
+	release chan struct{}
+}
+
+func (tx *blockingTransaction) ExecuteQuery(ctx context.Context, sql string, params []interface{}) (*postgres.QueryResult, error) {
+	<-tx.release
+	return tx.MockTransaction.ExecuteQuery(ctx, sql, params)
+}
+
+func TestHandleConnection_TransactionRollback(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+
+	t.Run("explicit rollback", func(t *testing.T) {
+		tx := &MockTransaction{}
+		mockClient := &MockPostgresClient{
+			BeginTransactionFunc: func(ctx context.Context) (postgres.Transaction, error) { return tx, nil },
+		}
+		ws := dialTestServer(t, NewServer(secret, mockClient, DefaultOptions()))
+
+		sendMessage(t, ws, "begin-1", protocol.TypeBegin, nil)
+		expectTransactionStatus(t, ws, "begin-1", protocol.TransactionOpen)
+		sendMessage(t, ws, "rollback-1", protocol.TypeRollback, nil)
+		expectTransactionStatus(t, ws, "rollback-1", protocol.TransactionRolledBack)
+
+		if _, committed, rolledBack := tx.state(); committed || !rolledBack {
+			t.Errorf("Expected the transaction to be rolled back, got committed=%v rolledBack=%v", committed, rolledBack)
+		}
+	})
+
+	t.Run("commit of a failed transaction", func(t *testing.T) {
+		tx := &MockTransaction{commitErr: postgres.ErrTransactionRolledBack}
+		mockClient := &MockPostgresClient{
+			BeginTransactionFunc: func(ctx context.Context) (postgres.Transaction, error) { return tx, nil },
+		}
+		ws := dialTestServer(t, NewServer(secret, mockClient, DefaultOptions()))
+
+		sendMessage(t, ws, "begin-1", protocol.TypeBegin, nil)
+		expectTransactionStatus(t, ws, "begin-1", protocol.TransactionOpen)
+		sendMessage(t, ws, "commit-1", protocol.TypeCommit, nil)
+		expectTransactionStatus(t, ws, "commit-1", protocol.TransactionRolledBack)
+	})
+
+	t.Run("disconnect", func(t *testing.T) {
+		tx := &MockTransaction{}
+		mockClient := &MockPostgresClient{
+			BeginTransactionFunc: func(ctx context.Context) (postgres.Transaction, error) { return tx, nil },
+		}
+		ws := dialTestServer(t, NewServer(secret, mockClient, DefaultOptions()))
+
+		sendMessage(t, ws, "begin-1", protocol.TypeBegin, nil)
+		expectTransactionStatus(t, ws, "begin-1", protocol.TransactionOpen)
+		if err := ws.Close(); err != nil {
+			t.Fatalf("Failed to close connection: %v", err)
+		}
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if _, _, rolledBack := tx.state(); rolledBack {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("Transaction was not rolled back after the client disconnected")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+}
+
+func TestHandleConnection_TransactionErrors(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	ws := dialTestServer(t, NewServer(secret, &MockPostgresClient{}, DefaultOptions()))
+
+	expectError := func(code string) {
+		t.Helper()
+		var errorPayload protocol.ErrorPayload
+		if response := readResponse(t, ws, &errorPayload); response.Type != protocol.TypeError || errorPayload.Code != code {
+			t.Fatalf("Expected %s error, got %s %+v", code, response.Type, errorPayload)
+		}
+	}
+
+	sendMessage(t, ws, "commit-1", protocol.TypeCommit, nil)
+	expectError("NO_TRANSACTION")
+
+	sendMessage(t, ws, "begin-1", protocol.TypeBegin, nil)
+	expectTransactionStatus(t, ws, "begin-1", protocol.TransactionOpen)
+	sendMessage(t, ws, "begin-2", protocol.TypeBegin, nil)
+	expectError("TRANSACTION_ALREADY_OPEN")
+
+	sendMessage(t, ws, "script-1", protocol.TypeQuery, protocol.QueryPayload{SQL: "SELECT 1; SELECT 2", Multi: true})
+	expectError("INVALID_PAYLOAD")
+}
+
+func TestHandleConnection_IdleTransactionTimeout(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	tx := &MockTransaction{}
+	mockClient := &MockPostgresClient{
+		BeginTransactionFunc: func(ctx context.Context) (postgres.Transaction, error) { return tx, nil },
+	}
+	opts := DefaultOptions()
+	opts.IdleTransactionTimeout = 50 * time.Millisecond
+	ws := dialTestServer(t, NewServer(secret, mockClient, opts))
+
+	sendMessage(t, ws, "begin-1", protocol.TypeBegin, nil)
+	expectTransactionStatus(t, ws, "begin-1", protocol.TransactionOpen)
+
+	var errorPayload protocol.ErrorPayload
+	response := readResponse(t, ws, &errorPayload)
+	if response.Type != protocol.TypeError || errorPayload.Code != "TRANSACTION_TIMEOUT" {
+		t.Fatalf("Expected TRANSACTION_TIMEOUT error, got %s %+v", response.Type, errorPayload)
+	}
+	if response.ID != "begin-1" {
+		t.Errorf("Expected the timeout to reference begin-1, got %s", response.ID)
+	}
+	if _, _, rolledBack := tx.state(); !rolledBack {
+		t.Error("Expected the idle transaction to be rolled back")
+	}
+
+	// The transaction is gone, so committing now fails
+	sendMessage(t, ws, "commit-1", protocol.TypeCommit, nil)
+	readResponse(t, ws, &errorPayload)
+	if errorPayload.Code != "NO_TRANSACTION" {
+		t.Errorf("Expected NO_TRANSACTION after the timeout, got %s", errorPayload.Code)
+	}
+}
+
+func TestHandleQuery_Explain(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	plan := []interface{}{map[string]interface{}{"Plan": map[string]interface{}{"Node Type": "Seq Scan"}}}
+
+	tests := []struct {
+		name    string
+		payload protocol.QueryPayload
+		wantSQL string
+	}{
+		{
+			name:    "plan only",
+			payload: protocol.QueryPayload{SQL: "SELECT * FROM users;", Explain: true},
+			wantSQL: "EXPLAIN (FORMAT JSON) SELECT * FROM users",
+		},
+		{
+			name:    "analyze",
+			payload: protocol.QueryPayload{SQL: "SELECT * FROM users WHERE id = $1", Params: []interface{}{1}, Explain: true, Analyze: true},
+			wantSQL: "EXPLAIN (FORMAT JSON, ANALYZE, BUFFERS) SELECT * FROM users WHERE id = $1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotSQL string
+			var gotParams []interface{}
+			mockClient := &MockPostgresClient{
+				ExecuteQueryFunc: func(ctx context.Context, sql string, params []interface{}) (*postgres.QueryResult, error) {
+					gotSQL, gotParams = sql, params
+					return &postgres.QueryResult{
+						Rows:    []map[string]interface{}{{"QUERY PLAN": plan}},
+						Columns: []protocol.ColumnInfo{{Name: "QUERY PLAN", DataType: "json"}},
+					}, nil
+				},
+			}
+			server := NewServer(secret, mockClient, DefaultOptions())
+
+			response := server.handleMessage(protocol.ClientMessage{ID: "explain-1", Type: protocol.TypeQuery, Payload: tt.payload})
+
+			if response.Type != protocol.TypePlan {
+				t.Fatalf("Expected response type %s, got %s: %+v", protocol.TypePlan, response.Type, response.Payload)
+			}
+			if gotSQL != tt.wantSQL {
+				t.Errorf("Expected SQL %q, got %q", tt.wantSQL, gotSQL)
+			}
+			if len(gotParams) != len(tt.payload.Params) {
+				t.Errorf("Expected params %v to be passed through, got %v", tt.payload.Params, gotParams)
+			}
+
+			payload := response.Payload.(protocol.PlanPayload)
+			if payload.Analyzed != tt.payload.Analyze {
+				t.Errorf("Expected analyzed=%v, got %v", tt.payload.Analyze, payload.Analyzed)
+			}
+			if _, ok := payload.Plan.([]interface{}); !ok {
+				t.Errorf("Expected the plan to be passed through, got %T", payload.Plan)
+			}
+		})
+	}
+}
+
+func TestHandleQuery_ExplainValidation(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	mockClient := &MockPostgresClient{
+		ExecuteQueryFunc: func(ctx context.Context, sql string, params []interface{}) (*postgres.QueryResult, error) {
+			t.Errorf("Expected invalid explain not to reach the database, got: %s", sql)
+			return nil, nil
+		},
+	}
+	server := NewServer(secret, mockClient, Options{ReadOnly: true})
+
+	tests := []struct {
+		name     string
+		payload  protocol.QueryPayload
+		wantCode string
+	}{
+		{
+			name:     "analyze without explain",
+			payload:  protocol.QueryPayload{SQL: "SELECT 1", Analyze: true},
+			wantCode: "INVALID_PAYLOAD",
+		},
+		{
+			name:     "multi-statement script",
+			payload:  protocol.QueryPayload{SQL: "SELECT 1; SELECT 2", Multi: true, Explain: true},
+			wantCode: "INVALID_PAYLOAD",
+		},
+		{
+			name:     "analyze of a write in read-only mode",
+			payload:  protocol.QueryPayload{SQL: "DELETE FROM users", Explain: true, Analyze: true},
+			wantCode: "READ_ONLY_VIOLATION",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := server.handleMessage(protocol.ClientMessage{ID: "explain-1", Type: protocol.TypeQuery, Payload: tt.payload})
+
+			errorPayload, ok := response.Payload.(protocol.ErrorPayload)
+			if !ok {
+				t.Fatalf("Expected ErrorPayload in response, got %T", response.Payload)
+			}
+			if errorPayload.Code != tt.wantCode {
+				t.Errorf("Expected error code %s, got %s", tt.wantCode, errorPayload.Code)
+			}
+		})
+	}
+}
+
+func TestHandleQuery_ExplainWriteInReadOnlyMode(t *testing.T) {
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	mockClient := &MockPostgresClient{
+		ExecuteQueryFunc: func(ctx context.Context, sql string, params []interface{}) (*postgres.QueryResult, error) {
+			return &postgres.QueryResult{
+				Rows:    []map[string]interface{}{{"QUERY PLAN": []interface{}{}}},
+				Columns: []protocol.ColumnInfo{{Name: "QUERY PLAN", DataType: "json"}},
+			}, nil
+		},
+	}
+	server := NewServer(secret, mockClient, Options{ReadOnly: true})
+
+	// Planning a write doesn't execute it, so it's allowed
+	response := server.handleMessage(protocol.ClientMessage{
+		ID:      "explain-1",
+		Type:    protocol.TypeQuery,
+		Payload: protocol.QueryPayload{SQL: "DELETE FROM users", Explain: true},
+	})
+	if response.Type != protocol.TypePlan {
+		t.Errorf("Expected response type %s, got %s: %+v", protocol.TypePlan, response.Type, response.Payload)
+	}
+}
@@ -0,0 +1,100 @@
+package sqlutil
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// BindNamed rewrites :name placeholders in a query to positional $N parameters
+// and returns the values to bind in order. Each name gets one position however
+// often it appears. Colons in string literals, quoted identifiers, comments,
+// :: casts and array slices such as arr[lo:hi] are left alone, so a placeholder
+// in a subscript needs parentheses: arr[(:i)]. Every placeholder must have a
+// value; values no placeholder uses are ignored
+func BindNamed(sql string, params map[string]interface{}) (string, []interface{}, error) {
+	var out strings.Builder
+	var args []interface{}
+	positions := make(map[string]int)
+	// One entry per open bracket or parenthesis, true for a subscript, where a colon separates slice bounds
+	var subscripts []bool
+
+	start := 0
+	i := 0
+	for i < len(sql) {
+		if next := skipLiteral(sql, i); next > i {
+			i = next
+			continue
+		}
+		switch sql[i] {
+		case '[':
+			// ARRAY[...] builds an array out of values, which may be placeholders
+			subscripts = append(subscripts, !endsWithKeyword(sql[:i], "ARRAY"))
+		case '(':
+			subscripts = append(subscripts, false)
+		case ']', ')':
+			if len(subscripts) > 0 {
+				subscripts = subscripts[:len(subscripts)-1]
+			}
+		}
+		if sql[i] != ':' {
+			i++
+			continue
+		}
+		if i+1 < len(sql) && sql[i+1] == ':' {
+			i += 2 // a cast such as ::int
+			continue
+		}
+		if len(subscripts) > 0 && subscripts[len(subscripts)-1] {
+			i++ // an array slice such as arr[lo:hi] or arr[:hi]
+			continue
+		}
+
+		name := placeholderName(sql[i+1:])
+		if name == "" {
+			i++ // not a placeholder, e.g. :=
+			continue
+		}
+		position, seen := positions[name]
+		if !seen {
+			value, ok := params[name]
+			if !ok {
+				return "", nil, fmt.Errorf("no value given for parameter :%s", name)
+			}
+			args = append(args, value)
+			position = len(args)
+			positions[name] = position
+		}
+		out.WriteString(sql[start:i])
+		out.WriteString("$" + strconv.Itoa(position))
+		i += 1 + len(name)
+		start = i
+	}
+	out.WriteString(sql[start:])
+	return out.String(), args, nil
+}
+
+// placeholderName returns the identifier at the start of s, or "" if s doesn't start with one
+func placeholderName(s string) string {
+	first, _ := utf8.DecodeRuneInString(s)
+	if first != '_' && !unicode.IsLetter(first) {
+		return ""
+	}
+	end := strings.IndexFunc(s, func(r rune) bool { return !isIdentChar(r) })
+	if end < 0 {
+		return s
+	}
+	return s[:end]
+}
+
+// endsWithKeyword reports whether s ends with keyword, ignoring case and trailing whitespace
+func endsWithKeyword(s, keyword string) bool {
+	s = strings.TrimRightFunc(s, unicode.IsSpace)
+	if len(s) < len(keyword) || !strings.EqualFold(s[len(s)-len(keyword):], keyword) {
+		return false
+	}
+	before, _ := utf8.DecodeLastRuneInString(s[:len(s)-len(keyword)])
+	return before == utf8.RuneError || !isIdentChar(before)
+}
@@ -0,0 +1,104 @@
+package sqlutil
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBindNamed(t *testing.T) {
+	params := map[string]interface{}{"id": 7, "name": "alice", "min_age": 18, "unused": true}
+
+	tests := []struct {
+		name     string
+		sql      string
+		wantSQL  string
+		wantArgs []interface{}
+		wantErr  bool
+	}{
+		{
+			name:     "single parameter",
+			sql:      "SELECT * FROM users WHERE id = :id",
+			wantSQL:  "SELECT * FROM users WHERE id = $1",
+			wantArgs: []interface{}{7},
+		},
+		{
+			name:     "numbered in order of first use",
+			sql:      "SELECT * FROM users WHERE name = :name AND age >= :min_age AND id <> :id",
+			wantSQL:  "SELECT * FROM users WHERE name = $1 AND age >= $2 AND id <> $3",
+			wantArgs: []interface{}{"alice", 18, 7},
+		},
+		{
+			name:     "repeated name shares a position",
+			sql:      "SELECT :id, :name, :id",
+			wantSQL:  "SELECT $1, $2, $1",
+			wantArgs: []interface{}{7, "alice"},
+		},
+		{
+			name:     "casts are not parameters",
+			sql:      "SELECT :id::int, '1'::text",
+			wantSQL:  "SELECT $1::int, '1'::text",
+			wantArgs: []interface{}{7},
+		},
+		{
+			name:     "colons in literals, identifiers and comments",
+			sql:      "SELECT ':id', \":name\", $$ :id $$ -- :id\n/* :name */ FROM t WHERE id = :id",
+			wantSQL:  "SELECT ':id', \":name\", $$ :id $$ -- :id\n/* :name */ FROM t WHERE id = $1",
+			wantArgs: []interface{}{7},
+		},
+		{
+			name:     "escaped quote inside E string",
+			sql:      `SELECT E'it\'s :id', :name`,
+			wantSQL:  `SELECT E'it\'s :id', $1`,
+			wantArgs: []interface{}{"alice"},
+		},
+		{
+			name:    "named arguments and array slices",
+			sql:     "SELECT f(a := 1), arr[1:2] FROM t",
+			wantSQL: "SELECT f(a := 1), arr[1:2] FROM t",
+		},
+		{
+			name:     "slice bounds are not parameters",
+			sql:      "SELECT arr[lo:hi], arr[:hi], arr[lo:], m[1][i:j] FROM t WHERE id = :id",
+			wantSQL:  "SELECT arr[lo:hi], arr[:hi], arr[lo:], m[1][i:j] FROM t WHERE id = $1",
+			wantArgs: []interface{}{7},
+		},
+		{
+			name:     "placeholders in array constructors and parenthesized subscripts",
+			sql:      "SELECT ARRAY[:id, :min_age], array [:name], arr[(:id)], arr[(:id):(:min_age)]",
+			wantSQL:  "SELECT ARRAY[$1, $2], array [$3], arr[($1)], arr[($1):($2)]",
+			wantArgs: []interface{}{7, 18, "alice"},
+		},
+		{
+			name:     "placeholder at the end",
+			sql:      "SELECT :name",
+			wantSQL:  "SELECT $1",
+			wantArgs: []interface{}{"alice"},
+		},
+		{
+			name:    "missing value",
+			sql:     "SELECT :missing",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sql, args, err := BindNamed(tt.sql, params)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Expected an error, got %q %v", sql, args)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if sql != tt.wantSQL {
+				t.Errorf("BindNamed() sql = %q, want %q", sql, tt.wantSQL)
+			}
+			if !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("BindNamed() args = %v, want %v", args, tt.wantArgs)
+			}
+		})
+	}
+}
@@ -0,0 +1,385 @@
+package sqlutil
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// mutatingKeywords are statement keywords that modify data, schema, or privileges
+var mutatingKeywords = map[string]bool{
+	"INSERT":   true,
+	"UPDATE":   true,
+	"DELETE":   true,
+	"MERGE":    true,
+	"DROP":     true,
+	"CREATE":   true,
+	"ALTER":    true,
+	"TRUNCATE": true,
+	"GRANT":    true,
+	"REVOKE":   true,
+}
+
+// selectKeywords are statement keywords that begin a query returning rows
+var selectKeywords = map[string]bool{
+	"SELECT": true,
+	"WITH":   true,
+	"VALUES": true,
+	"TABLE":  true,
+}
+
+// readKeywords are statement keywords that begin a query which can only read data
+// WITH is left out because its CTEs may insert, update or delete
+var readKeywords = map[string]bool{
+	"SELECT": true,
+	"VALUES": true,
+	"TABLE":  true,
+}
+
+// ownTransactionKeywords are statements that begin or end a transaction themselves, or that
+// Postgres refuses to run inside a transaction block. CALL is here because a procedure may commit
+var ownTransactionKeywords = map[string]bool{
+	"BEGIN":    true,
+	"START":    true,
+	"COMMIT":   true,
+	"END":      true,
+	"ROLLBACK": true,
+	"ABORT":    true,
+	"VACUUM":   true,
+	"CALL":     true,
+}
+
+// ownTransactionObjects are objects that can't be created or dropped inside a transaction block
+var ownTransactionObjects = map[string]bool{
+	"DATABASE":     true,
+	"TABLESPACE":   true,
+	"SUBSCRIPTION": true,
+}
+
+// rowLimitKeywords are clauses that limit which rows a query returns
+var rowLimitKeywords = map[string]bool{
+	"LIMIT":  true,
+	"OFFSET": true,
+	"FETCH":  true,
+}
+
+// FirstKeyword returns the first keyword of a SQL statement in upper case
+// Leading whitespace, comments, and opening parentheses are skipped
+// Returns an empty string if the statement has no keyword
+func FirstKeyword(sql string) string {
+	i := skipInsignificant(sql, 0)
+	for i < len(sql) && sql[i] == '(' {
+		i = skipInsignificant(sql, i+1)
+	}
+
+	start := i
+	for i < len(sql) && isIdentChar(rune(sql[i])) {
+		i++
+	}
+	return strings.ToUpper(sql[start:i])
+}
+
+// IsMutating reports whether a statement starts with a data- or schema-modifying keyword
+// This is a best-effort check; data-modifying CTEs must be caught by the database
+func IsMutating(sql string) bool {
+	return mutatingKeywords[FirstKeyword(sql)]
+}
+
+// IsSelect reports whether a statement is a query that returns rows: SELECT, WITH, VALUES or TABLE
+// Like IsMutating it only looks at the first keyword; a data-modifying WITH is rejected by
+// Postgres when the query is wrapped in a subquery
+func IsSelect(sql string) bool {
+	return selectKeywords[FirstKeyword(sql)]
+}
+
+// IsReadOnly reports whether a statement is a plain SELECT, VALUES or TABLE query, which
+// can be stopped partway without losing a write. Functions it calls could still write
+func IsReadOnly(sql string) bool {
+	return readKeywords[FirstKeyword(sql)]
+}
+
+// AllowedInTransaction reports whether a statement can run inside a transaction block that the
+// caller opened for it. Statements such as VACUUM, CREATE DATABASE, CREATE INDEX CONCURRENTLY and
+// transaction control can't. Like IsMutating this is best-effort, looking only at keywords
+func AllowedInTransaction(sql string) bool {
+	keywords := topLevelKeywords(sql)
+	if len(keywords) == 0 {
+		return true
+	}
+	if ownTransactionKeywords[keywords[0]] {
+		return false
+	}
+	if len(keywords) > 1 {
+		switch keywords[0] {
+		case "CREATE", "DROP":
+			if ownTransactionObjects[keywords[1]] {
+				return false
+			}
+		case "ALTER":
+			if keywords[1] == "SYSTEM" {
+				return false
+			}
+		case "DISCARD":
+			if keywords[1] == "ALL" {
+				return false
+			}
+		case "REINDEX":
+			if keywords[1] == "DATABASE" || keywords[1] == "SYSTEM" {
+				return false
+			}
+		}
+	}
+	// REFRESH MATERIALIZED VIEW CONCURRENTLY is the one concurrent form allowed in a transaction
+	if keywords[0] != "REFRESH" {
+		for _, keyword := range keywords {
+			if keyword == "CONCURRENTLY" {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// topLevelKeywords returns the words of a statement outside parentheses, literals and comments,
+// in upper case. Quoted identifiers are skipped, so they can't be mistaken for keywords
+func topLevelKeywords(sql string) []string {
+	var keywords []string
+	depth := 0
+	i := 0
+	for i < len(sql) {
+		if next := skipLiteral(sql, i); next > i {
+			i = next
+			continue
+		}
+		switch c := sql[i]; {
+		case c == '(':
+			depth++
+			i++
+		case c == ')':
+			depth--
+			i++
+		case isIdentChar(rune(c)):
+			start := i
+			for i < len(sql) && isIdentChar(rune(sql[i])) {
+				i++
+			}
+			if depth == 0 {
+				keywords = append(keywords, strings.ToUpper(sql[start:i]))
+			}
+		default:
+			i++
+		}
+	}
+	return keywords
+}
+
+// HasPlaceholders reports whether a statement has $n parameter placeholders
+// A $ in a literal, quoted identifier, dollar-quoted body or comment, or inside an identifier, isn't one
+func HasPlaceholders(sql string) bool {
+	i := 0
+	for i < len(sql) {
+		if sql[i] == '$' && i+1 < len(sql) && unicode.IsDigit(rune(sql[i+1])) && (i == 0 || !isIdentChar(rune(sql[i-1]))) {
+			return true
+		}
+		if next := skipLiteral(sql, i); next > i {
+			i = next
+			continue
+		}
+		i++
+	}
+	return false
+}
+
+// HasRowLimit reports whether a query has its own LIMIT, OFFSET or FETCH clause
+// Clauses inside parentheses, such as in subqueries, don't count
+func HasRowLimit(sql string) bool {
+	for _, keyword := range topLevelKeywords(sql) {
+		if rowLimitKeywords[keyword] {
+			return true
+		}
+	}
+	return false
+}
+
+// Paginate wraps a query so it returns a single page of its rows
+// The limit and offset are bound as the two parameters after the query's own paramCount
+func Paginate(sql string, paramCount int) string {
+	return fmt.Sprintf("SELECT * FROM (\n%s\n) AS page LIMIT $%d OFFSET $%d", trimStatement(sql), paramCount+1, paramCount+2)
+}
+
+// Count wraps a query so it returns how many rows it would produce, in a column named total
+func Count(sql string) string {
+	return fmt.Sprintf("SELECT count(*) AS total FROM (\n%s\n) AS counted", trimStatement(sql))
+}
+
+// Explain wraps a statement in EXPLAIN so Postgres returns its plan as JSON
+// With analyze the statement is actually executed to measure real row counts and timings
+func Explain(sql string, analyze bool) string {
+	sql = trimStatement(sql)
+	if analyze {
+		return "EXPLAIN (FORMAT JSON, ANALYZE, BUFFERS) " + sql
+	}
+	return "EXPLAIN (FORMAT JSON) " + sql
+}
+
+// CopyToCSV wraps a query in a COPY that sends its rows to the client as CSV with a header line
+func CopyToCSV(sql string) string {
+	return fmt.Sprintf("COPY (\n%s\n) TO STDOUT WITH (FORMAT csv, HEADER)", trimStatement(sql))
+}
+
+// PreviewTable returns a query for the first rows of a table, view or other relation
+// The names are quoted, so any characters are safe; an empty schema leaves the table to
+// the search path. The row limit is bound as the query's only parameter
+func PreviewTable(schema, table string) string {
+	name := pgx.Identifier{table}
+	if schema != "" {
+		name = pgx.Identifier{schema, table}
+	}
+	return "SELECT * FROM " + name.Sanitize() + " LIMIT $1"
+}
+
+// SplitStatements splits a script into its statements at top-level semicolons
+// Semicolons inside string literals, quoted identifiers, dollar-quoted bodies, and
+// comments don't split. Statements are trimmed, and ones that are empty or contain
+// only comments are dropped
+func SplitStatements(sql string) []string {
+	var statements []string
+	start := 0
+	i := 0
+	for i < len(sql) {
+		if next := skipLiteral(sql, i); next > i {
+			i = next
+			continue
+		}
+		if sql[i] == ';' {
+			statements = appendStatement(statements, sql[start:i])
+			start = i + 1
+		}
+		i++
+	}
+	return appendStatement(statements, sql[start:])
+}
+
+// trimStatement removes surrounding whitespace and trailing semicolons so a statement can be wrapped
+func trimStatement(sql string) string {
+	return strings.TrimRight(strings.TrimSpace(sql), "; \t\r\n")
+}
+
+// skipLiteral advances past a string literal, quoted identifier, dollar-quoted body, or comment
+// starting at i, returning i unchanged if none starts there
+func skipLiteral(sql string, i int) int {
+	switch c := sql[i]; {
+	case c == '\'':
+		// E'...' strings allow backslash escapes, including \'
+		escapes := i > 0 && (sql[i-1] == 'E' || sql[i-1] == 'e') && (i < 2 || !isIdentChar(rune(sql[i-2])))
+		return skipQuoted(sql, i, '\'', escapes)
+	case c == '"':
+		return skipQuoted(sql, i, '"', false)
+	case c == '$':
+		return skipDollarQuoted(sql, i)
+	case strings.HasPrefix(sql[i:], "--"), strings.HasPrefix(sql[i:], "/*"):
+		return skipInsignificant(sql, i)
+	}
+	return i
+}
+
+// appendStatement adds a trimmed statement unless it has no content besides comments
+func appendStatement(statements []string, statement string) []string {
+	statement = strings.TrimSpace(statement)
+	if skipInsignificant(statement, 0) == len(statement) {
+		return statements
+	}
+	return append(statements, statement)
+}
+
+// skipQuoted advances past a quoted string or identifier starting at i
+// A doubled quote character is an escaped quote; backslash escapes are honored if escapes is set
+func skipQuoted(sql string, i int, quote byte, escapes bool) int {
+	i++
+	for i < len(sql) {
+		switch {
+		case escapes && sql[i] == '\\':
+			i += 2
+		case sql[i] == quote && i+1 < len(sql) && sql[i+1] == quote:
+			i += 2
+		case sql[i] == quote:
+			return i + 1
+		default:
+			i++
+		}
+	}
+	return len(sql)
+}
+
+// skipDollarQuoted advances past a dollar-quoted string ($$...$$ or $tag$...$tag$) starting at i
+// A $ that doesn't open a dollar quote, such as a $1 parameter, is skipped on its own
+func skipDollarQuoted(sql string, i int) int {
+	// $ can appear inside identifiers, e.g. my$table
+	if i > 0 && isIdentChar(rune(sql[i-1])) {
+		return i + 1
+	}
+
+	end := i + 1
+	for end < len(sql) && isIdentChar(rune(sql[end])) {
+		end++
+	}
+	if end >= len(sql) || sql[end] != '$' || (end > i+1 && unicode.IsDigit(rune(sql[i+1]))) {
+		return i + 1
+	}
+
+	delimiter := sql[i : end+1]
+	closing := strings.Index(sql[end+1:], delimiter)
+	if closing < 0 {
+		return len(sql)
+	}
+	return end + 1 + closing + len(delimiter)
+}
+
+// skipInsignificant advances past whitespace and comments starting at i
+func skipInsignificant(sql string, i int) int {
+	for i < len(sql) {
+		switch {
+		case unicode.IsSpace(rune(sql[i])):
+			i++
+		case strings.HasPrefix(sql[i:], "--"):
+			end := strings.IndexByte(sql[i:], '\n')
+			if end < 0 {
+				return len(sql)
+			}
+			i += end + 1
+		case strings.HasPrefix(sql[i:], "/*"):
+			i = skipBlockComment(sql, i)
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// skipBlockComment advances past a (possibly nested) block comment starting at i
+func skipBlockComment(sql string, i int) int {
+	depth := 0
+	for i < len(sql) {
+		switch {
+		case strings.HasPrefix(sql[i:], "/*"):
+			depth++
+			i += 2
+		case strings.HasPrefix(sql[i:], "*/"):
+			depth--
+			i += 2
+			if depth == 0 {
+				return i
+			}
+		default:
+			i++
+		}
+	}
+	return i
+}
+
+// isIdentChar reports whether r can appear in an unquoted SQL keyword
+func isIdentChar(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
@@ -0,0 +1,413 @@
+package sqlutil
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFirstKeyword(t *testing.T) {
+	tests := []struct {
+		name     string
+		sql      string
+		expected string
+	}{
+		{
+			name:     "simple select",
+			sql:      "SELECT 1",
+			expected: "SELECT",
+		},
+		{
+			name:     "lower case",
+			sql:      "insert into users values (1)",
+			expected: "INSERT",
+		},
+		{
+			name:     "leading whitespace",
+			sql:      "  \n\tUPDATE users SET name = 'x'",
+			expected: "UPDATE",
+		},
+		{
+			name:     "line comment",
+			sql:      "-- remove old rows\nDELETE FROM users",
+			expected: "DELETE",
+		},
+		{
+			name:     "nested block comment",
+			sql:      "/* outer /* inner */ still comment */ DROP TABLE users",
+			expected: "DROP",
+		},
+		{
+			name:     "parenthesized select",
+			sql:      "(SELECT 1) UNION (SELECT 2)",
+			expected: "SELECT",
+		},
+		{
+			name:     "common table expression",
+			sql:      "WITH x AS (SELECT 1) SELECT * FROM x",
+			expected: "WITH",
+		},
+		{
+			name:     "empty string",
+			sql:      "",
+			expected: "",
+		},
+		{
+			name:     "only comment",
+			sql:      "-- nothing here",
+			expected: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := FirstKeyword(tt.sql); got != tt.expected {
+				t.Errorf("FirstKeyword(%q) = %q, want %q", tt.sql, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestIsMutating(t *testing.T) {
+	tests := []struct {
+		sql      string
+		expected bool
+	}{
+		{"SELECT * FROM users", false},
+		{"WITH x AS (SELECT 1) SELECT * FROM x", false},
+		{"EXPLAIN SELECT 1", false},
+		{"SHOW search_path", false},
+		{"INSERT INTO users VALUES (1)", true},
+		{"update users set name = 'x'", true},
+		{"DELETE FROM users", true},
+		{"DROP TABLE users", true},
+		{"CREATE TABLE t (id int)", true},
+		{"ALTER TABLE users ADD COLUMN x int", true},
+		{"TRUNCATE users", true},
+		{"GRANT SELECT ON users TO analyst", true},
+		{"/* sneaky */ insert into users values (1)", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.sql, func(t *testing.T) {
+			if got := IsMutating(tt.sql); got != tt.expected {
+				t.Errorf("IsMutating(%q) = %v, want %v", tt.sql, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestExplain(t *testing.T) {
+	tests := []struct {
+		sql      string
+		analyze  bool
+		expected string
+	}{
+		{"SELECT * FROM users", false, "EXPLAIN (FORMAT JSON) SELECT * FROM users"},
+		{"SELECT * FROM users", true, "EXPLAIN (FORMAT JSON, ANALYZE, BUFFERS) SELECT * FROM users"},
+		{"  SELECT 1;  \n", false, "EXPLAIN (FORMAT JSON) SELECT 1"},
+		{"DELETE FROM users WHERE id = $1;;", true, "EXPLAIN (FORMAT JSON, ANALYZE, BUFFERS) DELETE FROM users WHERE id = $1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expected, func(t *testing.T) {
+			if got := Explain(tt.sql, tt.analyze); got != tt.expected {
+				t.Errorf("Explain(%q, %v) = %q, want %q", tt.sql, tt.analyze, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestIsSelect(t *testing.T) {
+	tests := []struct {
+		sql      string
+		expected bool
+	}{
+		{"SELECT * FROM users", true},
+		{"  -- recent\n select 1", true},
+		{"(SELECT 1) UNION (SELECT 2)", true},
+		{"WITH x AS (SELECT 1) SELECT * FROM x", true},
+		{"VALUES (1), (2)", true},
+		{"TABLE users", true},
+		{"INSERT INTO users VALUES (1)", false},
+		{"EXPLAIN SELECT 1", false},
+		{"SHOW search_path", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.sql, func(t *testing.T) {
+			if got := IsSelect(tt.sql); got != tt.expected {
+				t.Errorf("IsSelect(%q) = %v, want %v", tt.sql, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestIsReadOnly(t *testing.T) {
+	tests := []struct {
+		sql      string
+		expected bool
+	}{
+		{"SELECT * FROM users", true},
+		{"(SELECT 1) UNION (SELECT 2)", true},
+		{"VALUES (1), (2)", true},
+		{"TABLE users", true},
+		{"WITH x AS (SELECT 1) SELECT * FROM x", false},
+		{"WITH gone AS (DELETE FROM users RETURNING *) SELECT * FROM gone", false},
+		{"INSERT INTO users SELECT 1 RETURNING id", false},
+		{"UPDATE users SET name = 'x' RETURNING *", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.sql, func(t *testing.T) {
+			if got := IsReadOnly(tt.sql); got != tt.expected {
+				t.Errorf("IsReadOnly(%q) = %v, want %v", tt.sql, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestAllowedInTransaction(t *testing.T) {
+	tests := []struct {
+		sql      string
+		expected bool
+	}{
+		{"SELECT * FROM users", true},
+		{"UPDATE users SET name = 'x'", true},
+		{"CREATE INDEX users_name ON users (name)", true},
+		{"ALTER DATABASE app SET timezone = 'UTC'", true},
+		{"REFRESH MATERIALIZED VIEW CONCURRENTLY totals", true},
+		{"SELECT 'VACUUM', \"concurrently\" FROM jobs", true},
+		{"VACUUM ANALYZE users", false},
+		{"  -- tidy up\nvacuum users", false},
+		{"CALL archive_orders()", false},
+		{"BEGIN", false},
+		{"COMMIT", false},
+		{"CREATE DATABASE app", false},
+		{"DROP TABLESPACE fast", false},
+		{"ALTER SYSTEM SET work_mem = '64MB'", false},
+		{"CREATE UNIQUE INDEX CONCURRENTLY users_email ON users (email)", false},
+		{"DROP INDEX CONCURRENTLY users_email", false},
+		{"ALTER TABLE events DETACH PARTITION events_2023 CONCURRENTLY", false},
+		{"REINDEX DATABASE app", false},
+		{"DISCARD ALL", false},
+		{"", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.sql, func(t *testing.T) {
+			if got := AllowedInTransaction(tt.sql); got != tt.expected {
+				t.Errorf("AllowedInTransaction(%q) = %v, want %v", tt.sql, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestHasPlaceholders(t *testing.T) {
+	tests := []struct {
+		sql      string
+		expected bool
+	}{
+		{"SELECT $1", true},
+		{"SELECT * FROM users WHERE id = $12", true},
+		{"SELECT 1", false},
+		{"SELECT '$1'", false},
+		{`SELECT "$1" FROM t`, false},
+		{"SELECT $$ $1 $$", false},
+		{"SELECT $tag$ $1 $tag$", false},
+		{"SELECT 1 -- $1", false},
+		{"SELECT price$1 FROM t", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.sql, func(t *testing.T) {
+			if got := HasPlaceholders(tt.sql); got != tt.expected {
+				t.Errorf("HasPlaceholders(%q) = %v, want %v", tt.sql, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestHasRowLimit(t *testing.T) {
+	tests := []struct {
+		sql      string
+		expected bool
+	}{
+		{"SELECT * FROM users", false},
+		{"SELECT * FROM users LIMIT 10", true},
+		{"select * from users offset 20", true},
+		{"SELECT * FROM users FETCH FIRST 5 ROWS ONLY", true},
+		{"SELECT * FROM (SELECT * FROM users LIMIT 10) sub", false},
+		{"SELECT * FROM users WHERE id IN (SELECT id FROM admins LIMIT 1)", false},
+		{"SELECT 'LIMIT 10' AS note", false},
+		{`SELECT "limit" FROM settings`, false},
+		{"SELECT 1 -- LIMIT 10", false},
+		{"SELECT $$ LIMIT $$", false},
+		{"SELECT limited FROM quotas", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.sql, func(t *testing.T) {
+			if got := HasRowLimit(tt.sql); got != tt.expected {
+				t.Errorf("HasRowLimit(%q) = %v, want %v", tt.sql, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestPaginate(t *testing.T) {
+	tests := []struct {
+		sql        string
+		paramCount int
+		expected   string
+	}{
+		{"SELECT * FROM users", 0, "SELECT * FROM (\nSELECT * FROM users\n) AS page LIMIT $1 OFFSET $2"},
+		{"SELECT * FROM users WHERE age > $1;", 1, "SELECT * FROM (\nSELECT * FROM users WHERE age > $1\n) AS page LIMIT $2 OFFSET $3"},
+		{"SELECT 1 -- trailing comment", 0, "SELECT * FROM (\nSELECT 1 -- trailing comment\n) AS page LIMIT $1 OFFSET $2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.sql, func(t *testing.T) {
+			if got := Paginate(tt.sql, tt.paramCount); got != tt.expected {
+				t.Errorf("Paginate(%q, %d) = %q, want %q", tt.sql, tt.paramCount, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCount(t *testing.T) {
+	expected := "SELECT count(*) AS total FROM (\nSELECT * FROM users\n) AS counted"
+	if got := Count("SELECT * FROM users;"); got != expected {
+		t.Errorf("Count() = %q, want %q", got, expected)
+	}
+}
+
+func TestCopyToCSV(t *testing.T) {
+	expected := "COPY (\nSELECT * FROM users\n) TO STDOUT WITH (FORMAT csv, HEADER)"
+	if got := CopyToCSV("SELECT * FROM users;"); got != expected {
+		t.Errorf("CopyToCSV() = %q, want %q", got, expected)
+	}
+}
+
+func TestPreviewTable(t *testing.T) {
+	tests := []struct {
+		schema string
+		table  string
+		want   string
+	}{
+		{schema: "public", table: "users", want: `SELECT * FROM "public"."users" LIMIT $1`},
+		{table: "users", want: `SELECT * FROM "users" LIMIT $1`},
+		{schema: "My Schema", table: "order", want: `SELECT * FROM "My Schema"."order" LIMIT $1`},
+		{schema: "app", table: `we"ird.name`, want: `SELECT * FROM "app"."we""ird.name" LIMIT $1`},
+	}
+
+	for _, tt := range tests {
+		if got := PreviewTable(tt.schema, tt.table); got != tt.want {
+			t.Errorf("PreviewTable(%q, %q) = %q, want %q", tt.schema, tt.table, got, tt.want)
+		}
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		name     string
+		sql      string
+		expected []string
+	}{
+		{
+			name:     "single statement",
+			sql:      "SELECT 1",
+			expected: []string{"SELECT 1"},
+		},
+		{
+			name:     "trailing semicolon",
+			sql:      "SELECT 1;",
+			expected: []string{"SELECT 1"},
+		},
+		{
+			name:     "multiple statements",
+			sql:      "CREATE TABLE t (id int);\nINSERT INTO t VALUES (1);\n  SELECT * FROM t",
+			expected: []string{"CREATE TABLE t (id int)", "INSERT INTO t VALUES (1)", "SELECT * FROM t"},
+		},
+		{
+			name:     "empty statements dropped",
+			sql:      ";; SELECT 1;  ; \n",
+			expected: []string{"SELECT 1"},
+		},
+		{
+			name:     "semicolon in string literal",
+			sql:      "SELECT 'a;b'; SELECT 'it''s; fine'",
+			expected: []string{"SELECT 'a;b'", "SELECT 'it''s; fine'"},
+		},
+		{
+			name:     "escape string with backslash quote",
+			sql:      `SELECT E'it\'s; fine'; SELECT 2`,
+			expected: []string{`SELECT E'it\'s; fine'`, "SELECT 2"},
+		},
+		{
+			name:     "backslash in standard string",
+			sql:      `SELECT 'C:\'; SELECT 2`,
+			expected: []string{`SELECT 'C:\'`, "SELECT 2"},
+		},
+		{
+			name:     "semicolon in quoted identifier",
+			sql:      `SELECT 1 AS "a;b"; SELECT 2`,
+			expected: []string{`SELECT 1 AS "a;b"`, "SELECT 2"},
+		},
+		{
+			name:     "semicolon in comments",
+			sql:      "SELECT 1; -- first; really\nSELECT /* two; */ 2",
+			expected: []string{"SELECT 1", "-- first; really\nSELECT /* two; */ 2"},
+		},
+		{
+			name:     "comment only statement dropped",
+			sql:      "SELECT 1; -- done;\n/* nothing else */",
+			expected: []string{"SELECT 1"},
+		},
+		{
+			name: "dollar quoted function body",
+			sql: "CREATE FUNCTION f() RETURNS int AS $$ BEGIN RETURN 1; END; $$ LANGUAGE plpgsql;\n" +
+				"SELECT f()",
+			expected: []string{
+				"CREATE FUNCTION f() RETURNS int AS $$ BEGIN RETURN 1; END; $$ LANGUAGE plpgsql",
+				"SELECT f()",
+			},
+		},
+		{
+			name:     "tagged dollar quote containing $$",
+			sql:      "DO $body$ BEGIN RAISE NOTICE '$$;'; END $body$; SELECT 2",
+			expected: []string{"DO $body$ BEGIN RAISE NOTICE '$$;'; END $body$", "SELECT 2"},
+		},
+		{
+			name:     "positional parameters are not dollar quotes",
+			sql:      "SELECT $1; SELECT $2",
+			expected: []string{"SELECT $1", "SELECT $2"},
+		},
+		{
+			name:     "dollar sign inside identifier",
+			sql:      "SELECT a$b$c FROM t; SELECT 2",
+			expected: []string{"SELECT a$b$c FROM t", "SELECT 2"},
+		},
+		{
+			name:     "unterminated string",
+			sql:      "SELECT 'oops; SELECT 2",
+			expected: []string{"SELECT 'oops; SELECT 2"},
+		},
+		{
+			name:     "empty script",
+			sql:      "  \n ",
+			expected: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := SplitStatements(tt.sql)
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("SplitStatements(%q) = %q, want %q", tt.sql, result, tt.expected)
+			}
+		})
+	}
+}